@@ -1,15 +1,30 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"slices"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/jaysonhurd/s3backup/models"
 	"github.com/jaysonhurd/s3backup/pkg/s3backup"
 	"github.com/jaysonhurd/s3backup/pkg/s3clean"
+	"github.com/jaysonhurd/s3backup/pkg/s3crypt"
+	"github.com/jaysonhurd/s3backup/pkg/s3index"
+	"github.com/jaysonhurd/s3backup/pkg/s3lock"
+	"github.com/jaysonhurd/s3backup/pkg/s3restore"
+	"github.com/jaysonhurd/s3backup/pkg/s3schedule"
+	"github.com/jaysonhurd/s3backup/pkg/s3snapshot"
+	"github.com/jaysonhurd/s3backup/pkg/s3watch"
 	"github.com/jaysonhurd/s3backup/pkg/utilities"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -29,36 +44,92 @@ const (
 	msgBackupDirectoryIssue  = "Issue with backup directory found"
 	msgSyncBucketFailed      = "syncBucket failed"
 	msgSyncNotSelected       = "Sync not selected. Any files located on S3 but not on the local filesystem will not be removed from S3"
+	msgRestoreDirectoryIssue = "Issue restoring backup directory"
+	msgRestoreWithBackup     = "The -restore option cannot be combined with -backup, -sync, -wipe, -watch or -daemon"
+	msgLoadIndexFailed       = "Failed to load local state index"
+	msgRebuildIndexFailed    = "Failed to rebuild local state index"
+	msgSaveIndexFailed       = "Failed to save local state index"
+	msgInvalidOlderThan      = "Invalid -older-than value"
+	msgPurgeTrashFailed      = "purgeTrash failed"
+	msgListSnapshotsFailed   = "Failed to list snapshots"
+	msgSaveSnapshotFailed    = "Failed to write snapshot manifest"
+	msgSnapshotNotSaved      = "Backup did not complete, snapshot manifest was not written"
+	msgInvalidAsOf           = "Invalid -as-of value, expected an RFC3339 time such as 2026-09-01T00:00:00Z"
+	msgAsOfWithSnapshot      = "The -as-of and -snapshot options cannot be combined"
+	msgLoadSnapshotFailed    = "Failed to read snapshot manifest"
+	msgLoadCipherFailed      = "Failed to load encryption key"
+	msgPruneVersionsFailed   = "pruneVersions failed"
+	msgAbortUploadsFailed    = "abortStaleUploads failed"
+	msgWatchFailed           = "Watch mode stopped with an error"
+	msgWipeBucketFailed      = "Unable to wipe bucket"
+	msgVerifyDirectoryIssue  = "Backup directory failed verification"
+	msgDaemonFailed          = "Daemon mode stopped with an error"
+	msgDaemonWithWatch       = "The -daemon option cannot be combined with -watch or -wipe"
+	msgAcquireLockFailed     = "Another run is using the bucket"
+	msgRunInterrupted        = "Interrupted, stopped once in-flight uploads had finished or been aborted"
+	msgRunLockLost           = "The run lock was lost, stopped once in-flight uploads had finished or been aborted"
+	msgFilesFailed           = "Some files could not be backed up"
+)
+
+// Exit codes. exitFailed is returned when any file or operation failed, after
+// everything else was still attempted, and when the run lock was lost.
+// exitInterrupted is returned for a run stopped by SIGINT or SIGTERM, the same
+// a shell reports for a command killed by SIGINT.
+const (
+	exitFailed      = 1
+	exitInterrupted = 130
 )
 
 //TODO: Write tests (centralized fakes for each package)
 //TODO: Clean up flag branching - hard to read
-//TODO: Write parallel option using wait groups and a goroutine for each directory structure given
 //TODO: Write README.md
-//TODO: Add a goroutine to continue checking for changed files and backing them up if they change
-//TODO: Restore option
 //TODO: Create RPM package for distribution
 //TODO: Create .deb package for distribution
 
 func main() {
+	os.Exit(run())
+}
+
+// run does the work of main and returns the exit code. Deferred cleanup such
+// as releasing the run lock happens before the process exits.
+func run() int {
 
 	var (
 		// Flags
-		fconfig  = flag.String("config", "/etc/config.json", "path to the configuration file")
-		fsync    = flag.Bool("sync", false, "After backup, perform a sync by removing files in S3 which no longer exist on the local filesystem")
-		fbackup  = flag.Bool("backup", false, "Use this value if doing a fwipe (-clean) if you want to also start a fresh new backup")
-		fwipe    = flag.Bool("wipe", false, "Wipe the bucket clean entirely - this is destructive")
-		fhelp    = flag.Bool("help", false, "Provide help file info")
-		fforce   = flag.Bool("force", false, "Force a wipe without asking for confirmation. Caution!!")
-		llevel   = flag.String("llevel", "info", "Logging level - default is info")
-		fconsole = flag.Bool("console", false, "Use this flag to also log at console level")
-		//background = flag.Bool("background", false, "Runs in the background to check for any changed file, then uploads")
+		fconfig       = flag.String("config", "/etc/config.json", "path to the configuration file")
+		fsync         = flag.Bool("sync", false, "After backup, perform a sync by removing files in S3 which no longer exist on the local filesystem")
+		fbackup       = flag.Bool("backup", false, "Use this value if doing a fwipe (-clean) if you want to also start a fresh new backup")
+		fwipe         = flag.Bool("wipe", false, "Wipe the bucket clean entirely - this is destructive")
+		fhelp         = flag.Bool("help", false, "Provide help file info")
+		fforce        = flag.Bool("force", false, "Force a wipe without asking for confirmation and skip the sync mass-deletion safety checks. Caution!!")
+		llevel        = flag.String("llevel", "info", "Logging level - default is info")
+		fconsole      = flag.Bool("console", false, "Use this flag to also log at console level")
+		fparallel     = flag.Int("parallel", 0, "Number of concurrent upload workers, overrides AWS.Concurrency from the config file")
+		frestore      = flag.Bool("restore", false, "Restore the backup directories from S3 to the local filesystem")
+		frestoreTo    = flag.String("restore-to", "", "Restore into this directory instead of over the original files")
+		fdryrun       = flag.Bool("dry-run", false, "Perform every read but only log the uploads and deletions that would have been made")
+		frebuild      = flag.Bool("rebuild-index", false, "Repopulate the local state index in AWS.StateDirectory from a listing of the bucket")
+		fpurge        = flag.Bool("purge-trash", false, "Permanently remove trash entries older than -older-than")
+		fabortUploads = flag.Bool("abort-stale-uploads", false, "Abort incomplete multipart uploads initiated more than -older-than ago")
+		folderThan    = flag.String("older-than", "", "Minimum age of what -purge-trash and -abort-stale-uploads remove, e.g. 30d or 24h")
+		fsnapshots    = flag.Bool("snapshots", false, "List the snapshots stored in the bucket")
+		fprune        = flag.Bool("prune", false, "Delete noncurrent object versions outside the KeepLast/KeepDaily/KeepWeekly/KeepMonthly/KeepYearly retention policy")
+		fallVersions  = flag.Bool("all-versions", false, "With -wipe, also delete every old object version and delete marker and abort incomplete multipart uploads")
+		fasOf         = flag.String("as-of", "", "With -restore, restore files as they were at this RFC3339 time (needs a versioned bucket)")
+		fsnapshot     = flag.String("snapshot", "", "With -restore, restore the files recorded in this snapshot")
+		frestorePath  = flag.String("restore-path", "", "With -restore, only restore this file or directory instead of every backup directory")
+		fwatch        = flag.Bool("watch", false, "Back up every directory once, then keep uploading files as they change until interrupted")
+		fverify       = flag.Bool("verify", false, "Check that every file is in the bucket and up to date without uploading anything")
+		fdaemon       = flag.Bool("daemon", false, "Run the jobs in the Schedule section of the config file on their cron schedule until interrupted")
 
 		// Error values used for structured logging when no upstream error exists.
 		errInvalidWipeResponse = errors.New(msgInvalidWipeResponse)
 		errNoBackupRequested   = errors.New(msgNoBackupRequested)
 		errSyncNotSelected     = errors.New(msgSyncNotSelected)
 		errWipeNotSelected     = errors.New(msgWipeNotSelected)
+		errRestoreWithBackup   = errors.New(msgRestoreWithBackup)
+		errAsOfWithSnapshot    = errors.New(msgAsOfWithSnapshot)
+		errDaemonWithWatch     = errors.New(msgDaemonWithWatch)
 
 		// Misc vars
 		logLevel zerolog.Level
@@ -66,6 +137,8 @@ func main() {
 
 		awsCfg aws.Config
 		svc    *s3.Client
+		idx    s3index.Indexer
+		cipher s3crypt.Cipher
 	)
 
 	// Begin setup items
@@ -93,6 +166,12 @@ func main() {
 	if *fconsole {
 		cfg.Logging.Console = *fconsole
 	}
+	cfg.DryRun = *fdryrun
+	cfg.Force = *fforce
+	cfg.WipeAllVersions = *fallVersions
+	if *fparallel > 0 {
+		cfg.AWS.Concurrency = *fparallel
+	}
 
 	l, err := utilities.LoggerSetup(cfg, logLevel)
 
@@ -102,56 +181,280 @@ func main() {
 	}
 	svc = s3.NewFromConfig(awsCfg)
 
-	// Begin backup procedures
-	if *fwipe {
-		if !*fforce {
-			l.Warn().
-				Str("bucket", cfg.AWS.S3Bucket).
-				Str("region", cfg.AWS.S3Region).
-				Msg(msgWipeWarning)
-			l.Warn().Msg(msgWipeContinuePrompt)
-			var answer string
-			_, err = fmt.Scanln(&answer)
+	// Validate -older-than up front rather than after a backup has already run
+	var olderThan time.Duration
+	if *fpurge || *fabortUploads {
+		olderThan, err = utilities.ParseAge(*folderThan)
+		if err != nil {
+			l.Fatal().Err(err).Str("older_than", *folderThan).Msg(msgInvalidOlderThan)
+		}
+	}
+
+	// Client-side encryption is optional and only used when a key is configured
+	cipher, err = s3crypt.New(cfg)
+	if err != nil {
+		l.Fatal().Err(err).Msg(msgLoadCipherFailed)
+	}
+
+	// The local state index is optional and only used when a state directory is configured
+	if cfg.AWS.StateDirectory != "" || *frebuild {
+		idx, err = s3index.New(cfg, svc, l)
+		if err != nil {
+			l.Fatal().Err(err).Msg(msgLoadIndexFailed)
+		}
+	}
+	if *frebuild {
+		err = idx.Rebuild()
+		if err != nil {
+			l.Fatal().Err(err).Msg(msgRebuildIndexFailed)
+		}
+		err = idx.Save()
+		if err != nil {
+			l.Fatal().Err(err).Msg(msgSaveIndexFailed)
+		}
+	}
+
+	// Restore is exclusive of every other operation
+	if *frestore {
+		if *fbackup || *fsync || *fwipe || *fwatch || *fdaemon {
+			l.Fatal().Err(errRestoreWithBackup).Msg(msgRestoreWithBackup)
+		}
+		if *fasOf != "" && *fsnapshot != "" {
+			l.Fatal().Err(errAsOfWithSnapshot).Msg(msgAsOfWithSnapshot)
+		}
+	}
+
+	// Daemon mode takes the lock for each job it runs instead
+	if *fdaemon && (*fwatch || *fwipe) {
+		l.Fatal().Err(errDaemonWithWatch).Msg(msgDaemonWithWatch)
+	}
+
+	// Ask before anything else so that Ctrl-C still simply ends the program.
+	// Listing snapshots never wipes, so it does not ask
+	if *fwipe && !*fforce && !cfg.DryRun && !*fsnapshots {
+		l.Warn().
+			Str("bucket", cfg.AWS.S3Bucket).
+			Str("region", cfg.AWS.S3Region).
+			Msg(msgWipeWarning)
+		l.Warn().Msg(msgWipeContinuePrompt)
+		var answer string
+		_, err = fmt.Scanln(&answer)
+		if err != nil {
+			log.Fatal().Err(err).Msg(msgProgramExiting)
+		}
+		if answer != "y" {
+			l.Fatal().Err(errInvalidWipeResponse).Msg(msgInvalidWipeResponse)
+			os.Exit(1)
+		}
+	}
+
+	// From here on SIGINT or SIGTERM stops the run gracefully: no new uploads,
+	// downloads or deletions are started, the ones in flight finish or are
+	// aborted, and what completed is reported. A second signal ends the
+	// program at once.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	context.AfterFunc(ctx, stop)
+
+	var completed []string
+	// stopped records op as completed, or if a signal arrived or the run lock
+	// was lost while it ran logs what completed before it and reports that the
+	// run must stop.
+	stopped := func(op string) bool {
+		if ctx.Err() == nil {
+			completed = append(completed, op)
+			return false
+		}
+		if errors.Is(context.Cause(ctx), s3lock.ErrLockLost) {
+			l.Error().Err(s3lock.ErrLockLost).Strs("completed", completed).Str("interrupted", op).Msg(msgRunLockLost)
+			return true
+		}
+		l.Warn().Strs("completed", completed).Str("interrupted", op).Msg(msgRunInterrupted)
+		return true
+	}
+
+	// Listing snapshots only reads the bucket
+	if *fsnapshots {
+		summaries, err := newSnapshotter(cfg, svc, cipher, l).List(ctx)
+		if stopped("list-snapshots") {
+			return exitInterrupted
+		}
+		if err != nil {
+			l.Fatal().Err(err).Msg(msgListSnapshotsFailed)
+		}
+		printSnapshots(summaries)
+		return 0
+	}
+
+	if *frestore {
+		var asOf time.Time
+		if *fasOf != "" {
+			asOf, err = time.Parse(time.RFC3339, *fasOf)
 			if err != nil {
-				log.Fatal().Err(err).Msg(msgProgramExiting)
+				l.Fatal().Err(err).Str("as_of", *fasOf).Msg(msgInvalidAsOf)
 			}
-			if answer != "y" {
-				l.Fatal().Err(errInvalidWipeResponse).Msg(msgInvalidWipeResponse)
-				os.Exit(1)
+		}
+		var manifest s3snapshot.Manifest
+		if *fsnapshot != "" {
+			manifest, err = newSnapshotter(cfg, svc, cipher, l).Manifest(ctx, *fsnapshot)
+			if stopped("load-snapshot") {
+				return exitInterrupted
+			}
+			if err != nil {
+				l.Fatal().Err(err).Str("snapshot", *fsnapshot).Msg(msgLoadSnapshotFailed)
+			}
+		}
+
+		status := 0
+		restorePaths := []string{*frestorePath}
+		if *frestorePath == "" {
+			restorePaths = restorePaths[:0]
+			for i := range cfg.AWS.BackupDirectories {
+				restorePaths = append(restorePaths, cfg.AWS.BackupDirectories[i].Path)
 			}
 		}
+		for _, restorePath := range restorePaths {
+			restore := s3restore.New(
+				cfg,
+				svc,
+				restorePath,
+				*frestoreTo,
+				l,
+			)
+			if !asOf.IsZero() {
+				_ = restore.SetAsOf(asOf)
+			}
+			if *fsnapshot != "" {
+				_ = restore.SetSnapshot(manifest)
+			}
+			if cipher != nil {
+				_ = restore.SetCipher(cipher)
+			}
+			err = restore.RestoreDirectory(ctx)
+			if stopped("restore " + restorePath) {
+				return exitInterrupted
+			}
+			if err != nil {
+				l.Error().Err(err).Str("root_dir", restorePath).Msg(msgRestoreDirectoryIssue)
+				status = exitFailed
+			}
+		}
+		return status
+	}
+
+	// Everything below changes the bucket, which only one run may do at a time.
+	// Once the lock is held errors return from run rather than exiting, so
+	// that the lock is always released
+	if !*fdaemon && (*fwipe || *fbackup || *fsync || *fprune || *fpurge || *fabortUploads || *fwatch) {
+		lock := s3lock.New(cfg, svc, l)
+		lockCtx, lockErr := lock.Lock(ctx)
+		if lockErr == nil {
+			defer func() { _ = lock.Unlock() }()
+		}
+		if stopped("lock") {
+			return exitInterrupted
+		}
+		if lockErr != nil {
+			l.Error().Err(lockErr).Msg(msgAcquireLockFailed)
+			return exitFailed
+		}
+		// Losing the lock stops the run the same way a signal does
+		ctx = lockCtx
+	}
+
+	// Begin backup procedures
+	if *fwipe {
 		bucketToWipe := s3clean.New(
 			cfg,
 			svc,
 			l,
 		)
-		err = bucketToWipe.WipeS3Bucket()
-		if err != nil {
-			log.Fatal().Err(err).Msg(msgProgramExiting)
+		err = bucketToWipe.WipeS3Bucket(ctx)
+		if err != nil && ctx.Err() == nil {
+			l.Error().Err(err).Str("bucket", cfg.AWS.S3Bucket).Msg(msgWipeBucketFailed)
+			return exitFailed
+		}
+
+		// Nothing in the index is in the bucket any more, which is also true
+		// of part of it after an interrupted wipe
+		if idx != nil && !cfg.DryRun {
+			idx.Reset()
+			err = idx.Save()
+			if err != nil {
+				l.Error().Err(err).Msg(msgSaveIndexFailed)
+				return exitFailed
+			}
+		}
+		if stopped("wipe") {
+			return stoppedStatus(ctx)
 		}
 		l.Info().Str("bucket", cfg.AWS.S3Bucket).Msg(msgBucketWiped)
 
-		if !*fbackup {
-			l.Fatal().Err(errNoBackupRequested).Msg(msgNoBackupRequested)
-			os.Exit(1)
+		if !*fbackup && !*fwatch {
+			l.Warn().Err(errNoBackupRequested).Msg(msgNoBackupRequested)
+			return 0
 		}
 
 	} else {
 		l.Warn().Err(errWipeNotSelected).Msg(msgWipeNotSelected)
 	}
 
+	// Daemon mode runs the scheduled jobs until SIGINT or SIGTERM
+	if *fdaemon {
+		scheduler := s3schedule.New(
+			cfg,
+			map[string]func(ctx context.Context) error{
+				s3schedule.JobBackup: withLock(cfg, svc, l, func(ctx context.Context) error { return runBackup(ctx, cfg, svc, idx, cipher, l) }),
+				s3schedule.JobSync:   withLock(cfg, svc, l, s3clean.New(cfg, svc, l).SyncS3Bucket),
+				s3schedule.JobPrune:  withLock(cfg, svc, l, s3clean.New(cfg, svc, l).PruneVersions),
+				s3schedule.JobVerify: func(ctx context.Context) error { return verifyDirectories(ctx, cfg, svc, cipher, l) },
+			},
+			l,
+		)
+		err = scheduler.Run(ctx)
+		if err != nil {
+			l.Error().Err(err).Msg(msgDaemonFailed)
+			return exitFailed
+		}
+		return 0
+	}
+
+	// Watch mode runs until SIGINT or SIGTERM and replaces a one-off backup
+	if *fwatch {
+		backups := make([]s3backup.S3backuper, 0, len(cfg.AWS.BackupDirectories))
+		for _, dir := range cfg.AWS.BackupDirectories {
+			backups = append(backups, newBackuper(cfg, svc, dir, idx, nil, cipher, l))
+		}
+		watcher := s3watch.New(
+			cfg,
+			backups,
+			s3clean.New(cfg, svc, l),
+			idx,
+			l,
+		)
+		err = watcher.Watch(ctx)
+		if err == nil && errors.Is(context.Cause(ctx), s3lock.ErrLockLost) {
+			err = s3lock.ErrLockLost
+		}
+		if err != nil {
+			l.Error().Err(err).Msg(msgWatchFailed)
+			return exitFailed
+		}
+		return 0
+	}
+
+	// A failure is logged and the remaining operations still run, but the
+	// exit code reports it
+	status := 0
+
 	if *fbackup {
-		for i := range cfg.AWS.BackupDirectories {
-			backup := s3backup.New(
-				cfg,
-				svc,
-				cfg.AWS.BackupDirectories[i],
-				l,
-			)
-			err = backup.BackupDirectory()
-			if err != nil {
-				l.Fatal().Err(err).Msg(msgBackupDirectoryIssue)
-			}
+		err = runBackup(ctx, cfg, svc, idx, cipher, l)
+		if stopped("backup") {
+			return stoppedStatus(ctx)
+		}
+		if err != nil {
+			l.Error().Err(err).Msg(msgBackupDirectoryIssue)
+			status = exitFailed
 		}
 	}
 
@@ -162,12 +465,243 @@ func main() {
 				svc,
 				l,
 			)
-			err = cleanBucket.SyncS3Bucket()
+			err = cleanBucket.SyncS3Bucket(ctx)
+			if stopped("sync") {
+				return stoppedStatus(ctx)
+			}
 			if err != nil {
 				l.Error().Err(err).Str("bucket", cfg.AWS.S3Bucket).Msg(msgSyncBucketFailed)
+				status = exitFailed
 			}
 		}
 	} else {
 		l.Warn().Err(errSyncNotSelected).Msg(msgSyncNotSelected)
 	}
+
+	if *fprune {
+		pruneBucket := s3clean.New(
+			cfg,
+			svc,
+			l,
+		)
+		err = pruneBucket.PruneVersions(ctx)
+		if stopped("prune") {
+			return stoppedStatus(ctx)
+		}
+		if err != nil {
+			l.Error().Err(err).Str("bucket", cfg.AWS.S3Bucket).Msg(msgPruneVersionsFailed)
+			status = exitFailed
+		}
+	}
+
+	if *fverify {
+		err = verifyDirectories(ctx, cfg, svc, cipher, l)
+		if stopped("verify") {
+			return stoppedStatus(ctx)
+		}
+		if err != nil {
+			l.Error().Err(err).Str("bucket", cfg.AWS.S3Bucket).Msg(msgVerifyDirectoryIssue)
+			status = exitFailed
+		}
+	}
+
+	if *fpurge {
+		purgeTrash := s3clean.New(
+			cfg,
+			svc,
+			l,
+		)
+		err = purgeTrash.PurgeTrash(ctx, olderThan)
+		if stopped("purge-trash") {
+			return stoppedStatus(ctx)
+		}
+		if err != nil {
+			l.Error().Err(err).Str("bucket", cfg.AWS.S3Bucket).Msg(msgPurgeTrashFailed)
+			status = exitFailed
+		}
+	}
+
+	if *fabortUploads {
+		abortUploads := s3clean.New(
+			cfg,
+			svc,
+			l,
+		)
+		err = abortUploads.AbortStaleUploads(ctx, olderThan)
+		if stopped("abort-stale-uploads") {
+			return stoppedStatus(ctx)
+		}
+		if err != nil {
+			l.Error().Err(err).Str("bucket", cfg.AWS.S3Bucket).Msg(msgAbortUploadsFailed)
+			status = exitFailed
+		}
+	}
+	return status
+}
+
+// stoppedStatus is the exit code of a run that stopped part way: exitFailed
+// when the run lock was lost, exitInterrupted after SIGINT or SIGTERM.
+func stoppedStatus(ctx context.Context) int {
+	if errors.Is(context.Cause(ctx), s3lock.ErrLockLost) {
+		return exitFailed
+	}
+	return exitInterrupted
+}
+
+// runBackup backs up every configured directory, writes the snapshot manifest
+// in snapshot mode and saves the local state index, also when ctx was
+// cancelled part way.
+func runBackup(ctx context.Context, cfg models.Config, svc *s3.Client, idx s3index.Indexer, c s3crypt.Cipher, l *zerolog.Logger) error {
+	var snap s3snapshot.Snapshotter
+	if cfg.AWS.BackupMode == s3backup.BackupModeSnapshot {
+		snap = newSnapshotter(cfg, svc, c, l)
+	}
+	err := backupDirectories(ctx, cfg, svc, idx, snap, c, l)
+	// A manifest is written for every backup that ran to completion, also when
+	// some files could not be backed up, but not for one that was interrupted
+	// or failed outright
+	if snap != nil && (err == nil || errors.Is(err, s3backup.ErrFilesFailed)) {
+		if err = snap.Save(ctx); err != nil {
+			l.Error().Err(err).Msg(msgSaveSnapshotFailed)
+		}
+	} else if snap != nil {
+		l.Error().Str("snapshot", snap.ID()).Msg(msgSnapshotNotSaved)
+	}
+	if idx != nil && !cfg.DryRun {
+		if saveErr := idx.Save(); saveErr != nil {
+			l.Error().Err(saveErr).Msg(msgSaveIndexFailed)
+		}
+	}
+	return err
+}
+
+// backupDirectories backs up every configured directory. Up to AWS.Concurrency
+// directories are walked at once and share one pool of AWS.Concurrency upload
+// workers, so no more than that many files are uploaded at a time.
+// Every directory is attempted and all failures are returned together, and
+// the files that could not be backed up in any directory are logged once
+// more as a single list. s3backup.ErrFilesFailed is only returned on its own
+// when nothing else went wrong. Once ctx is done no further directories are
+// started.
+func backupDirectories(ctx context.Context, cfg models.Config, svc *s3.Client, idx s3index.Indexer, snap s3snapshot.Snapshotter, c s3crypt.Cipher, l *zerolog.Logger) error {
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		errs   []error
+		failed []string
+		sem    = make(chan struct{}, max(cfg.AWS.Concurrency, 1))
+		pool   = s3backup.NewPool(cfg.AWS.Concurrency)
+	)
+
+	for _, dir := range cfg.AWS.BackupDirectories {
+		sem <- struct{}{}
+		wg.Go(func() {
+			defer func() { <-sem }()
+			backup := newBackuper(cfg, svc, dir, idx, snap, c, l)
+			_ = backup.SetPool(pool)
+			err := backup.BackupDirectory(ctx)
+			if err != nil {
+				if ctx.Err() == nil {
+					l.Error().Err(err).Str("root_dir", dir.Path).Msg(msgBackupDirectoryIssue)
+				}
+				mu.Lock()
+				if !errors.Is(err, s3backup.ErrFilesFailed) {
+					errs = append(errs, err)
+				}
+				failed = append(failed, backup.FailedFiles()...)
+				mu.Unlock()
+			}
+		})
+	}
+	wg.Wait()
+
+	if len(failed) > 0 {
+		slices.Sort(failed)
+		l.Error().Int("files_failed", len(failed)).Strs("failed_files", failed).Msg(msgFilesFailed)
+	}
+
+	// A directory that was never started must not count as backed up
+	if err := ctx.Err(); err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) == 0 && len(failed) > 0 {
+		return s3backup.ErrFilesFailed
+	}
+	return errors.Join(errs...)
+}
+
+// verifyDirectories checks every configured directory against the bucket.
+// Every directory is checked and all failures are returned together. The
+// cipher is needed to find encrypted snapshot contents and hashes.
+func verifyDirectories(ctx context.Context, cfg models.Config, svc *s3.Client, c s3crypt.Cipher, l *zerolog.Logger) error {
+	var errs []error
+	for _, dir := range cfg.AWS.BackupDirectories {
+		err := newBackuper(cfg, svc, dir, nil, nil, c, l).VerifyDirectory(ctx)
+		if ctx.Err() != nil {
+			return errors.Join(append(errs, err)...)
+		}
+		if err != nil {
+			l.Error().Err(err).Str("root_dir", dir.Path).Msg(msgVerifyDirectoryIssue)
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// withLock wraps job so that it holds the run lock while it runs. The job is
+// stopped if the lock is lost.
+func withLock(cfg models.Config, svc *s3.Client, l *zerolog.Logger, job func(ctx context.Context) error) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		lock := s3lock.New(cfg, svc, l)
+		lockCtx, err := lock.Lock(ctx)
+		if err != nil {
+			return err
+		}
+		err = job(lockCtx)
+		if errors.Is(context.Cause(lockCtx), s3lock.ErrLockLost) {
+			err = errors.Join(err, s3lock.ErrLockLost)
+		}
+		return errors.Join(err, lock.Unlock())
+	}
+}
+
+// newBackuper returns a backuper for dir using whichever of the index,
+// snapshot and cipher are in use.
+func newBackuper(cfg models.Config, svc *s3.Client, dir models.BackupDirectory, idx s3index.Indexer, snap s3snapshot.Snapshotter, c s3crypt.Cipher, l *zerolog.Logger) s3backup.S3backuper {
+	backup := s3backup.New(
+		cfg,
+		svc,
+		dir,
+		l,
+	)
+	if idx != nil {
+		_ = backup.SetIndex(idx)
+	}
+	if snap != nil {
+		_ = backup.SetSnapshot(snap)
+	}
+	if c != nil {
+		_ = backup.SetCipher(c)
+	}
+	return backup
+}
+
+// newSnapshotter returns a snapshotter that encrypts and decrypts manifests
+// when a cipher is in use.
+func newSnapshotter(cfg models.Config, svc *s3.Client, c s3crypt.Cipher, l *zerolog.Logger) s3snapshot.Snapshotter {
+	snap := s3snapshot.New(cfg, svc, l)
+	if c != nil {
+		_ = snap.SetCipher(c)
+	}
+	return snap
+}
+
+// printSnapshots writes the snapshot listing to stdout as a table.
+func printSnapshots(summaries []s3snapshot.Summary) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tCREATED\tFILES\tBYTES")
+	for _, s := range summaries {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\n", s.ID, s.Created.Local().Format(time.RFC3339), s.Files, s.Bytes)
+	}
+	w.Flush()
 }
@@ -1,12 +1,26 @@
 package models
 
 import (
+	"encoding/json"
 	"sync"
 )
 
 type Config struct {
-	AWS     AWS     `json:"AWS"`
-	Logging Logging `json:"Logging"`
+	AWS      AWS      `json:"AWS"`
+	Logging  Logging  `json:"Logging"`
+	Schedule Schedule `json:"Schedule"`
+
+	// DryRun is set from the -dry-run flag. All reads are performed but every
+	// write or delete against the bucket is only logged.
+	DryRun bool `json:"-"`
+
+	// Force is set from the -force flag and overrides the wipe confirmation
+	// prompt and the sync safety checks.
+	Force bool `json:"-"`
+
+	// WipeAllVersions is set from the -all-versions flag and makes -wipe remove
+	// every object version, delete marker and incomplete multipart upload.
+	WipeAllVersions bool `json:"-"`
 }
 
 type Logging struct {
@@ -17,16 +31,81 @@ type Logging struct {
 	Console         bool
 }
 
+// Schedule holds the cron expression of each job -daemon runs. A job with an
+// empty expression is not scheduled.
+type Schedule struct {
+	Backup string `json:"Backup"`
+	Sync   string `json:"Sync"`
+	Prune  string `json:"Prune"`
+	Verify string `json:"Verify"`
+}
+
 type AWS struct {
-	S3Region             string   `json:"S3Region"`
-	S3Bucket             string   `json:"S3Bucket"`
-	SecretAccessKey      string   `json:"SecretAccessKey"`
-	AccessKeyId          string   `json:"AccessKeyId"`
-	BackupDirectories    []string `json:"BackupDirectories"`
-	ACL                  string   `json:"ACL"`
-	ContentDisposition   string   `json:"ContentDisposition"`
-	ServerSideEncryption string   `json:"ServerSideEncryption"`
-	StorageClass         string   `json:"StorageClass"`
+	S3Region                 string                `json:"S3Region"`
+	S3Bucket                 string                `json:"S3Bucket"`
+	SecretAccessKey          string                `json:"SecretAccessKey"`
+	AccessKeyId              string                `json:"AccessKeyId"`
+	BackupDirectories        []BackupDirectory     `json:"BackupDirectories"`
+	ACL                      string                `json:"ACL"`
+	ContentDisposition       string                `json:"ContentDisposition"`
+	ServerSideEncryption     string                `json:"ServerSideEncryption"`
+	StorageClass             string                `json:"StorageClass"`
+	Concurrency              int                   `json:"Concurrency"`
+	MultipartThresholdMB     int                   `json:"MultipartThresholdMB"`
+	MultipartPartSizeMB      int                   `json:"MultipartPartSizeMB"`
+	MultipartConcurrency     int                   `json:"MultipartConcurrency"`
+	ChangeDetection          string                `json:"ChangeDetection"`
+	StateDirectory           string                `json:"StateDirectory"`
+	SyncOrphanedPrefixes     bool                  `json:"SyncOrphanedPrefixes"`
+	SyncMaxDeleteCount       int                   `json:"SyncMaxDeleteCount"`
+	SyncMaxDeletePercent     float64               `json:"SyncMaxDeletePercent"`
+	SyncMode                 string                `json:"SyncMode"`
+	TrashPrefix              string                `json:"TrashPrefix"`
+	BackupMode               string                `json:"BackupMode"`
+	KeepLast                 int                   `json:"KeepLast"`
+	KeepDaily                int                   `json:"KeepDaily"`
+	KeepWeekly               int                   `json:"KeepWeekly"`
+	KeepMonthly              int                   `json:"KeepMonthly"`
+	KeepYearly               int                   `json:"KeepYearly"`
+	EncryptionKeyFile        string                `json:"EncryptionKeyFile"`
+	EncryptionPassphraseFile string                `json:"EncryptionPassphraseFile"`
+	Compression              string                `json:"Compression"`
+	CompressionOverrides     []CompressionOverride `json:"CompressionOverrides"`
+	PreserveXattrs           bool                  `json:"PreserveXattrs"`
+	SymlinkMode              string                `json:"SymlinkMode"`
+	WatchDebounceSeconds     int                   `json:"WatchDebounceSeconds"`
+	WatchDeletes             bool                  `json:"WatchDeletes"`
+	LockFile                 string                `json:"LockFile"`
+	LockWaitSeconds          int                   `json:"LockWaitSeconds"`
+	S3Lock                   bool                  `json:"S3Lock"`
+	S3LockKey                string                `json:"S3LockKey"`
+	LockLeaseSeconds         int                   `json:"LockLeaseSeconds"`
+	RetryMaxAttempts         int                   `json:"RetryMaxAttempts"`
+	RetryBaseBackoffMS       int                   `json:"RetryBaseBackoffMS"`
+	RetryMaxBackoffSeconds   int                   `json:"RetryMaxBackoffSeconds"`
+	RetryJitter              string                `json:"RetryJitter"`
+	RetryErrorCodes          []string              `json:"RetryErrorCodes"`
+	RetryStatusCodes         []int                 `json:"RetryStatusCodes"`
+}
+
+// BackupDirectory is a directory to back up along with optional gitignore-style
+// Include and Exclude patterns relative to Path.
+type BackupDirectory struct {
+	Path    string   `json:"Path"`
+	Include []string `json:"Include"`
+	Exclude []string `json:"Exclude"`
+}
+
+// UnmarshalJSON accepts either a plain path string, as used by older config
+// files, or an object with Path, Include and Exclude.
+func (d *BackupDirectory) UnmarshalJSON(data []byte) error {
+	var path string
+	if err := json.Unmarshal(data, &path); err == nil {
+		*d = BackupDirectory{Path: path}
+		return nil
+	}
+	type plain BackupDirectory
+	return json.Unmarshal(data, (*plain)(d))
 }
 
 type AppConfig struct {
@@ -40,3 +119,10 @@ func NewAppConfig(config *Config) *AppConfig {
 		config: config,
 	}
 }
+
+// CompressionOverride sets the compression for files under a backup directory
+// matching Patterns, which use the same syntax as BackupDirectory.Include.
+type CompressionOverride struct {
+	Patterns    []string `json:"Patterns"`
+	Compression string   `json:"Compression"`
+}
@@ -0,0 +1,199 @@
+package fileattr
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	msgXattrsTooLarge = "extended attributes are too large to store in object metadata"
+)
+
+// Object metadata keys holding a file's attributes. S3 stores these as
+// x-amz-meta-* headers and always returns the keys in lower case.
+const (
+	MetadataMtime  = "mtime"
+	MetadataAtime  = "atime"
+	MetadataMode   = "mode"
+	MetadataUID    = "uid"
+	MetadataGID    = "gid"
+	MetadataXattrs = "xattrs"
+)
+
+// MaxXattrsSize is the largest encoded size of a file's extended attributes
+// that is stored. S3 limits all user metadata on an object to 2 KB.
+const MaxXattrsSize = 1024
+
+const (
+	modeSetuid = 0o4000
+	modeSetgid = 0o2000
+	modeSticky = 0o1000
+)
+
+var errXattrsTooLarge = errors.New(msgXattrsTooLarge)
+
+// Attributes are the POSIX attributes of a file that are preserved alongside
+// its contents. Mode holds the permission bits plus setuid, setgid and
+// sticky. Owner is only meaningful when HasOwner is set, since 0 is root.
+type Attributes struct {
+	Mode     fs.FileMode
+	UID      int
+	GID      int
+	HasOwner bool
+	Mtime    time.Time
+	Atime    time.Time
+	Xattrs   map[string][]byte
+}
+
+// FromFileInfo returns the attributes of the file described by info. Owner
+// and access time are only available on Linux and macOS.
+func FromFileInfo(info fs.FileInfo) Attributes {
+	attrs := Attributes{
+		Mode:  info.Mode() & (fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky),
+		Mtime: info.ModTime(),
+	}
+	attrs.UID, attrs.GID, attrs.Atime, attrs.HasOwner = ownerAndAtime(info)
+	return attrs
+}
+
+// LinkID identifies the inode shared by hard links to the same file.
+type LinkID struct {
+	Dev uint64
+	Ino uint64
+}
+
+// HardLinkID returns the inode of the file described by info when more than
+// one hard link to it exists. It always reports false outside Linux and macOS.
+func HardLinkID(info fs.FileInfo) (LinkID, bool) {
+	return hardLinkID(info)
+}
+
+// ReadXattrs returns the extended attributes of path, which on Linux include
+// its POSIX ACLs. It returns nil on platforms or filesystems without them,
+// and an error when they would not fit in MaxXattrsSize.
+func ReadXattrs(path string) (map[string][]byte, error) {
+	xattrs, err := readXattrs(path)
+	if err != nil || len(xattrs) == 0 {
+		return nil, err
+	}
+	if encoded, _ := encodeXattrs(xattrs); len(encoded) > MaxXattrsSize {
+		return nil, errXattrsTooLarge
+	}
+	return xattrs, nil
+}
+
+// Metadata encodes the attributes as object metadata.
+func (a Attributes) Metadata() map[string]string {
+	metadata := map[string]string{
+		MetadataMode: strconv.FormatUint(uint64(unixMode(a.Mode)), 8),
+	}
+	if !a.Mtime.IsZero() {
+		metadata[MetadataMtime] = a.Mtime.UTC().Format(time.RFC3339Nano)
+	}
+	if !a.Atime.IsZero() {
+		metadata[MetadataAtime] = a.Atime.UTC().Format(time.RFC3339Nano)
+	}
+	if a.HasOwner {
+		metadata[MetadataUID] = strconv.Itoa(a.UID)
+		metadata[MetadataGID] = strconv.Itoa(a.GID)
+	}
+	if encoded, err := encodeXattrs(a.Xattrs); err == nil && encoded != "" {
+		metadata[MetadataXattrs] = encoded
+	}
+	return metadata
+}
+
+// Parse decodes attributes written by Metadata. Missing or malformed values
+// are left at their zero value, so objects uploaded before attributes were
+// recorded restore with defaults.
+func Parse(metadata map[string]string) Attributes {
+	var attrs Attributes
+	if mode, err := strconv.ParseUint(metadata[MetadataMode], 8, 32); err == nil {
+		attrs.Mode = goMode(uint32(mode))
+	}
+	attrs.Mtime, _ = time.Parse(time.RFC3339Nano, metadata[MetadataMtime])
+	attrs.Atime, _ = time.Parse(time.RFC3339Nano, metadata[MetadataAtime])
+
+	uid, uidErr := strconv.Atoi(metadata[MetadataUID])
+	gid, gidErr := strconv.Atoi(metadata[MetadataGID])
+	if uidErr == nil && gidErr == nil {
+		attrs.UID, attrs.GID, attrs.HasOwner = uid, gid, true
+	}
+
+	if encoded := metadata[MetadataXattrs]; encoded != "" {
+		if raw, err := base64.StdEncoding.DecodeString(encoded); err == nil {
+			_ = json.Unmarshal(raw, &attrs.Xattrs)
+		}
+	}
+	return attrs
+}
+
+// Apply sets the attributes on path. Ownership is set first because changing
+// it clears the setuid and setgid bits. Every attribute is attempted and all
+// failures are returned together; setting another user's ownership or some
+// extended attributes needs root.
+func Apply(path string, a Attributes) error {
+	var errs []error
+	if a.HasOwner {
+		errs = append(errs, os.Lchown(path, a.UID, a.GID))
+	}
+	for name, value := range a.Xattrs {
+		errs = append(errs, writeXattr(path, name, value))
+	}
+	if a.Mode != 0 {
+		errs = append(errs, os.Chmod(path, a.Mode))
+	}
+	if !a.Mtime.IsZero() {
+		atime := a.Atime
+		if atime.IsZero() {
+			atime = a.Mtime
+		}
+		errs = append(errs, os.Chtimes(path, atime, a.Mtime))
+	}
+	return errors.Join(errs...)
+}
+
+func encodeXattrs(xattrs map[string][]byte) (string, error) {
+	if len(xattrs) == 0 {
+		return "", nil
+	}
+	raw, err := json.Marshal(xattrs)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(raw), nil
+}
+
+// unixMode converts Go's file mode bits to the traditional octal layout.
+func unixMode(mode fs.FileMode) uint32 {
+	bits := uint32(mode.Perm())
+	if mode&fs.ModeSetuid != 0 {
+		bits |= modeSetuid
+	}
+	if mode&fs.ModeSetgid != 0 {
+		bits |= modeSetgid
+	}
+	if mode&fs.ModeSticky != 0 {
+		bits |= modeSticky
+	}
+	return bits
+}
+
+func goMode(bits uint32) fs.FileMode {
+	mode := fs.FileMode(bits) & fs.ModePerm
+	if bits&modeSetuid != 0 {
+		mode |= fs.ModeSetuid
+	}
+	if bits&modeSetgid != 0 {
+		mode |= fs.ModeSetgid
+	}
+	if bits&modeSticky != 0 {
+		mode |= fs.ModeSticky
+	}
+	return mode
+}
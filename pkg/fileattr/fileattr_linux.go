@@ -0,0 +1,10 @@
+package fileattr
+
+import (
+	"syscall"
+	"time"
+)
+
+func accessTime(st *syscall.Stat_t) time.Time {
+	return time.Unix(st.Atim.Unix())
+}
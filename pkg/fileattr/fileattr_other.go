@@ -0,0 +1,24 @@
+//go:build !linux && !darwin
+
+package fileattr
+
+import (
+	"io/fs"
+	"time"
+)
+
+func ownerAndAtime(info fs.FileInfo) (uid int, gid int, atime time.Time, ok bool) {
+	return 0, 0, time.Time{}, false
+}
+
+func hardLinkID(info fs.FileInfo) (LinkID, bool) {
+	return LinkID{}, false
+}
+
+func readXattrs(path string) (map[string][]byte, error) {
+	return nil, nil
+}
+
+func writeXattr(path string, name string, value []byte) error {
+	return nil
+}
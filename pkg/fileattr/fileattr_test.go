@@ -0,0 +1,77 @@
+package fileattr_test
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jaysonhurd/s3backup/pkg/fileattr"
+)
+
+func TestMetadataRoundTrip(t *testing.T) {
+	attrs := fileattr.Attributes{
+		Mode:     0o750 | fs.ModeSetgid,
+		UID:      0,
+		GID:      100,
+		HasOwner: true,
+		Mtime:    time.Date(2026, 9, 1, 12, 0, 0, 123, time.UTC),
+		Atime:    time.Date(2026, 9, 2, 12, 0, 0, 0, time.UTC),
+		Xattrs:   map[string][]byte{"user.comment": []byte("quarterly report")},
+	}
+
+	metadata := attrs.Metadata()
+	if metadata[fileattr.MetadataMode] != "2750" {
+		t.Fatalf("mode metadata = %q, want %q", metadata[fileattr.MetadataMode], "2750")
+	}
+
+	got := fileattr.Parse(metadata)
+	if got.Mode != attrs.Mode || got.UID != 0 || got.GID != 100 || !got.HasOwner {
+		t.Fatalf("Parse() = %+v, want %+v", got, attrs)
+	}
+	if !got.Mtime.Equal(attrs.Mtime) || !got.Atime.Equal(attrs.Atime) {
+		t.Fatalf("Parse() times %v %v, want %v %v", got.Mtime, got.Atime, attrs.Mtime, attrs.Atime)
+	}
+	if string(got.Xattrs["user.comment"]) != "quarterly report" {
+		t.Fatalf("Parse() xattrs = %v", got.Xattrs)
+	}
+}
+
+func TestParseWithoutAttributes(t *testing.T) {
+	got := fileattr.Parse(map[string]string{fileattr.MetadataUID: "1000"})
+	if got.HasOwner || got.Mode != 0 || !got.Mtime.IsZero() {
+		t.Fatalf("Parse() = %+v, want the zero value for missing attributes", got)
+	}
+}
+
+func TestApply(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file.txt")
+	if err := os.WriteFile(path, []byte("hello"), 0o600); err != nil {
+		t.Fatalf("unable to create temp file: %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("unable to stat temp file: %v", err)
+	}
+	current := fileattr.FromFileInfo(info)
+
+	mtime := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+	err = fileattr.Apply(path, fileattr.Attributes{
+		Mode:     0o640,
+		UID:      current.UID,
+		GID:      current.GID,
+		HasOwner: current.HasOwner,
+		Mtime:    mtime,
+	})
+	if err != nil {
+		t.Fatalf("Apply() unexpected error: %v", err)
+	}
+
+	if info, err = os.Stat(path); err != nil {
+		t.Fatalf("unable to stat temp file: %v", err)
+	}
+	if info.Mode().Perm() != 0o640 || !info.ModTime().Equal(mtime) {
+		t.Fatalf("file mode %v mtime %v, want %v and %v", info.Mode().Perm(), info.ModTime(), fs.FileMode(0o640), mtime)
+	}
+}
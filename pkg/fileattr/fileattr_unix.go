@@ -0,0 +1,64 @@
+//go:build linux || darwin
+
+package fileattr
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func ownerAndAtime(info fs.FileInfo) (uid int, gid int, atime time.Time, ok bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, time.Time{}, false
+	}
+	return int(st.Uid), int(st.Gid), accessTime(st), true
+}
+
+func hardLinkID(info fs.FileInfo) (LinkID, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || st.Nlink < 2 {
+		return LinkID{}, false
+	}
+	return LinkID{Dev: uint64(st.Dev), Ino: uint64(st.Ino)}, true
+}
+
+func readXattrs(path string) (map[string][]byte, error) {
+	size, err := unix.Listxattr(path, nil)
+	if errors.Is(err, unix.ENOTSUP) {
+		return nil, nil
+	}
+	if err != nil || size == 0 {
+		return nil, err
+	}
+	names := make([]byte, size)
+	if size, err = unix.Listxattr(path, names); err != nil {
+		return nil, err
+	}
+
+	xattrs := make(map[string][]byte)
+	for name := range bytes.SplitSeq(names[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		valueSize, err := unix.Getxattr(path, string(name), nil)
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, valueSize)
+		if valueSize, err = unix.Getxattr(path, string(name), value); err != nil {
+			return nil, err
+		}
+		xattrs[string(name)] = value[:valueSize]
+	}
+	return xattrs, nil
+}
+
+func writeXattr(path string, name string, value []byte) error {
+	return unix.Setxattr(path, name, value, 0)
+}
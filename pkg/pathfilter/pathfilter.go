@@ -0,0 +1,206 @@
+package pathfilter
+
+import (
+	"bufio"
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// IgnoreFileName is read from every directory that is walked. Its patterns use
+// the same syntax as Exclude and are relative to the directory it is found in.
+const IgnoreFileName = ".s3backupignore"
+
+const (
+	patternSeparator = "/"
+	patternNegate    = "!"
+	patternComment   = "#"
+	patternAnyDepth  = "**"
+	currentDirectory = "."
+)
+
+// Matcher decides which paths under a backup directory are backed up. Paths
+// are always relative to the backup directory and slash-separated.
+//
+// Patterns follow gitignore rules: a pattern without a slash matches a name at
+// any depth, a pattern containing a slash is anchored to the directory it is
+// defined in, a trailing slash only matches directories, "**" matches any
+// number of directories, a leading "!" re-includes a previously excluded path
+// and the last matching pattern wins. A pattern that matches a directory also
+// matches everything below it.
+type Matcher interface {
+	Excluded(rel string, isDir bool) bool
+	Included(rel string) bool
+	LoadIgnoreFile(dir string, rel string) error
+}
+
+type rule struct {
+	base     string
+	segments []string
+	negate   bool
+	dirOnly  bool
+}
+
+type matcher struct {
+	include []rule
+	exclude []rule
+}
+
+// New returns a Matcher for a backup directory's Include and Exclude lists. An
+// empty Include list includes every file.
+func New(include []string, exclude []string) Matcher {
+	m := &matcher{}
+	for _, p := range include {
+		if r, ok := parseRule(p, ""); ok {
+			m.include = append(m.include, r)
+		}
+	}
+	for _, p := range exclude {
+		if r, ok := parseRule(p, ""); ok {
+			m.exclude = append(m.exclude, r)
+		}
+	}
+	return m
+}
+
+// Excluded reports whether rel matches the exclude patterns, including those
+// read from ignore files in rel's ancestors.
+func (m *matcher) Excluded(rel string, isDir bool) bool {
+	return evaluate(m.exclude, rel, isDir)
+}
+
+// Included reports whether the file rel matches the include patterns.
+func (m *matcher) Included(rel string) bool {
+	if len(m.include) == 0 {
+		return true
+	}
+	return evaluate(m.include, rel, false)
+}
+
+// Match reports whether the file rel matches patterns, which use the same
+// syntax as Include.
+func Match(patterns []string, rel string) bool {
+	rules := make([]rule, 0, len(patterns))
+	for _, p := range patterns {
+		if r, ok := parseRule(p, ""); ok {
+			rules = append(rules, r)
+		}
+	}
+	return evaluate(rules, rel, false)
+}
+
+// LoadIgnoreFile adds the patterns from dir's ignore file, if it has one, as
+// exclude patterns relative to rel.
+func (m *matcher) LoadIgnoreFile(dir string, rel string) error {
+	f, err := os.Open(filepath.Join(dir, IgnoreFileName))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	base := filepath.ToSlash(rel)
+	if base == currentDirectory {
+		base = ""
+	}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if r, ok := parseRule(scanner.Text(), base); ok {
+			m.exclude = append(m.exclude, r)
+		}
+	}
+	return scanner.Err()
+}
+
+func parseRule(pattern string, base string) (rule, bool) {
+	pattern = strings.TrimSpace(pattern)
+	if pattern == "" || strings.HasPrefix(pattern, patternComment) {
+		return rule{}, false
+	}
+
+	r := rule{base: base}
+	if strings.HasPrefix(pattern, patternNegate) {
+		r.negate = true
+		pattern = pattern[len(patternNegate):]
+	}
+	if strings.HasSuffix(pattern, patternSeparator) {
+		r.dirOnly = true
+		pattern = strings.TrimSuffix(pattern, patternSeparator)
+	}
+	if pattern == "" {
+		return rule{}, false
+	}
+
+	if strings.Contains(pattern, patternSeparator) {
+		pattern = strings.TrimPrefix(pattern, patternSeparator)
+	} else {
+		pattern = patternAnyDepth + patternSeparator + pattern
+	}
+	r.segments = strings.Split(pattern, patternSeparator)
+	return r, true
+}
+
+// evaluate applies rules in order and returns the outcome of the last one that
+// matches rel.
+func evaluate(rules []rule, rel string, isDir bool) bool {
+	matched := false
+	for i := range rules {
+		if rules[i].matches(rel, isDir) {
+			matched = !rules[i].negate
+		}
+	}
+	return matched
+}
+
+// matches reports whether the rule matches rel or any of its parent
+// directories.
+func (r rule) matches(rel string, isDir bool) bool {
+	if r.base != "" {
+		if !strings.HasPrefix(rel, r.base+patternSeparator) {
+			return false
+		}
+		rel = strings.TrimPrefix(rel, r.base+patternSeparator)
+	}
+
+	segments := strings.Split(rel, patternSeparator)
+	for n := len(segments); n > 0; n-- {
+		// Every prefix shorter than the full path is a directory.
+		if r.dirOnly && n == len(segments) && !isDir {
+			continue
+		}
+		if matchSegments(r.segments, segments[:n]) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchSegments(pattern []string, segments []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == patternAnyDepth {
+			pattern = pattern[1:]
+			if len(pattern) == 0 {
+				return len(segments) > 0
+			}
+			for i := 0; i <= len(segments); i++ {
+				if matchSegments(pattern, segments[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(segments) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], segments[0]); !ok {
+			return false
+		}
+		pattern, segments = pattern[1:], segments[1:]
+	}
+	return len(segments) == 0
+}
@@ -0,0 +1,124 @@
+package pathfilter_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jaysonhurd/s3backup/pkg/pathfilter"
+)
+
+func TestExcluded(t *testing.T) {
+	matcher := pathfilter.New(nil, []string{
+		"node_modules/",
+		"*.swp",
+		"/build",
+		"docs/**/*.tmp",
+		"*.log",
+		"!keep.log",
+	})
+
+	tests := []struct {
+		rel   string
+		isDir bool
+		want  bool
+	}{
+		{rel: "node_modules", isDir: true, want: true},
+		{rel: "web/node_modules", isDir: true, want: true},
+		{rel: "node_modules", isDir: false, want: false},
+		{rel: "web/node_modules/pkg/index.js", isDir: false, want: true},
+		{rel: "src/.main.go.swp", isDir: false, want: true},
+		{rel: "build", isDir: true, want: true},
+		{rel: "src/build", isDir: true, want: false},
+		{rel: "docs/a/b/c.tmp", isDir: false, want: true},
+		{rel: "docs/c.tmp", isDir: false, want: true},
+		{rel: "src/c.tmp", isDir: false, want: false},
+		{rel: "var/app.log", isDir: false, want: true},
+		{rel: "var/keep.log", isDir: false, want: false},
+		{rel: "src/main.go", isDir: false, want: false},
+	}
+	for _, tt := range tests {
+		if got := matcher.Excluded(tt.rel, tt.isDir); got != tt.want {
+			t.Errorf("Excluded(%q, %v) = %v, want %v", tt.rel, tt.isDir, got, tt.want)
+		}
+	}
+}
+
+func TestIncluded(t *testing.T) {
+	matcher := pathfilter.New([]string{"*.go", "docs"}, nil)
+
+	tests := []struct {
+		rel  string
+		want bool
+	}{
+		{rel: "main.go", want: true},
+		{rel: "pkg/s3backup/s3backup.go", want: true},
+		{rel: "docs/guide/index.md", want: true},
+		{rel: "README.md", want: false},
+	}
+	for _, tt := range tests {
+		if got := matcher.Included(tt.rel); got != tt.want {
+			t.Errorf("Included(%q) = %v, want %v", tt.rel, got, tt.want)
+		}
+	}
+
+	if !pathfilter.New(nil, nil).Included("anything") {
+		t.Errorf("expected an empty include list to include every file")
+	}
+}
+
+func TestLoadIgnoreFile(t *testing.T) {
+	root := t.TempDir()
+	sub := filepath.Join(root, "project")
+	if err := os.MkdirAll(sub, 0o755); err != nil {
+		t.Fatalf("unable to create directory: %v", err)
+	}
+	ignore := "# build output\n\n/dist\n.cache/\n"
+	if err := os.WriteFile(filepath.Join(sub, pathfilter.IgnoreFileName), []byte(ignore), 0o600); err != nil {
+		t.Fatalf("unable to write ignore file: %v", err)
+	}
+
+	matcher := pathfilter.New(nil, nil)
+	if err := matcher.LoadIgnoreFile(root, "."); err != nil {
+		t.Fatalf("LoadIgnoreFile() on directory without ignore file: %v", err)
+	}
+	if err := matcher.LoadIgnoreFile(sub, "project"); err != nil {
+		t.Fatalf("LoadIgnoreFile() unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		rel   string
+		isDir bool
+		want  bool
+	}{
+		{rel: "project/dist", isDir: true, want: true},
+		{rel: "dist", isDir: true, want: false},
+		{rel: "project/src/dist", isDir: true, want: false},
+		{rel: "project/src/.cache", isDir: true, want: true},
+		{rel: ".cache", isDir: true, want: false},
+	}
+	for _, tt := range tests {
+		if got := matcher.Excluded(tt.rel, tt.isDir); got != tt.want {
+			t.Errorf("Excluded(%q, %v) = %v, want %v", tt.rel, tt.isDir, got, tt.want)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		rel      string
+		want     bool
+	}{
+		{patterns: []string{"*.csv"}, rel: "reports/2026/q1.csv", want: true},
+		{patterns: []string{"/logs"}, rel: "logs/app.log", want: true},
+		{patterns: []string{"/logs"}, rel: "old/logs/app.log", want: false},
+		{patterns: []string{"*.log", "!debug.log"}, rel: "debug.log", want: false},
+		{patterns: nil, rel: "anything", want: false},
+	}
+	for _, tt := range tests {
+		if got := pathfilter.Match(tt.patterns, tt.rel); got != tt.want {
+			t.Errorf("Match(%q, %q) = %v, want %v", tt.patterns, tt.rel, got, tt.want)
+		}
+	}
+}
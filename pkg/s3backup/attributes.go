@@ -0,0 +1,26 @@
+package s3backup
+
+import (
+	"io/fs"
+
+	"github.com/jaysonhurd/s3backup/pkg/fileattr"
+)
+
+const (
+	msgReadXattrsError = "unable to read extended attributes - uploading without them"
+)
+
+// fileMetadata returns the object metadata recording the file's mode,
+// ownership, modification and access times and, with AWS.PreserveXattrs, its
+// extended attributes.
+func (b *s3backup) fileMetadata(path string, fileInfo fs.FileInfo) map[string]string {
+	attrs := fileattr.FromFileInfo(fileInfo)
+	if b.cfg.AWS.PreserveXattrs {
+		xattrs, err := fileattr.ReadXattrs(path)
+		if err != nil {
+			b.l.Warn().Err(err).Str("path", path).Msg(msgReadXattrsError)
+		}
+		attrs.Xattrs = xattrs
+	}
+	return attrs.Metadata()
+}
@@ -0,0 +1,229 @@
+package s3backup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/jaysonhurd/s3backup/pkg/fileattr"
+	"github.com/jaysonhurd/s3backup/pkg/s3index"
+)
+
+const (
+	msgInvalidChangeDetection = "invalid change detection mode in configuration"
+	msgUnsupportedDetection   = "unsupported change detection mode"
+	msgSkippingIndexedFile    = "skipping file because the local state index shows it unchanged"
+)
+
+// Change detection modes for AWS.ChangeDetection. An empty value behaves like
+// ChangeDetectionMtime.
+const (
+	ChangeDetectionMtime     = "mtime"
+	ChangeDetectionSizeMtime = "size+mtime"
+	ChangeDetectionSHA256    = "sha256"
+)
+
+// Object metadata keys written on upload. S3 stores these as x-amz-meta-*
+// headers and always returns the keys in lower case.
+const (
+	MetadataMtime  = fileattr.MetadataMtime
+	MetadataSHA256 = "sha256"
+	MetadataSize   = "size"
+
+	// MetadataCompression replaces Content-Encoding on encrypted objects,
+	// whose body is ciphertext that no client could decode as such.
+	MetadataCompression = "compression"
+)
+
+var errUnsupportedDetection = errors.New(msgUnsupportedDetection)
+
+func validateChangeDetection(mode string) error {
+	switch mode {
+	case "", ChangeDetectionMtime, ChangeDetectionSizeMtime, ChangeDetectionSHA256:
+		return nil
+	}
+	return errUnsupportedDetection
+}
+
+// fileChanged reports whether the local file differs from the object described
+// by head, which is nil when the object does not exist. An object standing in
+// for a link always differs. Any metadata computed while deciding (the content
+// hash in sha256 mode) is added to metadata so it can be stored with the upload.
+func (b *s3backup) fileChanged(path string, fileInfo fs.FileInfo, head *s3.HeadObjectOutput, metadata map[string]string) (bool, error) {
+	if head != nil && storedLink(head) {
+		return true, nil
+	}
+	switch b.cfg.AWS.ChangeDetection {
+	case ChangeDetectionSizeMtime:
+		if head == nil {
+			return true, nil
+		}
+		if storedSize(head) != fileInfo.Size() {
+			return true, nil
+		}
+		if stored, ok := storedMtime(head); ok {
+			return !stored.Equal(fileInfo.ModTime()), nil
+		}
+		return newerThanObject(fileInfo, head), nil
+
+	case ChangeDetectionSHA256:
+		sum, err := b.contentHash(path, metadata)
+		if err != nil {
+			return false, err
+		}
+		if head == nil {
+			return true, nil
+		}
+		stored, err := b.storedHash(sum)
+		if err != nil {
+			return false, err
+		}
+		return head.Metadata[MetadataSHA256] != stored, nil
+
+	default:
+		return newerThanObject(fileInfo, head), nil
+	}
+}
+
+// indexUnchanged reports whether the local state index already records this
+// exact file, in which case no S3 request is needed at all. It always returns
+// false when no index has been set.
+func (b *s3backup) indexUnchanged(key string, path string, fileInfo fs.FileInfo, metadata map[string]string) (bool, error) {
+	if b.idx == nil {
+		return false, nil
+	}
+	entry, ok := b.idx.Lookup(key)
+	if !ok || entry.Size != fileInfo.Size() {
+		return false, nil
+	}
+
+	switch b.cfg.AWS.ChangeDetection {
+	case ChangeDetectionSizeMtime:
+		return entry.Mtime.Equal(fileInfo.ModTime()), nil
+
+	case ChangeDetectionSHA256:
+		if entry.SHA256 == "" {
+			return false, nil
+		}
+		sum, err := b.contentHash(path, metadata)
+		if err != nil {
+			return false, err
+		}
+		return entry.SHA256 == sum, nil
+
+	default:
+		return !fileInfo.ModTime().After(entry.Mtime), nil
+	}
+}
+
+// recordIndex remembers the file as it is now stored in S3.
+func (b *s3backup) recordIndex(key string, fileInfo fs.FileInfo, etag string, metadata map[string]string) {
+	if b.idx == nil {
+		return
+	}
+	b.idx.Record(s3index.Entry{
+		Key:    key,
+		Size:   fileInfo.Size(),
+		Mtime:  fileInfo.ModTime(),
+		ETag:   etag,
+		SHA256: metadata[MetadataSHA256],
+	})
+}
+
+// pruneIndex forgets indexed files under this directory that no longer exist
+// locally, so a file that reappears later is checked against S3 again.
+func (b *s3backup) pruneIndex() {
+	if b.idx == nil {
+		return
+	}
+	prefix, err := ObjectKey(b.dir.Path)
+	if err != nil {
+		return
+	}
+	for _, key := range b.idx.Keys(b.indexKey(prefix)) {
+		path := LocalPath(strings.TrimPrefix(key, b.indexKey("")))
+		if _, err = os.Lstat(path); errors.Is(err, fs.ErrNotExist) {
+			b.idx.Remove(key)
+		}
+	}
+}
+
+// contentHash returns the SHA-256 of the file, computing it at most once per
+// file by caching it in the upload metadata.
+func (b *s3backup) contentHash(path string, metadata map[string]string) (string, error) {
+	if sum, ok := metadata[MetadataSHA256]; ok {
+		return sum, nil
+	}
+	sum, err := fileSHA256(path)
+	if err != nil {
+		return "", err
+	}
+	metadata[MetadataSHA256] = sum
+	return sum, nil
+}
+
+// storedHash returns a file's SHA-256 as it is recorded on its object. With
+// encryption that is the cipher's ContentID of it, so the bucket does not
+// reveal which known files it holds.
+func (b *s3backup) storedHash(sum string) (string, error) {
+	if b.c == nil {
+		return sum, nil
+	}
+	return b.c.ContentID(sum)
+}
+
+// newerThanObject is the original mtime check: the file changed if it was
+// modified after the object was last written to S3.
+func newerThanObject(fileInfo fs.FileInfo, head *s3.HeadObjectOutput) bool {
+	if head == nil || head.LastModified == nil {
+		return true
+	}
+	return fileInfo.ModTime().After(*head.LastModified)
+}
+
+// storedSize returns the size of the local file the object was uploaded from.
+// This differs from the object's own length when it was encrypted.
+func storedSize(head *s3.HeadObjectOutput) int64 {
+	if value, ok := head.Metadata[MetadataSize]; ok {
+		if size, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return size
+		}
+	}
+	return aws.ToInt64(head.ContentLength)
+}
+
+// storedMtime returns the local modification time recorded on the object when
+// it was uploaded, if there is one.
+func storedMtime(head *s3.HeadObjectOutput) (time.Time, bool) {
+	value, ok := head.Metadata[MetadataMtime]
+	if !ok {
+		return time.Time{}, false
+	}
+	stored, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return stored, true
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
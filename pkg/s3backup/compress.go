@@ -0,0 +1,117 @@
+package s3backup
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"path/filepath"
+
+	"github.com/jaysonhurd/s3backup/pkg/pathfilter"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	msgInvalidCompression     = "invalid compression in configuration"
+	msgUnsupportedCompression = "unsupported compression"
+)
+
+// Compression algorithms for AWS.Compression and CompressionOverrides. An
+// empty value behaves like CompressionNone. The algorithm is recorded as the
+// object's Content-Encoding, or in MetadataCompression when encrypting.
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+// Incompressible data is stored in raw blocks, which gzip and zstd frame with a
+// few bytes each, plus a header and trailer per stream. These bound that
+// growth generously.
+const (
+	compressionOverheadRatio = 1000
+	compressionOverheadBytes = 1024
+)
+
+var errUnsupportedCompression = errors.New(msgUnsupportedCompression)
+
+func validateCompression(algorithm string) error {
+	switch algorithm {
+	case "", CompressionNone, CompressionGzip, CompressionZstd:
+		return nil
+	}
+	return errUnsupportedCompression
+}
+
+// validateCompressionConfig checks AWS.Compression and every override.
+func (b *s3backup) validateCompressionConfig() (string, error) {
+	if err := validateCompression(b.cfg.AWS.Compression); err != nil {
+		return b.cfg.AWS.Compression, err
+	}
+	for _, override := range b.cfg.AWS.CompressionOverrides {
+		if err := validateCompression(override.Compression); err != nil {
+			return override.Compression, err
+		}
+	}
+	return "", nil
+}
+
+// compressionFor returns the algorithm for the file at path. The first
+// override with a pattern matching the path relative to the backup directory
+// wins, otherwise AWS.Compression applies.
+func (b *s3backup) compressionFor(path string) string {
+	if rel, err := filepath.Rel(b.dir.Path, path); err == nil {
+		rel = filepath.ToSlash(rel)
+		for _, override := range b.cfg.AWS.CompressionOverrides {
+			if pathfilter.Match(override.Patterns, rel) {
+				return override.Compression
+			}
+		}
+	}
+	return b.cfg.AWS.Compression
+}
+
+// compress returns a reader producing body compressed with algorithm. The
+// compression runs in its own goroutine, which exits once the returned reader
+// is closed or body is exhausted.
+func compress(body io.Reader, algorithm string) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		var (
+			w   io.WriteCloser
+			err error
+		)
+		switch algorithm {
+		case CompressionGzip:
+			w = gzip.NewWriter(pw)
+		case CompressionZstd:
+			// Files are already compressed in parallel by the upload workers.
+			w, err = zstd.NewWriter(pw, zstd.WithEncoderConcurrency(1))
+		default:
+			err = errUnsupportedCompression
+		}
+		if err == nil {
+			if _, err = io.Copy(w, body); err == nil {
+				err = w.Close()
+			}
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// Decompress returns a reader producing the original contents of an object
+// stored with the given Content-Encoding. Objects without one, or with an
+// encoding S3Backup did not write, are returned unchanged.
+func Decompress(body io.Reader, contentEncoding string) (io.ReadCloser, error) {
+	switch contentEncoding {
+	case CompressionGzip:
+		return gzip.NewReader(body)
+	case CompressionZstd:
+		d, err := zstd.NewReader(body, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	}
+	return io.NopCloser(body), nil
+}
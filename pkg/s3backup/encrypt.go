@@ -0,0 +1,21 @@
+package s3backup
+
+import (
+	"io"
+	"maps"
+)
+
+// encryptedContentType is used for every encrypted object, since the detected
+// type of the plaintext would leak what the file is.
+const encryptedContentType = "application/octet-stream"
+
+// encrypt wraps body with the configured cipher and returns the ciphertext and
+// its size, adding the encryption parameters to metadata.
+func (b *s3backup) encrypt(body io.Reader, size int64, metadata map[string]string) (io.Reader, int64, error) {
+	ciphertext, ciphertextSize, encMetadata, err := b.c.Encrypt(body, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	maps.Copy(metadata, encMetadata)
+	return ciphertext, ciphertextSize, nil
+}
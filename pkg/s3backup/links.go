@@ -0,0 +1,190 @@
+package s3backup
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/url"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/jaysonhurd/s3backup/pkg/fileattr"
+	"github.com/jaysonhurd/s3backup/pkg/s3snapshot"
+)
+
+const (
+	msgInvalidSymlinkMode     = "invalid symlink mode in configuration"
+	msgUnsupportedSymlinkMode = "unsupported symlink mode"
+	msgBackingUpMarker        = "storing directory, symbolic link or hard link"
+	msgSkippingMarker         = "skipping directory, symbolic link or hard link because it is already stored"
+	msgReadSymlinkError       = "unable to read symbolic link target"
+)
+
+// Symlink modes for AWS.SymlinkMode. An empty value behaves like
+// SymlinkModeSkip.
+const (
+	SymlinkModeSkip   = "skip"
+	SymlinkModeFollow = "follow"
+	SymlinkModeStore  = "store"
+)
+
+// Object metadata keys of the zero-byte objects that stand in for symbolic
+// links and hard links. The values are URL path escaped, since S3 metadata
+// must be ASCII. MetadataSymlinkTarget holds the link's target exactly as
+// read from the link, MetadataHardLinkTarget the key of the object holding
+// the contents shared by the link.
+const (
+	MetadataSymlinkTarget  = "symlink-target"
+	MetadataHardLinkTarget = "hardlink-target"
+)
+
+// DirectoryContentType is set on the marker objects, with keys ending in a
+// slash, that record empty directories.
+const DirectoryContentType = "application/x-directory"
+
+const markerContentType = "application/octet-stream"
+
+var errUnsupportedSymlinkMode = errors.New(msgUnsupportedSymlinkMode)
+
+func validateSymlinkMode(mode string) error {
+	switch mode {
+	case "", SymlinkModeSkip, SymlinkModeFollow, SymlinkModeStore:
+		return nil
+	}
+	return errUnsupportedSymlinkMode
+}
+
+// backupEntry backs up one path found by the walk.
+// Entries still queued when ctx is done are dropped.
+func (b *s3backup) backupEntry(ctx context.Context, entry walkEntry) {
+	if ctx.Err() != nil {
+		return
+	}
+	switch entry.kind {
+	case entryUnreadable:
+		b.summary.fail(entry.path)
+	case entryFile:
+		b.backupFile(ctx, entry.path)
+	default:
+		b.backupMarker(ctx, entry)
+	}
+}
+
+// backupMarker stores an empty directory, symbolic link or hard link
+// reference as a zero-byte object whose metadata describes it. In snapshot
+// mode directories and symbolic links are recorded in the manifest instead.
+func (b *s3backup) backupMarker(ctx context.Context, entry walkEntry) {
+	key, metadata, err := b.markerMetadata(entry)
+	if err != nil {
+		b.l.Error().Err(err).Str("path", entry.path).Msg(msgReadSymlinkError)
+		b.summary.fail(entry.path)
+		return
+	}
+
+	if b.cfg.AWS.BackupMode == BackupModeSnapshot {
+		b.snap.Add(s3snapshot.Entry{Path: key, Attributes: metadata})
+		return
+	}
+
+	head, err := b.s3ObjectHead(ctx, key)
+	if ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		b.l.Error().Err(err).Str("path", entry.path).Msg(msgGetS3TimestampError)
+		b.summary.fail(entry.path)
+		return
+	}
+	if head != nil && head.Metadata[MetadataSymlinkTarget] == metadata[MetadataSymlinkTarget] &&
+		head.Metadata[MetadataHardLinkTarget] == metadata[MetadataHardLinkTarget] {
+		b.l.Info().Str("path", entry.path).Msg(msgSkippingMarker)
+		b.summary.skipped.Add(1)
+		return
+	}
+
+	if b.cfg.DryRun {
+		b.l.Info().Bool("dry_run", true).Str("path", entry.path).Str("s3_key", key).Int64("size", 0).Msg(msgDryRunUpload)
+		b.summary.uploaded(0)
+		return
+	}
+
+	b.l.Info().Str("path", entry.path).Str("s3_key", key).Msg(msgBackingUpMarker)
+	contentType := markerContentType
+	if entry.kind == entryDirectory {
+		contentType = DirectoryContentType
+	}
+	if err = b.putMarker(ctx, key, contentType, metadata); err != nil {
+		b.l.Error().Err(err).Str("path", entry.path).Msg(msgUploadToS3Error)
+		b.summary.fail(entry.path)
+		return
+	}
+	b.summary.uploaded(0)
+	if b.idx != nil {
+		b.idx.Remove(key)
+	}
+}
+
+// markerMetadata returns the key and metadata of the object standing in for
+// entry.
+func (b *s3backup) markerMetadata(entry walkEntry) (string, map[string]string, error) {
+	key, err := ObjectKey(entry.path)
+	if err != nil {
+		return "", nil, err
+	}
+	info, err := os.Lstat(entry.path)
+	if err != nil {
+		return "", nil, err
+	}
+
+	switch entry.kind {
+	case entryDirectory:
+		return key + "/", b.fileMetadata(entry.path, info), nil
+	case entrySymlink:
+		target, err := os.Readlink(entry.path)
+		if err != nil {
+			return "", nil, err
+		}
+		// Extended attributes would be read through the link, so only the
+		// link's own attributes are kept.
+		metadata := fileattr.FromFileInfo(info).Metadata()
+		metadata[MetadataSymlinkTarget] = url.PathEscape(target)
+		return key, metadata, nil
+	default:
+		metadata := b.fileMetadata(entry.path, info)
+		metadata[MetadataHardLinkTarget] = url.PathEscape(entry.target)
+		return key, metadata, nil
+	}
+}
+
+// putMarker writes a zero-byte object. It keeps the bucket's default storage
+// class so that its metadata can be read back without restoring it first.
+func (b *s3backup) putMarker(ctx context.Context, key string, contentType string, metadata map[string]string) error {
+	objectACL, err := ObjectCannedACL(b.cfg.AWS.ACL)
+	if err != nil {
+		return err
+	}
+	input := &s3.PutObjectInput{
+		Bucket:               aws.String(b.cfg.AWS.S3Bucket),
+		Key:                  aws.String(key),
+		Body:                 bytes.NewReader(nil),
+		ContentLength:        aws.Int64(0),
+		ContentType:          aws.String(contentType),
+		ServerSideEncryption: s3types.ServerSideEncryption(b.cfg.AWS.ServerSideEncryption),
+		Metadata:             metadata,
+	}
+	if objectACL != "" {
+		input.ACL = objectACL
+	}
+	_, err = b.svc.PutObject(context.WithoutCancel(ctx), input)
+	return err
+}
+
+// storedLink reports whether the object stands in for a symbolic link or hard
+// link, in which case it never holds the current contents of a regular file.
+func storedLink(head *s3.HeadObjectOutput) bool {
+	_, symlink := head.Metadata[MetadataSymlinkTarget]
+	_, hardLink := head.Metadata[MetadataHardLinkTarget]
+	return symlink || hardLink
+}
@@ -0,0 +1,219 @@
+package s3backup
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"slices"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const (
+	msgMultipartUpload         = "uploading file in parts"
+	msgCreateMultipartError    = "CreateMultipartUpload failed"
+	msgUploadPartError         = "UploadPart failed"
+	msgReadPartError           = "error reading file part for upload"
+	msgCompleteMultipartError  = "CompleteMultipartUpload failed"
+	msgAbortMultipartUpload    = "aborting multipart upload"
+	msgAbortMultipartError     = "AbortMultipartUpload failed"
+	msgMultipartUploadComplete = "multipart upload complete"
+	msgMissingPartETag         = "UploadPart returned no ETag"
+)
+
+const (
+	megabyte = 1024 * 1024
+
+	defaultMultipartThresholdMB = 100
+	defaultMultipartPartSizeMB  = 16
+	defaultMultipartConcurrency = 4
+	minMultipartPartSize        = 5 * megabyte
+	maxMultipartParts           = 10000
+)
+
+var errMissingPartETag = errors.New(msgMissingPartETag)
+
+// multipartThreshold returns the file size in bytes at or above which files
+// are uploaded in parts rather than with a single PutObject.
+func (b *s3backup) multipartThreshold() int64 {
+	if b.cfg.AWS.MultipartThresholdMB < 1 {
+		return defaultMultipartThresholdMB * megabyte
+	}
+	return int64(b.cfg.AWS.MultipartThresholdMB) * megabyte
+}
+
+// multipartPartSize returns the part size for an upload of at most size
+// bytes. The configured size is raised when needed to respect S3's 5 MiB
+// minimum part size and its limit of 10,000 parts per upload.
+func (b *s3backup) multipartPartSize(size int64) int64 {
+	partSize := int64(b.cfg.AWS.MultipartPartSizeMB) * megabyte
+	if partSize < 1 {
+		partSize = defaultMultipartPartSizeMB * megabyte
+	}
+	partSize = max(partSize, minMultipartPartSize)
+	if size/partSize >= maxMultipartParts {
+		partSize = size/(maxMultipartParts-1) + 1
+	}
+	return partSize
+}
+
+func (b *s3backup) multipartConcurrency() int {
+	if b.cfg.AWS.MultipartConcurrency < 1 {
+		return defaultMultipartConcurrency
+	}
+	return b.cfg.AWS.MultipartConcurrency
+}
+
+// multipartUpload streams body to S3 in parts of multipartPartSize. Parts are
+// read sequentially and uploaded by up to MultipartConcurrency goroutines, so
+// at most that many parts are held in memory at once. If any part fails, or
+// ctx is done before the last part is sent, the upload is aborted so that no
+// orphaned parts are left behind in the bucket. size is an upper bound on the
+// object's size and decides the part size.
+func (b *s3backup) multipartUpload(ctx context.Context, putObject *s3.PutObjectInput, body io.Reader, size int64) (string, error) {
+	key := aws.ToString(putObject.Key)
+	b.l.Info().Str("s3_key", key).Int64("size", size).Msg(msgMultipartUpload)
+
+	created, err := b.svc.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:               putObject.Bucket,
+		Key:                  putObject.Key,
+		ACL:                  putObject.ACL,
+		ContentType:          putObject.ContentType,
+		ContentEncoding:      putObject.ContentEncoding,
+		ContentDisposition:   putObject.ContentDisposition,
+		ServerSideEncryption: putObject.ServerSideEncryption,
+		StorageClass:         putObject.StorageClass,
+		Metadata:             putObject.Metadata,
+	})
+	if err != nil {
+		b.l.Error().Err(err).Str("s3_key", key).Msg(msgCreateMultipartError)
+		return "", err
+	}
+
+	parts, err := b.uploadParts(ctx, putObject, created.UploadId, body, b.multipartPartSize(size))
+	if err != nil {
+		b.abortMultipartUpload(ctx, putObject, created.UploadId)
+		return "", err
+	}
+
+	completed, err := b.svc.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          putObject.Bucket,
+		Key:             putObject.Key,
+		UploadId:        created.UploadId,
+		MultipartUpload: &s3types.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		b.l.Error().Err(err).Str("s3_key", key).Msg(msgCompleteMultipartError)
+		b.abortMultipartUpload(ctx, putObject, created.UploadId)
+		return "", err
+	}
+
+	b.l.Info().Str("s3_key", key).Int("parts", len(parts)).Msg(msgMultipartUploadComplete)
+	return aws.ToString(completed.ETag), nil
+}
+
+// uploadParts reads body in partSize chunks and uploads them concurrently,
+// holding at most MultipartConcurrency parts in memory. It stops reading as
+// soon as any part fails and returns the first error seen.
+func (b *s3backup) uploadParts(parent context.Context, putObject *s3.PutObjectInput, uploadID *string, body io.Reader, partSize int64) ([]s3types.CompletedPart, error) {
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		parts    []s3types.CompletedPart
+		firstErr error
+		sem      = make(chan struct{}, b.multipartConcurrency())
+	)
+
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+	}
+
+	for partNumber := int32(1); ctx.Err() == nil; partNumber++ {
+		// A slot is taken before the part is read, so no more than the
+		// concurrency limit of part buffers are ever held at once.
+		sem <- struct{}{}
+		if ctx.Err() != nil {
+			<-sem
+			break
+		}
+		buf := make([]byte, partSize)
+		n, readErr := io.ReadFull(body, buf)
+		if readErr != nil && !errors.Is(readErr, io.ErrUnexpectedEOF) && !errors.Is(readErr, io.EOF) {
+			<-sem
+			b.l.Error().Err(readErr).Str("s3_key", aws.ToString(putObject.Key)).Msg(msgReadPartError)
+			fail(readErr)
+			break
+		}
+		// An empty read after the first part means the previous part was the last.
+		if n == 0 && partNumber > 1 {
+			<-sem
+			break
+		}
+
+		wg.Go(func() {
+			defer func() { <-sem }()
+			part, err := b.svc.UploadPart(ctx, &s3.UploadPartInput{
+				Bucket:        putObject.Bucket,
+				Key:           putObject.Key,
+				UploadId:      uploadID,
+				PartNumber:    aws.Int32(partNumber),
+				Body:          bytes.NewReader(buf[:n]),
+				ContentLength: aws.Int64(int64(n)),
+			})
+			if err == nil && part.ETag == nil {
+				err = errMissingPartETag
+			}
+			if err != nil {
+				b.l.Error().Err(err).Str("s3_key", aws.ToString(putObject.Key)).Int32("part", partNumber).Msg(msgUploadPartError)
+				fail(err)
+				return
+			}
+			mu.Lock()
+			parts = append(parts, s3types.CompletedPart{ETag: part.ETag, PartNumber: aws.Int32(partNumber)})
+			mu.Unlock()
+		})
+
+		if n < len(buf) {
+			break
+		}
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if err := parent.Err(); err != nil {
+		return nil, err
+	}
+	slices.SortFunc(parts, func(a, b s3types.CompletedPart) int {
+		return int(aws.ToInt32(a.PartNumber) - aws.ToInt32(b.PartNumber))
+	})
+	return parts, nil
+}
+
+// abortMultipartUpload discards every part uploaded so far. It deliberately
+// ignores the cancellation of ctx so that the abort still happens when the
+// upload failed because its own context was cancelled.
+func (b *s3backup) abortMultipartUpload(ctx context.Context, putObject *s3.PutObjectInput, uploadID *string) {
+	b.l.Warn().Str("s3_key", aws.ToString(putObject.Key)).Str("upload_id", aws.ToString(uploadID)).Msg(msgAbortMultipartUpload)
+	_, err := b.svc.AbortMultipartUpload(context.WithoutCancel(ctx), &s3.AbortMultipartUploadInput{
+		Bucket:   putObject.Bucket,
+		Key:      putObject.Key,
+		UploadId: uploadID,
+	})
+	if err != nil {
+		b.l.Error().Err(err).Str("s3_key", aws.ToString(putObject.Key)).Msg(msgAbortMultipartError)
+	}
+}
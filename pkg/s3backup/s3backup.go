@@ -1,21 +1,30 @@
 package s3backup
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"io"
 	"io/fs"
+	"maps"
 	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
-	"time"
+	"sync"
+	"sync/atomic"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/aws/smithy-go"
 	"github.com/jaysonhurd/s3backup/models"
+	"github.com/jaysonhurd/s3backup/pkg/fileattr"
+	"github.com/jaysonhurd/s3backup/pkg/s3crypt"
+	"github.com/jaysonhurd/s3backup/pkg/s3index"
+	"github.com/jaysonhurd/s3backup/pkg/s3snapshot"
 	"github.com/rs/zerolog"
 )
 
@@ -23,11 +32,11 @@ const (
 	msgWalkFilesystemError    = "error while walking filesystem path"
 	msgSkipDirectory          = "skipping directory"
 	msgSkipNonRegularFile     = "skipping non-regular file"
-	msgGetS3TimestampError    = "error getting S3 file timestamp"
-	msgGetLocalTimestampError = "localFileTimestamp failed - continuing"
+	msgGetS3TimestampError    = "error getting S3 object metadata"
+	msgGetLocalTimestampError = "localFileInfo failed - continuing"
 	msgBackingUpFile          = "backing up file"
 	msgUploadToS3Error        = "error uploading file to S3"
-	msgSkippingFile           = "skipping file because it has the same or older timestamp than S3"
+	msgSkippingFile           = "skipping file because it has not changed since it was last backed up"
 	msgWalkRootPathError      = "error walking root path"
 	msgLocalFileStatError     = "error checking local file timestamp"
 	msgOpenFileError          = "error opening file for upload"
@@ -35,8 +44,31 @@ const (
 	msgSeekFileError          = "error seeking file for upload"
 	msgInvalidObjectACL       = "invalid object ACL in configuration"
 	msgPutObjectError         = "PutObject failed"
+	msgChangeDetectionError   = "error checking file for changes"
+	msgObjectKeyError         = "unable to determine S3 key for file"
+	msgSkipExcludedDirectory  = "skipping excluded directory"
+	msgSkipExcludedFile       = "skipping excluded file"
+	msgLoadIgnoreFileError    = "unable to read ignore file - continuing without it"
+	msgDryRunUpload           = "dry run: would upload file"
+	msgBackupSummary          = "backup of directory complete"
+	msgDryRunBackupSummary    = "dry run of directory backup complete, nothing was uploaded"
+	msgEncryptFileError       = "error encrypting file for upload"
+	msgOutsideDirectory       = "path is not below the backup directory"
+	msgBackupFileFailed       = "path could not be backed up"
+	msgUploadInterrupted      = "upload of file was interrupted and aborted"
+	msgFilesFailed            = "some files could not be backed up"
+	msgInterruptedSummary     = "backup of directory was interrupted"
 )
 
+var (
+	errOutsideDirectory = errors.New(msgOutsideDirectory)
+	errBackupFileFailed = errors.New(msgBackupFileFailed)
+)
+
+// ErrFilesFailed is returned by BackupDirectory when the walk completed but
+// some files could not be backed up. FailedFiles lists them.
+var ErrFilesFailed = errors.New(msgFilesFailed)
+
 var objectACLMap = map[string]s3types.ObjectCannedACL{
 	"private":                   s3types.ObjectCannedACLPrivate,
 	"public-read":               s3types.ObjectCannedACLPublicRead,
@@ -49,35 +81,51 @@ var objectACLMap = map[string]s3types.ObjectCannedACL{
 
 //go:generate go run github.com/maxbrunsfeld/counterfeiter/v6 -o ../../test/fakes/s3api/s3api.go github.com/jaysonhurd/s3backup/pkg/s3backup/.S3API
 
-var (
-	err error
-	//file fs.File
-	file *os.File
-)
-
 type S3backuper interface {
-	BackupDirectory() error
+	BackupDirectory(ctx context.Context) error
+	BackupFile(ctx context.Context, path string) error
+	VerifyDirectory(ctx context.Context) error
+	FailedFiles() []string
 	SetConfig(cfg models.Config) error
 	SetAWSS3(svc S3API) error
-	SetDirectory(dir string) error
+	SetDirectory(dir models.BackupDirectory) error
+	SetIndex(idx s3index.Indexer) error
+	SetSnapshot(snap s3snapshot.Snapshotter) error
+	SetCipher(c s3crypt.Cipher) error
+	SetPool(pool Pool) error
 }
 
 type S3API interface {
 	HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
 	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	CreateMultipartUpload(ctx context.Context, params *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error)
+	UploadPart(ctx context.Context, params *s3.UploadPartInput, optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error)
+	CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error)
+	AbortMultipartUpload(ctx context.Context, params *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error)
 }
 
 type s3backup struct {
-	cfg models.Config
-	svc S3API
-	dir string
-	l   *zerolog.Logger
+	cfg  models.Config
+	svc  S3API
+	dir  models.BackupDirectory
+	l    *zerolog.Logger
+	idx  s3index.Indexer
+	snap s3snapshot.Snapshotter
+	c    s3crypt.Cipher
+	pool Pool
+
+	summary *runSummary
+
+	// links holds the key of the first path seen for every hard-linked inode
+	// by the last BackupDirectory. BackupFile keeps using it, so that a path
+	// stored as a hard link reference stays one between full walks.
+	links map[fileattr.LinkID]string
 }
 
 func New(
 	cfg models.Config,
 	svc S3API,
-	dir string,
+	dir models.BackupDirectory,
 	l *zerolog.Logger,
 ) S3backuper {
 	return &s3backup{
@@ -98,118 +146,393 @@ func (b *s3backup) SetAWSS3(svc S3API) (err error) {
 	return nil
 }
 
-func (b *s3backup) SetDirectory(dir string) (err error) {
+func (b *s3backup) SetDirectory(dir models.BackupDirectory) (err error) {
 	b.dir = dir
 	return nil
 }
 
-// This method backs up an enitre directory structure from the config.json file.
-// It will structure the file structure in S3 exactly as it is on the local filesystem.
-func (b *s3backup) BackupDirectory() (err error) {
+// SetIndex enables the local state index. Files the index knows to be
+// unchanged are skipped without a HeadObject call.
+func (b *s3backup) SetIndex(idx s3index.Indexer) (err error) {
+	b.idx = idx
+	return nil
+}
 
-	err = filepath.WalkDir(b.dir, func(path string, info fs.DirEntry, err error) error {
+// SetCipher enables client-side encryption. Every object is encrypted before
+// it leaves the machine and the original size is kept in its metadata.
+func (b *s3backup) SetCipher(c s3crypt.Cipher) (err error) {
+	b.c = c
+	return nil
+}
 
-		if err != nil {
-			b.l.Error().Err(err).Str("path", path).Msg(msgWalkFilesystemError)
-			return err
-		}
+// SetPool shares pool with other backupers, so that the files of every
+// directory using it are backed up by at most pool's size workers in all.
+// Without it each BackupDirectory has a pool of AWS.Concurrency of its own.
+func (b *s3backup) SetPool(pool Pool) (err error) {
+	b.pool = pool
+	return nil
+}
 
-		if info.IsDir() {
-			b.l.Debug().Str("path", path).Msg(msgSkipDirectory)
-			return nil
-		}
+// This method backs up an enitre directory structure from the config.json file.
+// It will structure the file structure in S3 exactly as it is on the local filesystem,
+// or in snapshot mode record every file in the snapshot set with SetSnapshot.
+// Files are handed to a bounded pool of workers (AWS.Concurrency, or the Pool
+// set with SetPool) as the walk finds them.
+// Once ctx is done no new uploads are started: a single PutObject already in
+// flight is allowed to finish, a multipart upload is aborted, and ctx.Err() is
+// returned after the summary of what was done has been logged. A file that
+// cannot be backed up, after the retries of the configured retry policy, does
+// not stop the rest of the directory; once the walk is done an error is
+// returned and FailedFiles lists every such file.
+func (b *s3backup) BackupDirectory(ctx context.Context) (err error) {
+
+	if err = b.validate(); err != nil {
+		return err
+	}
 
-		if !info.Type().IsRegular() {
-			b.l.Debug().Str("path", path).Msg(msgSkipNonRegularFile)
-			return nil
-		}
+	b.summary = new(runSummary)
 
-		s3objectTime, err := b.s3FileTimestamp(b.cfg, path)
-		if err != nil {
-			b.l.Error().Err(err).Str("path", path).Msg(msgGetS3TimestampError)
-			//return err
-		}
+	var (
+		entries = make(chan walkEntry)
+		wg      sync.WaitGroup
+		pool    = b.pool
+	)
+	if pool == nil {
+		pool = NewPool(b.workers())
+	}
 
-		// Error checking here is for good measure but would likely never be reached.
-		// The WalkDir function would have to find a file, then the file disappear in between
-		// (microseconds).  This proved too difficult to write a test for.
-		localFileTime, err := b.localFileTimestamp(path)
-		if err != nil {
-			b.l.Error().Err(err).Str("path", path).Msg(msgGetLocalTimestampError)
-		}
-		if localFileTime.After(s3objectTime) {
-			b.l.Info().Str("path", path).Str("storage_class", b.cfg.AWS.StorageClass).Msg(msgBackingUpFile)
-			err = b.uploadFileToS3(path)
-			if err != nil {
-				b.l.Error().Err(err).Str("path", path).Msg(msgUploadToS3Error)
-				//return err
+	for range cap(pool) {
+		wg.Go(func() {
+			for entry := range entries {
+				pool <- struct{}{}
+				b.backupEntry(ctx, entry)
+				<-pool
 			}
-		} else {
-			b.l.Info().Str("path", path).Msg(msgSkippingFile)
-		}
+		})
+	}
+
+	w := b.newWalker(ctx, func(entry walkEntry) { entries <- entry })
+	b.links = w.links
+	err = filepath.WalkDir(b.dir.Path, w.visit)
+
+	close(entries)
+	wg.Wait()
+
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		// The walk stopped part way, so the index must not be pruned of the
+		// files it never reached.
+		b.logSummary(true)
+		return ctxErr
+	}
+	if err != nil {
+		b.l.Error().Err(err).Str("root_dir", b.dir.Path).Msg(msgWalkRootPathError)
+		return err
+	}
+
+	b.pruneIndex()
+	b.logSummary(false)
+	if b.summary.failed.Load() > 0 {
+		return ErrFilesFailed
+	}
+	return nil
+}
+
+// FailedFiles returns the paths that could not be backed up by the last
+// BackupDirectory, or by every BackupFile since, sorted.
+func (b *s3backup) FailedFiles() []string {
+	if b.summary == nil {
 		return nil
+	}
+	return b.summary.failedFiles()
+}
+
+// BackupFile backs up a single path below the backup directory the way the
+// directory walk would: a directory is walked in full, excluded paths are
+// skipped and symbolic links are handled according to SymlinkMode. Watch mode
+// uses it to back up what changed without walking everything again. A hard
+// link found by an earlier walk is stored as a reference again, and the
+// contents it shares are backed up under the first path instead.
+func (b *s3backup) BackupFile(ctx context.Context, path string) (err error) {
+	if err = b.validate(); err != nil {
+		return err
+	}
+	if b.summary == nil {
+		b.summary = new(runSummary)
+	}
+
+	rel, err := filepath.Rel(b.dir.Path, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		b.l.Error().Err(errOutsideDirectory).Str("path", path).Str("root_dir", b.dir.Path).Msg(msgOutsideDirectory)
+		return errOutsideDirectory
+	}
+
+	w := b.newWalker(ctx, func(entry walkEntry) {
+		b.backupEntry(ctx, entry)
+		// The contents may have been written through this link.
+		if entry.kind == entryHardLink {
+			b.backupEntry(ctx, walkEntry{path: LocalPath(entry.target), kind: entryFile})
+		}
 	})
+	if b.links == nil {
+		b.links = w.links
+	}
+	w.links = b.links
+	if w.excludedAncestor(rel) {
+		b.l.Debug().Str("path", path).Msg(msgSkipExcludedFile)
+		return nil
+	}
 
-	if err != nil {
-		b.l.Error().Err(err).Str("root_dir", b.dir).Msg(msgWalkRootPathError)
+	failed := b.summary.failed.Load()
+	if err = filepath.WalkDir(path, w.visit); err != nil {
+		return err
+	}
+	if b.summary.failed.Load() > failed {
+		return errBackupFileFailed
+	}
+	return nil
+}
+
+// validate checks the configuration options that BackupDirectory and
+// BackupFile depend on.
+func (b *s3backup) validate() (err error) {
+	if err = b.validateOptions(); err != nil {
+		return err
+	}
+	if b.cfg.AWS.BackupMode == BackupModeSnapshot && b.snap == nil {
+		b.l.Error().Err(errNoSnapshot).Str("root_dir", b.dir.Path).Msg(msgNoSnapshot)
+		return errNoSnapshot
+	}
+	return nil
+}
+
+// validateOptions checks the configured modes, which every walk of the
+// backup directory depends on.
+func (b *s3backup) validateOptions() (err error) {
+	if err = validateBackupMode(b.cfg.AWS.BackupMode); err != nil {
+		b.l.Error().Err(err).Str("backup_mode", b.cfg.AWS.BackupMode).Msg(msgInvalidBackupMode)
+		return err
+	}
+
+	if err = validateChangeDetection(b.cfg.AWS.ChangeDetection); err != nil {
+		b.l.Error().Err(err).Str("change_detection", b.cfg.AWS.ChangeDetection).Msg(msgInvalidChangeDetection)
+		return err
+	}
+
+	if err = validateSymlinkMode(b.cfg.AWS.SymlinkMode); err != nil {
+		b.l.Error().Err(err).Str("symlink_mode", b.cfg.AWS.SymlinkMode).Msg(msgInvalidSymlinkMode)
+		return err
+	}
+
+	if value, err := b.validateCompressionConfig(); err != nil {
+		b.l.Error().Err(err).Str("compression", value).Msg(msgInvalidCompression)
 		return err
 	}
 	return nil
 }
 
-// localFileTimestamp - gets the file timestamp of a given file on the local filesystem.
-func (b *s3backup) localFileTimestamp(file string) (time.Time, error) {
-	var filestat fs.FileInfo
-	filestat, err = os.Stat(file)
+// backupFile compares a single file against its copy in S3 and uploads it
+// when the configured change detection mode reports a change. Errors are
+// logged rather than returned so that one bad file does not stop the rest of
+// the directory from being backed up.
+func (b *s3backup) backupFile(ctx context.Context, path string) {
+	// Error checking here is for good measure but would likely never be reached.
+	// The WalkDir function would have to find a file, then the file disappear in between
+	// (microseconds).  This proved too difficult to write a test for.
+	fileInfo, err := b.localFileInfo(path)
+	if err != nil {
+		b.l.Error().Err(err).Str("path", path).Msg(msgGetLocalTimestampError)
+		b.summary.fail(path)
+		return
+	}
+
+	key, err := ObjectKey(path)
+	if err != nil {
+		b.l.Error().Err(err).Str("path", path).Msg(msgObjectKeyError)
+		b.summary.fail(path)
+		return
+	}
+
+	if b.cfg.AWS.BackupMode == BackupModeSnapshot {
+		b.snapshotFile(ctx, path, key, fileInfo)
+		return
+	}
+
+	metadata := b.fileMetadata(path, fileInfo)
+
+	unchanged, err := b.indexUnchanged(key, path, fileInfo, metadata)
+	if err != nil {
+		b.l.Error().Err(err).Str("path", path).Msg(msgChangeDetectionError)
+		b.summary.fail(path)
+		return
+	}
+	if unchanged {
+		b.l.Info().Str("path", path).Msg(msgSkippingIndexedFile)
+		b.summary.skipped.Add(1)
+		return
+	}
+
+	head, err := b.s3ObjectHead(ctx, key)
+	if ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		b.l.Error().Err(err).Str("path", path).Msg(msgGetS3TimestampError)
+		b.summary.fail(path)
+		return
+	}
+
+	changed, err := b.fileChanged(path, fileInfo, head, metadata)
+	if err != nil {
+		b.l.Error().Err(err).Str("path", path).Msg(msgChangeDetectionError)
+		b.summary.fail(path)
+		return
+	}
+
+	if changed {
+		if b.cfg.DryRun {
+			b.l.Info().Bool("dry_run", true).Str("path", path).Str("s3_key", key).Int64("size", fileInfo.Size()).Msg(msgDryRunUpload)
+			b.summary.uploaded(fileInfo.Size())
+			return
+		}
+		b.l.Info().Str("path", path).Str("storage_class", b.cfg.AWS.StorageClass).Msg(msgBackingUpFile)
+		etag, err := b.uploadFileToS3(ctx, path, key, metadata)
+		if err != nil && ctx.Err() != nil {
+			b.l.Warn().Err(err).Str("path", path).Msg(msgUploadInterrupted)
+			return
+		}
+		if err != nil {
+			b.l.Error().Err(err).Str("path", path).Msg(msgUploadToS3Error)
+			b.summary.fail(path)
+			return
+		}
+		b.summary.uploaded(fileInfo.Size())
+		b.recordIndex(key, fileInfo, etag, metadata)
+	} else {
+		b.l.Info().Str("path", path).Msg(msgSkippingFile)
+		b.summary.skipped.Add(1)
+		b.recordIndex(key, fileInfo, aws.ToString(head.ETag), metadata)
+	}
+}
+
+// runSummary counts what a BackupDirectory run did, or would have done in a
+// dry run. It is updated concurrently by the upload workers.
+type runSummary struct {
+	files   atomic.Int64
+	bytes   atomic.Int64
+	skipped atomic.Int64
+	failed  atomic.Int64
+
+	mu          sync.Mutex
+	failedPaths []string
+}
+
+func (r *runSummary) uploaded(size int64) {
+	r.files.Add(1)
+	r.bytes.Add(size)
+}
+
+// fail records a path that could not be backed up.
+func (r *runSummary) fail(path string) {
+	r.failed.Add(1)
+	r.mu.Lock()
+	r.failedPaths = append(r.failedPaths, path)
+	r.mu.Unlock()
+}
+
+func (r *runSummary) failedFiles() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Sorted(slices.Values(r.failedPaths))
+}
+
+// logSummary logs what the run did. interrupted reports that the run was
+// cancelled before the whole directory was walked.
+func (b *s3backup) logSummary(interrupted bool) {
+	msg := msgBackupSummary
+	switch {
+	case interrupted:
+		msg = msgInterruptedSummary
+	case b.cfg.DryRun:
+		msg = msgDryRunBackupSummary
+	}
+	b.l.Info().
+		Bool("dry_run", b.cfg.DryRun).
+		Bool("interrupted", interrupted).
+		Str("root_dir", b.dir.Path).
+		Int64("files_uploaded", b.summary.files.Load()).
+		Int64("bytes_uploaded", b.summary.bytes.Load()).
+		Int64("files_unchanged", b.summary.skipped.Load()).
+		Int64("files_failed", b.summary.failed.Load()).
+		Strs("failed_files", b.summary.failedFiles()).
+		Msg(msg)
+}
+
+// Pool bounds how many files are backed up at once. Sharing one between the
+// backupers of several directories bounds the uploads of the whole run.
+type Pool chan struct{}
+
+// NewPool returns a Pool of size workers, never less than one.
+func NewPool(size int) Pool {
+	return make(Pool, max(size, 1))
+}
+
+// workers returns the number of upload workers to run, never less than one.
+func (b *s3backup) workers() int {
+	if b.cfg.AWS.Concurrency < 1 {
+		return 1
+	}
+	return b.cfg.AWS.Concurrency
+}
+
+// localFileInfo - gets the file info of a given file on the local filesystem.
+func (b *s3backup) localFileInfo(file string) (fs.FileInfo, error) {
+	filestat, err := os.Stat(file)
 	if err != nil {
 		b.l.Error().Err(err).Str("file", file).Msg(msgLocalFileStatError)
-		return time.Now(), err
+		return nil, err
 	}
-	return filestat.ModTime(), nil
+	return filestat, nil
 }
 
-// s3FileTimestamp - gets the file timestamp of a given file in S3
-func (b *s3backup) s3FileTimestamp(cfg models.Config, file string) (time.Time, error) {
+// s3ObjectHead - gets the HeadObject result for a given key in S3. A nil
+// result with a nil error means the object does not exist yet.
+func (b *s3backup) s3ObjectHead(ctx context.Context, key string) (*s3.HeadObjectOutput, error) {
 
 	var (
-		result *s3.HeadObjectOutput
-		epoch  time.Time
 		apiErr smithy.APIError
 		nfErr  *s3types.NotFound
 	)
 
 	input := s3.HeadObjectInput{
-		Bucket: aws.String(cfg.AWS.S3Bucket),
-		Key:    aws.String(file),
+		Bucket: aws.String(b.cfg.AWS.S3Bucket),
+		Key:    aws.String(key),
 	}
 
-	result, err = b.svc.HeadObject(context.Background(), &input)
+	result, err := b.svc.HeadObject(ctx, &input)
 
 	if err != nil {
-		epoch = time.Date(1970, 01, 01, 01, 01, 01, 1, time.UTC)
 		if errors.As(err, &nfErr) {
-			return epoch, nil
+			return nil, nil
 		}
 		if errors.As(err, &apiErr) && apiErr.ErrorCode() == "NotFound" {
-			return epoch, nil
+			return nil, nil
 		}
-		return epoch, err
+		return nil, err
 	}
 
-	if result == nil || result.LastModified == nil {
-		return time.Date(1970, 01, 01, 01, 01, 01, 1, time.UTC), nil
-	}
-
-	return *result.LastModified, nil
+	return result, nil
 }
 
-// s3FileTimestamp - Upload file to S3
-func (b *s3backup) uploadFileToS3(fileName string) error {
+// uploadFileToS3 - Upload file to S3 under key. Files at or above the multipart
+// threshold are streamed in parts, everything else is sent with a single PutObject.
+// A single PutObject is not interrupted when ctx is done, a multipart upload is
+// aborted between parts.
+func (b *s3backup) uploadFileToS3(ctx context.Context, fileName string, key string, metadata map[string]string) (string, error) {
 
-	fileName, file, err = b.openFile(fileName)
+	file, err := os.Open(fileName)
 	if err != nil {
 		b.l.Error().Err(err).Msg(msgOpenFileError)
-		return err
+		return "", err
 	}
 
 	defer file.Close()
@@ -217,51 +540,125 @@ func (b *s3backup) uploadFileToS3(fileName string) error {
 	fileInfo, statErr := file.Stat()
 	if statErr != nil {
 		b.l.Error().Err(statErr).Msg(msgLocalFileStatError)
-		return statErr
+		return "", statErr
 	}
 
 	header := make([]byte, 512)
 	n, err := file.Read(header)
 	if err != nil && !errors.Is(err, io.EOF) {
 		b.l.Error().Err(err).Msg(msgReadFileBufferError)
-		return err
+		return "", err
 	}
 
 	if _, err = file.Seek(0, 0); err != nil {
 		b.l.Error().Err(err).Msg(msgSeekFileError)
-		return err
+		return "", err
 	}
 
-	objectACL, err := objectCannedACLFromString(b.cfg.AWS.ACL)
+	objectACL, err := ObjectCannedACL(b.cfg.AWS.ACL)
 	if err != nil {
 		b.l.Error().Err(err).Str("acl", b.cfg.AWS.ACL).Msg(msgInvalidObjectACL)
-		return err
+		return "", err
+	}
+
+	var (
+		body        io.Reader = file
+		size                  = fileInfo.Size()
+		contentType           = http.DetectContentType(header[:n])
+		encoding              = b.compressionFor(fileName)
+	)
+	if encoding == CompressionNone {
+		encoding = ""
+	}
+
+	// A compressed or encrypted object records the size of the local file,
+	// which is what change detection compares against.
+	if encoding != "" || b.c != nil {
+		metadata = maps.Clone(metadata)
+		metadata[MetadataSize] = strconv.FormatInt(fileInfo.Size(), 10)
+	}
+	if encoding != "" {
+		compressed := compress(file, encoding)
+		defer compressed.Close()
+		body, size = compressed, -1
+	}
+	if b.c != nil {
+		if sum, ok := metadata[MetadataSHA256]; ok {
+			if metadata[MetadataSHA256], err = b.storedHash(sum); err != nil {
+				b.l.Error().Err(err).Msg(msgEncryptFileError)
+				return "", err
+			}
+		}
+		if body, size, err = b.encrypt(body, size, metadata); err != nil {
+			b.l.Error().Err(err).Msg(msgEncryptFileError)
+			return "", err
+		}
+		contentType = encryptedContentType
 	}
 
 	putObject := s3.PutObjectInput{
 		Bucket:               aws.String(b.cfg.AWS.S3Bucket),
-		Key:                  aws.String(fileName),
-		Body:                 file,
-		ContentLength:        aws.Int64(fileInfo.Size()),
-		ContentType:          aws.String(http.DetectContentType(header[:n])),
+		Key:                  aws.String(key),
+		Body:                 body,
+		ContentType:          aws.String(contentType),
 		ContentDisposition:   aws.String(b.cfg.AWS.ContentDisposition),
 		ServerSideEncryption: s3types.ServerSideEncryption(b.cfg.AWS.ServerSideEncryption),
 		StorageClass:         s3types.StorageClass(b.cfg.AWS.StorageClass),
+		Metadata:             metadata,
 	}
 	if objectACL != "" {
 		putObject.ACL = objectACL
 	}
+	switch {
+	case encoding != "" && b.c != nil:
+		metadata[MetadataCompression] = encoding
+	case encoding != "":
+		putObject.ContentEncoding = aws.String(encoding)
+	}
 
-	_, err = b.svc.PutObject(context.Background(), &putObject)
+	// The threshold applies to the local file size. Parts are sized for the
+	// most the object can grow to, as compression can add a little to
+	// incompressible data and encryption adds a tag to every chunk.
+	if fileInfo.Size() >= b.multipartThreshold() {
+		return b.multipartUpload(ctx, &putObject, body, b.uploadSizeBound(fileInfo.Size(), encoding))
+	}
+	if body != file {
+		// A compressed or encrypted stream cannot be rewound for request
+		// signing or retries, so small objects are transformed into memory first.
+		transformed, err := io.ReadAll(body)
+		if err != nil {
+			b.l.Error().Err(err).Str("compression", encoding).Msg(msgReadFileBufferError)
+			return "", err
+		}
+		body, size = bytes.NewReader(transformed), int64(len(transformed))
+		putObject.Body = body
+	}
+	putObject.ContentLength = aws.Int64(size)
+
+	result, err := b.svc.PutObject(context.WithoutCancel(ctx), &putObject)
 
 	if err != nil {
 		b.l.Error().Err(err).Msg(msgPutObjectError)
-		return err
+		return "", err
 	}
-	return nil
+	return aws.ToString(result.ETag), nil
 }
 
-func objectCannedACLFromString(acl string) (s3types.ObjectCannedACL, error) {
+// uploadSizeBound returns an upper bound on the size of the object uploaded
+// for a local file of size bytes.
+func (b *s3backup) uploadSizeBound(size int64, encoding string) int64 {
+	if encoding != "" {
+		size += size/compressionOverheadRatio + compressionOverheadBytes
+	}
+	if b.c != nil {
+		size = s3crypt.CiphertextSize(size)
+	}
+	return size
+}
+
+// ObjectCannedACL maps the configured ACL, in any case and with surrounding
+// spaces, to the canned ACL S3 expects. An empty ACL maps to none.
+func ObjectCannedACL(acl string) (s3types.ObjectCannedACL, error) {
 	trimmed := strings.TrimSpace(acl)
 	if trimmed == "" {
 		return "", nil
@@ -273,11 +670,18 @@ func objectCannedACLFromString(acl string) (s3types.ObjectCannedACL, error) {
 	return mapped, nil
 }
 
-func (b *s3backup) openFile(fileName string) (string, *os.File, error) {
-	fileName, _ = filepath.Abs(fileName)
-	file, err = os.Open(fileName)
+// ObjectKey returns the S3 key a local path is stored under. Keys mirror the
+// absolute path of the file on the local filesystem.
+func ObjectKey(path string) (string, error) {
+	abs, err := filepath.Abs(path)
 	if err != nil {
-		return "", nil, err
+		return "", err
 	}
-	return fileName, file, nil
+	return filepath.ToSlash(abs), nil
+}
+
+// LocalPath is the inverse of ObjectKey and returns the local path an S3 key
+// was backed up from.
+func LocalPath(key string) string {
+	return filepath.FromSlash("/" + strings.TrimLeft(key, "/"))
 }
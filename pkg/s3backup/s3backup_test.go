@@ -1,16 +1,32 @@
 package s3backup_test
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/jaysonhurd/s3backup/models"
 	"github.com/jaysonhurd/s3backup/pkg/s3backup"
+	"github.com/jaysonhurd/s3backup/pkg/s3crypt"
+	"github.com/jaysonhurd/s3backup/pkg/s3index"
+	"github.com/jaysonhurd/s3backup/pkg/s3snapshot"
 	"github.com/jaysonhurd/s3backup/test/fakes/s3api"
 	"github.com/rs/zerolog"
 )
@@ -47,9 +63,9 @@ func TestBackupDirectoryNothingToDo(t *testing.T) {
 	lastModified, err := time.Parse("2 Jan 06 03:04PM", "10 Nov 10 11:00PM")
 	fakes3api.HeadObjectReturns(&s3.HeadObjectOutput{LastModified: &lastModified}, nil)
 	myTime, _ = time.Parse("2 Jan 06 03:04PM", "10 Nov 10 11:00PM")
-	myS3 := s3backup.New(cfg, fakes3api, testDirectory, &l)
+	myS3 := s3backup.New(cfg, fakes3api, models.BackupDirectory{Path: testDirectory}, &l)
 
-	err = myS3.BackupDirectory()
+	err = myS3.BackupDirectory(context.Background())
 	if err != nil {
 		t.Fail()
 	}
@@ -76,9 +92,9 @@ func TestBackupDirectoryNonExistentDirectory(t *testing.T) {
 	lastModified, err := time.Parse("2 Jan 06 03:04PM", "10 Nov 10 11:00PM")
 	fakes3api.HeadObjectReturns(&s3.HeadObjectOutput{LastModified: &lastModified}, nil)
 	myTime, _ = time.Parse("2 Jan 06 03:04PM", "10 Nov 10 11:00PM")
-	myS3 := s3backup.New(cfg, fakes3api, "nodirectory", &l)
+	myS3 := s3backup.New(cfg, fakes3api, models.BackupDirectory{Path: "nodirectory"}, &l)
 
-	err = myS3.BackupDirectory()
+	err = myS3.BackupDirectory(context.Background())
 	if err == nil {
 		t.Fail()
 	}
@@ -105,11 +121,17 @@ func TestBackupDirectoryHeadObjectFails(t *testing.T) {
 	//lastModified, err := time.Parse("2 Jan 06 03:04PM", "10 Nov 10 11:00PM")
 	fakes3api.HeadObjectReturns(&s3.HeadObjectOutput{}, errors.New("something went wrong"))
 	myTime, _ = time.Parse("2 Jan 06 03:04PM", "10 Nov 10 11:00PM")
-	myS3 := s3backup.New(cfg, fakes3api, testDirectory, &l)
+	myS3 := s3backup.New(cfg, fakes3api, models.BackupDirectory{Path: testDirectory}, &l)
 
-	err = myS3.BackupDirectory()
-	if err != nil {
-		t.Fatalf("expected nil error, got %v", err)
+	err = myS3.BackupDirectory(context.Background())
+	if err == nil {
+		t.Fatalf("expected an error for the files that could not be checked")
+	}
+	if got := myS3.FailedFiles(); len(got) != 2 {
+		t.Fatalf("expected both files to be listed as failed, got %v", got)
+	}
+	if fakes3api.PutObjectCallCount() != 0 {
+		t.Fatalf("expected PutObject not to be called when HeadObject fails")
 	}
 }
 
@@ -129,7 +151,7 @@ func TestSetConfig(t *testing.T) {
 		},
 	}
 	for _, cases := range setConfigTests {
-		backup = s3backup.New(cases.cfg, svc, cases.dir, &l)
+		backup = s3backup.New(cases.cfg, svc, models.BackupDirectory{Path: cases.dir}, &l)
 		err = backup.SetConfig(cases.cfg)
 		if err != cases.expectedErr {
 			t.Errorf("wanted %q: got: %v", cases.expectedErr, err.Error())
@@ -150,7 +172,7 @@ func TestSetAWSS3(t *testing.T) {
 		},
 	}
 	for _, test := range tests {
-		backup = s3backup.New(test.cfg, svc, "/etc", &l)
+		backup = s3backup.New(test.cfg, svc, models.BackupDirectory{Path: "/etc"}, &l)
 		err = backup.SetAWSS3(svc)
 		if err != nil {
 			t.Errorf("wanted %q: got: %v", test.expect, err.Error())
@@ -171,8 +193,8 @@ func TestSetDirectory(t *testing.T) {
 		},
 	}
 	for _, test := range tests {
-		backup = s3backup.New(test.cfg, svc, "/etc", &l)
-		err = backup.SetDirectory("")
+		backup = s3backup.New(test.cfg, svc, models.BackupDirectory{Path: "/etc"}, &l)
+		err = backup.SetDirectory(models.BackupDirectory{})
 		if err != nil {
 			t.Errorf("wanted %q: got: %v", test.expect, err.Error())
 		}
@@ -203,8 +225,8 @@ func TestBackupDirectorySetsConfiguredACL(t *testing.T) {
 	old := time.Unix(0, 0).UTC()
 	fakes3api.HeadObjectReturns(&s3.HeadObjectOutput{LastModified: &old}, nil)
 
-	backupRunner := s3backup.New(cfg, fakes3api, tmpDir, &l)
-	if backupErr := backupRunner.BackupDirectory(); backupErr != nil {
+	backupRunner := s3backup.New(cfg, fakes3api, models.BackupDirectory{Path: tmpDir}, &l)
+	if backupErr := backupRunner.BackupDirectory(context.Background()); backupErr != nil {
 		t.Fatalf("BackupDirectory() returned unexpected error: %v", backupErr)
 	}
 
@@ -240,12 +262,1026 @@ func TestBackupDirectorySkipsPutObjectOnInvalidACL(t *testing.T) {
 	old := time.Unix(0, 0).UTC()
 	fakes3api.HeadObjectReturns(&s3.HeadObjectOutput{LastModified: &old}, nil)
 
-	backupRunner := s3backup.New(cfg, fakes3api, tmpDir, &l)
-	if backupErr := backupRunner.BackupDirectory(); backupErr != nil {
-		t.Fatalf("BackupDirectory() returned unexpected error: %v", backupErr)
+	backupRunner := s3backup.New(cfg, fakes3api, models.BackupDirectory{Path: tmpDir}, &l)
+	if backupErr := backupRunner.BackupDirectory(context.Background()); backupErr == nil {
+		t.Fatalf("expected BackupDirectory() to report the file that failed")
 	}
 
 	if fakes3api.LastPutObjectInput != nil {
 		t.Fatalf("expected PutObject not to be called for invalid ACL")
 	}
+	if got := backupRunner.FailedFiles(); !slices.Equal(got, []string{tmpFile}) {
+		t.Fatalf("FailedFiles() = %v, want [%s]", got, tmpFile)
+	}
+}
+
+func TestBackupDirectoryConcurrentWorkers(t *testing.T) {
+	tmpDir := t.TempDir()
+	for i := 0; i < 20; i++ {
+		tmpFile := filepath.Join(tmpDir, fmt.Sprintf("sample%d.txt", i))
+		if writeErr := os.WriteFile(tmpFile, []byte("hello"), 0o600); writeErr != nil {
+			t.Fatalf("unable to create temp file: %v", writeErr)
+		}
+	}
+
+	cfg = models.Config{
+		AWS: models.AWS{
+			S3Region:    "us-east-1",
+			S3Bucket:    "testbucket",
+			Concurrency: 4,
+		},
+		Logging: models.Logging{},
+	}
+
+	fakes3api = new(s3api.FakeS3API)
+	fakes3api.PutObjectReturns(&s3.PutObjectOutput{}, nil)
+	old := time.Unix(0, 0).UTC()
+	fakes3api.HeadObjectReturns(&s3.HeadObjectOutput{LastModified: &old}, nil)
+
+	backupRunner := s3backup.New(cfg, fakes3api, models.BackupDirectory{Path: tmpDir}, &l)
+	if backupErr := backupRunner.BackupDirectory(context.Background()); backupErr != nil {
+		t.Fatalf("BackupDirectory() returned unexpected error: %v", backupErr)
+	}
+
+	if got := fakes3api.PutObjectCallCount(); got != 20 {
+		t.Fatalf("expected 20 PutObject calls, got %d", got)
+	}
+}
+
+// inFlightS3API records the most PutObject calls that ran at the same time.
+type inFlightS3API struct {
+	*s3api.FakeS3API
+	inFlight    atomic.Int64
+	maxInFlight atomic.Int64
+}
+
+func (f *inFlightS3API) PutObject(ctx context.Context, in *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	n := f.inFlight.Add(1)
+	defer f.inFlight.Add(-1)
+	for {
+		highest := f.maxInFlight.Load()
+		if n <= highest || f.maxInFlight.CompareAndSwap(highest, n) {
+			break
+		}
+	}
+	time.Sleep(time.Millisecond)
+	return f.FakeS3API.PutObject(ctx, in, optFns...)
+}
+
+func TestBackupDirectorySharedPool(t *testing.T) {
+	cfg = models.Config{AWS: models.AWS{S3Bucket: "testbucket", Concurrency: 4}}
+	fake := &inFlightS3API{FakeS3API: new(s3api.FakeS3API)}
+	fake.HeadObjectReturns(nil, &s3types.NotFound{})
+	pool := s3backup.NewPool(2)
+
+	var wg sync.WaitGroup
+	for range 3 {
+		tmpDir := t.TempDir()
+		for i := range 10 {
+			if writeErr := os.WriteFile(filepath.Join(tmpDir, fmt.Sprintf("sample%d.txt", i)), []byte("hello"), 0o600); writeErr != nil {
+				t.Fatalf("unable to create temp file: %v", writeErr)
+			}
+		}
+		backupRunner := s3backup.New(cfg, fake, models.BackupDirectory{Path: tmpDir}, &l)
+		_ = backupRunner.SetPool(pool)
+		wg.Go(func() {
+			if backupErr := backupRunner.BackupDirectory(context.Background()); backupErr != nil {
+				t.Errorf("BackupDirectory() returned unexpected error: %v", backupErr)
+			}
+		})
+	}
+	wg.Wait()
+
+	if got := fake.PutObjectCallCount(); got != 30 {
+		t.Fatalf("expected 30 PutObject calls, got %d", got)
+	}
+	if got := fake.maxInFlight.Load(); got > 2 {
+		t.Fatalf("%d uploads ran at once, want at most the 2 of the shared pool", got)
+	}
+}
+
+func TestBackupDirectoryMultipartUpload(t *testing.T) {
+	tmpDir := t.TempDir()
+	tmpFile := filepath.Join(tmpDir, "large.img")
+	if writeErr := os.WriteFile(tmpFile, nil, 0o600); writeErr != nil {
+		t.Fatalf("unable to create temp file: %v", writeErr)
+	}
+	// 11 MiB at the minimum 5 MiB part size is three parts.
+	if truncErr := os.Truncate(tmpFile, 11*1024*1024); truncErr != nil {
+		t.Fatalf("unable to size temp file: %v", truncErr)
+	}
+
+	cfg = models.Config{
+		AWS: models.AWS{
+			S3Region:             "us-east-1",
+			S3Bucket:             "testbucket",
+			MultipartThresholdMB: 1,
+			MultipartPartSizeMB:  1,
+			MultipartConcurrency: 2,
+		},
+		Logging: models.Logging{},
+	}
+
+	fakes3api = new(s3api.FakeS3API)
+	old := time.Unix(0, 0).UTC()
+	fakes3api.HeadObjectReturns(&s3.HeadObjectOutput{LastModified: &old}, nil)
+
+	backupRunner := s3backup.New(cfg, fakes3api, models.BackupDirectory{Path: tmpDir}, &l)
+	if backupErr := backupRunner.BackupDirectory(context.Background()); backupErr != nil {
+		t.Fatalf("BackupDirectory() returned unexpected error: %v", backupErr)
+	}
+
+	if fakes3api.PutObjectCallCount() != 0 {
+		t.Fatalf("expected PutObject not to be called for a multipart upload")
+	}
+	if got := fakes3api.UploadPartCallCount(); got != 3 {
+		t.Fatalf("expected 3 UploadPart calls, got %d", got)
+	}
+	if fakes3api.CompleteMultipartUploadCallCount() != 1 {
+		t.Fatalf("expected CompleteMultipartUpload to be called once")
+	}
+}
+
+func TestBackupDirectoryMultipartUploadAbortsOnFailure(t *testing.T) {
+	tmpDir := t.TempDir()
+	tmpFile := filepath.Join(tmpDir, "large.img")
+	if writeErr := os.WriteFile(tmpFile, nil, 0o600); writeErr != nil {
+		t.Fatalf("unable to create temp file: %v", writeErr)
+	}
+	if truncErr := os.Truncate(tmpFile, 6*1024*1024); truncErr != nil {
+		t.Fatalf("unable to size temp file: %v", truncErr)
+	}
+
+	cfg = models.Config{
+		AWS: models.AWS{
+			S3Region:             "us-east-1",
+			S3Bucket:             "testbucket",
+			MultipartThresholdMB: 1,
+		},
+		Logging: models.Logging{},
+	}
+
+	fakes3api = new(s3api.FakeS3API)
+	old := time.Unix(0, 0).UTC()
+	fakes3api.HeadObjectReturns(&s3.HeadObjectOutput{LastModified: &old}, nil)
+	fakes3api.UploadPartReturns(errors.New("connection reset"))
+
+	backupRunner := s3backup.New(cfg, fakes3api, models.BackupDirectory{Path: tmpDir}, &l)
+	if backupErr := backupRunner.BackupDirectory(context.Background()); backupErr == nil {
+		t.Fatalf("expected BackupDirectory() to report the file that failed")
+	}
+	if got := backupRunner.FailedFiles(); !slices.Equal(got, []string{tmpFile}) {
+		t.Fatalf("FailedFiles() = %v, want [%s]", got, tmpFile)
+	}
+
+	if fakes3api.AbortMultipartUploadCallCount() != 1 {
+		t.Fatalf("expected AbortMultipartUpload to be called once")
+	}
+	if fakes3api.CompleteMultipartUploadCallCount() != 0 {
+		t.Fatalf("expected CompleteMultipartUpload not to be called")
+	}
+}
+
+func TestBackupDirectoryCancelled(t *testing.T) {
+	tmpDir := t.TempDir()
+	if writeErr := os.WriteFile(filepath.Join(tmpDir, "sample.txt"), []byte("hello"), 0o600); writeErr != nil {
+		t.Fatalf("unable to create temp file: %v", writeErr)
+	}
+
+	cfg = models.Config{
+		AWS: models.AWS{
+			S3Region: "us-east-1",
+			S3Bucket: "testbucket",
+		},
+		Logging: models.Logging{},
+	}
+
+	fakes3api = new(s3api.FakeS3API)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	backupRunner := s3backup.New(cfg, fakes3api, models.BackupDirectory{Path: tmpDir}, &l)
+	if backupErr := backupRunner.BackupDirectory(ctx); !errors.Is(backupErr, context.Canceled) {
+		t.Fatalf("BackupDirectory() error = %v, want %v", backupErr, context.Canceled)
+	}
+	if fakes3api.HeadObjectCallCount() != 0 || fakes3api.PutObjectCallCount() != 0 {
+		t.Fatalf("expected nothing to be sent to S3 once cancelled")
+	}
+}
+
+func TestBackupDirectoryChangeDetection(t *testing.T) {
+	// sha256 of "hello"
+	const helloSHA256 = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+
+	tmpDir := t.TempDir()
+	tmpFile := filepath.Join(tmpDir, "sample.txt")
+	if writeErr := os.WriteFile(tmpFile, []byte("hello"), 0o600); writeErr != nil {
+		t.Fatalf("unable to create temp file: %v", writeErr)
+	}
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC)
+	if chtimesErr := os.Chtimes(tmpFile, mtime, mtime); chtimesErr != nil {
+		t.Fatalf("unable to set temp file time: %v", chtimesErr)
+	}
+	// Newer than the local file, as it would be right after an upload.
+	uploaded := mtime.Add(time.Hour)
+
+	tests := []struct {
+		name       string
+		mode       string
+		head       *s3.HeadObjectOutput
+		wantUpload bool
+	}{
+		{name: "mtime unchanged", mode: s3backup.ChangeDetectionMtime, head: &s3.HeadObjectOutput{LastModified: &uploaded}, wantUpload: false},
+		{name: "size+mtime unchanged", mode: s3backup.ChangeDetectionSizeMtime, head: &s3.HeadObjectOutput{
+			ContentLength: aws.Int64(5),
+			Metadata:      map[string]string{s3backup.MetadataMtime: mtime.Format(time.RFC3339Nano)},
+		}, wantUpload: false},
+		{name: "size+mtime touched", mode: s3backup.ChangeDetectionSizeMtime, head: &s3.HeadObjectOutput{
+			ContentLength: aws.Int64(5),
+			LastModified:  &uploaded,
+			Metadata:      map[string]string{s3backup.MetadataMtime: mtime.Add(-time.Hour).Format(time.RFC3339Nano)},
+		}, wantUpload: true},
+		{name: "size+mtime size differs", mode: s3backup.ChangeDetectionSizeMtime, head: &s3.HeadObjectOutput{
+			ContentLength: aws.Int64(4),
+			Metadata:      map[string]string{s3backup.MetadataMtime: mtime.Format(time.RFC3339Nano)},
+		}, wantUpload: true},
+		{name: "sha256 unchanged", mode: s3backup.ChangeDetectionSHA256, head: &s3.HeadObjectOutput{
+			Metadata: map[string]string{s3backup.MetadataSHA256: helloSHA256},
+		}, wantUpload: false},
+		{name: "sha256 old object newer than file", mode: s3backup.ChangeDetectionSHA256, head: &s3.HeadObjectOutput{
+			LastModified: &uploaded,
+			Metadata:     map[string]string{s3backup.MetadataSHA256: "stale"},
+		}, wantUpload: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg = models.Config{AWS: models.AWS{S3Bucket: "testbucket", ChangeDetection: tt.mode}}
+			fakes3api = new(s3api.FakeS3API)
+			fakes3api.HeadObjectReturns(tt.head, nil)
+
+			backupRunner := s3backup.New(cfg, fakes3api, models.BackupDirectory{Path: tmpDir}, &l)
+			if backupErr := backupRunner.BackupDirectory(context.Background()); backupErr != nil {
+				t.Fatalf("BackupDirectory() returned unexpected error: %v", backupErr)
+			}
+
+			didUpload := fakes3api.PutObjectCallCount() == 1
+			if didUpload != tt.wantUpload {
+				t.Fatalf("uploaded = %v, want %v", didUpload, tt.wantUpload)
+			}
+			if didUpload && tt.mode == s3backup.ChangeDetectionSHA256 &&
+				fakes3api.LastPutObjectInput.Metadata[s3backup.MetadataSHA256] != helloSHA256 {
+				t.Fatalf("expected sha256 metadata to be stored on upload")
+			}
+		})
+	}
+}
+
+func TestBackupDirectoryInvalidChangeDetection(t *testing.T) {
+	cfg = models.Config{AWS: models.AWS{S3Bucket: "testbucket", ChangeDetection: "ctime"}}
+	fakes3api = new(s3api.FakeS3API)
+
+	backupRunner := s3backup.New(cfg, fakes3api, models.BackupDirectory{Path: t.TempDir()}, &l)
+	if backupErr := backupRunner.BackupDirectory(context.Background()); backupErr == nil {
+		t.Fatalf("expected BackupDirectory() to reject an unknown change detection mode")
+	}
+}
+
+func TestBackupDirectorySkipsIndexedFiles(t *testing.T) {
+	tmpDir := t.TempDir()
+	unchanged := filepath.Join(tmpDir, "unchanged.txt")
+	changed := filepath.Join(tmpDir, "changed.txt")
+	for _, f := range []string{unchanged, changed} {
+		if writeErr := os.WriteFile(f, []byte("hello"), 0o600); writeErr != nil {
+			t.Fatalf("unable to create temp file: %v", writeErr)
+		}
+	}
+
+	cfg = models.Config{AWS: models.AWS{S3Bucket: "testbucket", StateDirectory: t.TempDir()}}
+	fakes3api = new(s3api.FakeS3API)
+	idx, idxErr := s3index.New(cfg, fakes3api, &l)
+	if idxErr != nil {
+		t.Fatalf("s3index.New() returned unexpected error: %v", idxErr)
+	}
+
+	unchangedInfo, _ := os.Stat(unchanged)
+	unchangedKey, _ := s3backup.ObjectKey(unchanged)
+	idx.Record(s3index.Entry{Key: unchangedKey, Size: unchangedInfo.Size(), Mtime: unchangedInfo.ModTime()})
+	changedKey, _ := s3backup.ObjectKey(changed)
+	idx.Record(s3index.Entry{Key: changedKey, Size: 1, Mtime: unchangedInfo.ModTime()})
+	goneKey, _ := s3backup.ObjectKey(filepath.Join(tmpDir, "gone.txt"))
+	idx.Record(s3index.Entry{Key: goneKey, Size: 1})
+
+	backupRunner := s3backup.New(cfg, fakes3api, models.BackupDirectory{Path: tmpDir}, &l)
+	_ = backupRunner.SetIndex(idx)
+	if backupErr := backupRunner.BackupDirectory(context.Background()); backupErr != nil {
+		t.Fatalf("BackupDirectory() returned unexpected error: %v", backupErr)
+	}
+
+	if got := fakes3api.HeadObjectCallCount(); got != 1 {
+		t.Fatalf("expected 1 HeadObject call, got %d", got)
+	}
+	if got := fakes3api.PutObjectCallCount(); got != 1 {
+		t.Fatalf("expected 1 PutObject call, got %d", got)
+	}
+	if entry, ok := idx.Lookup(changedKey); !ok || entry.Size != 5 {
+		t.Fatalf("expected index entry for uploaded file to be updated, got %+v", entry)
+	}
+	if _, ok := idx.Lookup(goneKey); ok {
+		t.Fatalf("expected index entry for deleted file to be pruned")
+	}
+}
+
+func TestBackupDirectoryIncludeExclude(t *testing.T) {
+	tmpDir := t.TempDir()
+	files := map[string]string{
+		"main.go":                     "package main",
+		"notes.txt":                   "notes",
+		"node_modules/pkg/index.go":   "package pkg",
+		"vendor/lib/lib.go":           "package lib",
+		"vendor/" + ".s3backupignore": "lib/\n",
+	}
+	for name, content := range files {
+		full := filepath.Join(tmpDir, name)
+		if mkdirErr := os.MkdirAll(filepath.Dir(full), 0o755); mkdirErr != nil {
+			t.Fatalf("unable to create directory: %v", mkdirErr)
+		}
+		if writeErr := os.WriteFile(full, []byte(content), 0o600); writeErr != nil {
+			t.Fatalf("unable to create temp file: %v", writeErr)
+		}
+	}
+
+	cfg = models.Config{AWS: models.AWS{S3Bucket: "testbucket"}}
+	fakes3api = new(s3api.FakeS3API)
+
+	dir := models.BackupDirectory{
+		Path:    tmpDir,
+		Include: []string{"*.go"},
+		Exclude: []string{"node_modules/"},
+	}
+	backupRunner := s3backup.New(cfg, fakes3api, dir, &l)
+	if backupErr := backupRunner.BackupDirectory(context.Background()); backupErr != nil {
+		t.Fatalf("BackupDirectory() returned unexpected error: %v", backupErr)
+	}
+
+	if got := fakes3api.PutObjectCallCount(); got != 1 {
+		t.Fatalf("expected only main.go to be uploaded, got %d uploads", got)
+	}
+	wantKey, _ := s3backup.ObjectKey(filepath.Join(tmpDir, "main.go"))
+	if gotKey := aws.ToString(fakes3api.LastPutObjectInput.Key); gotKey != wantKey {
+		t.Fatalf("uploaded key = %q, want %q", gotKey, wantKey)
+	}
+}
+
+func TestBackupDirectoryDryRun(t *testing.T) {
+	tmpDir := t.TempDir()
+	tmpFile := filepath.Join(tmpDir, "sample.txt")
+	if writeErr := os.WriteFile(tmpFile, []byte("hello"), 0o600); writeErr != nil {
+		t.Fatalf("unable to create temp file: %v", writeErr)
+	}
+
+	cfg = models.Config{AWS: models.AWS{S3Bucket: "testbucket"}, DryRun: true}
+	fakes3api = new(s3api.FakeS3API)
+
+	backupRunner := s3backup.New(cfg, fakes3api, models.BackupDirectory{Path: tmpDir}, &l)
+	if backupErr := backupRunner.BackupDirectory(context.Background()); backupErr != nil {
+		t.Fatalf("BackupDirectory() returned unexpected error: %v", backupErr)
+	}
+
+	if fakes3api.HeadObjectCallCount() != 1 {
+		t.Fatalf("expected a dry run to still call HeadObject")
+	}
+	if fakes3api.PutObjectCallCount() != 0 {
+		t.Fatalf("expected no PutObject calls in a dry run")
+	}
+}
+
+func TestBackupDirectorySnapshotSharesContent(t *testing.T) {
+	tmpDir := t.TempDir()
+	for _, name := range []string{"a.txt", "b.txt"} {
+		if writeErr := os.WriteFile(filepath.Join(tmpDir, name), []byte("same contents"), 0o600); writeErr != nil {
+			t.Fatalf("unable to create temp file: %v", writeErr)
+		}
+	}
+
+	cfg = models.Config{AWS: models.AWS{S3Bucket: "testbucket", BackupMode: s3backup.BackupModeSnapshot, StateDirectory: t.TempDir()}}
+	fakes3api = new(s3api.FakeS3API)
+	fakes3api.HeadObjectReturns(nil, &s3types.NotFound{})
+	idx, idxErr := s3index.New(cfg, fakes3api, &l)
+	if idxErr != nil {
+		t.Fatalf("s3index.New() returned unexpected error: %v", idxErr)
+	}
+	snap := s3snapshot.New(cfg, fakes3api, &l)
+
+	backupRunner := s3backup.New(cfg, fakes3api, models.BackupDirectory{Path: tmpDir}, &l)
+	_ = backupRunner.SetIndex(idx)
+	_ = backupRunner.SetSnapshot(snap)
+	if backupErr := backupRunner.BackupDirectory(context.Background()); backupErr != nil {
+		t.Fatalf("BackupDirectory() returned unexpected error: %v", backupErr)
+	}
+
+	if got := fakes3api.PutObjectCallCount(); got != 1 {
+		t.Fatalf("expected identical files to be uploaded once, got %d uploads", got)
+	}
+	sum := sha256.Sum256([]byte("same contents"))
+	wantKey := s3snapshot.ContentKey(hex.EncodeToString(sum[:]))
+	if gotKey := aws.ToString(fakes3api.LastPutObjectInput.Key); gotKey != wantKey {
+		t.Fatalf("uploaded key = %q, want %q", gotKey, wantKey)
+	}
+
+	if saveErr := snap.Save(context.Background()); saveErr != nil {
+		t.Fatalf("Save() returned unexpected error: %v", saveErr)
+	}
+	var manifest s3snapshot.Manifest
+	if decodeErr := json.NewDecoder(fakes3api.LastPutObjectInput.Body).Decode(&manifest); decodeErr != nil {
+		t.Fatalf("unable to decode manifest: %v", decodeErr)
+	}
+	if len(manifest.Entries) != 2 || manifest.Entries[0].Key != wantKey || manifest.Entries[1].Key != wantKey {
+		t.Fatalf("manifest entries = %+v, want two files sharing %q", manifest.Entries, wantKey)
+	}
+}
+
+func TestBackupDirectorySnapshotThenMirror(t *testing.T) {
+	tmpDir := t.TempDir()
+	if writeErr := os.WriteFile(filepath.Join(tmpDir, "a.txt"), []byte("contents"), 0o600); writeErr != nil {
+		t.Fatalf("unable to create temp file: %v", writeErr)
+	}
+
+	cfg = models.Config{AWS: models.AWS{S3Bucket: "testbucket", BackupMode: s3backup.BackupModeSnapshot, StateDirectory: t.TempDir()}}
+	fakes3api = new(s3api.FakeS3API)
+	fakes3api.HeadObjectReturns(nil, &s3types.NotFound{})
+	idx, idxErr := s3index.New(cfg, fakes3api, &l)
+	if idxErr != nil {
+		t.Fatalf("s3index.New() returned unexpected error: %v", idxErr)
+	}
+	backupRunner := s3backup.New(cfg, fakes3api, models.BackupDirectory{Path: tmpDir}, &l)
+	_ = backupRunner.SetIndex(idx)
+	_ = backupRunner.SetSnapshot(s3snapshot.New(cfg, fakes3api, &l))
+	if backupErr := backupRunner.BackupDirectory(context.Background()); backupErr != nil {
+		t.Fatalf("BackupDirectory() returned unexpected error: %v", backupErr)
+	}
+
+	// The file was only stored as snapshot content, so mirror mode must
+	// still upload it under its own key.
+	cfg.AWS.BackupMode = s3backup.BackupModeMirror
+	backupRunner = s3backup.New(cfg, fakes3api, models.BackupDirectory{Path: tmpDir}, &l)
+	_ = backupRunner.SetIndex(idx)
+	if backupErr := backupRunner.BackupDirectory(context.Background()); backupErr != nil {
+		t.Fatalf("BackupDirectory() returned unexpected error: %v", backupErr)
+	}
+	wantKey, _ := s3backup.ObjectKey(filepath.Join(tmpDir, "a.txt"))
+	if gotKey := aws.ToString(fakes3api.LastPutObjectInput.Key); gotKey != wantKey {
+		t.Fatalf("last uploaded key = %q, want the mirror key %q", gotKey, wantKey)
+	}
+}
+
+func TestBackupDirectorySnapshotWithFailedFile(t *testing.T) {
+	tmpDir := t.TempDir()
+	for _, name := range []string{"a.txt", "b.txt"} {
+		if writeErr := os.WriteFile(filepath.Join(tmpDir, name), []byte(name), 0o600); writeErr != nil {
+			t.Fatalf("unable to create temp file: %v", writeErr)
+		}
+	}
+
+	cfg = models.Config{AWS: models.AWS{S3Bucket: "testbucket", BackupMode: s3backup.BackupModeSnapshot, Concurrency: 1}}
+	fakes3api = new(s3api.FakeS3API)
+	fakes3api.HeadObjectReturns(nil, &s3types.NotFound{})
+	fakes3api.PutObjectReturnsOnCall(0, nil, errors.New("something went wrong"))
+	snap := s3snapshot.New(cfg, fakes3api, &l)
+
+	backupRunner := s3backup.New(cfg, fakes3api, models.BackupDirectory{Path: tmpDir}, &l)
+	_ = backupRunner.SetSnapshot(snap)
+	backupErr := backupRunner.BackupDirectory(context.Background())
+	if !errors.Is(backupErr, s3backup.ErrFilesFailed) {
+		t.Fatalf("BackupDirectory() error = %v, want %v", backupErr, s3backup.ErrFilesFailed)
+	}
+	if failed := backupRunner.FailedFiles(); len(failed) != 1 {
+		t.Fatalf("FailedFiles() = %v, want one file", failed)
+	}
+
+	// The run completed, so the manifest is still written with the file that
+	// was backed up
+	if saveErr := snap.Save(context.Background()); saveErr != nil {
+		t.Fatalf("Save() returned unexpected error: %v", saveErr)
+	}
+	var manifest s3snapshot.Manifest
+	if decodeErr := json.NewDecoder(fakes3api.LastPutObjectInput.Body).Decode(&manifest); decodeErr != nil {
+		t.Fatalf("unable to decode manifest: %v", decodeErr)
+	}
+	if len(manifest.Entries) != 1 {
+		t.Fatalf("manifest entries = %+v, want the one file that was backed up", manifest.Entries)
+	}
+}
+
+func TestBackupDirectorySnapshotRequiresSnapshot(t *testing.T) {
+	cfg = models.Config{AWS: models.AWS{S3Bucket: "testbucket", BackupMode: s3backup.BackupModeSnapshot}}
+	backupRunner := s3backup.New(cfg, new(s3api.FakeS3API), models.BackupDirectory{Path: t.TempDir()}, &l)
+	if backupErr := backupRunner.BackupDirectory(context.Background()); backupErr == nil {
+		t.Fatalf("expected an error when no snapshot was set")
+	}
+}
+
+func TestBackupDirectoryEncrypted(t *testing.T) {
+	tmpDir := t.TempDir()
+	tmpFile := filepath.Join(tmpDir, "secret.txt")
+	if writeErr := os.WriteFile(tmpFile, []byte("hello"), 0o600); writeErr != nil {
+		t.Fatalf("unable to create temp file: %v", writeErr)
+	}
+	keyFile := filepath.Join(t.TempDir(), "backup.key")
+	if writeErr := os.WriteFile(keyFile, []byte(strings.Repeat("k", 32)), 0o600); writeErr != nil {
+		t.Fatalf("unable to create key file: %v", writeErr)
+	}
+
+	cfg = models.Config{AWS: models.AWS{S3Bucket: "testbucket", EncryptionKeyFile: keyFile}}
+	cipher, cipherErr := s3crypt.New(cfg)
+	if cipherErr != nil {
+		t.Fatalf("s3crypt.New() unexpected error: %v", cipherErr)
+	}
+	fakes3api = new(s3api.FakeS3API)
+	fakes3api.HeadObjectReturns(nil, &s3types.NotFound{})
+
+	backupRunner := s3backup.New(cfg, fakes3api, models.BackupDirectory{Path: tmpDir}, &l)
+	_ = backupRunner.SetCipher(cipher)
+	if backupErr := backupRunner.BackupDirectory(context.Background()); backupErr != nil {
+		t.Fatalf("BackupDirectory() returned unexpected error: %v", backupErr)
+	}
+
+	input := fakes3api.LastPutObjectInput
+	if input == nil {
+		t.Fatalf("expected the file to be uploaded")
+	}
+	if aws.ToString(input.ContentType) != "application/octet-stream" || input.Metadata[s3backup.MetadataSize] != "5" {
+		t.Fatalf("content type %q metadata %v, want an opaque type and the original size", aws.ToString(input.ContentType), input.Metadata)
+	}
+	plaintext, decryptErr := cipher.Decrypt(input.Body, input.Metadata)
+	if decryptErr != nil {
+		t.Fatalf("Decrypt() unexpected error: %v", decryptErr)
+	}
+	if got, _ := io.ReadAll(plaintext); string(got) != "hello" {
+		t.Fatalf("uploaded object decrypts to %q, want %q", got, "hello")
+	}
+}
+
+func TestBackupDirectorySnapshotEncrypted(t *testing.T) {
+	tmpDir := t.TempDir()
+	if writeErr := os.WriteFile(filepath.Join(tmpDir, "secret.txt"), []byte("hello"), 0o600); writeErr != nil {
+		t.Fatalf("unable to create temp file: %v", writeErr)
+	}
+	keyFile := filepath.Join(t.TempDir(), "backup.key")
+	if writeErr := os.WriteFile(keyFile, []byte(strings.Repeat("k", 32)), 0o600); writeErr != nil {
+		t.Fatalf("unable to create key file: %v", writeErr)
+	}
+
+	cfg = models.Config{AWS: models.AWS{S3Bucket: "testbucket", BackupMode: s3backup.BackupModeSnapshot, EncryptionKeyFile: keyFile}}
+	cipher, cipherErr := s3crypt.New(cfg)
+	if cipherErr != nil {
+		t.Fatalf("s3crypt.New() unexpected error: %v", cipherErr)
+	}
+	fakes3api = new(s3api.FakeS3API)
+	fakes3api.HeadObjectReturns(nil, &s3types.NotFound{})
+	snap := s3snapshot.New(cfg, fakes3api, &l)
+	_ = snap.SetCipher(cipher)
+
+	backupRunner := s3backup.New(cfg, fakes3api, models.BackupDirectory{Path: tmpDir}, &l)
+	_ = backupRunner.SetSnapshot(snap)
+	_ = backupRunner.SetCipher(cipher)
+	if backupErr := backupRunner.BackupDirectory(context.Background()); backupErr != nil {
+		t.Fatalf("BackupDirectory() returned unexpected error: %v", backupErr)
+	}
+
+	// Neither the key nor the metadata of the content object may give away
+	// the hash of the file
+	sum := sha256.Sum256([]byte("hello"))
+	id, _ := cipher.ContentID(hex.EncodeToString(sum[:]))
+	input := fakes3api.LastPutObjectInput
+	if gotKey := aws.ToString(input.Key); gotKey != s3snapshot.ContentKey(id) {
+		t.Fatalf("uploaded key = %q, want %q", gotKey, s3snapshot.ContentKey(id))
+	}
+	if _, ok := input.Metadata[s3backup.MetadataSHA256]; ok {
+		t.Fatalf("metadata %v, want no plaintext hash on an encrypted object", input.Metadata)
+	}
+}
+
+func TestBackupDirectoryEncryptedHidesContent(t *testing.T) {
+	contents := strings.Repeat("timestamp,level,message\n", 1000)
+	tmpDir := t.TempDir()
+	if writeErr := os.WriteFile(filepath.Join(tmpDir, "app.log"), []byte(contents), 0o600); writeErr != nil {
+		t.Fatalf("unable to create temp file: %v", writeErr)
+	}
+	keyFile := filepath.Join(t.TempDir(), "backup.key")
+	if writeErr := os.WriteFile(keyFile, []byte(strings.Repeat("k", 32)), 0o600); writeErr != nil {
+		t.Fatalf("unable to create key file: %v", writeErr)
+	}
+
+	cfg = models.Config{AWS: models.AWS{
+		S3Bucket:          "testbucket",
+		EncryptionKeyFile: keyFile,
+		ChangeDetection:   s3backup.ChangeDetectionSHA256,
+		Compression:       s3backup.CompressionGzip,
+	}}
+	cipher, cipherErr := s3crypt.New(cfg)
+	if cipherErr != nil {
+		t.Fatalf("s3crypt.New() unexpected error: %v", cipherErr)
+	}
+	fakes3api = new(s3api.FakeS3API)
+	fakes3api.HeadObjectReturns(nil, &s3types.NotFound{})
+
+	backupRunner := s3backup.New(cfg, fakes3api, models.BackupDirectory{Path: tmpDir}, &l)
+	_ = backupRunner.SetCipher(cipher)
+	if backupErr := backupRunner.BackupDirectory(context.Background()); backupErr != nil {
+		t.Fatalf("BackupDirectory() returned unexpected error: %v", backupErr)
+	}
+
+	// The body is ciphertext, so the compression is recorded in metadata
+	// rather than as a Content-Encoding, and the hash is keyed.
+	input := fakes3api.LastPutObjectInput
+	sum := sha256.Sum256([]byte(contents))
+	id, _ := cipher.ContentID(hex.EncodeToString(sum[:]))
+	if input.ContentEncoding != nil || input.Metadata[s3backup.MetadataCompression] != s3backup.CompressionGzip {
+		t.Fatalf("Content-Encoding %q metadata %v, want the compression in metadata only", aws.ToString(input.ContentEncoding), input.Metadata)
+	}
+	if input.Metadata[s3backup.MetadataSHA256] != id {
+		t.Fatalf("sha256 metadata = %q, want the keyed hash %q", input.Metadata[s3backup.MetadataSHA256], id)
+	}
+	plaintext, decryptErr := cipher.Decrypt(input.Body, input.Metadata)
+	if decryptErr != nil {
+		t.Fatalf("Decrypt() unexpected error: %v", decryptErr)
+	}
+	reader, decompressErr := s3backup.Decompress(plaintext, input.Metadata[s3backup.MetadataCompression])
+	if decompressErr != nil {
+		t.Fatalf("Decompress() unexpected error: %v", decompressErr)
+	}
+	if got, _ := io.ReadAll(reader); string(got) != contents {
+		t.Fatalf("uploaded object does not decrypt and decompress to the file contents")
+	}
+
+	// The keyed hash on the object is recognised as the unchanged file
+	fakes3api.HeadObjectReturns(&s3.HeadObjectOutput{Metadata: input.Metadata}, nil)
+	backupRunner = s3backup.New(cfg, fakes3api, models.BackupDirectory{Path: tmpDir}, &l)
+	_ = backupRunner.SetCipher(cipher)
+	if backupErr := backupRunner.BackupDirectory(context.Background()); backupErr != nil {
+		t.Fatalf("BackupDirectory() returned unexpected error: %v", backupErr)
+	}
+	if got := fakes3api.PutObjectCallCount(); got != 1 {
+		t.Fatalf("expected the unchanged file not to be uploaded again, got %d uploads", got)
+	}
+}
+
+func TestBackupDirectoryCompression(t *testing.T) {
+	contents := strings.Repeat("timestamp,level,message\n", 1000)
+	overrides := []models.CompressionOverride{
+		{Patterns: []string{"*.csv"}, Compression: s3backup.CompressionGzip},
+		{Patterns: []string{"*.jpg"}, Compression: s3backup.CompressionNone},
+	}
+
+	tests := []struct {
+		name     string
+		file     string
+		encoding string
+	}{
+		{name: "default", file: "app.log", encoding: s3backup.CompressionZstd},
+		{name: "override", file: "export.csv", encoding: s3backup.CompressionGzip},
+		{name: "override to none", file: "photo.jpg", encoding: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			if writeErr := os.WriteFile(filepath.Join(tmpDir, tt.file), []byte(contents), 0o600); writeErr != nil {
+				t.Fatalf("unable to create temp file: %v", writeErr)
+			}
+			cfg = models.Config{AWS: models.AWS{S3Bucket: "testbucket", Compression: s3backup.CompressionZstd, CompressionOverrides: overrides}}
+			fakes3api = new(s3api.FakeS3API)
+			fakes3api.HeadObjectReturns(nil, &s3types.NotFound{})
+
+			backupRunner := s3backup.New(cfg, fakes3api, models.BackupDirectory{Path: tmpDir}, &l)
+			if backupErr := backupRunner.BackupDirectory(context.Background()); backupErr != nil {
+				t.Fatalf("BackupDirectory() returned unexpected error: %v", backupErr)
+			}
+
+			input := fakes3api.LastPutObjectInput
+			if got := aws.ToString(input.ContentEncoding); got != tt.encoding {
+				t.Fatalf("Content-Encoding = %q, want %q", got, tt.encoding)
+			}
+			if tt.encoding == "" {
+				return
+			}
+			if input.Metadata[s3backup.MetadataSize] != fmt.Sprint(len(contents)) || aws.ToInt64(input.ContentLength) >= int64(len(contents)) {
+				t.Fatalf("metadata %v length %d, want the original size recorded and a smaller object", input.Metadata, aws.ToInt64(input.ContentLength))
+			}
+			reader, decompressErr := s3backup.Decompress(input.Body, tt.encoding)
+			if decompressErr != nil {
+				t.Fatalf("Decompress() unexpected error: %v", decompressErr)
+			}
+			if got, _ := io.ReadAll(reader); string(got) != contents {
+				t.Fatalf("uploaded object does not decompress to the file contents")
+			}
+		})
+	}
+}
+
+func TestBackupDirectoryCompressedUnchanged(t *testing.T) {
+	tmpDir := t.TempDir()
+	tmpFile := filepath.Join(tmpDir, "app.log")
+	if writeErr := os.WriteFile(tmpFile, []byte("hello hello hello"), 0o600); writeErr != nil {
+		t.Fatalf("unable to create temp file: %v", writeErr)
+	}
+	info, statErr := os.Stat(tmpFile)
+	if statErr != nil {
+		t.Fatalf("unable to stat temp file: %v", statErr)
+	}
+
+	cfg = models.Config{AWS: models.AWS{S3Bucket: "testbucket", Compression: s3backup.CompressionGzip, ChangeDetection: s3backup.ChangeDetectionSizeMtime}}
+	fakes3api = new(s3api.FakeS3API)
+	fakes3api.HeadObjectReturns(&s3.HeadObjectOutput{
+		ContentLength:   aws.Int64(9),
+		ContentEncoding: aws.String(s3backup.CompressionGzip),
+		Metadata: map[string]string{
+			s3backup.MetadataSize:  fmt.Sprint(info.Size()),
+			s3backup.MetadataMtime: info.ModTime().UTC().Format(time.RFC3339Nano),
+		},
+	}, nil)
+
+	backupRunner := s3backup.New(cfg, fakes3api, models.BackupDirectory{Path: tmpDir}, &l)
+	if backupErr := backupRunner.BackupDirectory(context.Background()); backupErr != nil {
+		t.Fatalf("BackupDirectory() returned unexpected error: %v", backupErr)
+	}
+	if fakes3api.PutObjectCallCount() != 0 {
+		t.Fatalf("expected a compressed object recording the local size and mtime to be left alone")
+	}
+}
+
+func TestBackupDirectoryInvalidCompression(t *testing.T) {
+	cfg = models.Config{AWS: models.AWS{S3Bucket: "testbucket", CompressionOverrides: []models.CompressionOverride{{Patterns: []string{"*.log"}, Compression: "brotli"}}}}
+	backupRunner := s3backup.New(cfg, new(s3api.FakeS3API), models.BackupDirectory{Path: t.TempDir()}, &l)
+	if backupErr := backupRunner.BackupDirectory(context.Background()); backupErr == nil {
+		t.Fatalf("expected BackupDirectory() to reject an unsupported compression")
+	}
+}
+
+func TestBackupDirectoryLinksAndDirectories(t *testing.T) {
+	tmpDir := t.TempDir()
+	outside := t.TempDir()
+	mustDo := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("unable to create test tree: %v", err)
+		}
+	}
+	mustDo(os.WriteFile(filepath.Join(tmpDir, "a.txt"), []byte("hello"), 0o600))
+	mustDo(os.Link(filepath.Join(tmpDir, "a.txt"), filepath.Join(tmpDir, "b.txt")))
+	mustDo(os.Symlink("a.txt", filepath.Join(tmpDir, "c.txt")))
+	mustDo(os.Mkdir(filepath.Join(tmpDir, "empty"), 0o700))
+	mustDo(os.WriteFile(filepath.Join(outside, "inner.txt"), []byte("inner"), 0o600))
+	mustDo(os.Symlink(outside, filepath.Join(tmpDir, "linked")))
+	mustDo(os.Symlink(tmpDir, filepath.Join(tmpDir, "loop")))
+
+	root, keyErr := s3backup.ObjectKey(tmpDir)
+	if keyErr != nil {
+		t.Fatalf("ObjectKey() unexpected error: %v", keyErr)
+	}
+
+	tests := []struct {
+		mode string
+		want map[string]map[string]string
+	}{
+		{mode: s3backup.SymlinkModeSkip, want: map[string]map[string]string{
+			"/a.txt":  {},
+			"/b.txt":  {s3backup.MetadataHardLinkTarget: url.PathEscape(root + "/a.txt")},
+			"/empty/": {},
+		}},
+		{mode: s3backup.SymlinkModeStore, want: map[string]map[string]string{
+			"/a.txt":  {},
+			"/b.txt":  {s3backup.MetadataHardLinkTarget: url.PathEscape(root + "/a.txt")},
+			"/c.txt":  {s3backup.MetadataSymlinkTarget: "a.txt"},
+			"/empty/": {},
+			"/linked": {s3backup.MetadataSymlinkTarget: url.PathEscape(outside)},
+			"/loop":   {s3backup.MetadataSymlinkTarget: url.PathEscape(tmpDir)},
+		}},
+		{mode: s3backup.SymlinkModeFollow, want: map[string]map[string]string{
+			"/a.txt":            {},
+			"/b.txt":            {s3backup.MetadataHardLinkTarget: url.PathEscape(root + "/a.txt")},
+			"/c.txt":            {},
+			"/empty/":           {},
+			"/linked/inner.txt": {},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			cfg = models.Config{AWS: models.AWS{S3Bucket: "testbucket", SymlinkMode: tt.mode}}
+			fakes3api = new(s3api.FakeS3API)
+			fakes3api.HeadObjectReturns(nil, &s3types.NotFound{})
+
+			backupRunner := s3backup.New(cfg, fakes3api, models.BackupDirectory{Path: tmpDir}, &l)
+			if backupErr := backupRunner.BackupDirectory(context.Background()); backupErr != nil {
+				t.Fatalf("BackupDirectory() returned unexpected error: %v", backupErr)
+			}
+
+			got := make(map[string]*s3.PutObjectInput)
+			for _, input := range fakes3api.PutObjectInputs() {
+				got[strings.TrimPrefix(aws.ToString(input.Key), root)] = input
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("uploaded %d objects, want %d: %v", len(got), len(tt.want), slices.Collect(maps.Keys(got)))
+			}
+			for key, metadata := range tt.want {
+				input, ok := got[key]
+				if !ok {
+					t.Fatalf("expected %s to be uploaded", key)
+				}
+				for name, value := range metadata {
+					if input.Metadata[name] != value {
+						t.Fatalf("%s metadata %s = %q, want %q", key, name, input.Metadata[name], value)
+					}
+				}
+			}
+			if got := aws.ToString(got["/empty/"].ContentType); got != s3backup.DirectoryContentType {
+				t.Fatalf("directory marker content type = %q, want %q", got, s3backup.DirectoryContentType)
+			}
+		})
+	}
+}
+
+func TestBackupFile(t *testing.T) {
+	tmpDir := t.TempDir()
+	files := map[string]string{
+		"docs/a.txt":                "a",
+		"docs/b.txt":                "b",
+		"build/out.txt":             "out",
+		"docs/tmp/scratch.txt":      "scratch",
+		"docs/" + ".s3backupignore": "tmp/\n",
+	}
+	for name, content := range files {
+		full := filepath.Join(tmpDir, name)
+		if mkdirErr := os.MkdirAll(filepath.Dir(full), 0o755); mkdirErr != nil {
+			t.Fatalf("unable to create directory: %v", mkdirErr)
+		}
+		if writeErr := os.WriteFile(full, []byte(content), 0o600); writeErr != nil {
+			t.Fatalf("unable to create temp file: %v", writeErr)
+		}
+	}
+
+	cfg = models.Config{AWS: models.AWS{S3Bucket: "testbucket"}}
+	dir := models.BackupDirectory{Path: tmpDir, Exclude: []string{"build/"}}
+
+	tests := []struct {
+		name     string
+		path     string
+		wantKeys []string
+		wantErr  bool
+	}{
+		{name: "file", path: "docs/a.txt", wantKeys: []string{"docs/a.txt"}},
+		{name: "directory", path: "docs", wantKeys: []string{"docs/.s3backupignore", "docs/a.txt", "docs/b.txt"}},
+		{name: "excluded ancestor", path: "build/out.txt"},
+		{name: "ignore file of ancestor", path: "docs/tmp/scratch.txt"},
+		{name: "outside directory", path: "..", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakes3api = new(s3api.FakeS3API)
+			backupRunner := s3backup.New(cfg, fakes3api, dir, &l)
+
+			backupErr := backupRunner.BackupFile(context.Background(), filepath.Join(tmpDir, tt.path))
+			if (backupErr != nil) != tt.wantErr {
+				t.Fatalf("BackupFile() error = %v, wantErr %v", backupErr, tt.wantErr)
+			}
+
+			var gotKeys []string
+			for _, input := range fakes3api.PutObjectInputs() {
+				gotKeys = append(gotKeys, aws.ToString(input.Key))
+			}
+			slices.Sort(gotKeys)
+			var wantKeys []string
+			for _, name := range tt.wantKeys {
+				key, _ := s3backup.ObjectKey(filepath.Join(tmpDir, name))
+				wantKeys = append(wantKeys, key)
+			}
+			if !slices.Equal(gotKeys, wantKeys) {
+				t.Fatalf("uploaded keys = %v, want %v", gotKeys, wantKeys)
+			}
+		})
+	}
+}
+
+func TestVerifyDirectory(t *testing.T) {
+	tmpDir := t.TempDir()
+	for _, name := range []string{"a.txt", "b.txt"} {
+		if writeErr := os.WriteFile(filepath.Join(tmpDir, name), []byte(name), 0o600); writeErr != nil {
+			t.Fatalf("unable to create temp file: %v", writeErr)
+		}
+	}
+	future := time.Now().Add(time.Hour)
+	past := time.Now().Add(-time.Hour)
+
+	tests := []struct {
+		name    string
+		head    *s3.HeadObjectOutput
+		headErr error
+		wantErr bool
+	}{
+		{name: "current", head: &s3.HeadObjectOutput{LastModified: &future}},
+		{name: "outdated", head: &s3.HeadObjectOutput{LastModified: &past}, wantErr: true},
+		{name: "missing", headErr: &s3types.NotFound{}, wantErr: true},
+		{name: "head fails", headErr: errors.New("access denied"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg = models.Config{AWS: models.AWS{S3Bucket: "testbucket"}}
+			fakes3api = new(s3api.FakeS3API)
+			fakes3api.HeadObjectReturns(tt.head, tt.headErr)
+
+			backupRunner := s3backup.New(cfg, fakes3api, models.BackupDirectory{Path: tmpDir}, &l)
+			verifyErr := backupRunner.VerifyDirectory(context.Background())
+			if (verifyErr != nil) != tt.wantErr {
+				t.Fatalf("VerifyDirectory() error = %v, wantErr %v", verifyErr, tt.wantErr)
+			}
+			if got := fakes3api.HeadObjectCallCount(); got != 2 {
+				t.Fatalf("expected both files to be checked, got %d HeadObject calls", got)
+			}
+			if fakes3api.PutObjectCallCount() != 0 {
+				t.Fatalf("expected VerifyDirectory not to upload anything")
+			}
+		})
+	}
+}
+
+// bucketS3API answers HeadObject from the objects written with PutObject, so
+// a backup can be verified against what it actually stored.
+type bucketS3API struct {
+	*s3api.FakeS3API
+	mu      sync.Mutex
+	objects map[string]*s3.PutObjectInput
+}
+
+func newBucketS3API() *bucketS3API {
+	return &bucketS3API{FakeS3API: new(s3api.FakeS3API), objects: make(map[string]*s3.PutObjectInput)}
+}
+
+func (f *bucketS3API) PutObject(ctx context.Context, in *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	f.mu.Lock()
+	f.objects[aws.ToString(in.Key)] = in
+	f.mu.Unlock()
+	return f.FakeS3API.PutObject(ctx, in, optFns...)
+}
+
+func (f *bucketS3API) HeadObject(ctx context.Context, in *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	_, _ = f.FakeS3API.HeadObject(ctx, in, optFns...)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	stored, ok := f.objects[aws.ToString(in.Key)]
+	if !ok {
+		return nil, &s3types.NotFound{}
+	}
+	now := time.Now()
+	return &s3.HeadObjectOutput{LastModified: &now, Metadata: stored.Metadata}, nil
+}
+
+func TestVerifyDirectoryEncrypted(t *testing.T) {
+	tmpDir := t.TempDir()
+	if writeErr := os.WriteFile(filepath.Join(tmpDir, "secret.txt"), []byte("hello"), 0o600); writeErr != nil {
+		t.Fatalf("unable to create temp file: %v", writeErr)
+	}
+	keyFile := filepath.Join(t.TempDir(), "backup.key")
+	if writeErr := os.WriteFile(keyFile, []byte(strings.Repeat("k", 32)), 0o600); writeErr != nil {
+		t.Fatalf("unable to create key file: %v", writeErr)
+	}
+
+	tests := []struct {
+		name string
+		aws  models.AWS
+	}{
+		{name: "snapshot", aws: models.AWS{BackupMode: s3backup.BackupModeSnapshot}},
+		{name: "sha256", aws: models.AWS{ChangeDetection: s3backup.ChangeDetectionSHA256}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.aws.S3Bucket = "testbucket"
+			tt.aws.EncryptionKeyFile = keyFile
+			cfg = models.Config{AWS: tt.aws}
+			cipher, cipherErr := s3crypt.New(cfg)
+			if cipherErr != nil {
+				t.Fatalf("s3crypt.New() unexpected error: %v", cipherErr)
+			}
+			fake := newBucketS3API()
+
+			backupRunner := s3backup.New(cfg, fake, models.BackupDirectory{Path: tmpDir}, &l)
+			_ = backupRunner.SetCipher(cipher)
+			if tt.aws.BackupMode == s3backup.BackupModeSnapshot {
+				snap := s3snapshot.New(cfg, fake, &l)
+				_ = snap.SetCipher(cipher)
+				_ = backupRunner.SetSnapshot(snap)
+			}
+			if backupErr := backupRunner.BackupDirectory(context.Background()); backupErr != nil {
+				t.Fatalf("BackupDirectory() returned unexpected error: %v", backupErr)
+			}
+			uploaded := fake.PutObjectCallCount()
+
+			verifier := s3backup.New(cfg, fake, models.BackupDirectory{Path: tmpDir}, &l)
+			_ = verifier.SetCipher(cipher)
+			if verifyErr := verifier.VerifyDirectory(context.Background()); verifyErr != nil {
+				t.Fatalf("VerifyDirectory() returned unexpected error: %v", verifyErr)
+			}
+			if fake.PutObjectCallCount() != uploaded {
+				t.Fatalf("expected VerifyDirectory not to upload anything")
+			}
+		})
+	}
 }
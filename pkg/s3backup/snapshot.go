@@ -0,0 +1,178 @@
+package s3backup
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/jaysonhurd/s3backup/pkg/s3index"
+	"github.com/jaysonhurd/s3backup/pkg/s3snapshot"
+)
+
+const (
+	msgInvalidBackupMode    = "invalid backup mode in configuration"
+	msgUnsupportedMode      = "unsupported backup mode"
+	msgNoSnapshot           = "snapshot backup mode requires a snapshot to record files in"
+	msgSnapshotHashError    = "error hashing file for snapshot"
+	msgSharedContent        = "file contents are already stored, adding to snapshot without uploading"
+	msgContentLookupError   = "error checking for stored file contents"
+	msgBackingUpFileContent = "uploading file contents for snapshot"
+)
+
+// Backup modes for AWS.BackupMode. An empty value behaves like BackupModeMirror.
+const (
+	BackupModeMirror   = "mirror"
+	BackupModeSnapshot = "snapshot"
+)
+
+// snapshotIndexPrefix namespaces the index entries of files backed up in
+// snapshot mode. Bucket keys never start with it.
+const snapshotIndexPrefix = "snapshot:"
+
+var (
+	errUnsupportedMode = errors.New(msgUnsupportedMode)
+	errNoSnapshot      = errors.New(msgNoSnapshot)
+)
+
+func validateBackupMode(mode string) error {
+	switch mode {
+	case "", BackupModeMirror, BackupModeSnapshot:
+		return nil
+	}
+	return errUnsupportedMode
+}
+
+// SetSnapshot sets the snapshot that files are recorded in when AWS.BackupMode
+// is snapshot.
+func (b *s3backup) SetSnapshot(snap s3snapshot.Snapshotter) (err error) {
+	b.snap = snap
+	return nil
+}
+
+// snapshotFile stores the file's contents under their SHA-256, or an HMAC of
+// it when encrypting, uploading them only if no earlier snapshot already did,
+// and adds the file to the snapshot.
+func (b *s3backup) snapshotFile(ctx context.Context, path string, key string, fileInfo fs.FileInfo) {
+	sum, err := b.snapshotHash(key, path, fileInfo)
+	if err != nil {
+		b.l.Error().Err(err).Str("path", path).Msg(msgSnapshotHashError)
+		b.summary.fail(path)
+		return
+	}
+	contentKey, err := b.contentKey(sum)
+	if err != nil {
+		b.l.Error().Err(err).Str("path", path).Msg(msgSnapshotHashError)
+		b.summary.fail(path)
+		return
+	}
+	metadata := map[string]string{MetadataSHA256: sum}
+	// An encrypted content object must not give away the hash its key hides.
+	uploadMetadata := metadata
+	if b.c != nil {
+		uploadMetadata = map[string]string{}
+	}
+
+	stored, err := b.contentStored(ctx, contentKey)
+	if ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		b.l.Error().Err(err).Str("path", path).Str("s3_key", contentKey).Msg(msgContentLookupError)
+		b.summary.fail(path)
+		return
+	}
+
+	switch {
+	case stored:
+		b.l.Info().Str("path", path).Str("s3_key", contentKey).Msg(msgSharedContent)
+		b.summary.skipped.Add(1)
+	case b.cfg.DryRun:
+		b.l.Info().Bool("dry_run", true).Str("path", path).Str("s3_key", contentKey).Int64("size", fileInfo.Size()).Msg(msgDryRunUpload)
+		b.summary.uploaded(fileInfo.Size())
+	default:
+		b.l.Info().Str("path", path).Str("s3_key", contentKey).Str("storage_class", b.cfg.AWS.StorageClass).Msg(msgBackingUpFileContent)
+		etag, err := b.uploadFileToS3(ctx, path, contentKey, uploadMetadata)
+		if err != nil && ctx.Err() != nil {
+			b.l.Warn().Err(err).Str("path", path).Msg(msgUploadInterrupted)
+			return
+		}
+		if err != nil {
+			b.l.Error().Err(err).Str("path", path).Msg(msgUploadToS3Error)
+			b.summary.fail(path)
+			return
+		}
+		b.summary.uploaded(fileInfo.Size())
+		if b.idx != nil {
+			b.idx.Record(s3index.Entry{Key: contentKey, Size: fileInfo.Size(), ETag: etag, SHA256: sum})
+		}
+	}
+
+	if !b.cfg.DryRun {
+		b.recordIndex(b.indexKey(key), fileInfo, "", metadata)
+	}
+	// The content object may be shared with other files, so each file's own
+	// attributes are kept in the manifest instead of on the object.
+	attributes := b.fileMetadata(path, fileInfo)
+	delete(attributes, MetadataMtime)
+	b.snap.Add(s3snapshot.Entry{
+		Path:       key,
+		Size:       fileInfo.Size(),
+		Mtime:      fileInfo.ModTime(),
+		Mode:       fileInfo.Mode(),
+		SHA256:     sum,
+		Key:        contentKey,
+		Attributes: attributes,
+	})
+}
+
+// contentKey returns the key of the content object for a file with the given
+// SHA-256, named by the cipher when encrypting.
+func (b *s3backup) contentKey(sum string) (string, error) {
+	id, err := b.storedHash(sum)
+	if err != nil {
+		return "", err
+	}
+	return s3snapshot.ContentKey(id), nil
+}
+
+// indexKey returns the key a file is recorded under in the local state index.
+// Snapshot mode records files that were never uploaded to their own keys, so
+// it keeps them apart from the keys mirror mode looks up.
+func (b *s3backup) indexKey(key string) string {
+	if b.cfg.AWS.BackupMode == BackupModeSnapshot {
+		return snapshotIndexPrefix + key
+	}
+	return key
+}
+
+// snapshotHash returns the file's SHA-256. The hash recorded in the local
+// state index is reused when the file's size and mtime have not changed, so
+// unchanged files are not read again.
+func (b *s3backup) snapshotHash(key string, path string, fileInfo fs.FileInfo) (string, error) {
+	if b.idx != nil {
+		entry, ok := b.idx.Lookup(b.indexKey(key))
+		if ok && entry.SHA256 != "" && entry.Size == fileInfo.Size() && entry.Mtime.Equal(fileInfo.ModTime()) {
+			return entry.SHA256, nil
+		}
+	}
+	return fileSHA256(path)
+}
+
+// contentStored reports whether an object with these contents is already in
+// the bucket, asking the local state index before S3.
+func (b *s3backup) contentStored(ctx context.Context, contentKey string) (bool, error) {
+	if b.idx != nil {
+		if _, ok := b.idx.Lookup(contentKey); ok {
+			return true, nil
+		}
+	}
+	head, err := b.s3ObjectHead(ctx, contentKey)
+	if err != nil {
+		return false, err
+	}
+	if head != nil && b.idx != nil && !b.cfg.DryRun {
+		b.idx.Record(s3index.Entry{Key: contentKey, Size: storedSize(head), ETag: aws.ToString(head.ETag), SHA256: head.Metadata[MetadataSHA256]})
+	}
+	return head != nil, nil
+}
@@ -0,0 +1,192 @@
+package s3backup
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	msgVerifyMissing  = "path is missing from the bucket"
+	msgVerifyOutdated = "object in the bucket is out of date"
+	msgVerifyError    = "unable to verify path"
+	msgVerifySummary  = "verification of directory complete"
+	msgVerifyFailed   = "backup of directory is incomplete or out of date"
+)
+
+var errVerifyFailed = errors.New(msgVerifyFailed)
+
+// verifyResult is what verification found for one path.
+type verifyResult int
+
+const (
+	verifyCurrent verifyResult = iota
+	verifyMissing
+	verifyOutdated
+)
+
+// verifySummary counts what a VerifyDirectory run found. It is updated
+// concurrently by the workers.
+type verifySummary struct {
+	current  atomic.Int64
+	missing  atomic.Int64
+	outdated atomic.Int64
+	failed   atomic.Int64
+}
+
+// VerifyDirectory checks, without uploading anything, that every path a
+// backup would store is in the bucket and up to date according to
+// ChangeDetection. The local state index is not consulted, so this also
+// catches objects that were removed from the bucket behind its back. In
+// snapshot mode it checks that the contents of every file are stored. An
+// error is returned if anything is missing, out of date or could not be
+// checked, or ctx.Err() if ctx is done before every path was checked.
+func (b *s3backup) VerifyDirectory(ctx context.Context) (err error) {
+	if err = b.validateOptions(); err != nil {
+		return err
+	}
+
+	var (
+		summary verifySummary
+		entries = make(chan walkEntry)
+		wg      sync.WaitGroup
+	)
+
+	for range b.workers() {
+		wg.Go(func() {
+			for entry := range entries {
+				b.verifyEntry(ctx, entry, &summary)
+			}
+		})
+	}
+
+	w := b.newWalker(ctx, func(entry walkEntry) { entries <- entry })
+	err = filepath.WalkDir(b.dir.Path, w.visit)
+
+	close(entries)
+	wg.Wait()
+
+	interrupted := ctx.Err() != nil
+	if err != nil && !interrupted {
+		b.l.Error().Err(err).Str("root_dir", b.dir.Path).Msg(msgWalkRootPathError)
+		return err
+	}
+
+	b.l.Info().
+		Str("root_dir", b.dir.Path).
+		Bool("interrupted", interrupted).
+		Int64("paths_current", summary.current.Load()).
+		Int64("paths_missing", summary.missing.Load()).
+		Int64("paths_outdated", summary.outdated.Load()).
+		Int64("paths_failed", summary.failed.Load()).
+		Msg(msgVerifySummary)
+
+	if interrupted {
+		return ctx.Err()
+	}
+
+	if summary.missing.Load()+summary.outdated.Load()+summary.failed.Load() > 0 {
+		b.l.Error().Err(errVerifyFailed).Str("root_dir", b.dir.Path).Msg(msgVerifyFailed)
+		return errVerifyFailed
+	}
+	return nil
+}
+
+// verifyEntry checks one path found by the walk and counts the result.
+func (b *s3backup) verifyEntry(ctx context.Context, entry walkEntry, summary *verifySummary) {
+	if ctx.Err() != nil {
+		return
+	}
+	if entry.kind == entryUnreadable {
+		summary.failed.Add(1)
+		return
+	}
+	key, result, err := b.checkEntry(ctx, entry)
+	switch {
+	case ctx.Err() != nil:
+		// A check cut short by cancellation is not counted.
+	case err != nil:
+		b.l.Error().Err(err).Str("path", entry.path).Msg(msgVerifyError)
+		summary.failed.Add(1)
+	case result == verifyMissing:
+		b.l.Warn().Str("path", entry.path).Str("s3_key", key).Msg(msgVerifyMissing)
+		summary.missing.Add(1)
+	case result == verifyOutdated:
+		b.l.Warn().Str("path", entry.path).Str("s3_key", key).Msg(msgVerifyOutdated)
+		summary.outdated.Add(1)
+	default:
+		summary.current.Add(1)
+	}
+}
+
+// checkEntry compares one path with the object that stands for it and
+// returns that object's key.
+func (b *s3backup) checkEntry(ctx context.Context, entry walkEntry) (string, verifyResult, error) {
+	if entry.kind != entryFile {
+		// In snapshot mode only manifests record links and directories.
+		if b.cfg.AWS.BackupMode == BackupModeSnapshot {
+			return "", verifyCurrent, nil
+		}
+		key, metadata, err := b.markerMetadata(entry)
+		if err != nil {
+			return "", verifyCurrent, err
+		}
+		head, err := b.s3ObjectHead(ctx, key)
+		switch {
+		case err != nil:
+			return key, verifyCurrent, err
+		case head == nil:
+			return key, verifyMissing, nil
+		case head.Metadata[MetadataSymlinkTarget] != metadata[MetadataSymlinkTarget] ||
+			head.Metadata[MetadataHardLinkTarget] != metadata[MetadataHardLinkTarget]:
+			return key, verifyOutdated, nil
+		}
+		return key, verifyCurrent, nil
+	}
+
+	fileInfo, err := b.localFileInfo(entry.path)
+	if err != nil {
+		return "", verifyCurrent, err
+	}
+
+	if b.cfg.AWS.BackupMode == BackupModeSnapshot {
+		sum, err := fileSHA256(entry.path)
+		if err != nil {
+			return "", verifyCurrent, err
+		}
+		key, err := b.contentKey(sum)
+		if err != nil {
+			return "", verifyCurrent, err
+		}
+		head, err := b.s3ObjectHead(ctx, key)
+		if err != nil {
+			return key, verifyCurrent, err
+		}
+		if head == nil {
+			return key, verifyMissing, nil
+		}
+		return key, verifyCurrent, nil
+	}
+
+	key, err := ObjectKey(entry.path)
+	if err != nil {
+		return "", verifyCurrent, err
+	}
+	head, err := b.s3ObjectHead(ctx, key)
+	if err != nil {
+		return key, verifyCurrent, err
+	}
+	if head == nil {
+		return key, verifyMissing, nil
+	}
+	changed, err := b.fileChanged(entry.path, fileInfo, head, make(map[string]string))
+	if err != nil {
+		return key, verifyCurrent, err
+	}
+	if changed {
+		return key, verifyOutdated, nil
+	}
+	return key, verifyCurrent, nil
+}
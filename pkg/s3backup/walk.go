@@ -0,0 +1,265 @@
+package s3backup
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jaysonhurd/s3backup/pkg/fileattr"
+	"github.com/jaysonhurd/s3backup/pkg/pathfilter"
+)
+
+const (
+	msgSkipSymlink        = "skipping symbolic link"
+	msgDanglingSymlink    = "skipping symbolic link whose target does not exist"
+	msgSymlinkLoop        = "not following symbolic link to a directory that is already being walked"
+	msgFollowSymlink      = "following symbolic link to directory"
+	msgHardLinkReference  = "file is a hard link to a file already backed up, storing a reference"
+	msgReadDirectoryError = "unable to check whether directory is empty"
+)
+
+const currentDirectory = "."
+
+// entryKind says how a walked path is stored. entryUnreadable marks a path
+// the walk could not read, which is counted as failed.
+type entryKind int
+
+const (
+	entryFile entryKind = iota
+	entryDirectory
+	entrySymlink
+	entryHardLink
+	entryUnreadable
+)
+
+// walkEntry is one path found by the walk. For entryHardLink, target is the
+// key of the first path found for the same inode.
+type walkEntry struct {
+	path   string
+	kind   entryKind
+	target string
+}
+
+// walker walks a backup directory and hands every path to be backed up to
+// emit. It runs in a single goroutine, so the first path found for a
+// hard-linked inode is always the same one.
+type walker struct {
+	ctx    context.Context
+	b      *s3backup
+	filter pathfilter.Matcher
+	emit   func(entry walkEntry)
+
+	// following holds the resolved targets of the directory symlinks being
+	// walked in SymlinkModeFollow, links the key of the first path seen for
+	// every hard-linked inode.
+	following map[string]bool
+	links     map[fileattr.LinkID]string
+}
+
+// newWalker returns a walker that stops once ctx is done.
+func (b *s3backup) newWalker(ctx context.Context, emit func(entry walkEntry)) *walker {
+	return &walker{
+		ctx:       ctx,
+		b:         b,
+		filter:    pathfilter.New(b.dir.Include, b.dir.Exclude),
+		emit:      emit,
+		following: make(map[string]bool),
+		links:     make(map[fileattr.LinkID]string),
+	}
+}
+
+// excludedAncestor loads the ignore files of every directory above rel, as a
+// walk from the backup directory would have, and reports whether one of those
+// directories is excluded.
+func (w *walker) excludedAncestor(rel string) bool {
+	if rel == currentDirectory {
+		return false
+	}
+	dir, parent := w.b.dir.Path, filepath.Dir(rel)
+	if err := w.filter.LoadIgnoreFile(dir, currentDirectory); err != nil {
+		w.b.l.Warn().Err(err).Str("path", dir).Msg(msgLoadIgnoreFileError)
+	}
+	if parent == currentDirectory {
+		return false
+	}
+	var sub string
+	for _, name := range strings.Split(parent, string(filepath.Separator)) {
+		sub = filepath.Join(sub, name)
+		dir = filepath.Join(dir, name)
+		if w.filter.Excluded(filepath.ToSlash(sub), true) {
+			return true
+		}
+		if err := w.filter.LoadIgnoreFile(dir, sub); err != nil {
+			w.b.l.Warn().Err(err).Str("path", dir).Msg(msgLoadIgnoreFileError)
+		}
+	}
+	return false
+}
+
+func (w *walker) visit(path string, info fs.DirEntry, err error) error {
+	b := w.b
+
+	if ctxErr := w.ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	if err != nil {
+		b.l.Error().Err(err).Str("path", path).Msg(msgWalkFilesystemError)
+		// Only a root that cannot be read stops the walk. Anything below it
+		// is reported as failed and the walk goes on.
+		if info == nil {
+			return err
+		}
+		w.emit(walkEntry{path: path, kind: entryUnreadable})
+		return nil
+	}
+
+	rel, err := filepath.Rel(b.dir.Path, path)
+	if err != nil {
+		return err
+	}
+	rel = filepath.ToSlash(rel)
+
+	if info.IsDir() {
+		if rel != "." && w.filter.Excluded(rel, true) {
+			b.l.Debug().Str("path", path).Msg(msgSkipExcludedDirectory)
+			return fs.SkipDir
+		}
+		if err = w.filter.LoadIgnoreFile(path, rel); err != nil {
+			b.l.Warn().Err(err).Str("path", path).Msg(msgLoadIgnoreFileError)
+		}
+		if w.emptyDirectory(path) && (rel == "." || w.filter.Included(rel)) {
+			w.emit(walkEntry{path: path, kind: entryDirectory})
+		}
+		b.l.Debug().Str("path", path).Msg(msgSkipDirectory)
+		return nil
+	}
+
+	if w.filter.Excluded(rel, false) || !w.filter.Included(rel) {
+		b.l.Debug().Str("path", path).Msg(msgSkipExcludedFile)
+		return nil
+	}
+
+	if info.Type()&fs.ModeSymlink != 0 {
+		switch b.cfg.AWS.SymlinkMode {
+		case SymlinkModeStore:
+			w.emit(walkEntry{path: path, kind: entrySymlink})
+		case SymlinkModeFollow:
+			return w.follow(path)
+		default:
+			b.l.Debug().Str("path", path).Msg(msgSkipSymlink)
+		}
+		return nil
+	}
+
+	if !info.Type().IsRegular() {
+		b.l.Debug().Str("path", path).Msg(msgSkipNonRegularFile)
+		return nil
+	}
+
+	w.emit(w.fileEntry(path, info))
+	return nil
+}
+
+// fileEntry returns the entry for a regular file. In mirror mode every
+// further path to an inode that was already seen becomes a reference to the
+// first one, unless that path has since been removed or replaced; in snapshot
+// mode identical contents are shared anyway.
+func (w *walker) fileEntry(path string, info fs.DirEntry) walkEntry {
+	entry := walkEntry{path: path, kind: entryFile}
+	if w.b.cfg.AWS.BackupMode == BackupModeSnapshot {
+		return entry
+	}
+	fileInfo, err := info.Info()
+	if err != nil {
+		return entry
+	}
+	id, ok := fileattr.HardLinkID(fileInfo)
+	if !ok {
+		return entry
+	}
+	key, err := ObjectKey(path)
+	if err != nil {
+		return entry
+	}
+	if first, seen := w.links[id]; seen && first != key && sameInode(first, id) {
+		w.b.l.Debug().Str("path", path).Str("target", first).Msg(msgHardLinkReference)
+		return walkEntry{path: path, kind: entryHardLink, target: first}
+	}
+	w.links[id] = key
+	return entry
+}
+
+// sameInode reports whether the path stored under key is still a hard link to
+// the inode id.
+func sameInode(key string, id fileattr.LinkID) bool {
+	info, err := os.Stat(LocalPath(key))
+	if err != nil {
+		return false
+	}
+	current, ok := fileattr.HardLinkID(info)
+	return ok && current == id
+}
+
+// follow backs up what a symbolic link points to under the link's own path.
+// Links to directories are walked unless that would loop, i.e. the target is
+// already being walked or contains the link.
+func (w *walker) follow(path string) error {
+	b := w.b
+
+	target, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		b.l.Warn().Err(err).Str("path", path).Msg(msgDanglingSymlink)
+		return nil
+	}
+	targetInfo, err := os.Stat(target)
+	if err != nil {
+		b.l.Warn().Err(err).Str("path", path).Msg(msgDanglingSymlink)
+		return nil
+	}
+	if targetInfo.Mode().IsRegular() {
+		w.emit(walkEntry{path: path, kind: entryFile})
+		return nil
+	}
+	if !targetInfo.IsDir() {
+		b.l.Debug().Str("path", path).Msg(msgSkipNonRegularFile)
+		return nil
+	}
+
+	parent, err := filepath.EvalSymlinks(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	if w.following[target] || parent == target || strings.HasPrefix(parent, target+string(filepath.Separator)) {
+		b.l.Warn().Str("path", path).Str("target", target).Msg(msgSymlinkLoop)
+		return nil
+	}
+
+	b.l.Debug().Str("path", path).Str("target", target).Msg(msgFollowSymlink)
+	w.following[target] = true
+	defer delete(w.following, target)
+
+	// Paths under the target are reported under the link so that they are
+	// stored where they appear in the backed-up tree.
+	return filepath.WalkDir(target, func(p string, info fs.DirEntry, err error) error {
+		rel, relErr := filepath.Rel(target, p)
+		if relErr != nil {
+			return relErr
+		}
+		return w.visit(filepath.Join(path, rel), info, err)
+	})
+}
+
+// emptyDirectory reports whether the directory has no entries at all. An
+// empty directory is stored as a marker object so that it is restored.
+func (w *walker) emptyDirectory(path string) bool {
+	dir, err := os.Open(path)
+	if err != nil {
+		w.b.l.Warn().Err(err).Str("path", path).Msg(msgReadDirectoryError)
+		return false
+	}
+	defer dir.Close()
+	names, _ := dir.Readdirnames(1)
+	return len(names) == 0
+}
@@ -0,0 +1,78 @@
+package s3clean
+
+import (
+	"errors"
+	"os"
+)
+
+const (
+	msgBackupRootMissing  = "backup directory is missing or unreadable, refusing to sync (use -force to override)"
+	msgBackupRootEmpty    = "backup directory is empty, refusing to sync (use -force to override)"
+	msgMassDeletion       = "sync would delete more objects than allowed, refusing to sync (use -force to override)"
+	msgSafetyCheckSkipped = "sync safety checks overridden with -force"
+)
+
+var (
+	errBackupRootMissing = errors.New(msgBackupRootMissing)
+	errBackupRootEmpty   = errors.New(msgBackupRootEmpty)
+	errMassDeletion      = errors.New(msgMassDeletion)
+)
+
+// checkBackupRoots makes sure every configured backup directory exists and
+// has something in it. An unmounted disk or a mistyped path would otherwise
+// make every object under it look stale.
+func (s *s3clean) checkBackupRoots() error {
+	for _, dir := range s.cfg.AWS.BackupDirectories {
+		entries, err := os.ReadDir(dir.Path)
+		switch {
+		case err != nil && s.cfg.Force:
+			s.l.Warn().Err(err).Str("root_dir", dir.Path).Msg(msgSafetyCheckSkipped)
+		case err != nil:
+			s.l.Error().Err(err).Str("root_dir", dir.Path).Msg(msgBackupRootMissing)
+			return errBackupRootMissing
+		case len(entries) == 0 && s.cfg.Force:
+			s.l.Warn().Str("root_dir", dir.Path).Msg(msgSafetyCheckSkipped)
+		case len(entries) == 0:
+			s.l.Error().Str("root_dir", dir.Path).Msg(msgBackupRootEmpty)
+			return errBackupRootEmpty
+		}
+	}
+	return nil
+}
+
+// checkDeletionThreshold aborts a sync whose planned deletions exceed either
+// SyncMaxDeleteCount or SyncMaxDeletePercent of the objects listed. A zero
+// limit is not enforced.
+func (s *s3clean) checkDeletionThreshold(planned int, listed int) error {
+	var (
+		maxCount   = s.cfg.AWS.SyncMaxDeleteCount
+		maxPercent = s.cfg.AWS.SyncMaxDeletePercent
+		percent    float64
+	)
+	if listed > 0 {
+		percent = float64(planned) / float64(listed) * 100
+	}
+
+	exceeded := (maxCount > 0 && planned > maxCount) || (maxPercent > 0 && percent > maxPercent)
+	if !exceeded {
+		return nil
+	}
+
+	event := s.l.Error()
+	if s.cfg.Force {
+		event = s.l.Warn()
+	}
+	event.
+		Int("planned_deletions", planned).
+		Int("objects_listed", listed).
+		Float64("planned_percent", percent).
+		Int("max_delete_count", maxCount).
+		Float64("max_delete_percent", maxPercent).
+		Msg(msgMassDeletion)
+
+	if s.cfg.Force {
+		s.l.Warn().Msg(msgSafetyCheckSkipped)
+		return nil
+	}
+	return errMassDeletion
+}
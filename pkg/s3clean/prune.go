@@ -0,0 +1,174 @@
+package s3clean
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const (
+	msgNoRetentionPolicy  = "no retention policy configured, refusing to prune (set at least one of KeepLast, KeepDaily, KeepWeekly, KeepMonthly or KeepYearly)"
+	msgListVersionsError  = "unable to list object versions"
+	msgPruneVersion       = "version is outside the retention policy, scheduling removal"
+	msgPruneSummary       = "prune of noncurrent versions complete"
+	msgDryRunPruneSummary = "dry run of version prune complete, nothing was deleted"
+)
+
+var errNoRetentionPolicy = errors.New(msgNoRetentionPolicy)
+
+// retentionPeriod buckets version times into one calendar period; a policy
+// keeps the newest version of each of the most recent periods.
+type retentionPeriod struct {
+	keep   int
+	bucket func(t time.Time) string
+}
+
+// PruneVersions applies the grandfather-father-son retention policy from the
+// config to every key under the configured backup directories. For each key
+// the current version and the KeepLast newest versions are kept, plus the
+// newest version of each of the last KeepDaily days, KeepWeekly weeks,
+// KeepMonthly months and KeepYearly years that have a version. Everything
+// else is deleted in DeleteObjects batches. Delete markers are left alone so
+// that deleted files stay deleted.
+func (s *s3clean) PruneVersions(ctx context.Context) (err error) {
+	periods := s.retentionPeriods()
+	if s.cfg.AWS.KeepLast < 1 && len(periods) == 0 {
+		s.l.Error().Err(errNoRetentionPolicy).Msg(msgNoRetentionPolicy)
+		return errNoRetentionPolicy
+	}
+
+	prefixes, err := s.syncPrefixes()
+	if err != nil {
+		return err
+	}
+
+	var (
+		expired []s3types.ObjectIdentifier
+		sizes   = make(map[string]int64)
+	)
+	for _, prefix := range outermostPrefixes(prefixes) {
+		err = s.listKeyVersions(ctx, prefix, func(versions []s3types.ObjectVersion) {
+			for _, version := range s.expiredVersions(versions, periods) {
+				s.l.Info().
+					Str("s3_key", aws.ToString(version.Key)).
+					Str("version_id", aws.ToString(version.VersionId)).
+					Time("last_modified", aws.ToTime(version.LastModified)).
+					Msg(msgPruneVersion)
+				expired = append(expired, s3types.ObjectIdentifier{Key: version.Key, VersionId: version.VersionId})
+				sizes[objectID(version.Key, version.VersionId)] = aws.ToInt64(version.Size)
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	deleted, err := s.deleteObjects(ctx, expired)
+	var reclaimed int64
+	for i := range deleted {
+		reclaimed += sizes[objectID(deleted[i].Key, deleted[i].VersionId)]
+	}
+
+	msg := msgPruneSummary
+	if s.cfg.DryRun {
+		msg = msgDryRunPruneSummary
+	}
+	s.l.Info().
+		Bool("dry_run", s.cfg.DryRun).
+		Str("bucket", s.cfg.AWS.S3Bucket).
+		Int("versions_deleted", len(deleted)).
+		Int64("bytes_reclaimed", reclaimed).
+		Msg(msg)
+	return err
+}
+
+func (s *s3clean) retentionPeriods() []retentionPeriod {
+	candidates := []retentionPeriod{
+		{keep: s.cfg.AWS.KeepDaily, bucket: func(t time.Time) string { return t.Format(time.DateOnly) }},
+		{keep: s.cfg.AWS.KeepWeekly, bucket: func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+		{keep: s.cfg.AWS.KeepMonthly, bucket: func(t time.Time) string { return t.Format("2006-01") }},
+		{keep: s.cfg.AWS.KeepYearly, bucket: func(t time.Time) string { return t.Format("2006") }},
+	}
+	periods := make([]retentionPeriod, 0, len(candidates))
+	for _, period := range candidates {
+		if period.keep > 0 {
+			periods = append(periods, period)
+		}
+	}
+	return periods
+}
+
+// expiredVersions returns the versions of a single key, given newest first,
+// that the policy does not keep.
+func (s *s3clean) expiredVersions(versions []s3types.ObjectVersion, periods []retentionPeriod) []s3types.ObjectVersion {
+	keep := make([]bool, len(versions))
+	for i := range versions {
+		if aws.ToBool(versions[i].IsLatest) || i < s.cfg.AWS.KeepLast {
+			keep[i] = true
+		}
+	}
+	for _, period := range periods {
+		kept, last := 0, ""
+		for i := range versions {
+			if kept == period.keep {
+				break
+			}
+			bucket := period.bucket(aws.ToTime(versions[i].LastModified).Local())
+			if bucket == last {
+				continue
+			}
+			last = bucket
+			keep[i] = true
+			kept++
+		}
+	}
+
+	var expired []s3types.ObjectVersion
+	for i := range versions {
+		if !keep[i] {
+			expired = append(expired, versions[i])
+		}
+	}
+	return expired
+}
+
+// listKeyVersions calls fn once per key under prefix with all of that key's
+// versions, newest first. S3 lists versions grouped by key, so a key's
+// versions are complete once the next key appears even across pages.
+func (s *s3clean) listKeyVersions(ctx context.Context, prefix string, fn func(versions []s3types.ObjectVersion)) error {
+	p := s3.NewListObjectVersionsPaginator(s.svc, &s3.ListObjectVersionsInput{
+		Bucket: aws.String(s.cfg.AWS.S3Bucket),
+		Prefix: aws.String(prefix),
+	})
+
+	var current []s3types.ObjectVersion
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			s.l.Error().Err(err).Str("bucket", s.cfg.AWS.S3Bucket).Str("prefix", prefix).Msg(msgListVersionsError)
+			return err
+		}
+		for _, version := range page.Versions {
+			if version.Key == nil {
+				continue
+			}
+			if len(current) > 0 && aws.ToString(current[0].Key) != *version.Key {
+				fn(current)
+				current = nil
+			}
+			current = append(current, version)
+		}
+	}
+	if len(current) > 0 {
+		fn(current)
+	}
+	return nil
+}
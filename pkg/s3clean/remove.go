@@ -0,0 +1,113 @@
+package s3clean
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/jaysonhurd/s3backup/pkg/s3backup"
+)
+
+const (
+	msgRemoveSummary       = "removal of deleted paths complete"
+	msgDryRunRemoveSummary = "dry run of removal of deleted paths complete, nothing was deleted"
+	msgRemovePathError     = "unable to determine S3 key for deleted path"
+	msgBackupRootRemoved   = "backup directory was removed, refusing to delete its objects"
+)
+
+var errBackupRootRemoved = errors.New(msgBackupRootRemoved)
+
+// RemovePaths removes the objects of local paths that no longer exist, the
+// way a sync would but without listing the whole bucket. A path that is a
+// directory removes everything under it. Paths that exist again by the time
+// they are looked at are left alone, and SyncMode decides whether objects are
+// moved to the trash or deleted. Only the backup directories holding a
+// removed path are listed, and the sync deletion limits are applied to what
+// was listed there. A removed backup directory itself is refused, as that is
+// more likely an unmounted disk than a deliberate deletion.
+func (s *s3clean) RemovePaths(ctx context.Context, paths []string) (err error) {
+	if err = validateSyncMode(s.cfg.AWS.SyncMode); err != nil {
+		s.l.Error().Err(err).Str("sync_mode", s.cfg.AWS.SyncMode).Msg(msgInvalidSyncMode)
+		return err
+	}
+
+	if err = s.checkBackupRoots(); err != nil {
+		return err
+	}
+
+	prefixes, err := s.syncPrefixes()
+	if err != nil {
+		return err
+	}
+
+	var keys []string
+	for _, path := range paths {
+		if _, statErr := os.Lstat(path); !errors.Is(statErr, fs.ErrNotExist) {
+			continue
+		}
+		key, keyErr := s3backup.ObjectKey(path)
+		if keyErr != nil {
+			s.l.Error().Err(keyErr).Str("local_path", path).Msg(msgRemovePathError)
+			return keyErr
+		}
+		key = strings.TrimSuffix(key, keyPathSeparator)
+		if slices.Contains(prefixes, key+keyPathSeparator) {
+			s.l.Error().Err(errBackupRootRemoved).Str("root_dir", path).Msg(msgBackupRootRemoved)
+			return errBackupRootRemoved
+		}
+		keys = append(keys, key)
+	}
+
+	var (
+		stale  []s3types.Object
+		listed int
+		seen   = make(map[string]bool)
+	)
+	for _, prefix := range prefixes {
+		if !slices.ContainsFunc(keys, func(key string) bool { return strings.HasPrefix(key, prefix) }) {
+			continue
+		}
+		err = s.listObjects(ctx, prefix, func(object s3types.Object) {
+			s3file := aws.ToString(object.Key)
+			// Nested backup directories list some objects twice
+			if seen[s3file] {
+				return
+			}
+			seen[s3file] = true
+			listed++
+			if !slices.ContainsFunc(keys, func(key string) bool {
+				return s3file == key || strings.HasPrefix(s3file, key+keyPathSeparator)
+			}) {
+				return
+			}
+			s.l.Info().Str("local_path", s3backup.LocalPath(s3file)).Str("s3_key", s3file).Msg(msgMissingLocalFile)
+			stale = append(stale, object)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if err = s.checkDeletionThreshold(len(stale), listed); err != nil {
+		return err
+	}
+
+	toDelete := make([]s3types.ObjectIdentifier, 0, len(stale))
+	for i := range stale {
+		toDelete = append(toDelete, s3types.ObjectIdentifier{Key: stale[i].Key})
+	}
+
+	var trashErr error
+	if s.cfg.AWS.SyncMode == SyncModeTrash {
+		toDelete, trashErr = s.moveToTrash(ctx, stale)
+	}
+
+	deleted, err := s.deleteObjects(ctx, toDelete)
+	s.logSummary(msgRemoveSummary, msgDryRunRemoveSummary, len(deleted))
+	return errors.Join(trashErr, err)
+}
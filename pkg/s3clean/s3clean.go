@@ -3,30 +3,56 @@ package s3clean
 import (
 	"context"
 	"errors"
+	"io"
+	"io/fs"
 	"os"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/aws/smithy-go"
 	"github.com/jaysonhurd/s3backup/models"
+	"github.com/jaysonhurd/s3backup/pkg/s3backup"
+	"github.com/jaysonhurd/s3backup/pkg/s3lock"
 	"github.com/rs/zerolog"
 )
 
 const (
 	msgListObjectsBucketError = "Unable to list objects in bucket"
 	msgDeleteObjectsBucketErr = "Unable to delete objects from bucket"
-	msgMissingLocalFile       = "local file does not exist, attempting S3 removal"
+	msgMissingLocalFile       = "local file does not exist, scheduling S3 removal"
+	msgDirectoryNotEmpty      = "local directory is no longer empty, scheduling removal of its marker"
 	msgUnableToRemoveS3File   = "unable to remove object from S3; continuing"
 	msgRemovedFromS3          = "removed object from S3"
-	msgDeleteObjectFailed     = "delete object failed"
 	msgNoSuchBucket           = "NoSuchBucket"
-	msgListObjectsFailed      = "list objects failed"
+	msgDeleteBatchIncomplete  = "one or more objects could not be deleted"
+	msgOrphanedKey            = "object is not under any configured backup directory, scheduling S3 removal"
+	msgSyncPrefixError        = "unable to determine S3 prefix for backup directory"
+	msgDryRunDelete           = "dry run: would delete object"
+	msgWipeSummary            = "wipe of bucket complete"
+	msgDryRunWipeSummary      = "dry run of bucket wipe complete, nothing was deleted"
+	msgSyncSummary            = "sync of bucket complete"
+	msgDryRunSyncSummary      = "dry run of bucket sync complete, nothing was deleted"
 )
 
+const (
+	// maxDeleteBatch is the most keys a single DeleteObjects request accepts.
+	maxDeleteBatch   = 1000
+	keyPathSeparator = "/"
+)
+
+var errDeleteBatchIncomplete = errors.New(msgDeleteBatchIncomplete)
+
 type S3Cleaner interface {
-	SyncS3Bucket() (err error)
-	WipeS3Bucket() (err error)
+	SyncS3Bucket(ctx context.Context) (err error)
+	WipeS3Bucket(ctx context.Context) (err error)
+	PurgeTrash(ctx context.Context, olderThan time.Duration) (err error)
+	PruneVersions(ctx context.Context) (err error)
+	AbortStaleUploads(ctx context.Context, olderThan time.Duration) (err error)
+	RemovePaths(ctx context.Context, paths []string) (err error)
 }
 
 type s3clean struct {
@@ -37,8 +63,16 @@ type s3clean struct {
 
 type S3API interface {
 	ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
-	DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error)
 	DeleteObjects(ctx context.Context, params *s3.DeleteObjectsInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error)
+	CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error)
+	HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+	CreateMultipartUpload(ctx context.Context, params *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error)
+	UploadPartCopy(ctx context.Context, params *s3.UploadPartCopyInput, optFns ...func(*s3.Options)) (*s3.UploadPartCopyOutput, error)
+	CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error)
+	AbortMultipartUpload(ctx context.Context, params *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error)
+	ListObjectVersions(ctx context.Context, params *s3.ListObjectVersionsInput, optFns ...func(*s3.Options)) (*s3.ListObjectVersionsOutput, error)
+	ListMultipartUploads(ctx context.Context, params *s3.ListMultipartUploadsInput, optFns ...func(*s3.Options)) (*s3.ListMultipartUploadsOutput, error)
+	ListParts(ctx context.Context, params *s3.ListPartsInput, optFns ...func(*s3.Options)) (*s3.ListPartsOutput, error)
 }
 
 func New(
@@ -54,115 +88,375 @@ func New(
 }
 
 // Wipes out the entire bucket.  This can be used by itself to empty a bucket
-// or before a backup if a clean start backup is required.
-func (s *s3clean) WipeS3Bucket() (err error) {
-	ctx := context.Background()
+// or before a backup if a clean start backup is required. With WipeAllVersions
+// every object version and delete marker is removed and incomplete multipart
+// uploads are aborted, so that a versioned bucket is really empty afterwards.
+// The lock object is left alone, since the run doing the wipe holds it.
+func (s *s3clean) WipeS3Bucket(ctx context.Context) (err error) {
+	if s.cfg.WipeAllVersions {
+		return s.wipeAllVersions(ctx)
+	}
+
+	lockKey := s3lock.Key(s.cfg)
+	deleted := 0
 	p := s3.NewListObjectsV2Paginator(s.svc, &s3.ListObjectsV2Input{Bucket: aws.String(s.cfg.AWS.S3Bucket)})
 
 	for p.HasMorePages() {
 		page, pageErr := p.NextPage(ctx)
 		if pageErr != nil {
-			s.l.Error().Err(pageErr).Str("bucket", s.cfg.AWS.S3Bucket).Msg(msgListObjectsBucketError)
+			s.logListError(pageErr)
 			return pageErr
 		}
 
-		if len(page.Contents) == 0 {
-			continue
-		}
-
 		objects := make([]s3types.ObjectIdentifier, 0, len(page.Contents))
 		for i := range page.Contents {
-			if page.Contents[i].Key == nil {
+			if page.Contents[i].Key == nil || *page.Contents[i].Key == lockKey {
 				continue
 			}
 			objects = append(objects, s3types.ObjectIdentifier{Key: page.Contents[i].Key})
 		}
 
-		if len(objects) == 0 {
-			continue
+		removed, deleteErr := s.deleteObjects(ctx, objects)
+		deleted += len(removed)
+		if deleteErr != nil {
+			return deleteErr
 		}
+	}
 
-		_, deleteErr := s.svc.DeleteObjects(ctx, &s3.DeleteObjectsInput{
-			Bucket: aws.String(s.cfg.AWS.S3Bucket),
-			Delete: &s3types.Delete{Objects: objects, Quiet: aws.Bool(true)},
-		})
+	s.logSummary(msgWipeSummary, msgDryRunWipeSummary, deleted)
+	return nil
+}
+
+// wipeAllVersions deletes every version and delete marker in the bucket, a
+// page at a time, then aborts all incomplete multipart uploads.
+func (s *s3clean) wipeAllVersions(ctx context.Context) error {
+	lockKey := s3lock.Key(s.cfg)
+	deleted := 0
+	p := s3.NewListObjectVersionsPaginator(s.svc, &s3.ListObjectVersionsInput{Bucket: aws.String(s.cfg.AWS.S3Bucket)})
+
+	for p.HasMorePages() {
+		page, pageErr := p.NextPage(ctx)
+		if pageErr != nil {
+			s.logListError(pageErr)
+			return pageErr
+		}
+
+		objects := make([]s3types.ObjectIdentifier, 0, len(page.Versions)+len(page.DeleteMarkers))
+		for i := range page.Versions {
+			if page.Versions[i].Key == nil || *page.Versions[i].Key == lockKey {
+				continue
+			}
+			objects = append(objects, s3types.ObjectIdentifier{Key: page.Versions[i].Key, VersionId: page.Versions[i].VersionId})
+		}
+		for i := range page.DeleteMarkers {
+			if page.DeleteMarkers[i].Key == nil || *page.DeleteMarkers[i].Key == lockKey {
+				continue
+			}
+			objects = append(objects, s3types.ObjectIdentifier{Key: page.DeleteMarkers[i].Key, VersionId: page.DeleteMarkers[i].VersionId})
+		}
+
+		removed, deleteErr := s.deleteObjects(ctx, objects)
+		deleted += len(removed)
 		if deleteErr != nil {
-			s.l.Error().Err(deleteErr).Str("bucket", s.cfg.AWS.S3Bucket).Msg(msgDeleteObjectsBucketErr)
 			return deleteErr
 		}
 	}
 
-	return nil
+	aborted, err := s.abortMultipartUploads(ctx, time.Now())
+
+	msg := msgWipeSummary
+	if s.cfg.DryRun {
+		msg = msgDryRunWipeSummary
+	}
+	s.l.Info().
+		Bool("dry_run", s.cfg.DryRun).
+		Str("bucket", s.cfg.AWS.S3Bucket).
+		Int("versions_deleted", deleted).
+		Int("uploads_aborted", aborted.uploads).
+		Int64("upload_bytes_reclaimed", aborted.bytes).
+		Msg(msg)
+	return err
 }
 
 // This method is intended to be run after a backup but can be run by itself.
 // It is used to remove any files in S3 which do not exist in the backup list provided in
-// the config file.
-func (s *s3clean) SyncS3Bucket() (err error) {
+// the config file. Only keys under the configured backup directories are considered,
+// plus, when SyncOrphanedPrefixes is set, backup keys of directories no longer configured.
+// Everything is listed before anything is deleted, and stale objects are then removed
+// in DeleteObjects batches. With SyncMode trash each stale object is first copied to
+// the trash prefix and only deleted once the copy succeeded.
+func (s *s3clean) SyncS3Bucket(ctx context.Context) (err error) {
+	if err = validateSyncMode(s.cfg.AWS.SyncMode); err != nil {
+		s.l.Error().Err(err).Str("sync_mode", s.cfg.AWS.SyncMode).Msg(msgInvalidSyncMode)
+		return err
+	}
 
-	input := s.createInput()
+	if err = s.checkBackupRoots(); err != nil {
+		return err
+	}
 
-	result, done := s.objectList(input)
-	if done {
-		return
+	stale, listed, err := s.staleObjects(ctx)
+	if err != nil {
+		return err
 	}
 
-	for i := range result.Contents {
-		s3file := *result.Contents[i].Key
-		osfile := "/" + *result.Contents[i].Key
-		_, err = os.Open(osfile)
-		if errors.Is(err, os.ErrNotExist) {
-			s.l.Info().Str("local_path", osfile).Msg(msgMissingLocalFile)
-			err = s.deleteS3File(input, s3file)
-			if err != nil {
-				s.l.Warn().Err(err).Str("s3_key", s3file).Msg(msgUnableToRemoveS3File)
-			} else {
-				s.l.Info().Str("local_path", osfile).Str("s3_key", s3file).Msg(msgRemovedFromS3)
+	if err = s.checkDeletionThreshold(len(stale), listed); err != nil {
+		return err
+	}
+
+	toDelete := make([]s3types.ObjectIdentifier, 0, len(stale))
+	for i := range stale {
+		toDelete = append(toDelete, s3types.ObjectIdentifier{Key: stale[i].Key})
+	}
+
+	var trashErr error
+	if s.cfg.AWS.SyncMode == SyncModeTrash {
+		toDelete, trashErr = s.moveToTrash(ctx, stale)
+	}
+
+	deleted, err := s.deleteObjects(ctx, toDelete)
+	s.logSummary(msgSyncSummary, msgDryRunSyncSummary, len(deleted))
+	return errors.Join(trashErr, err)
+}
+
+// staleObjects returns the objects under the configured backup directories
+// whose local file no longer exists, and the markers of empty directories
+// that are no longer empty. With SyncOrphanedPrefixes the whole
+// bucket is listed instead and backup keys outside every configured directory
+// are returned as well. Objects in the trash are never returned. The number
+// of objects considered is returned too.
+func (s *s3clean) staleObjects(ctx context.Context) ([]s3types.Object, int, error) {
+	var (
+		stale  []s3types.Object
+		listed int
+	)
+
+	prefixes, err := s.syncPrefixes()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// The trash of earlier syncs is never stale, even where it lies under a
+	// backup directory or looks like an orphaned backup key. The lock object
+	// is skipped by listObjects already.
+	trashPrefix := s.trashPrefix()
+	listBackupObjects := func(prefix string, fn func(object s3types.Object)) error {
+		return s.listObjects(ctx, prefix, func(object s3types.Object) {
+			if strings.HasPrefix(aws.ToString(object.Key), trashPrefix) {
+				return
 			}
+			fn(object)
+		})
+	}
+
+	checkLocal := func(object s3types.Object) {
+		listed++
+		s3file := aws.ToString(object.Key)
+		// A directory marker's key ends in a slash, which would make Lstat
+		// fail on a file that replaced the directory.
+		osfile := s3backup.LocalPath(strings.TrimSuffix(s3file, keyPathSeparator))
+		info, err := os.Lstat(osfile)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			s.l.Info().Str("local_path", osfile).Str("s3_key", s3file).Msg(msgMissingLocalFile)
+			stale = append(stale, object)
+		case err == nil && strings.HasSuffix(s3file, keyPathSeparator) && !emptyDirectory(osfile, info):
+			s.l.Info().Str("local_path", osfile).Str("s3_key", s3file).Msg(msgDirectoryNotEmpty)
+			stale = append(stale, object)
 		}
 	}
 
-	return nil
+	if !s.cfg.AWS.SyncOrphanedPrefixes {
+		for _, prefix := range outermostPrefixes(prefixes) {
+			if err = listBackupObjects(prefix, checkLocal); err != nil {
+				return nil, 0, err
+			}
+		}
+		return stale, listed, nil
+	}
+
+	err = listBackupObjects("", func(object s3types.Object) {
+		s3file := aws.ToString(object.Key)
+		if hasAnyPrefix(s3file, prefixes) {
+			checkLocal(object)
+			return
+		}
+		// Backup keys are absolute paths; anything else was not written by a backup.
+		if strings.HasPrefix(s3file, keyPathSeparator) {
+			listed++
+			s.l.Info().Str("s3_key", s3file).Msg(msgOrphanedKey)
+			stale = append(stale, object)
+		}
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return stale, listed, nil
 }
 
-func (s *s3clean) deleteS3File(input *s3.ListObjectsV2Input, s3file string) error {
+// emptyDirectory reports whether path, described by info, is still the empty
+// directory its marker object records. A directory that cannot be read is
+// treated as empty, so its marker is kept.
+func emptyDirectory(path string, info fs.FileInfo) bool {
+	if !info.IsDir() {
+		return false
+	}
+	dir, err := os.Open(path)
+	if err != nil {
+		return true
+	}
+	defer dir.Close()
+	names, err := dir.Readdirnames(1)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return true
+	}
+	return len(names) == 0
+}
 
-	deleteInput := &s3.DeleteObjectInput{
-		Bucket: input.Bucket,
-		Key:    aws.String(s3file),
+// syncPrefixes returns the key prefix of every configured backup directory.
+func (s *s3clean) syncPrefixes() ([]string, error) {
+	prefixes := make([]string, 0, len(s.cfg.AWS.BackupDirectories))
+	for _, dir := range s.cfg.AWS.BackupDirectories {
+		prefix, err := s3backup.ObjectKey(dir.Path)
+		if err != nil {
+			s.l.Error().Err(err).Str("root_dir", dir.Path).Msg(msgSyncPrefixError)
+			return nil, err
+		}
+		prefixes = append(prefixes, strings.TrimSuffix(prefix, keyPathSeparator)+keyPathSeparator)
 	}
-	_, err := s.svc.DeleteObject(context.Background(), deleteInput)
+	return prefixes, nil
+}
 
-	if err != nil {
-		s.l.Info().Err(err).Msg(msgDeleteObjectFailed)
-		return err
+// outermostPrefixes drops every prefix that lies under another one, so that
+// nested backup directories do not list their objects twice.
+func outermostPrefixes(prefixes []string) []string {
+	var outermost []string
+	for i, prefix := range prefixes {
+		duplicate := slices.Contains(prefixes[:i], prefix)
+		nested := slices.ContainsFunc(prefixes, func(other string) bool { return other != prefix && strings.HasPrefix(prefix, other) })
+		if !duplicate && !nested {
+			outermost = append(outermost, prefix)
+		}
 	}
+	return outermost
+}
 
+// listObjects calls fn for every object under prefix, across all pages. The
+// lock object is skipped, so sync never removes the lock the run holds.
+func (s *s3clean) listObjects(ctx context.Context, prefix string, fn func(object s3types.Object)) error {
+	lockKey := s3lock.Key(s.cfg)
+	input := &s3.ListObjectsV2Input{Bucket: aws.String(s.cfg.AWS.S3Bucket)}
+	if prefix != "" {
+		input.Prefix = aws.String(prefix)
+	}
+	p := s3.NewListObjectsV2Paginator(s.svc, input)
+
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			s.logListError(err)
+			return err
+		}
+		for i := range page.Contents {
+			if page.Contents[i].Key == nil || *page.Contents[i].Key == lockKey {
+				continue
+			}
+			fn(page.Contents[i])
+		}
+	}
 	return nil
 }
 
-func (s *s3clean) createInput() *s3.ListObjectsV2Input {
-	input := &s3.ListObjectsV2Input{
-		Bucket:  aws.String(s.cfg.AWS.S3Bucket),
-		MaxKeys: aws.Int32(200),
+func hasAnyPrefix(key string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
 	}
-	return input
+	return false
 }
 
-func (s *s3clean) objectList(input *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, bool) {
-	result, err := s.svc.ListObjectsV2(context.Background(), input)
-	if err != nil {
-		var apiErr smithy.APIError
-		if errors.As(err, &apiErr) {
-			if apiErr.ErrorCode() == "NoSuchBucket" {
-				s.l.Info().Err(err).Msg(msgNoSuchBucket)
-			} else {
-				s.l.Info().Err(err).Msg(msgListObjectsFailed)
+// deleteObjects removes objects in batches of up to maxDeleteBatch keys and
+// returns the ones that were deleted. Keys S3 reports as failed in a batch
+// response are logged individually and do not stop the remaining batches.
+// Once ctx is done the batch in flight is allowed to finish and no further
+// batches are sent.
+func (s *s3clean) deleteObjects(ctx context.Context, objects []s3types.ObjectIdentifier) ([]s3types.ObjectIdentifier, error) {
+	if s.cfg.DryRun {
+		for i := range objects {
+			s.l.Info().Bool("dry_run", true).Str("s3_key", aws.ToString(objects[i].Key)).Str("version_id", aws.ToString(objects[i].VersionId)).Msg(msgDryRunDelete)
+		}
+		return objects, nil
+	}
+
+	var (
+		deleted []s3types.ObjectIdentifier
+		failed  bool
+	)
+	for start := 0; start < len(objects); start += maxDeleteBatch {
+		if err := ctx.Err(); err != nil {
+			return deleted, err
+		}
+		batch := objects[start:min(start+maxDeleteBatch, len(objects))]
+
+		result, err := s.svc.DeleteObjects(context.WithoutCancel(ctx), &s3.DeleteObjectsInput{
+			Bucket: aws.String(s.cfg.AWS.S3Bucket),
+			Delete: &s3types.Delete{Objects: batch, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			s.l.Error().Err(err).Str("bucket", s.cfg.AWS.S3Bucket).Int("batch_size", len(batch)).Msg(msgDeleteObjectsBucketErr)
+			return deleted, err
+		}
+
+		failedKeys := make(map[string]bool, len(result.Errors))
+		for _, deleteErr := range result.Errors {
+			s.l.Warn().
+				Str("s3_key", aws.ToString(deleteErr.Key)).
+				Str("version_id", aws.ToString(deleteErr.VersionId)).
+				Str("code", aws.ToString(deleteErr.Code)).
+				Str("error", aws.ToString(deleteErr.Message)).
+				Msg(msgUnableToRemoveS3File)
+			failedKeys[objectID(deleteErr.Key, deleteErr.VersionId)] = true
+			failed = true
+		}
+		for i := range batch {
+			if failedKeys[objectID(batch[i].Key, batch[i].VersionId)] {
+				continue
 			}
-		} else {
-			s.l.Info().Err(err).Msg(msgListObjectsFailed)
+			s.l.Debug().Str("s3_key", aws.ToString(batch[i].Key)).Str("version_id", aws.ToString(batch[i].VersionId)).Msg(msgRemovedFromS3)
+			deleted = append(deleted, batch[i])
 		}
-		return nil, true
 	}
-	return result, false
+
+	if failed {
+		return deleted, errDeleteBatchIncomplete
+	}
+	return deleted, nil
+}
+
+// objectID identifies a single object version within a DeleteObjects batch.
+func objectID(key *string, versionID *string) string {
+	return aws.ToString(key) + "\x00" + aws.ToString(versionID)
+}
+
+func (s *s3clean) logListError(err error) {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && apiErr.ErrorCode() == msgNoSuchBucket {
+		s.l.Error().Err(err).Str("bucket", s.cfg.AWS.S3Bucket).Msg(msgNoSuchBucket)
+		return
+	}
+	s.l.Error().Err(err).Str("bucket", s.cfg.AWS.S3Bucket).Msg(msgListObjectsBucketError)
+}
+
+// logSummary reports how many objects were deleted, or would have been in a
+// dry run.
+func (s *s3clean) logSummary(msg string, dryRunMsg string, deleted int) {
+	if s.cfg.DryRun {
+		msg = dryRunMsg
+	}
+	s.l.Info().
+		Bool("dry_run", s.cfg.DryRun).
+		Str("bucket", s.cfg.AWS.S3Bucket).
+		Int("objects_deleted", deleted).
+		Msg(msg)
 }
@@ -1,13 +1,21 @@
 package s3clean_test
 
 import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
 	"github.com/jaysonhurd/s3backup/models"
 	"github.com/jaysonhurd/s3backup/pkg/s3clean"
+	"github.com/jaysonhurd/s3backup/pkg/s3lock"
 	"github.com/jaysonhurd/s3backup/test/fakes/s3api"
 	"github.com/rs/zerolog"
 )
@@ -18,14 +26,20 @@ func TestWipeBucket(t *testing.T) {
 
 	fake := new(s3api.FakeS3API)
 	fake.ListObjectsV2Returns(&s3.ListObjectsV2Output{
-		Contents: []types.Object{{Key: aws.String("old/file.txt")}},
+		Contents: []types.Object{{Key: aws.String("old/file.txt")}, {Key: aws.String(s3lock.DefaultS3LockKey)}},
 	}, nil)
 	fake.DeleteObjectsReturns(&s3.DeleteObjectsOutput{}, nil)
 
 	cleaner := s3clean.New(cfg, fake, &l)
-	if err := cleaner.WipeS3Bucket(); err != nil {
+	if err := cleaner.WipeS3Bucket(context.Background()); err != nil {
 		t.Fatalf("WipeS3Bucket() unexpected error: %v", err)
 	}
+
+	// The lock object held by the run doing the wipe is left alone
+	inputs := fake.DeleteObjectsInputs()
+	if len(inputs) != 1 || len(inputs[0].Delete.Objects) != 1 || aws.ToString(inputs[0].Delete.Objects[0].Key) != "old/file.txt" {
+		t.Fatalf("expected only old/file.txt to be deleted")
+	}
 }
 
 func TestSyncS3Bucket(t *testing.T) {
@@ -39,7 +53,760 @@ func TestSyncS3Bucket(t *testing.T) {
 	fake.DeleteObjectReturns(&s3.DeleteObjectOutput{}, nil)
 
 	cleaner := s3clean.New(cfg, fake, &l)
-	if err := cleaner.SyncS3Bucket(); err != nil {
+	if err := cleaner.SyncS3Bucket(context.Background()); err != nil {
+		t.Fatalf("SyncS3Bucket() unexpected error: %v", err)
+	}
+}
+
+func TestWipeBucketDryRun(t *testing.T) {
+	l := zerolog.Nop()
+	cfg := models.Config{AWS: models.AWS{S3Bucket: "test-bucket"}, DryRun: true}
+
+	fake := new(s3api.FakeS3API)
+	fake.ListObjectsV2Returns(&s3.ListObjectsV2Output{
+		Contents: []types.Object{{Key: aws.String("old/file.txt")}},
+	}, nil)
+
+	cleaner := s3clean.New(cfg, fake, &l)
+	if err := cleaner.WipeS3Bucket(context.Background()); err != nil {
+		t.Fatalf("WipeS3Bucket() unexpected error: %v", err)
+	}
+	if fake.DeleteObjectsCallCount() != 0 {
+		t.Fatalf("expected no DeleteObjects calls in a dry run")
+	}
+}
+
+func TestSyncS3BucketDryRun(t *testing.T) {
+	l := zerolog.Nop()
+	cfg := models.Config{AWS: models.AWS{
+		S3Bucket:          "test-bucket",
+		BackupDirectories: []models.BackupDirectory{{Path: "/does-not-exist"}},
+	}, DryRun: true, Force: true}
+
+	fake := new(s3api.FakeS3API)
+	fake.ListObjectsV2Returns(&s3.ListObjectsV2Output{
+		Contents: []types.Object{{Key: aws.String("/does-not-exist/missing-local.txt")}},
+	}, nil)
+
+	cleaner := s3clean.New(cfg, fake, &l)
+	if err := cleaner.SyncS3Bucket(context.Background()); err != nil {
 		t.Fatalf("SyncS3Bucket() unexpected error: %v", err)
 	}
+	if fake.DeleteObjectCallCount() != 0 || fake.DeleteObjectsCallCount() != 0 {
+		t.Fatalf("expected no deletes in a dry run")
+	}
+}
+
+func TestSyncS3BucketPaginatesAndBatches(t *testing.T) {
+	l := zerolog.Nop()
+	cfg := models.Config{AWS: models.AWS{
+		S3Bucket:          "test-bucket",
+		BackupDirectories: []models.BackupDirectory{{Path: "/does-not-exist"}},
+	}, Force: true}
+
+	missing := func(start, count int) []types.Object {
+		objects := make([]types.Object, 0, count)
+		for i := start; i < start+count; i++ {
+			objects = append(objects, types.Object{Key: aws.String(fmt.Sprintf("/does-not-exist/file-%d.txt", i))})
+		}
+		return objects
+	}
+
+	fake := new(s3api.FakeS3API)
+	fake.ListObjectsV2ReturnsPages(
+		&s3.ListObjectsV2Output{Contents: missing(0, 1000)},
+		&s3.ListObjectsV2Output{Contents: missing(1000, 1000)},
+		&s3.ListObjectsV2Output{Contents: missing(2000, 200)},
+	)
+
+	cleaner := s3clean.New(cfg, fake, &l)
+	if err := cleaner.SyncS3Bucket(context.Background()); err != nil {
+		t.Fatalf("SyncS3Bucket() unexpected error: %v", err)
+	}
+
+	inputs := fake.DeleteObjectsInputs()
+	if len(inputs) != 3 {
+		t.Fatalf("expected 3 DeleteObjects batches, got %d", len(inputs))
+	}
+	for i, want := range []int{1000, 1000, 200} {
+		if got := len(inputs[i].Delete.Objects); got != want {
+			t.Fatalf("batch %d has %d keys, want %d", i, got, want)
+		}
+	}
+	if fake.DeleteObjectCallCount() != 0 {
+		t.Fatalf("expected no single-key DeleteObject calls")
+	}
+}
+
+func TestSyncS3BucketReportsPerKeyErrors(t *testing.T) {
+	l := zerolog.Nop()
+	cfg := models.Config{AWS: models.AWS{
+		S3Bucket:          "test-bucket",
+		BackupDirectories: []models.BackupDirectory{{Path: "/does-not-exist"}},
+	}, Force: true}
+
+	fake := new(s3api.FakeS3API)
+	fake.ListObjectsV2Returns(&s3.ListObjectsV2Output{
+		Contents: []types.Object{{Key: aws.String("/does-not-exist/missing-local.txt")}},
+	}, nil)
+	fake.DeleteObjectsReturns(&s3.DeleteObjectsOutput{
+		Errors: []types.Error{{Key: aws.String("/does-not-exist/missing-local.txt"), Code: aws.String("AccessDenied")}},
+	}, nil)
+
+	cleaner := s3clean.New(cfg, fake, &l)
+	if err := cleaner.SyncS3Bucket(context.Background()); err == nil {
+		t.Fatalf("expected SyncS3Bucket() to report keys that failed to delete")
+	}
+}
+
+func TestSyncS3BucketScopedToBackupDirectories(t *testing.T) {
+	l := zerolog.Nop()
+	existing := t.TempDir()
+	objects := []types.Object{
+		{Key: aws.String("/does-not-exist/missing-local.txt")},
+		{Key: aws.String("/not-configured/missing-local.txt")},
+		{Key: aws.String("written-by-another-tool.txt")},
+		{Key: aws.String(existing)},
+		{Key: aws.String("/locks/s3backup.lock")},
+	}
+
+	tests := []struct {
+		name     string
+		orphaned bool
+		want     []string
+	}{
+		{name: "configured directories only", want: []string{"/does-not-exist/missing-local.txt"}},
+		{name: "orphaned prefixes", orphaned: true, want: []string{
+			"/does-not-exist/missing-local.txt",
+			"/not-configured/missing-local.txt",
+			existing,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := models.Config{AWS: models.AWS{
+				S3Bucket:             "test-bucket",
+				BackupDirectories:    []models.BackupDirectory{{Path: "/does-not-exist"}},
+				SyncOrphanedPrefixes: tt.orphaned,
+				S3LockKey:            "/locks/s3backup.lock",
+			}, Force: true}
+			fake := new(s3api.FakeS3API)
+			fake.ListObjectsV2Returns(&s3.ListObjectsV2Output{Contents: objects}, nil)
+
+			cleaner := s3clean.New(cfg, fake, &l)
+			if err := cleaner.SyncS3Bucket(context.Background()); err != nil {
+				t.Fatalf("SyncS3Bucket() unexpected error: %v", err)
+			}
+
+			var got []string
+			for _, input := range fake.DeleteObjectsInputs() {
+				for _, object := range input.Delete.Objects {
+					got = append(got, aws.ToString(object.Key))
+				}
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Fatalf("deleted keys = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSyncS3BucketNestedBackupDirectories(t *testing.T) {
+	l := zerolog.Nop()
+	root := t.TempDir()
+	photos := filepath.Join(root, "photos")
+	if err := os.Mkdir(photos, 0o755); err != nil {
+		t.Fatalf("unable to create directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(photos, "kept.jpg"), []byte("kept"), 0o600); err != nil {
+		t.Fatalf("unable to create temp file: %v", err)
+	}
+	cfg := models.Config{AWS: models.AWS{
+		S3Bucket:           "test-bucket",
+		BackupDirectories:  []models.BackupDirectory{{Path: photos}, {Path: root}, {Path: root + "/"}},
+		SyncMaxDeleteCount: 1,
+	}}
+	fake := new(s3api.FakeS3API)
+	fake.ListObjectsV2Returns(&s3.ListObjectsV2Output{Contents: []types.Object{
+		{Key: aws.String(photos + "/missing-local.jpg")},
+	}}, nil)
+
+	// The object is listed, counted and deleted once, not once per directory
+	cleaner := s3clean.New(cfg, fake, &l)
+	if err := cleaner.SyncS3Bucket(context.Background()); err != nil {
+		t.Fatalf("SyncS3Bucket() unexpected error: %v", err)
+	}
+	var got []string
+	for _, input := range fake.DeleteObjectsInputs() {
+		for _, object := range input.Delete.Objects {
+			got = append(got, aws.ToString(object.Key))
+		}
+	}
+	if len(got) != 1 {
+		t.Fatalf("deleted keys = %v, want the object once", got)
+	}
+}
+
+func TestSyncS3BucketDirectoryMarkers(t *testing.T) {
+	l := zerolog.Nop()
+	root := t.TempDir()
+	for _, name := range []string{"empty", "filled"} {
+		if err := os.Mkdir(filepath.Join(root, name), 0o755); err != nil {
+			t.Fatalf("unable to create directory: %v", err)
+		}
+	}
+	for _, name := range []string{"filled/a.txt", "replaced"} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(name), 0o600); err != nil {
+			t.Fatalf("unable to create temp file: %v", err)
+		}
+	}
+	objects := []types.Object{
+		{Key: aws.String(root + "/empty/")},
+		{Key: aws.String(root + "/filled/")},
+		{Key: aws.String(root + "/filled/a.txt")},
+		{Key: aws.String(root + "/replaced")},
+		{Key: aws.String(root + "/replaced/")},
+	}
+
+	tests := []struct {
+		name       string
+		mode       string
+		wantCopies int
+	}{
+		{name: "delete", mode: s3clean.SyncModeDelete},
+		{name: "trash", mode: s3clean.SyncModeTrash, wantCopies: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := models.Config{AWS: models.AWS{
+				S3Bucket:          "test-bucket",
+				BackupDirectories: []models.BackupDirectory{{Path: root}},
+				SyncMode:          tt.mode,
+				TrashPrefix:       "trash",
+			}, Force: true}
+			fake := new(s3api.FakeS3API)
+			fake.ListObjectsV2Returns(&s3.ListObjectsV2Output{Contents: objects}, nil)
+
+			// Only the markers of directories that gained files, or became
+			// files, are stale
+			cleaner := s3clean.New(cfg, fake, &l)
+			if err := cleaner.SyncS3Bucket(context.Background()); err != nil {
+				t.Fatalf("SyncS3Bucket() unexpected error: %v", err)
+			}
+			var got []string
+			for _, input := range fake.DeleteObjectsInputs() {
+				for _, object := range input.Delete.Objects {
+					got = append(got, aws.ToString(object.Key))
+				}
+			}
+			want := []string{root + "/filled/", root + "/replaced/"}
+			if fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Fatalf("deleted keys = %v, want %v", got, want)
+			}
+			if copies := len(fake.CopyObjectInputs()); copies != tt.wantCopies {
+				t.Fatalf("expected %d markers moved to the trash, got %d", tt.wantCopies, copies)
+			}
+		})
+	}
+}
+
+func TestSyncS3BucketSafetyChecks(t *testing.T) {
+	l := zerolog.Nop()
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "kept.txt"), []byte("kept"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	emptyRoot := t.TempDir()
+
+	objects := []types.Object{{Key: aws.String(root + "/kept.txt")}}
+	for i := range 9 {
+		objects = append(objects, types.Object{Key: aws.String(fmt.Sprintf("%s/gone-%d.txt", root, i))})
+	}
+
+	tests := []struct {
+		name        string
+		root        string
+		maxCount    int
+		maxPercent  float64
+		force       bool
+		wantErr     bool
+		wantDeletes int
+	}{
+		{name: "no limits", root: root, wantDeletes: 9},
+		{name: "within count limit", root: root, maxCount: 9, wantDeletes: 9},
+		{name: "count limit exceeded", root: root, maxCount: 8, wantErr: true},
+		{name: "percent limit exceeded", root: root, maxPercent: 50, wantErr: true},
+		{name: "force overrides limit", root: root, maxCount: 1, force: true, wantDeletes: 9},
+		{name: "missing root", root: filepath.Join(root, "unmounted"), wantErr: true},
+		{name: "empty root", root: emptyRoot, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := models.Config{AWS: models.AWS{
+				S3Bucket:             "test-bucket",
+				BackupDirectories:    []models.BackupDirectory{{Path: tt.root}},
+				SyncMaxDeleteCount:   tt.maxCount,
+				SyncMaxDeletePercent: tt.maxPercent,
+			}, Force: tt.force}
+			fake := new(s3api.FakeS3API)
+			fake.ListObjectsV2Returns(&s3.ListObjectsV2Output{Contents: objects}, nil)
+			fake.DeleteObjectsReturns(&s3.DeleteObjectsOutput{}, nil)
+
+			cleaner := s3clean.New(cfg, fake, &l)
+			err := cleaner.SyncS3Bucket(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SyncS3Bucket() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			deleted := 0
+			for _, input := range fake.DeleteObjectsInputs() {
+				deleted += len(input.Delete.Objects)
+			}
+			if deleted != tt.wantDeletes {
+				t.Fatalf("deleted %d objects, want %d", deleted, tt.wantDeletes)
+			}
+		})
+	}
+}
+
+func TestSyncS3BucketTrashMode(t *testing.T) {
+	l := zerolog.Nop()
+	cfg := models.Config{AWS: models.AWS{
+		S3Bucket:          "test-bucket",
+		BackupDirectories: []models.BackupDirectory{{Path: "/does-not-exist"}},
+		SyncMode:          s3clean.SyncModeTrash,
+		TrashPrefix:       "trash",
+		ACL:               "Bucket-Owner-Full-Control",
+	}, Force: true}
+
+	fake := new(s3api.FakeS3API)
+	fake.ListObjectsV2Returns(&s3.ListObjectsV2Output{
+		Contents: []types.Object{{Key: aws.String("/does-not-exist/a file.txt"), StorageClass: types.ObjectStorageClassStandardIa}},
+	}, nil)
+
+	cleaner := s3clean.New(cfg, fake, &l)
+	if err := cleaner.SyncS3Bucket(context.Background()); err != nil {
+		t.Fatalf("SyncS3Bucket() unexpected error: %v", err)
+	}
+
+	copies := fake.CopyObjectInputs()
+	if len(copies) != 1 {
+		t.Fatalf("expected 1 CopyObject call, got %d", len(copies))
+	}
+	if got := aws.ToString(copies[0].CopySource); got != "test-bucket//does-not-exist/a%20file.txt" {
+		t.Fatalf("CopySource = %q", got)
+	}
+	key := aws.ToString(copies[0].Key)
+	if !strings.HasPrefix(key, "trash/") || !strings.HasSuffix(key, "/does-not-exist/a file.txt") {
+		t.Fatalf("trash key = %q, want trash/<timestamp>/does-not-exist/a file.txt", key)
+	}
+	if copies[0].StorageClass != types.StorageClassStandardIa {
+		t.Fatalf("StorageClass = %q, want it kept from the original", copies[0].StorageClass)
+	}
+	if copies[0].ACL != types.ObjectCannedACLBucketOwnerFullControl {
+		t.Fatalf("ACL = %q, want the configured ACL as backup maps it", copies[0].ACL)
+	}
+	if fake.DeleteObjectsCallCount() != 1 {
+		t.Fatalf("expected the original to be deleted after copying")
+	}
+}
+
+func TestSyncS3BucketSkipsAbsoluteTrashPrefix(t *testing.T) {
+	l := zerolog.Nop()
+	root := t.TempDir()
+
+	tests := []struct {
+		name        string
+		trashPrefix string
+		orphaned    bool
+	}{
+		{name: "inside backup directory", trashPrefix: root + "/.trash"},
+		{name: "inside backup directory with orphaned prefixes", trashPrefix: root + "/.trash", orphaned: true},
+		{name: "outside backup directory with orphaned prefixes", trashPrefix: "/srv/.trash/", orphaned: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := models.Config{AWS: models.AWS{
+				S3Bucket:             "test-bucket",
+				BackupDirectories:    []models.BackupDirectory{{Path: root}},
+				SyncMode:             s3clean.SyncModeTrash,
+				TrashPrefix:          tt.trashPrefix,
+				SyncOrphanedPrefixes: tt.orphaned,
+			}, Force: true}
+			trashed := strings.TrimSuffix(tt.trashPrefix, "/") + "/20260101T000000Z" + root + "/gone.txt"
+			fake := new(s3api.FakeS3API)
+			fake.ListObjectsV2Returns(&s3.ListObjectsV2Output{Contents: []types.Object{
+				{Key: aws.String(trashed)},
+				{Key: aws.String(root + "/gone.txt")},
+			}}, nil)
+
+			// Only the object of the deleted file is moved, never the trash
+			// of an earlier sync
+			cleaner := s3clean.New(cfg, fake, &l)
+			if err := cleaner.SyncS3Bucket(context.Background()); err != nil {
+				t.Fatalf("SyncS3Bucket() unexpected error: %v", err)
+			}
+			var got []string
+			for _, input := range fake.DeleteObjectsInputs() {
+				for _, object := range input.Delete.Objects {
+					got = append(got, aws.ToString(object.Key))
+				}
+			}
+			if want := []string{root + "/gone.txt"}; fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Fatalf("deleted keys = %v, want %v", got, want)
+			}
+			if copies := len(fake.CopyObjectInputs()); copies != 1 {
+				t.Fatalf("expected 1 object moved to the trash, got %d", copies)
+			}
+		})
+	}
+}
+
+func TestSyncS3BucketTrashModeLargeObject(t *testing.T) {
+	l := zerolog.Nop()
+	cfg := models.Config{AWS: models.AWS{
+		S3Bucket:          "test-bucket",
+		BackupDirectories: []models.BackupDirectory{{Path: "/does-not-exist"}},
+		SyncMode:          s3clean.SyncModeTrash,
+		ACL:               " Private ",
+	}, Force: true}
+	const size = 6000 * 1024 * 1024 * 1024
+	metadata := map[string]string{"s3backup-encryption": "AES256-GCM", "s3backup-key": "wrapped"}
+
+	fake := new(s3api.FakeS3API)
+	fake.ListObjectsV2Returns(&s3.ListObjectsV2Output{
+		Contents: []types.Object{{Key: aws.String("/does-not-exist/disk.img"), Size: aws.Int64(size)}},
+	}, nil)
+	fake.HeadObjectReturns(&s3.HeadObjectOutput{
+		Metadata:        metadata,
+		ContentType:     aws.String("application/octet-stream"),
+		ContentEncoding: aws.String("zstd"),
+		ETag:            aws.String(`"source"`),
+	}, nil)
+
+	cleaner := s3clean.New(cfg, fake, &l)
+	if err := cleaner.SyncS3Bucket(context.Background()); err != nil {
+		t.Fatalf("SyncS3Bucket() unexpected error: %v", err)
+	}
+
+	uploads := fake.CreateMultipartUploadInputs()
+	if len(uploads) != 1 {
+		t.Fatalf("expected 1 multipart upload, got %d", len(uploads))
+	}
+	if fmt.Sprint(uploads[0].Metadata) != fmt.Sprint(metadata) || aws.ToString(uploads[0].ContentEncoding) != "zstd" || uploads[0].ACL != types.ObjectCannedACLPrivate {
+		t.Fatalf("multipart upload did not keep the metadata and headers of the original: %+v", uploads[0])
+	}
+	parts := fake.UploadPartCopyInputs()
+	if len(parts) == 0 || len(parts) > 10000 {
+		t.Fatalf("copied in %d parts, want between 1 and 10000", len(parts))
+	}
+	if aws.ToString(parts[0].CopySourceIfMatch) != `"source"` {
+		t.Fatalf("expected every part to be copied from the version that was read")
+	}
+}
+
+func TestSyncS3BucketTrashCopyFailureKeepsObject(t *testing.T) {
+	l := zerolog.Nop()
+	cfg := models.Config{AWS: models.AWS{
+		S3Bucket:          "test-bucket",
+		BackupDirectories: []models.BackupDirectory{{Path: "/does-not-exist"}},
+		SyncMode:          s3clean.SyncModeTrash,
+	}, Force: true}
+
+	fake := new(s3api.FakeS3API)
+	fake.ListObjectsV2Returns(&s3.ListObjectsV2Output{
+		Contents: []types.Object{{Key: aws.String("/does-not-exist/missing-local.txt")}},
+	}, nil)
+	fake.CopyObjectReturns(&smithy.GenericAPIError{Code: "InvalidObjectState"})
+
+	cleaner := s3clean.New(cfg, fake, &l)
+	if err := cleaner.SyncS3Bucket(context.Background()); err == nil {
+		t.Fatalf("expected SyncS3Bucket() to report the failed copy")
+	}
+	for _, input := range fake.DeleteObjectsInputs() {
+		if len(input.Delete.Objects) > 0 {
+			t.Fatalf("expected nothing to be deleted when the copy to trash failed")
+		}
+	}
+}
+
+func TestSyncS3BucketInvalidSyncMode(t *testing.T) {
+	l := zerolog.Nop()
+	cfg := models.Config{AWS: models.AWS{S3Bucket: "test-bucket", SyncMode: "recycle"}}
+
+	fake := new(s3api.FakeS3API)
+	cleaner := s3clean.New(cfg, fake, &l)
+	if err := cleaner.SyncS3Bucket(context.Background()); err == nil {
+		t.Fatalf("expected an error for an unsupported SyncMode")
+	}
+}
+
+func TestPurgeTrash(t *testing.T) {
+	l := zerolog.Nop()
+	cfg := models.Config{AWS: models.AWS{S3Bucket: "test-bucket"}}
+	recent := time.Now().UTC().Add(-time.Hour).Format("20060102T150405Z")
+
+	fake := new(s3api.FakeS3API)
+	fake.ListObjectsV2Returns(&s3.ListObjectsV2Output{
+		Contents: []types.Object{
+			{Key: aws.String(".trash/20200101T000000Z/home/user/old.txt")},
+			{Key: aws.String(".trash/" + recent + "/home/user/recent.txt")},
+			{Key: aws.String(".trash/not-a-timestamp/home/user/other.txt")},
+			{Key: aws.String("/home/user/live.txt")},
+		},
+	}, nil)
+
+	cleaner := s3clean.New(cfg, fake, &l)
+	if err := cleaner.PurgeTrash(context.Background(), 30*24*time.Hour); err != nil {
+		t.Fatalf("PurgeTrash() unexpected error: %v", err)
+	}
+
+	var got []string
+	for _, input := range fake.DeleteObjectsInputs() {
+		for _, object := range input.Delete.Objects {
+			got = append(got, aws.ToString(object.Key))
+		}
+	}
+	if want := []string{".trash/20200101T000000Z/home/user/old.txt"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("purged keys = %v, want %v", got, want)
+	}
+}
+
+func TestPruneVersions(t *testing.T) {
+	l := zerolog.Nop()
+	cfg := models.Config{AWS: models.AWS{
+		S3Bucket:          "test-bucket",
+		BackupDirectories: []models.BackupDirectory{{Path: "/does-not-exist"}},
+		KeepLast:          1,
+		KeepDaily:         3,
+	}}
+	version := func(key string, id string, day int, hour int, latest bool) types.ObjectVersion {
+		return types.ObjectVersion{
+			Key:          aws.String(key),
+			VersionId:    aws.String(id),
+			LastModified: aws.Time(time.Date(2026, 9, day, hour, 0, 0, 0, time.UTC)),
+			IsLatest:     aws.Bool(latest),
+			Size:         aws.Int64(10),
+		}
+	}
+
+	fake := new(s3api.FakeS3API)
+	fake.ListObjectVersionsReturns(&s3.ListObjectVersionsOutput{
+		Versions: []types.ObjectVersion{
+			version("/does-not-exist/a.txt", "v5", 5, 12, true),
+			version("/does-not-exist/a.txt", "v4", 5, 11, false),
+			version("/does-not-exist/a.txt", "v3", 4, 12, false),
+			version("/does-not-exist/a.txt", "v2", 3, 12, false),
+			version("/does-not-exist/a.txt", "v1", 1, 12, false),
+			version("/does-not-exist/b.txt", "b1", 1, 12, true),
+		},
+		DeleteMarkers: []types.DeleteMarkerEntry{
+			{Key: aws.String("/does-not-exist/c.txt"), VersionId: aws.String("m1"), IsLatest: aws.Bool(true)},
+		},
+	}, nil)
+
+	cleaner := s3clean.New(cfg, fake, &l)
+	if err := cleaner.PruneVersions(context.Background()); err != nil {
+		t.Fatalf("PruneVersions() unexpected error: %v", err)
+	}
+
+	var got []string
+	for _, input := range fake.DeleteObjectsInputs() {
+		for _, object := range input.Delete.Objects {
+			got = append(got, aws.ToString(object.Key)+"@"+aws.ToString(object.VersionId))
+		}
+	}
+	if want := []string{"/does-not-exist/a.txt@v4", "/does-not-exist/a.txt@v1"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("pruned versions = %v, want %v", got, want)
+	}
+}
+
+func TestPruneVersionsRequiresPolicy(t *testing.T) {
+	l := zerolog.Nop()
+	cfg := models.Config{AWS: models.AWS{S3Bucket: "test-bucket"}}
+
+	fake := new(s3api.FakeS3API)
+	cleaner := s3clean.New(cfg, fake, &l)
+	if err := cleaner.PruneVersions(context.Background()); err == nil {
+		t.Fatalf("expected PruneVersions() to refuse to run without a retention policy")
+	}
+	if fake.DeleteObjectsCallCount() != 0 {
+		t.Fatalf("expected nothing to be deleted")
+	}
+}
+
+func TestWipeBucketAllVersions(t *testing.T) {
+	l := zerolog.Nop()
+	cfg := models.Config{AWS: models.AWS{S3Bucket: "test-bucket"}, WipeAllVersions: true}
+
+	fake := new(s3api.FakeS3API)
+	fake.ListObjectVersionsReturns(&s3.ListObjectVersionsOutput{
+		Versions: []types.ObjectVersion{
+			{Key: aws.String("/home/user/a.txt"), VersionId: aws.String("v2")},
+			{Key: aws.String("/home/user/a.txt"), VersionId: aws.String("v1")},
+			{Key: aws.String(s3lock.DefaultS3LockKey), VersionId: aws.String("l2")},
+			{Key: aws.String(s3lock.DefaultS3LockKey), VersionId: aws.String("l1")},
+		},
+		DeleteMarkers: []types.DeleteMarkerEntry{
+			{Key: aws.String("/home/user/b.txt"), VersionId: aws.String("m1")},
+		},
+	}, nil)
+	fake.ListMultipartUploadsReturns(&s3.ListMultipartUploadsOutput{
+		Uploads: []types.MultipartUpload{
+			{Key: aws.String("/home/user/big.iso"), UploadId: aws.String("u1"), Initiated: aws.Time(time.Now().Add(-time.Hour))},
+		},
+	}, nil)
+
+	cleaner := s3clean.New(cfg, fake, &l)
+	if err := cleaner.WipeS3Bucket(context.Background()); err != nil {
+		t.Fatalf("WipeS3Bucket() unexpected error: %v", err)
+	}
+
+	var got []string
+	for _, input := range fake.DeleteObjectsInputs() {
+		for _, object := range input.Delete.Objects {
+			got = append(got, aws.ToString(object.Key)+"@"+aws.ToString(object.VersionId))
+		}
+	}
+	want := []string{"/home/user/a.txt@v2", "/home/user/a.txt@v1", "/home/user/b.txt@m1"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("deleted = %v, want %v", got, want)
+	}
+	if fake.AbortMultipartUploadCallCount() != 1 {
+		t.Fatalf("expected the incomplete multipart upload to be aborted")
+	}
+}
+
+func TestAbortStaleUploads(t *testing.T) {
+	l := zerolog.Nop()
+	cfg := models.Config{AWS: models.AWS{S3Bucket: "test-bucket"}}
+
+	fake := new(s3api.FakeS3API)
+	fake.ListMultipartUploadsReturns(&s3.ListMultipartUploadsOutput{
+		Uploads: []types.MultipartUpload{
+			{Key: aws.String("/home/user/stale.iso"), UploadId: aws.String("u1"), Initiated: aws.Time(time.Now().Add(-48 * time.Hour))},
+			{Key: aws.String("/home/user/running.iso"), UploadId: aws.String("u2"), Initiated: aws.Time(time.Now().Add(-time.Hour))},
+		},
+	}, nil)
+	fake.ListPartsReturns(&s3.ListPartsOutput{Parts: []types.Part{{Size: aws.Int64(5 << 20)}, {Size: aws.Int64(5 << 20)}}})
+
+	cleaner := s3clean.New(cfg, fake, &l)
+	if err := cleaner.AbortStaleUploads(context.Background(), 24*time.Hour); err != nil {
+		t.Fatalf("AbortStaleUploads() unexpected error: %v", err)
+	}
+	if got := fake.AbortMultipartUploadCallCount(); got != 1 {
+		t.Fatalf("expected only the stale upload to be aborted, got %d aborts", got)
+	}
+}
+
+func TestAbortStaleUploadsDryRun(t *testing.T) {
+	l := zerolog.Nop()
+	cfg := models.Config{AWS: models.AWS{S3Bucket: "test-bucket"}, DryRun: true}
+
+	fake := new(s3api.FakeS3API)
+	fake.ListMultipartUploadsReturns(&s3.ListMultipartUploadsOutput{
+		Uploads: []types.MultipartUpload{
+			{Key: aws.String("/home/user/stale.iso"), UploadId: aws.String("u1"), Initiated: aws.Time(time.Now().Add(-48 * time.Hour))},
+		},
+	}, nil)
+
+	cleaner := s3clean.New(cfg, fake, &l)
+	if err := cleaner.AbortStaleUploads(context.Background(), 24*time.Hour); err != nil {
+		t.Fatalf("AbortStaleUploads() unexpected error: %v", err)
+	}
+	if fake.AbortMultipartUploadCallCount() != 0 {
+		t.Fatalf("expected no aborts in a dry run")
+	}
+}
+
+func TestRemovePaths(t *testing.T) {
+	l := zerolog.Nop()
+	root := t.TempDir()
+	kept := filepath.Join(root, "keep.txt")
+	if err := os.WriteFile(kept, []byte("keep"), 0o600); err != nil {
+		t.Fatalf("unable to create temp file: %v", err)
+	}
+	gone := filepath.Join(root, "gone")
+	objects := []types.Object{
+		{Key: aws.String(gone + "/a.txt")},
+		{Key: aws.String(gone + "/sub/b.txt")},
+		{Key: aws.String(gone + "-sibling.txt")},
+		{Key: aws.String(kept)},
+	}
+
+	cfg := models.Config{AWS: models.AWS{
+		S3Bucket:          "test-bucket",
+		BackupDirectories: []models.BackupDirectory{{Path: root}},
+	}}
+	fake := new(s3api.FakeS3API)
+	fake.ListObjectsV2Returns(&s3.ListObjectsV2Output{Contents: objects}, nil)
+
+	cleaner := s3clean.New(cfg, fake, &l)
+	if err := cleaner.RemovePaths(context.Background(), []string{gone, kept}); err != nil {
+		t.Fatalf("RemovePaths() unexpected error: %v", err)
+	}
+
+	var got []string
+	for _, input := range fake.DeleteObjectsInputs() {
+		for _, object := range input.Delete.Objects {
+			got = append(got, aws.ToString(object.Key))
+		}
+	}
+	want := []string{gone + "/a.txt", gone + "/sub/b.txt"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("deleted keys = %v, want %v", got, want)
+	}
+}
+
+func TestRemovePathsSafetyChecks(t *testing.T) {
+	l := zerolog.Nop()
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "keep.txt"), []byte("keep"), 0o600); err != nil {
+		t.Fatalf("unable to create temp file: %v", err)
+	}
+	gone := filepath.Join(root, "gone")
+	removedRoot := filepath.Join(t.TempDir(), "unmounted")
+
+	tests := []struct {
+		name  string
+		paths []string
+		dirs  []models.BackupDirectory
+		cfg   models.Config
+	}{
+		{
+			name:  "deletion limit",
+			paths: []string{gone},
+			cfg:   models.Config{AWS: models.AWS{SyncMaxDeletePercent: 50}},
+			dirs:  []models.BackupDirectory{{Path: root}},
+		},
+		{
+			// -force gets past the missing root check, the removal must still be refused
+			name:  "removed backup directory",
+			paths: []string{removedRoot},
+			cfg:   models.Config{Force: true},
+			dirs:  []models.BackupDirectory{{Path: root}, {Path: removedRoot}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg
+			cfg.AWS.S3Bucket = "test-bucket"
+			cfg.AWS.BackupDirectories = tt.dirs
+			fake := new(s3api.FakeS3API)
+			fake.ListObjectsV2Returns(&s3.ListObjectsV2Output{Contents: []types.Object{
+				{Key: aws.String(gone + "/a.txt")},
+				{Key: aws.String(gone + "/b.txt")},
+				{Key: aws.String(filepath.Join(root, "keep.txt"))},
+				{Key: aws.String(removedRoot + "/c.txt")},
+			}}, nil)
+
+			cleaner := s3clean.New(cfg, fake, &l)
+			if err := cleaner.RemovePaths(context.Background(), tt.paths); err == nil {
+				t.Fatalf("expected RemovePaths() to refuse")
+			}
+			if fake.DeleteObjectsCallCount() != 0 {
+				t.Fatalf("expected nothing to be deleted")
+			}
+		})
+	}
 }
@@ -0,0 +1,259 @@
+package s3clean
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/jaysonhurd/s3backup/pkg/s3backup"
+)
+
+const (
+	msgInvalidSyncMode      = "invalid sync mode in configuration"
+	msgUnsupportedSyncMode  = "unsupported sync mode"
+	msgMovedToTrash         = "copied object to trash"
+	msgTrashCopyError       = "unable to copy object to trash, leaving it in place"
+	msgTrashIncomplete      = "one or more objects could not be moved to trash"
+	msgDryRunTrash          = "dry run: would move object to trash"
+	msgAbortTrashCopy       = "aborting multipart copy to trash"
+	msgAbortTrashCopyError  = "AbortMultipartUpload failed for copy to trash"
+	msgUnrecognisedTrashKey = "trash key has no recognisable timestamp, leaving it in place"
+	msgExpiredTrash         = "trash entry is past its retention, scheduling removal"
+	msgPurgeSummary         = "purge of trash complete"
+	msgDryRunPurgeSummary   = "dry run of trash purge complete, nothing was deleted"
+)
+
+// Sync modes for AWS.SyncMode. An empty value behaves like SyncModeDelete.
+const (
+	SyncModeDelete = "delete"
+	SyncModeTrash  = "trash"
+)
+
+const (
+	// DefaultTrashPrefix is used when AWS.TrashPrefix is not set.
+	DefaultTrashPrefix = ".trash/"
+
+	trashTimestampFormat = "20060102T150405Z"
+
+	// maxCopyObjectSize is the largest object a single CopyObject request can
+	// copy; anything bigger is copied in parts of copyPartSize, or larger ones
+	// where that would take more than maxCopyParts parts.
+	maxCopyObjectSize = 5 * 1024 * 1024 * 1024
+	copyPartSize      = 512 * 1024 * 1024
+	maxCopyParts      = 10000
+)
+
+var (
+	errUnsupportedSyncMode = errors.New(msgUnsupportedSyncMode)
+	errTrashIncomplete     = errors.New(msgTrashIncomplete)
+)
+
+func validateSyncMode(mode string) error {
+	switch mode {
+	case "", SyncModeDelete, SyncModeTrash:
+		return nil
+	}
+	return errUnsupportedSyncMode
+}
+
+// trashPrefix returns the configured trash prefix with exactly one trailing
+// slash.
+func (s *s3clean) trashPrefix() string {
+	prefix := s.cfg.AWS.TrashPrefix
+	if prefix == "" {
+		prefix = DefaultTrashPrefix
+	}
+	return strings.TrimSuffix(prefix, keyPathSeparator) + keyPathSeparator
+}
+
+// trashKey returns where key is kept in the trash for a sync that started at
+// stamp, e.g. ".trash/20240131T020000Z/home/user/file.txt".
+func (s *s3clean) trashKey(stamp string, key string) string {
+	return s.trashPrefix() + stamp + keyPathSeparator + strings.TrimPrefix(key, keyPathSeparator)
+}
+
+// moveToTrash copies every object into a trash prefix named after the current
+// time and returns the objects that were copied and can now be deleted. An
+// object that fails to copy is left where it is, so nothing is ever deleted
+// without a copy in the trash.
+func (s *s3clean) moveToTrash(ctx context.Context, objects []s3types.Object) ([]s3types.ObjectIdentifier, error) {
+	stamp := time.Now().UTC().Format(trashTimestampFormat)
+	copied := make([]s3types.ObjectIdentifier, 0, len(objects))
+	failed := false
+
+	for i := range objects {
+		key := aws.ToString(objects[i].Key)
+		trashKey := s.trashKey(stamp, key)
+
+		if s.cfg.DryRun {
+			s.l.Info().Bool("dry_run", true).Str("s3_key", key).Str("trash_key", trashKey).Msg(msgDryRunTrash)
+			copied = append(copied, s3types.ObjectIdentifier{Key: objects[i].Key})
+			continue
+		}
+
+		if err := s.copyObject(ctx, objects[i], trashKey); err != nil {
+			s.l.Warn().Err(err).Str("s3_key", key).Str("trash_key", trashKey).Msg(msgTrashCopyError)
+			failed = true
+			continue
+		}
+		s.l.Debug().Str("s3_key", key).Str("trash_key", trashKey).Msg(msgMovedToTrash)
+		copied = append(copied, s3types.ObjectIdentifier{Key: objects[i].Key})
+	}
+
+	if failed {
+		return copied, errTrashIncomplete
+	}
+	return copied, nil
+}
+
+// copyObject copies object to key within the bucket, keeping its metadata,
+// headers and storage class, and applying the configured ACL. Objects over
+// 5 GiB are copied with a multipart upload, which does not copy metadata by
+// itself, so it is read from the source first and set on the upload. Without
+// it the encryption metadata of an encrypted object would be lost and its
+// trashed copy could never be decrypted.
+func (s *s3clean) copyObject(ctx context.Context, object s3types.Object, key string) error {
+	source := copySource(s.cfg.AWS.S3Bucket, aws.ToString(object.Key))
+	storageClass := s3types.StorageClass(object.StorageClass)
+	var sse s3types.ServerSideEncryption
+	if s.cfg.AWS.ServerSideEncryption != "" {
+		sse = s3types.ServerSideEncryption(s.cfg.AWS.ServerSideEncryption)
+	}
+	acl, err := s3backup.ObjectCannedACL(s.cfg.AWS.ACL)
+	if err != nil {
+		return err
+	}
+
+	size := aws.ToInt64(object.Size)
+	if size <= maxCopyObjectSize {
+		_, err := s.svc.CopyObject(ctx, &s3.CopyObjectInput{
+			Bucket:               aws.String(s.cfg.AWS.S3Bucket),
+			Key:                  aws.String(key),
+			CopySource:           aws.String(source),
+			StorageClass:         storageClass,
+			ServerSideEncryption: sse,
+			ACL:                  acl,
+		})
+		return err
+	}
+
+	head, err := s.svc.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.cfg.AWS.S3Bucket),
+		Key:    object.Key,
+	})
+	if err != nil {
+		return err
+	}
+
+	created, err := s.svc.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:               aws.String(s.cfg.AWS.S3Bucket),
+		Key:                  aws.String(key),
+		StorageClass:         storageClass,
+		ServerSideEncryption: sse,
+		ACL:                  acl,
+		Metadata:             head.Metadata,
+		ContentType:          head.ContentType,
+		ContentEncoding:      head.ContentEncoding,
+		ContentDisposition:   head.ContentDisposition,
+		ContentLanguage:      head.ContentLanguage,
+		CacheControl:         head.CacheControl,
+	})
+	if err != nil {
+		return err
+	}
+
+	partSize := max(copyPartSize, (size+maxCopyParts-1)/maxCopyParts)
+	var parts []s3types.CompletedPart
+	for start, partNumber := int64(0), int32(1); start < size; start, partNumber = start+partSize, partNumber+1 {
+		end := min(start+partSize, size) - 1
+		// Every part must come from the version whose metadata was read
+		part, err := s.svc.UploadPartCopy(ctx, &s3.UploadPartCopyInput{
+			Bucket:            aws.String(s.cfg.AWS.S3Bucket),
+			Key:               aws.String(key),
+			UploadId:          created.UploadId,
+			PartNumber:        aws.Int32(partNumber),
+			CopySource:        aws.String(source),
+			CopySourceIfMatch: head.ETag,
+			CopySourceRange:   aws.String(fmt.Sprintf("bytes=%d-%d", start, end)),
+		})
+		if err != nil {
+			s.abortCopy(ctx, key, created.UploadId)
+			return err
+		}
+		var etag *string
+		if part.CopyPartResult != nil {
+			etag = part.CopyPartResult.ETag
+		}
+		parts = append(parts, s3types.CompletedPart{ETag: etag, PartNumber: aws.Int32(partNumber)})
+	}
+
+	_, err = s.svc.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.cfg.AWS.S3Bucket),
+		Key:             aws.String(key),
+		UploadId:        created.UploadId,
+		MultipartUpload: &s3types.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		s.abortCopy(ctx, key, created.UploadId)
+		return err
+	}
+	return nil
+}
+
+// abortCopy ignores the cancellation of ctx so that a copy interrupted by it
+// does not leave its parts behind.
+func (s *s3clean) abortCopy(ctx context.Context, key string, uploadID *string) {
+	s.l.Warn().Str("trash_key", key).Str("upload_id", aws.ToString(uploadID)).Msg(msgAbortTrashCopy)
+	_, err := s.svc.AbortMultipartUpload(context.WithoutCancel(ctx), &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(s.cfg.AWS.S3Bucket),
+		Key:      aws.String(key),
+		UploadId: uploadID,
+	})
+	if err != nil {
+		s.l.Error().Err(err).Str("trash_key", key).Msg(msgAbortTrashCopyError)
+	}
+}
+
+// copySource returns the URL-encoded bucket/key form CopyObject expects.
+func copySource(bucket string, key string) string {
+	segments := strings.Split(key, keyPathSeparator)
+	for i := range segments {
+		segments[i] = url.PathEscape(segments[i])
+	}
+	return bucket + keyPathSeparator + strings.Join(segments, keyPathSeparator)
+}
+
+// PurgeTrash permanently removes everything that was moved to the trash more
+// than olderThan ago. The age is taken from the timestamp in the trash key.
+func (s *s3clean) PurgeTrash(ctx context.Context, olderThan time.Duration) (err error) {
+	prefix := s.trashPrefix()
+	cutoff := time.Now().Add(-olderThan)
+
+	var expired []s3types.ObjectIdentifier
+	err = s.listObjects(ctx, prefix, func(object s3types.Object) {
+		key := aws.ToString(object.Key)
+		stamp, _, _ := strings.Cut(strings.TrimPrefix(key, prefix), keyPathSeparator)
+		trashed, parseErr := time.Parse(trashTimestampFormat, stamp)
+		if parseErr != nil {
+			s.l.Debug().Str("s3_key", key).Msg(msgUnrecognisedTrashKey)
+			return
+		}
+		if trashed.Before(cutoff) {
+			s.l.Info().Str("s3_key", key).Time("trashed", trashed).Msg(msgExpiredTrash)
+			expired = append(expired, s3types.ObjectIdentifier{Key: object.Key})
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	deleted, err := s.deleteObjects(ctx, expired)
+	s.logSummary(msgPurgeSummary, msgDryRunPurgeSummary, len(deleted))
+	return err
+}
@@ -0,0 +1,139 @@
+package s3clean
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const (
+	msgListUploadsError       = "unable to list multipart uploads"
+	msgAbortUploadError       = "unable to abort multipart upload; continuing"
+	msgAbortedUpload          = "aborted multipart upload"
+	msgDryRunAbortUpload      = "dry run: would abort multipart upload"
+	msgAbortUploadsIncomplete = "one or more multipart uploads could not be aborted"
+	msgListPartsError         = "unable to list parts of multipart upload; aborting it anyway"
+	msgStaleUploadsSummary    = "abort of stale multipart uploads complete"
+	msgDryRunStaleSummary     = "dry run of stale multipart upload abort complete, nothing was aborted"
+)
+
+var errAbortUploadsIncomplete = errors.New(msgAbortUploadsIncomplete)
+
+// uploadsSummary counts the multipart uploads aborted and the parts and bytes
+// they held.
+type uploadsSummary struct {
+	uploads int
+	parts   int
+	bytes   int64
+}
+
+// AbortStaleUploads aborts incomplete multipart uploads that were initiated
+// more than olderThan ago. Their parts are billed but never show up in an
+// object listing.
+func (s *s3clean) AbortStaleUploads(ctx context.Context, olderThan time.Duration) (err error) {
+	summary, err := s.abortMultipartUploads(ctx, time.Now().Add(-olderThan))
+
+	msg := msgStaleUploadsSummary
+	if s.cfg.DryRun {
+		msg = msgDryRunStaleSummary
+	}
+	s.l.Info().
+		Bool("dry_run", s.cfg.DryRun).
+		Str("bucket", s.cfg.AWS.S3Bucket).
+		Int("uploads_aborted", summary.uploads).
+		Int("parts_reclaimed", summary.parts).
+		Int64("bytes_reclaimed", summary.bytes).
+		Msg(msg)
+	return err
+}
+
+// abortMultipartUploads aborts every incomplete multipart upload in the bucket
+// that was initiated before the cutoff. Uploads that fail to abort are logged
+// and do not stop the rest.
+func (s *s3clean) abortMultipartUploads(ctx context.Context, before time.Time) (uploadsSummary, error) {
+	var (
+		summary uploadsSummary
+		failed  bool
+	)
+
+	p := s3.NewListMultipartUploadsPaginator(s.svc, &s3.ListMultipartUploadsInput{Bucket: aws.String(s.cfg.AWS.S3Bucket)})
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			s.l.Error().Err(err).Str("bucket", s.cfg.AWS.S3Bucket).Msg(msgListUploadsError)
+			return summary, err
+		}
+
+		for _, upload := range page.Uploads {
+			if upload.Initiated != nil && !upload.Initiated.Before(before) {
+				continue
+			}
+			parts, bytes := s.uploadParts(ctx, upload)
+			if err = s.abortUpload(ctx, upload, parts, bytes); err != nil {
+				failed = true
+				continue
+			}
+			summary.uploads++
+			summary.parts += parts
+			summary.bytes += bytes
+		}
+	}
+
+	if failed {
+		return summary, errAbortUploadsIncomplete
+	}
+	return summary, nil
+}
+
+// uploadParts returns how many parts an upload holds and their total size. A
+// failure to list them is only logged since the upload is aborted regardless.
+func (s *s3clean) uploadParts(ctx context.Context, upload s3types.MultipartUpload) (int, int64) {
+	var (
+		parts int
+		bytes int64
+	)
+	p := s3.NewListPartsPaginator(s.svc, &s3.ListPartsInput{
+		Bucket:   aws.String(s.cfg.AWS.S3Bucket),
+		Key:      upload.Key,
+		UploadId: upload.UploadId,
+	})
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			s.l.Warn().Err(err).Str("s3_key", aws.ToString(upload.Key)).Str("upload_id", aws.ToString(upload.UploadId)).Msg(msgListPartsError)
+			break
+		}
+		for i := range page.Parts {
+			parts++
+			bytes += aws.ToInt64(page.Parts[i].Size)
+		}
+	}
+	return parts, bytes
+}
+
+func (s *s3clean) abortUpload(ctx context.Context, upload s3types.MultipartUpload, parts int, bytes int64) error {
+	key := aws.ToString(upload.Key)
+	uploadID := aws.ToString(upload.UploadId)
+	initiated := aws.ToTime(upload.Initiated)
+
+	if s.cfg.DryRun {
+		s.l.Info().Bool("dry_run", true).Str("s3_key", key).Str("upload_id", uploadID).Time("initiated", initiated).Int("parts", parts).Int64("bytes", bytes).Msg(msgDryRunAbortUpload)
+		return nil
+	}
+
+	_, err := s.svc.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(s.cfg.AWS.S3Bucket),
+		Key:      upload.Key,
+		UploadId: upload.UploadId,
+	})
+	if err != nil {
+		s.l.Warn().Err(err).Str("s3_key", key).Str("upload_id", uploadID).Msg(msgAbortUploadError)
+		return err
+	}
+	s.l.Info().Str("s3_key", key).Str("upload_id", uploadID).Time("initiated", initiated).Int("parts", parts).Int64("bytes", bytes).Msg(msgAbortedUpload)
+	return nil
+}
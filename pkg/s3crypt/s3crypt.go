@@ -0,0 +1,398 @@
+package s3crypt
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/jaysonhurd/s3backup/models"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	msgBothKeySources       = "only one of EncryptionKeyFile and EncryptionPassphraseFile can be set"
+	msgInvalidKeyFile       = "encryption key file must hold 32 bytes, raw or hex or base64 encoded"
+	msgEmptyPassphrase      = "encryption passphrase file is empty"
+	msgUnsupportedAlgorithm = "object is encrypted with an unsupported algorithm"
+	msgMissingMetadata      = "object is missing its encryption metadata"
+	msgUnwrapKeyFailed      = "unable to unwrap data key, is this the right master key?"
+	msgTruncatedCiphertext  = "encrypted object is truncated"
+)
+
+// Object metadata keys written on encrypted uploads. S3 returns them in lower
+// case, so they are defined that way.
+const (
+	MetadataAlgorithm  = "encryption"
+	MetadataWrappedKey = "encryption-key"
+	MetadataNonce      = "encryption-nonce"
+	MetadataSalt       = "encryption-salt"
+)
+
+const (
+	// Algorithm names the format: AES-256-GCM over 64 KiB chunks, each sealed
+	// with a nonce made of a random per-object prefix, the chunk counter and a
+	// flag marking the last chunk, so chunks cannot be reordered, dropped or
+	// truncated without detection.
+	Algorithm = "aes-256-gcm-stream-v1"
+
+	chunkSize       = 64 * 1024
+	keySize         = 32
+	noncePrefixSize = 7
+	saltSize        = 16
+	gcmOverhead     = 16
+
+	// contentKeyLabel separates the key naming snapshot contents from every
+	// other use of the master key. With a passphrase it is also the salt, as
+	// the key must come out the same on every run for contents to be shared.
+	contentKeyLabel = "s3backup snapshot content key v1"
+
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+var (
+	errBothKeySources       = errors.New(msgBothKeySources)
+	errInvalidKeyFile       = errors.New(msgInvalidKeyFile)
+	errEmptyPassphrase      = errors.New(msgEmptyPassphrase)
+	errUnsupportedAlgorithm = errors.New(msgUnsupportedAlgorithm)
+	errMissingMetadata      = errors.New(msgMissingMetadata)
+	errUnwrapKeyFailed      = errors.New(msgUnwrapKeyFailed)
+	errTruncatedCiphertext  = errors.New(msgTruncatedCiphertext)
+)
+
+// Cipher encrypts file contents before upload and decrypts them on restore.
+// Every object gets its own random data key, which is stored in the object's
+// metadata wrapped by the master key. ContentID names snapshot contents
+// without revealing their hash.
+type Cipher interface {
+	Encrypt(plaintext io.Reader, size int64) (ciphertext io.Reader, ciphertextSize int64, metadata map[string]string, err error)
+	Decrypt(ciphertext io.Reader, metadata map[string]string) (io.Reader, error)
+	ContentID(sum string) (string, error)
+}
+
+type s3crypt struct {
+	// Exactly one of masterKey and passphrase is set.
+	masterKey  []byte
+	passphrase []byte
+
+	// With a passphrase, uploads share one salt per run so the key is derived
+	// only once; restores cache the key derived for every salt they meet.
+	once    sync.Once
+	salt    []byte
+	saltKey []byte
+	saltErr error
+	mu      sync.Mutex
+	derived map[string][]byte
+
+	// The content key is derived on first use.
+	contentOnce sync.Once
+	contentKey  []byte
+	contentErr  error
+}
+
+// New returns the Cipher configured by AWS.EncryptionKeyFile or
+// AWS.EncryptionPassphraseFile, or nil when neither is set.
+func New(cfg models.Config) (Cipher, error) {
+	keyFile, passphraseFile := cfg.AWS.EncryptionKeyFile, cfg.AWS.EncryptionPassphraseFile
+	switch {
+	case keyFile != "" && passphraseFile != "":
+		return nil, errBothKeySources
+	case keyFile != "":
+		data, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		key, err := parseKey(data)
+		if err != nil {
+			return nil, err
+		}
+		return &s3crypt{masterKey: key}, nil
+	case passphraseFile != "":
+		data, err := os.ReadFile(passphraseFile)
+		if err != nil {
+			return nil, err
+		}
+		passphrase := bytes.TrimRight(data, "\r\n")
+		if len(passphrase) == 0 {
+			return nil, errEmptyPassphrase
+		}
+		return &s3crypt{passphrase: passphrase, derived: make(map[string][]byte)}, nil
+	}
+	return nil, nil
+}
+
+// parseKey accepts a 32-byte key as raw bytes or hex or base64 text.
+func parseKey(data []byte) ([]byte, error) {
+	if len(data) == keySize {
+		return data, nil
+	}
+	text := string(bytes.TrimSpace(data))
+	if key, err := hex.DecodeString(text); err == nil && len(key) == keySize {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(text); err == nil && len(key) == keySize {
+		return key, nil
+	}
+	return nil, errInvalidKeyFile
+}
+
+// CiphertextSize returns the encrypted size of size bytes of plaintext. Every
+// chunk, including the single chunk of an empty file, adds a GCM tag. A
+// negative size means the plaintext size is not known and is returned as is.
+func CiphertextSize(size int64) int64 {
+	if size < 0 {
+		return size
+	}
+	chunks := max((size+chunkSize-1)/chunkSize, 1)
+	return size + chunks*gcmOverhead
+}
+
+// Encrypt returns a reader producing the ciphertext of plaintext, its exact
+// size (negative when size is) and the metadata that must be stored with it.
+func (c *s3crypt) Encrypt(plaintext io.Reader, size int64) (io.Reader, int64, map[string]string, error) {
+	metadata := map[string]string{MetadataAlgorithm: Algorithm}
+
+	masterKey := c.masterKey
+	if masterKey == nil {
+		c.once.Do(func() {
+			c.salt = make([]byte, saltSize)
+			if _, c.saltErr = rand.Read(c.salt); c.saltErr != nil {
+				return
+			}
+			c.saltKey, c.saltErr = deriveKey(c.passphrase, c.salt)
+		})
+		if c.saltErr != nil {
+			return nil, 0, nil, c.saltErr
+		}
+		masterKey = c.saltKey
+		metadata[MetadataSalt] = base64.StdEncoding.EncodeToString(c.salt)
+	}
+
+	dataKey := make([]byte, keySize)
+	prefix := make([]byte, noncePrefixSize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, 0, nil, err
+	}
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, 0, nil, err
+	}
+
+	wrapped, err := wrapKey(masterKey, dataKey)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	metadata[MetadataWrappedKey] = base64.StdEncoding.EncodeToString(wrapped)
+	metadata[MetadataNonce] = base64.StdEncoding.EncodeToString(prefix)
+
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	return &streamReader{aead: aead, prefix: prefix, src: bufio.NewReaderSize(plaintext, chunkSize), seal: true}, CiphertextSize(size), metadata, nil
+}
+
+// Decrypt returns a reader producing the plaintext of an object written by
+// Encrypt. Any tampering surfaces as a read error.
+func (c *s3crypt) Decrypt(ciphertext io.Reader, metadata map[string]string) (io.Reader, error) {
+	if metadata[MetadataAlgorithm] != Algorithm {
+		return nil, errUnsupportedAlgorithm
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(metadata[MetadataWrappedKey])
+	if err != nil || len(wrapped) == 0 {
+		return nil, errMissingMetadata
+	}
+	prefix, err := base64.StdEncoding.DecodeString(metadata[MetadataNonce])
+	if err != nil || len(prefix) != noncePrefixSize {
+		return nil, errMissingMetadata
+	}
+
+	masterKey := c.masterKey
+	if masterKey == nil {
+		if masterKey, err = c.keyForSalt(metadata[MetadataSalt]); err != nil {
+			return nil, err
+		}
+	}
+
+	dataKey, err := unwrapKey(masterKey, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &streamReader{aead: aead, prefix: prefix, src: bufio.NewReaderSize(ciphertext, chunkSize+gcmOverhead)}, nil
+}
+
+// ContentID returns the name file contents with the given SHA-256 are stored
+// under in snapshot mode: an HMAC of the hash under a key derived from the
+// master key. Identical files still share one object, but the bucket does not
+// reveal which known files it holds.
+func (c *s3crypt) ContentID(sum string) (string, error) {
+	c.contentOnce.Do(func() {
+		c.contentKey, c.contentErr = c.deriveContentKey()
+	})
+	if c.contentErr != nil {
+		return "", c.contentErr
+	}
+	mac := hmac.New(sha256.New, c.contentKey)
+	mac.Write([]byte(sum))
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+func (c *s3crypt) deriveContentKey() ([]byte, error) {
+	masterKey := c.masterKey
+	if masterKey == nil {
+		var err error
+		if masterKey, err = deriveKey(c.passphrase, []byte(contentKeyLabel)); err != nil {
+			return nil, err
+		}
+	}
+	mac := hmac.New(sha256.New, masterKey)
+	mac.Write([]byte(contentKeyLabel))
+	return mac.Sum(nil), nil
+}
+
+func (c *s3crypt) keyForSalt(encoded string) ([]byte, error) {
+	salt, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(salt) == 0 {
+		return nil, errMissingMetadata
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if key, ok := c.derived[encoded]; ok {
+		return key, nil
+	}
+	key, err := deriveKey(c.passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	c.derived[encoded] = key
+	return key, nil
+}
+
+func deriveKey(passphrase []byte, salt []byte) ([]byte, error) {
+	return scrypt.Key(passphrase, salt, scryptN, scryptR, scryptP, keySize)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// wrapKey seals the data key with the master key under a random nonce, which
+// is prepended to the result.
+func wrapKey(masterKey []byte, dataKey []byte) ([]byte, error) {
+	aead, err := newGCM(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, dataKey, nil), nil
+}
+
+func unwrapKey(masterKey []byte, wrapped []byte) ([]byte, error) {
+	aead, err := newGCM(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, errMissingMetadata
+	}
+	dataKey, err := aead.Open(nil, wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, errUnwrapKeyFailed
+	}
+	return dataKey, nil
+}
+
+// streamReader seals or opens one chunk at a time.
+type streamReader struct {
+	aead    cipher.AEAD
+	prefix  []byte
+	src     *bufio.Reader
+	seal    bool
+	counter uint32
+	out     []byte
+	done    bool
+}
+
+func (s *streamReader) Read(p []byte) (int, error) {
+	for len(s.out) == 0 {
+		if s.done {
+			return 0, io.EOF
+		}
+		if err := s.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, s.out)
+	s.out = s.out[n:]
+	return n, nil
+}
+
+// next reads and transforms the following chunk. A chunk is the last one when
+// the source has nothing after it.
+func (s *streamReader) next() error {
+	size := chunkSize
+	if !s.seal {
+		size += s.aead.Overhead()
+	}
+	buf := make([]byte, size)
+	n, err := io.ReadFull(s.src, buf)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return err
+	}
+	last := n < size
+	if !last {
+		if _, peekErr := s.src.Peek(1); errors.Is(peekErr, io.EOF) {
+			last = true
+		} else if peekErr != nil {
+			return peekErr
+		}
+	}
+
+	nonce := make([]byte, 0, s.aead.NonceSize())
+	nonce = append(nonce, s.prefix...)
+	nonce = binary.BigEndian.AppendUint32(nonce, s.counter)
+	if last {
+		nonce = append(nonce, 1)
+	} else {
+		nonce = append(nonce, 0)
+	}
+	s.counter++
+	s.done = last
+
+	if s.seal {
+		s.out = s.aead.Seal(buf[:0:0], nonce, buf[:n], nil)
+		return nil
+	}
+	if n < s.aead.Overhead() {
+		return errTruncatedCiphertext
+	}
+	plain, err := s.aead.Open(buf[:0], nonce, buf[:n], nil)
+	if err != nil {
+		return err
+	}
+	s.out = plain
+	return nil
+}
@@ -0,0 +1,195 @@
+package s3crypt_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jaysonhurd/s3backup/models"
+	"github.com/jaysonhurd/s3backup/pkg/s3crypt"
+)
+
+func newKeyCipher(t *testing.T) s3crypt.Cipher {
+	t.Helper()
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatalf("unable to generate key: %v", err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "backup.key")
+	if err := os.WriteFile(keyFile, []byte(hex.EncodeToString(key)+"\n"), 0o600); err != nil {
+		t.Fatalf("unable to write key file: %v", err)
+	}
+	c, err := s3crypt.New(models.Config{AWS: models.AWS{EncryptionKeyFile: keyFile}})
+	if err != nil {
+		t.Fatalf("New() unexpected error: %v", err)
+	}
+	return c
+}
+
+func encrypt(t *testing.T, c s3crypt.Cipher, plaintext []byte) ([]byte, map[string]string) {
+	t.Helper()
+	reader, size, metadata, err := c.Encrypt(bytes.NewReader(plaintext), int64(len(plaintext)))
+	if err != nil {
+		t.Fatalf("Encrypt() unexpected error: %v", err)
+	}
+	ciphertext, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("unable to read ciphertext: %v", err)
+	}
+	if int64(len(ciphertext)) != size {
+		t.Fatalf("ciphertext is %d bytes, Encrypt() reported %d", len(ciphertext), size)
+	}
+	return ciphertext, metadata
+}
+
+func TestRoundTrip(t *testing.T) {
+	c := newKeyCipher(t)
+	for _, size := range []int{0, 1, 64 * 1024, 64*1024 + 1, 3 * 64 * 1024} {
+		plaintext := make([]byte, size)
+		_, _ = rand.Read(plaintext)
+
+		ciphertext, metadata := encrypt(t, c, plaintext)
+		if metadata[s3crypt.MetadataAlgorithm] != s3crypt.Algorithm {
+			t.Fatalf("size %d: metadata = %v, want the algorithm recorded", size, metadata)
+		}
+
+		reader, err := c.Decrypt(bytes.NewReader(ciphertext), metadata)
+		if err != nil {
+			t.Fatalf("size %d: Decrypt() unexpected error: %v", size, err)
+		}
+		got, err := io.ReadAll(reader)
+		if err != nil {
+			t.Fatalf("size %d: unable to read plaintext: %v", size, err)
+		}
+		if !bytes.Equal(got, plaintext) {
+			t.Fatalf("size %d: round trip changed the contents", size)
+		}
+	}
+}
+
+func TestDecryptDetectsTampering(t *testing.T) {
+	c := newKeyCipher(t)
+	plaintext := make([]byte, 2*64*1024+10)
+	ciphertext, metadata := encrypt(t, c, plaintext)
+
+	tests := map[string][]byte{
+		"flipped bit":  append([]byte{ciphertext[0] ^ 1}, ciphertext[1:]...),
+		"truncated":    ciphertext[:64*1024+16],
+		"last dropped": ciphertext[:2*(64*1024+16)],
+	}
+	for name, tampered := range tests {
+		t.Run(name, func(t *testing.T) {
+			reader, err := c.Decrypt(bytes.NewReader(tampered), metadata)
+			if err == nil {
+				_, err = io.ReadAll(reader)
+			}
+			if err == nil {
+				t.Fatalf("expected tampered ciphertext to fail to decrypt")
+			}
+		})
+	}
+}
+
+func TestDecryptWrongKey(t *testing.T) {
+	ciphertext, metadata := encrypt(t, newKeyCipher(t), []byte("secret"))
+	if _, err := newKeyCipher(t).Decrypt(bytes.NewReader(ciphertext), metadata); err == nil {
+		t.Fatalf("expected Decrypt() with another master key to fail")
+	}
+}
+
+func TestPassphrase(t *testing.T) {
+	passphraseFile := filepath.Join(t.TempDir(), "passphrase")
+	if err := os.WriteFile(passphraseFile, []byte("correct horse battery staple\n"), 0o600); err != nil {
+		t.Fatalf("unable to write passphrase file: %v", err)
+	}
+	cfg := models.Config{AWS: models.AWS{EncryptionPassphraseFile: passphraseFile}}
+	c, err := s3crypt.New(cfg)
+	if err != nil {
+		t.Fatalf("New() unexpected error: %v", err)
+	}
+	ciphertext, metadata := encrypt(t, c, []byte("secret"))
+	if metadata[s3crypt.MetadataSalt] == "" {
+		t.Fatalf("expected the scrypt salt to be stored in metadata")
+	}
+
+	// A fresh cipher, as on restore, derives the key again from the salt.
+	restoreCipher, err := s3crypt.New(cfg)
+	if err != nil {
+		t.Fatalf("New() unexpected error: %v", err)
+	}
+	reader, err := restoreCipher.Decrypt(bytes.NewReader(ciphertext), metadata)
+	if err != nil {
+		t.Fatalf("Decrypt() unexpected error: %v", err)
+	}
+	if got, _ := io.ReadAll(reader); string(got) != "secret" {
+		t.Fatalf("decrypted %q, want %q", got, "secret")
+	}
+}
+
+func TestContentID(t *testing.T) {
+	sum := strings.Repeat("ab", 32)
+	contentID := func(c s3crypt.Cipher) string {
+		t.Helper()
+		id, err := c.ContentID(sum)
+		if err != nil {
+			t.Fatalf("ContentID() unexpected error: %v", err)
+		}
+		return id
+	}
+
+	keyCipher := newKeyCipher(t)
+	id := contentID(keyCipher)
+	if id == sum || contentID(keyCipher) != id {
+		t.Fatalf("ContentID() = %q, want a stable id other than the hash", id)
+	}
+	if contentID(newKeyCipher(t)) == id {
+		t.Fatalf("expected another master key to name the contents differently")
+	}
+
+	// With a passphrase every run must derive the same id, or contents would
+	// never be shared between snapshots.
+	passphraseFile := filepath.Join(t.TempDir(), "passphrase")
+	if err := os.WriteFile(passphraseFile, []byte("correct horse battery staple\n"), 0o600); err != nil {
+		t.Fatalf("unable to write passphrase file: %v", err)
+	}
+	cfg := models.Config{AWS: models.AWS{EncryptionPassphraseFile: passphraseFile}}
+	first, _ := s3crypt.New(cfg)
+	second, _ := s3crypt.New(cfg)
+	if contentID(first) != contentID(second) {
+		t.Fatalf("expected ContentID() to be the same on every run with one passphrase")
+	}
+}
+
+func TestNew(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "short.key")
+	if err := os.WriteFile(keyFile, []byte("too short"), 0o600); err != nil {
+		t.Fatalf("unable to write key file: %v", err)
+	}
+
+	tests := map[string]struct {
+		aws     models.AWS
+		wantNil bool
+		wantErr bool
+	}{
+		"not configured": {wantNil: true},
+		"both sources":   {aws: models.AWS{EncryptionKeyFile: keyFile, EncryptionPassphraseFile: keyFile}, wantNil: true, wantErr: true},
+		"invalid key":    {aws: models.AWS{EncryptionKeyFile: keyFile}, wantNil: true, wantErr: true},
+		"missing file":   {aws: models.AWS{EncryptionKeyFile: keyFile + ".missing"}, wantNil: true, wantErr: true},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			c, err := s3crypt.New(models.Config{AWS: tt.aws})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("New() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if (c == nil) != tt.wantNil {
+				t.Fatalf("New() cipher = %v, wantNil %v", c, tt.wantNil)
+			}
+		})
+	}
+}
@@ -0,0 +1,400 @@
+package s3index
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/jaysonhurd/s3backup/models"
+	"github.com/jaysonhurd/s3backup/pkg/fileattr"
+	"github.com/jaysonhurd/s3backup/pkg/s3crypt"
+	"github.com/jaysonhurd/s3backup/pkg/s3lock"
+	"github.com/jaysonhurd/s3backup/pkg/s3snapshot"
+	"github.com/rs/zerolog"
+)
+
+const (
+	msgLoadIndexError   = "unable to load local state index"
+	msgSaveIndexError   = "unable to save local state index"
+	msgListObjectsError = "unable to list objects while rebuilding index"
+	msgHeadObjectError  = "unable to read object metadata while rebuilding index"
+	msgUnknownSize      = "object does not record the size of its local file, leaving it out of the index"
+	msgIndexRebuilt     = "local state index rebuilt from bucket listing"
+	msgIndexSaved       = "local state index saved"
+	msgNoStateDirectory = "no StateDirectory configured for the local state index"
+)
+
+const (
+	indexFilePrefix       = "index-"
+	indexFileSuffix       = ".json"
+	indexTempFilePattern  = ".index-*"
+	indexDirectoryMode    = 0o700
+	indexFormatVersion    = 1
+	indexEntriesCapHint   = 1024
+	indexKeyPathSeparator = "/"
+)
+
+// Object metadata written by s3backup on upload, and its snapshot backup
+// mode. They are repeated here as s3backup imports this package.
+const (
+	metadataSize       = "size"
+	metadataSHA256     = "sha256"
+	backupModeSnapshot = "snapshot"
+)
+
+var errNoStateDirectory = errors.New(msgNoStateDirectory)
+
+// Entry is what the index remembers about an object after it was uploaded.
+// Size and Mtime describe the local file at upload time so an unchanged file
+// can be recognised without asking S3.
+type Entry struct {
+	Key    string    `json:"key"`
+	Size   int64     `json:"size"`
+	Mtime  time.Time `json:"mtime"`
+	ETag   string    `json:"etag,omitempty"`
+	SHA256 string    `json:"sha256,omitempty"`
+}
+
+type Indexer interface {
+	Lookup(key string) (Entry, bool)
+	Record(entry Entry)
+	Remove(key string)
+	Keys(prefix string) []string
+	Reset()
+	Rebuild() error
+	Save() error
+}
+
+type S3API interface {
+	ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
+	HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+}
+
+type indexFile struct {
+	Version int              `json:"version"`
+	Bucket  string           `json:"bucket"`
+	Entries map[string]Entry `json:"entries"`
+}
+
+type s3index struct {
+	cfg     models.Config
+	svc     S3API
+	l       *zerolog.Logger
+	path    string
+	mu      sync.Mutex
+	entries map[string]Entry
+}
+
+// New loads the index for the configured bucket from AWS.StateDirectory. A
+// missing index file is not an error; the index simply starts out empty.
+func New(
+	cfg models.Config,
+	svc S3API,
+	l *zerolog.Logger,
+) (Indexer, error) {
+	if cfg.AWS.StateDirectory == "" {
+		return nil, errNoStateDirectory
+	}
+
+	idx := &s3index{
+		cfg:     cfg,
+		svc:     svc,
+		l:       l,
+		path:    filepath.Join(cfg.AWS.StateDirectory, indexFilePrefix+cfg.AWS.S3Bucket+indexFileSuffix),
+		entries: make(map[string]Entry, indexEntriesCapHint),
+	}
+
+	f, err := os.ReadFile(idx.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return idx, nil
+	}
+	if err != nil {
+		l.Error().Err(err).Str("path", idx.path).Msg(msgLoadIndexError)
+		return nil, err
+	}
+
+	var stored indexFile
+	if err = json.Unmarshal(f, &stored); err != nil {
+		l.Error().Err(err).Str("path", idx.path).Msg(msgLoadIndexError)
+		return nil, err
+	}
+	if stored.Entries != nil {
+		idx.entries = stored.Entries
+	}
+	return idx, nil
+}
+
+func (i *s3index) Lookup(key string) (Entry, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	entry, ok := i.entries[key]
+	return entry, ok
+}
+
+func (i *s3index) Record(entry Entry) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.entries[entry.Key] = entry
+}
+
+func (i *s3index) Remove(key string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	delete(i.entries, key)
+}
+
+// Keys returns every indexed key that lies under the directory prefix.
+func (i *s3index) Keys(prefix string) []string {
+	prefix = strings.TrimSuffix(prefix, indexKeyPathSeparator) + indexKeyPathSeparator
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	var keys []string
+	for key := range i.entries {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// Reset forgets every entry, e.g. after the bucket has been wiped.
+func (i *s3index) Reset() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.entries = make(map[string]Entry, indexEntriesCapHint)
+}
+
+// Rebuild replaces the index with a listing of the bucket's backup keys,
+// leaving out snapshot manifests, the trash and the lock object. A listing only
+// carries the stored size, which is not the local file's size for compressed
+// or encrypted objects, so each object is looked up with HeadObject for the
+// size, mtime and hash recorded when it was uploaded. An object whose original
+// size is not known is left out and checked against S3 by the next backup.
+// An object without a recorded mtime gets LastModified; that is the same
+// comparison the default mtime change detection makes against S3.
+func (i *s3index) Rebuild() error {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+
+	var (
+		entries = make(map[string]Entry, indexEntriesCapHint)
+		objects = make(chan s3types.Object)
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+	)
+	for range i.workers() {
+		wg.Go(func() {
+			for object := range objects {
+				if ctx.Err() != nil {
+					continue
+				}
+				entry, ok, err := i.rebuildEntry(ctx, object)
+				if err != nil {
+					i.l.Error().Err(err).Str("s3_key", aws.ToString(object.Key)).Msg(msgHeadObjectError)
+					cancel(err)
+					continue
+				}
+				if ok {
+					mu.Lock()
+					entries[entry.Key] = entry
+					mu.Unlock()
+				}
+			}
+		})
+	}
+
+	var listErr error
+	for _, prefix := range i.rebuildPrefixes() {
+		listErr = i.listBackupKeys(ctx, prefix, objects)
+		if listErr != nil {
+			break
+		}
+	}
+	close(objects)
+	wg.Wait()
+
+	if err := context.Cause(ctx); err != nil {
+		return err
+	}
+	if listErr != nil {
+		i.l.Error().Err(listErr).Str("bucket", i.cfg.AWS.S3Bucket).Msg(msgListObjectsError)
+		return listErr
+	}
+
+	i.mu.Lock()
+	i.entries = entries
+	i.mu.Unlock()
+
+	i.l.Info().Str("bucket", i.cfg.AWS.S3Bucket).Int("entries", len(entries)).Msg(msgIndexRebuilt)
+	return nil
+}
+
+// rebuildPrefixes returns the prefixes backups write under: absolute paths,
+// and file contents in snapshot mode. Manifests and the default trash prefix
+// lie outside them and are never looked at.
+func (i *s3index) rebuildPrefixes() []string {
+	prefixes := []string{indexKeyPathSeparator}
+	if i.cfg.AWS.BackupMode == backupModeSnapshot {
+		prefixes = append(prefixes, s3snapshot.ObjectsPrefix)
+	}
+	return prefixes
+}
+
+// listBackupKeys sends every object under prefix to objects, leaving out the
+// lock object and the trash, which can also be configured under an absolute
+// path.
+func (i *s3index) listBackupKeys(ctx context.Context, prefix string, objects chan<- s3types.Object) error {
+	lockKey := s3lock.Key(i.cfg)
+	trashPrefix := ""
+	if i.cfg.AWS.TrashPrefix != "" {
+		trashPrefix = strings.TrimSuffix(i.cfg.AWS.TrashPrefix, indexKeyPathSeparator) + indexKeyPathSeparator
+	}
+
+	p := s3.NewListObjectsV2Paginator(i.svc, &s3.ListObjectsV2Input{
+		Bucket: aws.String(i.cfg.AWS.S3Bucket),
+		Prefix: aws.String(prefix),
+	})
+	for p.HasMorePages() && ctx.Err() == nil {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, object := range page.Contents {
+			key := aws.ToString(object.Key)
+			if object.Key == nil || key == lockKey || (trashPrefix != "" && strings.HasPrefix(key, trashPrefix)) {
+				continue
+			}
+			select {
+			case objects <- object:
+			case <-ctx.Done():
+			}
+		}
+	}
+	return nil
+}
+
+// rebuildEntry returns the entry the backup recorded when it uploaded object.
+// It reports false for an object that is gone or whose original size is not
+// known.
+func (i *s3index) rebuildEntry(ctx context.Context, object s3types.Object) (Entry, bool, error) {
+	head, err := i.svc.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(i.cfg.AWS.S3Bucket),
+		Key:    object.Key,
+	})
+	if err != nil {
+		if notFound(err) {
+			return Entry{}, false, nil
+		}
+		return Entry{}, false, err
+	}
+
+	size, ok := originalSize(head)
+	if !ok {
+		i.l.Debug().Str("s3_key", aws.ToString(object.Key)).Msg(msgUnknownSize)
+		return Entry{}, false, nil
+	}
+	mtime := aws.ToTime(object.LastModified)
+	if value, ok := head.Metadata[fileattr.MetadataMtime]; ok {
+		if stored, err := time.Parse(time.RFC3339Nano, value); err == nil {
+			mtime = stored
+		}
+	}
+	// An encrypted object records a keyed hash, not the file's SHA-256
+	sum := head.Metadata[metadataSHA256]
+	if _, encrypted := head.Metadata[s3crypt.MetadataAlgorithm]; encrypted {
+		sum = ""
+	}
+	return Entry{
+		Key:    aws.ToString(object.Key),
+		Size:   size,
+		Mtime:  mtime,
+		ETag:   aws.ToString(head.ETag),
+		SHA256: sum,
+	}, true, nil
+}
+
+// originalSize returns the size of the local file an object was uploaded
+// from. Compressed and encrypted objects record it in their metadata, any
+// other object is stored as is.
+func originalSize(head *s3.HeadObjectOutput) (int64, bool) {
+	if value, ok := head.Metadata[metadataSize]; ok {
+		size, err := strconv.ParseInt(value, 10, 64)
+		return size, err == nil
+	}
+	if _, encrypted := head.Metadata[s3crypt.MetadataAlgorithm]; encrypted || aws.ToString(head.ContentEncoding) != "" {
+		return 0, false
+	}
+	return aws.ToInt64(head.ContentLength), true
+}
+
+func notFound(err error) bool {
+	var (
+		apiErr smithy.APIError
+		nfErr  *s3types.NotFound
+	)
+	return errors.As(err, &nfErr) || (errors.As(err, &apiErr) && apiErr.ErrorCode() == "NotFound")
+}
+
+func (i *s3index) workers() int {
+	if i.cfg.AWS.Concurrency < 1 {
+		return 1
+	}
+	return i.cfg.AWS.Concurrency
+}
+
+// Save writes the index to a temporary file and renames it over the previous
+// copy so an interrupted save never leaves a truncated index behind.
+func (i *s3index) Save() error {
+	i.mu.Lock()
+	data, err := json.Marshal(indexFile{
+		Version: indexFormatVersion,
+		Bucket:  i.cfg.AWS.S3Bucket,
+		Entries: i.entries,
+	})
+	count := len(i.entries)
+	i.mu.Unlock()
+	if err != nil {
+		i.l.Error().Err(err).Str("path", i.path).Msg(msgSaveIndexError)
+		return err
+	}
+
+	dir := filepath.Dir(i.path)
+	if err = os.MkdirAll(dir, indexDirectoryMode); err != nil {
+		i.l.Error().Err(err).Str("path", i.path).Msg(msgSaveIndexError)
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, indexTempFilePattern)
+	if err != nil {
+		i.l.Error().Err(err).Str("path", i.path).Msg(msgSaveIndexError)
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		i.l.Error().Err(err).Str("path", i.path).Msg(msgSaveIndexError)
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		i.l.Error().Err(err).Str("path", i.path).Msg(msgSaveIndexError)
+		return err
+	}
+	if err = os.Rename(tmp.Name(), i.path); err != nil {
+		i.l.Error().Err(err).Str("path", i.path).Msg(msgSaveIndexError)
+		return err
+	}
+
+	i.l.Debug().Str("path", i.path).Int("entries", count).Msg(msgIndexSaved)
+	return nil
+}
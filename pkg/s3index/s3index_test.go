@@ -0,0 +1,221 @@
+package s3index_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/jaysonhurd/s3backup/models"
+	"github.com/jaysonhurd/s3backup/pkg/s3crypt"
+	"github.com/jaysonhurd/s3backup/pkg/s3index"
+	"github.com/jaysonhurd/s3backup/test/fakes/s3api"
+	"github.com/rs/zerolog"
+)
+
+func TestNewRequiresStateDirectory(t *testing.T) {
+	l := zerolog.Nop()
+	cfg := models.Config{AWS: models.AWS{S3Bucket: "test-bucket"}}
+
+	if _, err := s3index.New(cfg, new(s3api.FakeS3API), &l); err == nil {
+		t.Fatalf("expected New() to fail without a StateDirectory")
+	}
+}
+
+func TestSaveAndLoad(t *testing.T) {
+	l := zerolog.Nop()
+	cfg := models.Config{AWS: models.AWS{S3Bucket: "test-bucket", StateDirectory: t.TempDir()}}
+	mtime := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	idx, err := s3index.New(cfg, new(s3api.FakeS3API), &l)
+	if err != nil {
+		t.Fatalf("New() unexpected error: %v", err)
+	}
+	idx.Record(s3index.Entry{Key: "/srv/data/a.txt", Size: 5, Mtime: mtime, ETag: `"abc"`})
+	idx.Record(s3index.Entry{Key: "/srv/other/b.txt", Size: 7, Mtime: mtime})
+	if err = idx.Save(); err != nil {
+		t.Fatalf("Save() unexpected error: %v", err)
+	}
+
+	reloaded, err := s3index.New(cfg, new(s3api.FakeS3API), &l)
+	if err != nil {
+		t.Fatalf("New() unexpected error on reload: %v", err)
+	}
+	entry, ok := reloaded.Lookup("/srv/data/a.txt")
+	if !ok || entry.Size != 5 || !entry.Mtime.Equal(mtime) || entry.ETag != `"abc"` {
+		t.Fatalf("reloaded entry = %+v, %v", entry, ok)
+	}
+	if keys := reloaded.Keys("/srv/data"); len(keys) != 1 || keys[0] != "/srv/data/a.txt" {
+		t.Fatalf("Keys() = %v", keys)
+	}
+
+	reloaded.Reset()
+	if _, ok = reloaded.Lookup("/srv/data/a.txt"); ok {
+		t.Fatalf("expected Reset() to forget every entry")
+	}
+}
+
+func TestRebuild(t *testing.T) {
+	l := zerolog.Nop()
+	cfg := models.Config{AWS: models.AWS{S3Bucket: "test-bucket", StateDirectory: t.TempDir()}}
+	lastModified := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	fake := new(s3api.FakeS3API)
+	fake.ListObjectsV2Returns(&s3.ListObjectsV2Output{
+		Contents: []types.Object{{
+			Key:          aws.String("/srv/data/a.txt"),
+			Size:         aws.Int64(5),
+			LastModified: &lastModified,
+			ETag:         aws.String(`"abc"`),
+		}},
+	}, nil)
+	fake.HeadObjectReturns(&s3.HeadObjectOutput{ContentLength: aws.Int64(5), ETag: aws.String(`"abc"`)}, nil)
+
+	idx, err := s3index.New(cfg, fake, &l)
+	if err != nil {
+		t.Fatalf("New() unexpected error: %v", err)
+	}
+	idx.Record(s3index.Entry{Key: "/srv/data/stale.txt"})
+	if err = idx.Rebuild(); err != nil {
+		t.Fatalf("Rebuild() unexpected error: %v", err)
+	}
+
+	if entry, ok := idx.Lookup("/srv/data/a.txt"); !ok || entry.Size != 5 || !entry.Mtime.Equal(lastModified) {
+		t.Fatalf("rebuilt entry = %+v, %v", entry, ok)
+	}
+	if _, ok := idx.Lookup("/srv/data/stale.txt"); ok {
+		t.Fatalf("expected Rebuild() to drop entries missing from the bucket")
+	}
+}
+
+func TestRebuildBackupKeysOnly(t *testing.T) {
+	l := zerolog.Nop()
+	cfg := models.Config{AWS: models.AWS{
+		S3Bucket:       "test-bucket",
+		StateDirectory: t.TempDir(),
+		BackupMode:     "snapshot",
+		TrashPrefix:    "/srv/.trash",
+		S3LockKey:      "/srv/.s3backup.lock",
+	}}
+
+	fake := new(s3api.FakeS3API)
+	var contents []types.Object
+	for _, key := range []string{
+		"/srv/data/a.txt",
+		"objects/aa/aabb",
+		"snapshots/2026-01-02T03:04:05Z.json",
+		".trash/srv/data/old.txt",
+		"/srv/.trash/srv/data/old.txt",
+		"/srv/.s3backup.lock",
+	} {
+		contents = append(contents, types.Object{Key: aws.String(key), Size: aws.Int64(5)})
+	}
+	fake.ListObjectsV2Returns(&s3.ListObjectsV2Output{Contents: contents}, nil)
+	fake.HeadObjectReturns(&s3.HeadObjectOutput{ContentLength: aws.Int64(5)}, nil)
+
+	idx, err := s3index.New(cfg, fake, &l)
+	if err != nil {
+		t.Fatalf("New() unexpected error: %v", err)
+	}
+	if err = idx.Rebuild(); err != nil {
+		t.Fatalf("Rebuild() unexpected error: %v", err)
+	}
+
+	for _, key := range []string{"/srv/data/a.txt", "objects/aa/aabb"} {
+		if _, ok := idx.Lookup(key); !ok {
+			t.Errorf("expected Rebuild() to index %q", key)
+		}
+	}
+	for _, key := range []string{"snapshots/2026-01-02T03:04:05Z.json", ".trash/srv/data/old.txt", "/srv/.trash/srv/data/old.txt", "/srv/.s3backup.lock"} {
+		if _, ok := idx.Lookup(key); ok {
+			t.Errorf("expected Rebuild() to leave out %q", key)
+		}
+	}
+	if got := fake.HeadObjectCallCount(); got != 2 {
+		t.Fatalf("HeadObject called %d times, want 2", got)
+	}
+}
+
+func TestRebuildOriginalSize(t *testing.T) {
+	l := zerolog.Nop()
+	cfg := models.Config{AWS: models.AWS{S3Bucket: "test-bucket", StateDirectory: t.TempDir()}}
+	lastModified := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	mtime := time.Date(2025, 12, 24, 8, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		head      *s3.HeadObjectOutput
+		headErr   error
+		wantEntry *s3index.Entry
+		wantErr   bool
+	}{
+		{
+			name: "compressed",
+			head: &s3.HeadObjectOutput{
+				ContentLength:   aws.Int64(40),
+				ContentEncoding: aws.String("gzip"),
+				Metadata:        map[string]string{"size": "1000", "mtime": mtime.Format(time.RFC3339Nano), "sha256": "aa"},
+			},
+			wantEntry: &s3index.Entry{Size: 1000, Mtime: mtime, SHA256: "aa"},
+		},
+		{
+			name: "encrypted without a recorded size",
+			head: &s3.HeadObjectOutput{ContentLength: aws.Int64(1016), Metadata: map[string]string{s3crypt.MetadataAlgorithm: s3crypt.Algorithm}},
+		},
+		{
+			name:    "deleted since the listing",
+			headErr: &types.NotFound{},
+		},
+		{
+			name:    "head fails",
+			headErr: errors.New("something went wrong"),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := new(s3api.FakeS3API)
+			fake.ListObjectsV2Returns(&s3.ListObjectsV2Output{
+				Contents: []types.Object{{Key: aws.String("/srv/data/a.txt"), Size: aws.Int64(40), LastModified: &lastModified}},
+			}, nil)
+			fake.HeadObjectReturns(tt.head, tt.headErr)
+
+			idx, err := s3index.New(cfg, fake, &l)
+			if err != nil {
+				t.Fatalf("New() unexpected error: %v", err)
+			}
+			if err = idx.Rebuild(); (err != nil) != tt.wantErr {
+				t.Fatalf("Rebuild() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			entry, ok := idx.Lookup("/srv/data/a.txt")
+			if tt.wantEntry == nil {
+				if ok {
+					t.Fatalf("rebuilt entry = %+v, want the object left out", entry)
+				}
+				return
+			}
+			if !ok || entry.Size != tt.wantEntry.Size || !entry.Mtime.Equal(tt.wantEntry.Mtime) || entry.SHA256 != tt.wantEntry.SHA256 {
+				t.Fatalf("rebuilt entry = %+v, %v, want %+v", entry, ok, *tt.wantEntry)
+			}
+		})
+	}
+}
+
+func TestRebuildListFails(t *testing.T) {
+	l := zerolog.Nop()
+	cfg := models.Config{AWS: models.AWS{S3Bucket: "test-bucket", StateDirectory: t.TempDir()}}
+
+	fake := new(s3api.FakeS3API)
+	fake.ListObjectsV2Returns(nil, errors.New("something went wrong"))
+
+	idx, err := s3index.New(cfg, fake, &l)
+	if err != nil {
+		t.Fatalf("New() unexpected error: %v", err)
+	}
+	if err = idx.Rebuild(); err == nil {
+		t.Fatalf("expected Rebuild() to fail when listing fails")
+	}
+}
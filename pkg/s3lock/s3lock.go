@@ -0,0 +1,426 @@
+package s3lock
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/jaysonhurd/s3backup/models"
+	"github.com/rs/zerolog"
+)
+
+const (
+	msgLockAcquired        = "run lock acquired"
+	msgLockReleased        = "run lock released"
+	msgLocked              = "another run holds the lock, refusing to start"
+	msgWaitingForLock      = "another run holds the lock, waiting for it"
+	msgOpenLockFileError   = "unable to open lock file"
+	msgWriteLockFileError  = "unable to record holder in lock file"
+	msgWriteLockObjectErr  = "unable to write lock object"
+	msgReadLockObjectError = "unable to read lock object"
+	msgExpiredLockTaken    = "lease of lock object expired, taking over the lock"
+	msgRenewLeaseError     = "unable to renew lease of lock object"
+	msgLockLost            = "lock object was taken over by another run"
+	msgLeaseExpired        = "lease of lock object ran out before it could be renewed"
+	msgReleaseLockError    = "unable to release lock object"
+	msgRunLockLost         = "run lock was lost"
+)
+
+const (
+	// DefaultS3LockKey is where the lock object is written when S3LockKey is
+	// not set. Sync and restore only look at keys starting with a slash, so it
+	// is never mistaken for a backed-up file.
+	DefaultS3LockKey = "s3backup.lock"
+
+	defaultLease     = 5 * time.Minute
+	retryInterval    = 5 * time.Second
+	renewalsPerLease = 3
+	maxLockAttempts  = 3
+
+	lockFilePrefix  = "s3backup-"
+	lockFileSuffix  = ".lock"
+	lockContentType = "application/json"
+
+	errCodePreconditionFailed  = "PreconditionFailed"
+	errCodeConditionalConflict = "ConditionalRequestConflict"
+	errCodeNoSuchKey           = "NoSuchKey"
+	errCodeNotFound            = "NotFound"
+)
+
+var errLocked = errors.New(msgLocked)
+
+// ErrLockLost is the cause of the context returned by Lock once the lease of
+// the lock object is lost, either because another run took over the lock or
+// because it could not be renewed in time.
+var ErrLockLost = errors.New(msgRunLockLost)
+
+// Holder identifies the run holding the lock. It is the content of both the
+// lock file and the lock object.
+type Holder struct {
+	Hostname string    `json:"hostname"`
+	PID      int       `json:"pid"`
+	Acquired time.Time `json:"acquired"`
+	Expires  time.Time `json:"expires,omitzero"`
+}
+
+// Locker makes sure only one run at a time changes the bucket.
+type Locker interface {
+	Lock(ctx context.Context) (context.Context, error)
+	Unlock() error
+}
+
+type S3API interface {
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+	DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error)
+}
+
+type s3lock struct {
+	cfg models.Config
+	svc S3API
+	l   *zerolog.Logger
+
+	holder  Holder
+	file    *os.File
+	etag    string
+	expires time.Time
+	cancel  context.CancelCauseFunc
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+func New(
+	cfg models.Config,
+	svc S3API,
+	l *zerolog.Logger,
+) Locker {
+	return &s3lock{
+		cfg: cfg,
+		svc: svc,
+		l:   l,
+	}
+}
+
+// Lock takes an exclusive lock on the local LockFile and, with S3Lock, on the
+// lock object in the bucket, so runs on other hosts are kept out as well. The
+// lock object is written with If-None-Match and names its holder and the time
+// its lease runs out; the lease is renewed while the lock is held, and a lock
+// object whose lease has run out is taken over. No lock object is written in a
+// dry run. If the lock is held elsewhere Lock waits for up to
+// LockWaitSeconds, or fails at once if that is zero.
+//
+// The work done under the lock should use the returned context. It is
+// cancelled with ErrLockLost as its cause if the lease is lost while the lock
+// is held, so that the run stops instead of carrying on without the lock, and
+// it is cancelled by Unlock.
+func (k *s3lock) Lock(ctx context.Context) (context.Context, error) {
+	hostname, _ := os.Hostname()
+	k.holder = Holder{Hostname: hostname, PID: os.Getpid()}
+	deadline := time.Now().Add(time.Duration(k.cfg.AWS.LockWaitSeconds) * time.Second)
+
+	if err := k.wait(ctx, deadline, k.tryLockFile); err != nil {
+		return nil, err
+	}
+	s3Lock := k.cfg.AWS.S3Lock && !k.cfg.DryRun
+	if s3Lock {
+		if err := k.wait(ctx, deadline, k.tryLockObject); err != nil {
+			k.unlockFile()
+			return nil, err
+		}
+	}
+
+	ctx, k.cancel = context.WithCancelCause(ctx)
+	if s3Lock {
+		k.stop, k.done = make(chan struct{}), make(chan struct{})
+		go k.renew()
+	}
+
+	k.l.Info().Str("lock_file", k.lockFile()).Bool("s3_lock", k.stop != nil).Msg(msgLockAcquired)
+	return ctx, nil
+}
+
+// Unlock releases whatever Lock took. The lock object is only deleted while
+// it is still the one this run wrote.
+func (k *s3lock) Unlock() error {
+	var err error
+	if k.stop != nil {
+		close(k.stop)
+		<-k.done
+		k.stop = nil
+		if err = k.deleteLockObject(); err != nil {
+			k.l.Error().Err(err).Str("s3_key", k.lockKey()).Msg(msgReleaseLockError)
+		}
+	}
+	if k.cancel != nil {
+		k.cancel(nil)
+		k.cancel = nil
+	}
+	k.unlockFile()
+	k.l.Info().Msg(msgLockReleased)
+	return err
+}
+
+// wait calls try until it gets the lock, ctx is done or deadline has passed.
+func (k *s3lock) wait(ctx context.Context, deadline time.Time, try func(ctx context.Context) (Holder, bool, error)) error {
+	for {
+		holder, ok, err := try(ctx)
+		if err != nil || ok {
+			return err
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			k.l.Error().Err(errLocked).Str("holder_host", holder.Hostname).Int("holder_pid", holder.PID).Time("holder_since", holder.Acquired).Msg(msgLocked)
+			return errLocked
+		}
+		k.l.Warn().Str("holder_host", holder.Hostname).Int("holder_pid", holder.PID).Dur("wait_remaining", remaining).Msg(msgWaitingForLock)
+
+		timer := time.NewTimer(min(retryInterval, remaining))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// tryLockFile takes the local lock without blocking and records this run as
+// its holder. If the lock is held, the holder recorded in it is returned.
+func (k *s3lock) tryLockFile(context.Context) (Holder, bool, error) {
+	path := k.lockFile()
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		k.l.Error().Err(err).Str("lock_file", path).Msg(msgOpenLockFileError)
+		return Holder{}, false, err
+	}
+	ok, err := lockFile(f)
+	if err != nil || !ok {
+		f.Close()
+		var holder Holder
+		if data, readErr := os.ReadFile(path); readErr == nil {
+			_ = json.Unmarshal(data, &holder)
+		}
+		return holder, false, err
+	}
+
+	k.file = f
+	k.holder.Acquired = time.Now().UTC()
+	data, _ := json.Marshal(k.holder)
+	if err = f.Truncate(0); err == nil {
+		_, err = f.WriteAt(data, 0)
+	}
+	if err != nil {
+		k.l.Warn().Err(err).Str("lock_file", path).Msg(msgWriteLockFileError)
+	}
+	return k.holder, true, nil
+}
+
+func (k *s3lock) unlockFile() {
+	if k.file == nil {
+		return
+	}
+	_ = unlockFile(k.file)
+	k.file.Close()
+	k.file = nil
+}
+
+// tryLockObject creates the lock object unless it already exists. An existing
+// lock object whose lease has run out is replaced, conditional on it still
+// being the one that was read. If the lock is held, its holder is returned.
+func (k *s3lock) tryLockObject(ctx context.Context) (Holder, bool, error) {
+	for range maxLockAttempts {
+		etag, err := k.putLockObject(ctx, "")
+		if err == nil {
+			k.etag = etag
+			return k.holder, true, nil
+		}
+		if !conditionFailed(err) {
+			k.l.Error().Err(err).Str("s3_key", k.lockKey()).Msg(msgWriteLockObjectErr)
+			return Holder{}, false, err
+		}
+
+		holder, current, err := k.readLockObject(ctx)
+		if hasErrorCode(err, errCodeNoSuchKey) {
+			// Released since the write was refused.
+			continue
+		}
+		if err != nil {
+			k.l.Error().Err(err).Str("s3_key", k.lockKey()).Msg(msgReadLockObjectError)
+			return Holder{}, false, err
+		}
+		if time.Now().Before(holder.Expires) {
+			return holder, false, nil
+		}
+
+		k.l.Warn().Str("holder_host", holder.Hostname).Int("holder_pid", holder.PID).Time("expired", holder.Expires).Msg(msgExpiredLockTaken)
+		etag, err = k.putLockObject(ctx, current)
+		if err == nil {
+			k.etag = etag
+			return k.holder, true, nil
+		}
+		if !conditionFailed(err) {
+			k.l.Error().Err(err).Str("s3_key", k.lockKey()).Msg(msgWriteLockObjectErr)
+			return Holder{}, false, err
+		}
+	}
+	return Holder{}, false, nil
+}
+
+// putLockObject writes this run's holder record with a fresh lease. With an
+// empty ifMatch the write only succeeds if there is no lock object, otherwise
+// only if the lock object still has that ETag.
+func (k *s3lock) putLockObject(ctx context.Context, ifMatch string) (string, error) {
+	expires := time.Now().UTC().Add(k.lease())
+	k.holder.Expires = expires
+	data, err := json.Marshal(k.holder)
+	if err != nil {
+		return "", err
+	}
+
+	input := &s3.PutObjectInput{
+		Bucket:               aws.String(k.cfg.AWS.S3Bucket),
+		Key:                  aws.String(k.lockKey()),
+		Body:                 bytes.NewReader(data),
+		ContentLength:        aws.Int64(int64(len(data))),
+		ContentType:          aws.String(lockContentType),
+		ServerSideEncryption: s3types.ServerSideEncryption(k.cfg.AWS.ServerSideEncryption),
+	}
+	if ifMatch == "" {
+		input.IfNoneMatch = aws.String("*")
+	} else {
+		input.IfMatch = aws.String(ifMatch)
+	}
+
+	result, err := k.svc.PutObject(ctx, input)
+	if err != nil {
+		return "", err
+	}
+	k.expires = expires
+	return aws.ToString(result.ETag), nil
+}
+
+// readLockObject returns the holder recorded in the lock object and its ETag.
+func (k *s3lock) readLockObject(ctx context.Context) (Holder, string, error) {
+	var holder Holder
+	result, err := k.svc.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(k.cfg.AWS.S3Bucket),
+		Key:    aws.String(k.lockKey()),
+	})
+	if err != nil {
+		return holder, "", err
+	}
+	defer result.Body.Close()
+
+	err = json.NewDecoder(result.Body).Decode(&holder)
+	return holder, aws.ToString(result.ETag), err
+}
+
+// renew extends the lease of the lock object until Unlock is called. If the
+// lock object was taken over in the meantime, or the lease ran out because it
+// could not be renewed, renewing stops and the context returned by Lock is
+// cancelled.
+func (k *s3lock) renew() {
+	defer close(k.done)
+	ticker := time.NewTicker(k.lease() / renewalsPerLease)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-k.stop:
+			return
+		case <-ticker.C:
+		}
+		etag, err := k.putLockObject(context.Background(), k.etag)
+		if conditionFailed(err) {
+			k.l.Error().Err(err).Str("s3_key", k.lockKey()).Msg(msgLockLost)
+			k.cancel(ErrLockLost)
+			return
+		}
+		if err != nil && !time.Now().Before(k.expires) {
+			k.l.Error().Err(err).Str("s3_key", k.lockKey()).Time("expired", k.expires).Msg(msgLeaseExpired)
+			k.cancel(ErrLockLost)
+			return
+		}
+		if err != nil {
+			k.l.Warn().Err(err).Str("s3_key", k.lockKey()).Msg(msgRenewLeaseError)
+			continue
+		}
+		k.etag = etag
+	}
+}
+
+// deleteLockObject removes the lock object if it is still the one written by
+// this run.
+func (k *s3lock) deleteLockObject() error {
+	ctx := context.Background()
+	head, err := k.svc.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(k.cfg.AWS.S3Bucket),
+		Key:    aws.String(k.lockKey()),
+	})
+	var nfErr *s3types.NotFound
+	if errors.As(err, &nfErr) || hasErrorCode(err, errCodeNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if aws.ToString(head.ETag) != k.etag {
+		k.l.Warn().Str("s3_key", k.lockKey()).Msg(msgLockLost)
+		return nil
+	}
+	_, err = k.svc.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(k.cfg.AWS.S3Bucket),
+		Key:    aws.String(k.lockKey()),
+	})
+	return err
+}
+
+// lockFile returns LockFile, or a file in the temporary directory named after
+// the bucket.
+func (k *s3lock) lockFile() string {
+	if k.cfg.AWS.LockFile != "" {
+		return k.cfg.AWS.LockFile
+	}
+	return filepath.Join(os.TempDir(), lockFilePrefix+k.cfg.AWS.S3Bucket+lockFileSuffix)
+}
+
+func (k *s3lock) lockKey() string {
+	return Key(k.cfg)
+}
+
+// Key returns the key of the lock object, S3LockKey or DefaultS3LockKey.
+// Wipe and sync leave it alone, since the run doing them holds the lock.
+func Key(cfg models.Config) string {
+	if cfg.AWS.S3LockKey != "" {
+		return cfg.AWS.S3LockKey
+	}
+	return DefaultS3LockKey
+}
+
+func (k *s3lock) lease() time.Duration {
+	if k.cfg.AWS.LockLeaseSeconds > 0 {
+		return time.Duration(k.cfg.AWS.LockLeaseSeconds) * time.Second
+	}
+	return defaultLease
+}
+
+// conditionFailed reports whether a conditional write was refused because the
+// lock object exists or changed, or because of a concurrent conditional write.
+func conditionFailed(err error) bool {
+	return hasErrorCode(err, errCodePreconditionFailed) || hasErrorCode(err, errCodeConditionalConflict)
+}
+
+func hasErrorCode(err error, code string) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == code
+}
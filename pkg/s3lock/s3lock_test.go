@@ -0,0 +1,179 @@
+package s3lock_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+	"github.com/jaysonhurd/s3backup/models"
+	"github.com/jaysonhurd/s3backup/pkg/s3lock"
+	"github.com/jaysonhurd/s3backup/test/fakes/s3api"
+	"github.com/rs/zerolog"
+)
+
+var errPreconditionFailed = &smithy.GenericAPIError{Code: "PreconditionFailed", Message: "At least one of the pre-conditions you specified did not hold"}
+
+func lockConfig(t *testing.T, s3Lock bool) models.Config {
+	return models.Config{AWS: models.AWS{
+		S3Bucket: "test-bucket",
+		LockFile: filepath.Join(t.TempDir(), "s3backup.lock"),
+		S3Lock:   s3Lock,
+	}}
+}
+
+func lockObject(t *testing.T, holder s3lock.Holder, etag string) *s3.GetObjectOutput {
+	data, err := json.Marshal(holder)
+	if err != nil {
+		t.Fatalf("unable to encode holder: %v", err)
+	}
+	return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(string(data))), ETag: aws.String(etag)}
+}
+
+func TestLockFile(t *testing.T) {
+	l := zerolog.Nop()
+	cfg := lockConfig(t, false)
+
+	first := s3lock.New(cfg, new(s3api.FakeS3API), &l)
+	if _, err := first.Lock(context.Background()); err != nil {
+		t.Fatalf("Lock() unexpected error: %v", err)
+	}
+
+	second := s3lock.New(cfg, new(s3api.FakeS3API), &l)
+	if _, err := second.Lock(context.Background()); err == nil {
+		t.Fatalf("expected Lock() to fail while another run holds the lock")
+	}
+
+	if err := first.Unlock(); err != nil {
+		t.Fatalf("Unlock() unexpected error: %v", err)
+	}
+	if _, err := second.Lock(context.Background()); err != nil {
+		t.Fatalf("Lock() after Unlock() unexpected error: %v", err)
+	}
+	_ = second.Unlock()
+}
+
+func TestLockObject(t *testing.T) {
+	l := zerolog.Nop()
+	cfg := lockConfig(t, true)
+	fake := new(s3api.FakeS3API)
+	fake.PutObjectReturns(&s3.PutObjectOutput{ETag: aws.String(`"mine"`)}, nil)
+	fake.HeadObjectReturns(&s3.HeadObjectOutput{ETag: aws.String(`"mine"`)}, nil)
+
+	lock := s3lock.New(cfg, fake, &l)
+	if _, err := lock.Lock(context.Background()); err != nil {
+		t.Fatalf("Lock() unexpected error: %v", err)
+	}
+	input := fake.LastPutObjectInput
+	if aws.ToString(input.Key) != s3lock.DefaultS3LockKey || aws.ToString(input.IfNoneMatch) != "*" {
+		t.Fatalf("lock object written to %q with If-None-Match %q", aws.ToString(input.Key), aws.ToString(input.IfNoneMatch))
+	}
+	var holder s3lock.Holder
+	if err := json.NewDecoder(input.Body).Decode(&holder); err != nil {
+		t.Fatalf("unable to decode lock object: %v", err)
+	}
+	if holder.Hostname == "" || holder.PID == 0 || !holder.Expires.After(time.Now()) {
+		t.Fatalf("lock object does not identify its holder: %+v", holder)
+	}
+
+	if err := lock.Unlock(); err != nil {
+		t.Fatalf("Unlock() unexpected error: %v", err)
+	}
+	if fake.DeleteObjectCallCount() != 1 {
+		t.Fatalf("expected Unlock() to delete the lock object")
+	}
+}
+
+func TestLockObjectHeld(t *testing.T) {
+	l := zerolog.Nop()
+	cfg := lockConfig(t, true)
+
+	tests := []struct {
+		name    string
+		expires time.Time
+		wantErr bool
+	}{
+		{name: "lease current", expires: time.Now().Add(time.Hour), wantErr: true},
+		{name: "lease expired", expires: time.Now().Add(-time.Minute)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := new(s3api.FakeS3API)
+			fake.PutObjectReturnsOnCall(0, nil, errPreconditionFailed)
+			fake.PutObjectReturnsOnCall(1, &s3.PutObjectOutput{ETag: aws.String(`"mine"`)}, nil)
+			fake.GetObjectReturns(lockObject(t, s3lock.Holder{Hostname: "elsewhere", PID: 42, Expires: tt.expires}, `"theirs"`), nil)
+
+			lock := s3lock.New(cfg, fake, &l)
+			_, err := lock.Lock(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Lock() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				// The local lock must not be left behind.
+				localCfg := cfg
+				localCfg.AWS.S3Lock = false
+				local := s3lock.New(localCfg, fake, &l)
+				if _, localErr := local.Lock(context.Background()); localErr != nil {
+					t.Fatalf("local lock still held after Lock() failed: %v", localErr)
+				}
+				_ = local.Unlock()
+				return
+			}
+			defer lock.Unlock()
+
+			inputs := fake.PutObjectInputs()
+			if len(inputs) != 2 || aws.ToString(inputs[1].IfMatch) != `"theirs"` {
+				t.Fatalf("expected the expired lock object to be replaced conditionally")
+			}
+		})
+	}
+}
+
+func TestLockDryRun(t *testing.T) {
+	l := zerolog.Nop()
+	cfg := lockConfig(t, true)
+	cfg.DryRun = true
+	fake := new(s3api.FakeS3API)
+
+	lock := s3lock.New(cfg, fake, &l)
+	if _, err := lock.Lock(context.Background()); err != nil {
+		t.Fatalf("Lock() unexpected error: %v", err)
+	}
+	_ = lock.Unlock()
+	if fake.PutObjectCallCount() != 0 || fake.DeleteObjectCallCount() != 0 {
+		t.Fatalf("expected no lock object in a dry run")
+	}
+}
+
+func TestLockLostCancelsContext(t *testing.T) {
+	l := zerolog.Nop()
+	cfg := lockConfig(t, true)
+	cfg.AWS.LockLeaseSeconds = 1
+	fake := new(s3api.FakeS3API)
+	fake.PutObjectReturnsOnCall(0, &s3.PutObjectOutput{ETag: aws.String(`"mine"`)}, nil)
+	fake.PutObjectReturnsOnCall(1, nil, errPreconditionFailed)
+	fake.HeadObjectReturns(&s3.HeadObjectOutput{ETag: aws.String(`"theirs"`)}, nil)
+
+	lock := s3lock.New(cfg, fake, &l)
+	ctx, err := lock.Lock(context.Background())
+	if err != nil {
+		t.Fatalf("Lock() unexpected error: %v", err)
+	}
+	defer lock.Unlock()
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the context to be cancelled once the lock object was taken over")
+	}
+	if cause := context.Cause(ctx); !errors.Is(cause, s3lock.ErrLockLost) {
+		t.Fatalf("context cause = %v, want %v", cause, s3lock.ErrLockLost)
+	}
+}
@@ -0,0 +1,140 @@
+package s3restore
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jaysonhurd/s3backup/pkg/fileattr"
+	"github.com/jaysonhurd/s3backup/pkg/s3backup"
+)
+
+const (
+	msgRestoringDirectory = "restoring empty directory"
+	msgRestoringSymlink   = "restoring symbolic link"
+	msgRestoringHardLink  = "restoring hard link"
+	msgHardLinkFallback   = "hard link target was not restored, restoring its contents instead"
+	msgInvalidLinkTarget  = "object has an invalid link target"
+	msgUnsafeTarget       = "hard link target is outside the restore path"
+)
+
+var errUnsafeTarget = errors.New(msgUnsafeTarget)
+
+// hardLink is a file to be linked to targetKey once every file is restored.
+// key and targetKey are what they were backed up as.
+type hardLink struct {
+	key       string
+	targetKey string
+}
+
+// restoreWithoutContents recreates the empty directories, symbolic links and
+// hard links that the backup stored as zero-byte objects, or as manifest
+// entries without contents. It reports false for anything else, which is
+// restored as a regular file.
+func (r *s3restore) restoreWithoutContents(key string, metadata map[string]string, attrs fileattr.Attributes) (bool, error) {
+	localPath, err := r.destination(key)
+	if err != nil {
+		r.l.Error().Err(err).Str("s3_key", key).Msg(msgUnsafeKey)
+		return true, err
+	}
+
+	switch {
+	case strings.HasSuffix(key, restoredKeyPathSeparator):
+		r.l.Info().Str("s3_key", key).Str("path", localPath).Msg(msgRestoringDirectory)
+		if err := os.MkdirAll(localPath, restoredDirectoryMode); err != nil {
+			r.l.Error().Err(err).Str("path", localPath).Msg(msgCreateDirectoryError)
+			return true, err
+		}
+		if err := fileattr.Apply(localPath, attrs); err != nil {
+			r.l.Warn().Err(err).Str("path", localPath).Msg(msgSetAttributesError)
+		}
+		return true, nil
+
+	case metadata[s3backup.MetadataSymlinkTarget] != "":
+		target, err := url.PathUnescape(metadata[s3backup.MetadataSymlinkTarget])
+		if err != nil {
+			r.l.Error().Err(err).Str("s3_key", key).Msg(msgInvalidLinkTarget)
+			return true, err
+		}
+		r.l.Info().Str("s3_key", key).Str("path", localPath).Str("target", target).Msg(msgRestoringSymlink)
+		if err = r.replaceWith(localPath, func() error { return os.Symlink(target, localPath) }); err != nil {
+			return true, err
+		}
+		r.symlinks = append(r.symlinks, localPath)
+		if attrs.HasOwner {
+			if err = os.Lchown(localPath, attrs.UID, attrs.GID); err != nil {
+				r.l.Warn().Err(err).Str("path", localPath).Msg(msgSetAttributesError)
+			}
+		}
+		return true, nil
+
+	case metadata[s3backup.MetadataHardLinkTarget] != "":
+		targetKey, err := url.PathUnescape(metadata[s3backup.MetadataHardLinkTarget])
+		if err != nil {
+			r.l.Error().Err(err).Str("s3_key", key).Msg(msgInvalidLinkTarget)
+			return true, err
+		}
+		r.hardLinks = append(r.hardLinks, hardLink{key: key, targetKey: targetKey})
+		return true, nil
+	}
+	return false, nil
+}
+
+// restoreHardLinks links every hard link collected during the restore to its
+// restored target. When the target was not part of this restore, or lies
+// outside the restored directory, its contents are restored to the link's
+// path instead. It reports whether any failed.
+func (r *s3restore) restoreHardLinks(ctx context.Context) (failed bool) {
+	for _, link := range r.hardLinks {
+		if ctx.Err() != nil {
+			break
+		}
+		err := r.restoreHardLink(link)
+		if errors.Is(err, fs.ErrNotExist) || errors.Is(err, errUnsafeTarget) {
+			r.l.Warn().Str("s3_key", link.key).Str("target_key", link.targetKey).Msg(msgHardLinkFallback)
+			err = r.restoreFile(ctx, link.targetKey, "", fileAttributes{path: link.key})
+		}
+		if err != nil {
+			r.l.Error().Err(err).Str("s3_key", link.key).Msg(msgRestoreFileError)
+			failed = true
+		}
+	}
+	r.hardLinks = nil
+	return failed
+}
+
+// restoreHardLink links a single hard link to its target. Both paths are
+// resolved only now, so that symbolic links restored after the hard link was
+// listed are taken into account.
+func (r *s3restore) restoreHardLink(link hardLink) error {
+	path, err := r.destination(link.key)
+	if err != nil {
+		r.l.Error().Err(err).Str("s3_key", link.key).Msg(msgUnsafeKey)
+		return err
+	}
+	target, err := r.destination(link.targetKey)
+	if err != nil {
+		return errUnsafeTarget
+	}
+	r.l.Info().Str("s3_key", link.key).Str("path", path).Str("target", target).Msg(msgRestoringHardLink)
+	return r.replaceWith(path, func() error { return os.Link(target, path) })
+}
+
+// replaceWith creates the parent directory of path, removes whatever is at
+// path and calls create to put the link in its place.
+func (r *s3restore) replaceWith(path string, create func() error) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, restoredDirectoryMode); err != nil {
+		r.l.Error().Err(err).Str("path", dir).Msg(msgCreateDirectoryError)
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		r.l.Error().Err(err).Str("path", path).Msg(msgWriteFileError)
+		return err
+	}
+	return create()
+}
@@ -0,0 +1,459 @@
+package s3restore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/jaysonhurd/s3backup/models"
+	"github.com/jaysonhurd/s3backup/pkg/fileattr"
+	"github.com/jaysonhurd/s3backup/pkg/s3backup"
+	"github.com/jaysonhurd/s3backup/pkg/s3crypt"
+	"github.com/jaysonhurd/s3backup/pkg/s3snapshot"
+	"github.com/rs/zerolog"
+)
+
+const (
+	msgRestoreKeyError      = "unable to determine S3 prefix for directory"
+	msgListObjectsError     = "unable to list objects for restore"
+	msgRestoringFile        = "restoring file"
+	msgRestoreFileError     = "error restoring file from S3"
+	msgGetObjectError       = "GetObject failed"
+	msgCreateDirectoryError = "error creating local directory"
+	msgWriteFileError       = "error writing restored file"
+	msgSetAttributesError   = "unable to restore all attributes of file"
+	msgRestoreIncomplete    = "one or more files could not be restored"
+	msgListVersionsError    = "unable to list object versions for restore"
+	msgDeletedAsOf          = "file was deleted as of the requested time, skipping"
+	msgNoCipher             = "object is encrypted but no encryption key is configured"
+	msgDecryptError         = "unable to decrypt object"
+	msgDecompressError      = "unable to decompress object"
+	msgUnsafeKey            = "object would be restored outside the restore path, skipping"
+)
+
+const (
+	restoredDirectoryMode    = 0o755
+	restoredTempFilePattern  = ".s3restore-*"
+	restoredKeyPathSeparator = "/"
+)
+
+var (
+	errRestoreIncomplete = errors.New(msgRestoreIncomplete)
+	errNoCipher          = errors.New(msgNoCipher)
+	errUnsafeKey         = errors.New(msgUnsafeKey)
+)
+
+type S3restorer interface {
+	RestoreDirectory(ctx context.Context) error
+	SetAsOf(asOf time.Time) error
+	SetSnapshot(manifest s3snapshot.Manifest) error
+	SetCipher(c s3crypt.Cipher) error
+}
+
+type S3API interface {
+	ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	ListObjectVersions(ctx context.Context, params *s3.ListObjectVersionsInput, optFns ...func(*s3.Options)) (*s3.ListObjectVersionsOutput, error)
+}
+
+type s3restore struct {
+	cfg    models.Config
+	svc    S3API
+	dir    string
+	target string
+	l      *zerolog.Logger
+
+	// root is the local path of dir. Nothing is restored outside it.
+	root string
+
+	asOf     time.Time
+	manifest *s3snapshot.Manifest
+	c        s3crypt.Cipher
+
+	// hardLinks are created once every file has been restored, since the
+	// file a link refers to may come later in the listing.
+	hardLinks []hardLink
+	// symlinks are the symbolic links created so far. Nothing is restored
+	// through them.
+	symlinks []string
+}
+
+// New returns a restorer for a single backup directory, or any file or
+// directory below one. When target is empty files are written back to their
+// original location, otherwise the original absolute path is recreated
+// underneath target.
+func New(
+	cfg models.Config,
+	svc S3API,
+	dir string,
+	target string,
+	l *zerolog.Logger,
+) S3restorer {
+	return &s3restore{
+		cfg:    cfg,
+		svc:    svc,
+		dir:    dir,
+		target: target,
+		l:      l,
+	}
+}
+
+// SetAsOf restores every file as it was at asOf instead of its latest version.
+// This needs a bucket with versioning enabled.
+func (r *s3restore) SetAsOf(asOf time.Time) (err error) {
+	r.asOf = asOf
+	return nil
+}
+
+// SetSnapshot restores the files recorded in a snapshot manifest instead of
+// the mirrored objects.
+func (r *s3restore) SetSnapshot(manifest s3snapshot.Manifest) (err error) {
+	r.manifest = &manifest
+	return nil
+}
+
+// SetCipher sets the cipher used to decrypt objects that were encrypted on
+// upload. Objects without encryption metadata are restored as they are.
+func (r *s3restore) SetCipher(c s3crypt.Cipher) (err error) {
+	r.c = c
+	return nil
+}
+
+// RestoreDirectory downloads every object stored under the directory's key
+// prefix and writes it back to disk. Individual file failures are logged and
+// the restore continues; an error is returned at the end if any file failed.
+// Once ctx is done no further files are started, the one being written is
+// finished and the cause of ctx is returned.
+func (r *s3restore) RestoreDirectory(ctx context.Context) (err error) {
+	prefix, err := s3backup.ObjectKey(r.dir)
+	if err != nil {
+		r.l.Error().Err(err).Str("root_dir", r.dir).Msg(msgRestoreKeyError)
+		return err
+	}
+	prefix = strings.TrimSuffix(prefix, restoredKeyPathSeparator)
+	r.root = s3backup.LocalPath(prefix)
+
+	var failed bool
+	switch {
+	case r.manifest != nil:
+		failed = r.restoreSnapshot(ctx, prefix)
+	case !r.asOf.IsZero():
+		failed, err = r.restoreAsOf(ctx, prefix)
+	default:
+		failed, err = r.restoreLatest(ctx, prefix)
+	}
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	if r.restoreHardLinks(ctx) {
+		failed = true
+	}
+
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+	if failed {
+		return errRestoreIncomplete
+	}
+	return nil
+}
+
+// restoreLatest restores the current version of every object under prefix.
+func (r *s3restore) restoreLatest(ctx context.Context, prefix string) (failed bool, err error) {
+	p := s3.NewListObjectsV2Paginator(r.svc, &s3.ListObjectsV2Input{
+		Bucket: aws.String(r.cfg.AWS.S3Bucket),
+		Prefix: aws.String(prefix),
+	})
+
+	for p.HasMorePages() && ctx.Err() == nil {
+		page, pageErr := p.NextPage(ctx)
+		if pageErr != nil && ctx.Err() != nil {
+			return failed, nil
+		}
+		if pageErr != nil {
+			r.l.Error().Err(pageErr).Str("bucket", r.cfg.AWS.S3Bucket).Str("prefix", prefix).Msg(msgListObjectsError)
+			return failed, pageErr
+		}
+
+		for i := range page.Contents {
+			if ctx.Err() != nil {
+				return failed, nil
+			}
+			if page.Contents[i].Key == nil {
+				continue
+			}
+			key := *page.Contents[i].Key
+			if !r.restorable(key, prefix) {
+				continue
+			}
+			err = r.restoreFile(ctx, key, "", fileAttributes{})
+			if err != nil {
+				r.l.Error().Err(err).Str("s3_key", key).Msg(msgRestoreFileError)
+				failed = true
+			}
+		}
+	}
+	return failed, nil
+}
+
+// versionAsOf is the newest version or delete marker of a key that is not
+// after the requested time.
+type versionAsOf struct {
+	versionID    string
+	lastModified time.Time
+	deleted      bool
+}
+
+// restoreAsOf restores every key under prefix as it was at r.asOf. All
+// versions are listed first because the versions of one key may be split
+// across pages. Keys whose newest entry by then is a delete marker, or that
+// did not exist yet, are skipped.
+func (r *s3restore) restoreAsOf(ctx context.Context, prefix string) (failed bool, err error) {
+	chosen := make(map[string]versionAsOf)
+	consider := func(key *string, versionID *string, lastModified *time.Time, deleted bool) {
+		if key == nil || lastModified == nil || lastModified.After(r.asOf) {
+			return
+		}
+		if current, ok := chosen[*key]; ok && !lastModified.After(current.lastModified) {
+			return
+		}
+		chosen[*key] = versionAsOf{versionID: aws.ToString(versionID), lastModified: *lastModified, deleted: deleted}
+	}
+
+	p := s3.NewListObjectVersionsPaginator(r.svc, &s3.ListObjectVersionsInput{
+		Bucket: aws.String(r.cfg.AWS.S3Bucket),
+		Prefix: aws.String(prefix),
+	})
+	for p.HasMorePages() && ctx.Err() == nil {
+		page, pageErr := p.NextPage(ctx)
+		if pageErr != nil && ctx.Err() != nil {
+			return false, nil
+		}
+		if pageErr != nil {
+			r.l.Error().Err(pageErr).Str("bucket", r.cfg.AWS.S3Bucket).Str("prefix", prefix).Msg(msgListVersionsError)
+			return false, pageErr
+		}
+		for _, version := range page.Versions {
+			consider(version.Key, version.VersionId, version.LastModified, false)
+		}
+		for _, marker := range page.DeleteMarkers {
+			consider(marker.Key, marker.VersionId, marker.LastModified, true)
+		}
+	}
+
+	// Keys are restored in order, as in a snapshot, so that a symbolic link or
+	// directory marker always comes before the paths below it.
+	for _, key := range slices.Sorted(maps.Keys(chosen)) {
+		version := chosen[key]
+		if ctx.Err() != nil {
+			break
+		}
+		if !r.restorable(key, prefix) {
+			continue
+		}
+		if version.deleted {
+			r.l.Info().Str("s3_key", key).Time("as_of", r.asOf).Msg(msgDeletedAsOf)
+			continue
+		}
+		err = r.restoreFile(ctx, key, version.versionID, fileAttributes{})
+		if err != nil {
+			r.l.Error().Err(err).Str("s3_key", key).Str("version_id", version.versionID).Msg(msgRestoreFileError)
+			failed = true
+		}
+	}
+	return failed, nil
+}
+
+// restoreSnapshot restores the manifest's files under prefix from their
+// content-addressed objects.
+func (r *s3restore) restoreSnapshot(ctx context.Context, prefix string) (failed bool) {
+	for _, entry := range r.manifest.Entries {
+		if ctx.Err() != nil {
+			break
+		}
+		if !r.restorable(entry.Path, prefix) {
+			continue
+		}
+		var err error
+		if entry.Key == "" {
+			_, err = r.restoreWithoutContents(entry.Path, entry.Attributes, *snapshotAttributes(entry))
+		} else {
+			err = r.restoreFile(ctx, entry.Key, "", fileAttributes{path: entry.Path, attrs: snapshotAttributes(entry)})
+		}
+		if err != nil {
+			r.l.Error().Err(err).Str("s3_key", entry.Key).Str("path", entry.Path).Msg(msgRestoreFileError)
+			failed = true
+		}
+	}
+	return failed
+}
+
+// snapshotAttributes returns the attributes recorded for a file in a manifest.
+// Manifests written before attributes were recorded only carry the mode.
+func snapshotAttributes(entry s3snapshot.Entry) *fileattr.Attributes {
+	attrs := fileattr.Parse(entry.Attributes)
+	if _, ok := entry.Attributes[fileattr.MetadataMode]; !ok {
+		attrs.Mode = entry.Mode & (fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky)
+	}
+	attrs.Mtime = entry.Mtime
+	return &attrs
+}
+
+// restorable reports whether key is the prefix itself or lies below it.
+// Directory markers are included so that empty directories are recreated.
+func (r *s3restore) restorable(key string, prefix string) bool {
+	return key == prefix || strings.HasPrefix(key, prefix+restoredKeyPathSeparator)
+}
+
+// fileAttributes overrides what restoreFile derives from the object. The
+// zero value restores the file to the path its key mirrors with the
+// attributes recorded in the object's metadata.
+type fileAttributes struct {
+	path  string
+	attrs *fileattr.Attributes
+}
+
+// restoreFile downloads a single object, or one version of it when versionID
+// is set, into a temporary file next to its destination, applies the file's
+// attributes and renames it into place once the download is complete.
+func (r *s3restore) restoreFile(ctx context.Context, key string, versionID string, attrs fileAttributes) error {
+	if attrs.path == "" {
+		attrs.path = key
+	}
+	localPath, err := r.destination(attrs.path)
+	if err != nil {
+		r.l.Error().Err(err).Str("s3_key", key).Str("path", attrs.path).Msg(msgUnsafeKey)
+		return err
+	}
+	r.l.Info().Str("s3_key", key).Str("version_id", versionID).Str("path", localPath).Msg(msgRestoringFile)
+
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(r.cfg.AWS.S3Bucket),
+		Key:    aws.String(key),
+	}
+	if versionID != "" {
+		input.VersionId = aws.String(versionID)
+	}
+	// A file already being downloaded is finished rather than left behind
+	// half written.
+	result, err := r.svc.GetObject(context.WithoutCancel(ctx), input)
+	if err != nil {
+		r.l.Error().Err(err).Str("s3_key", key).Msg(msgGetObjectError)
+		return err
+	}
+	defer result.Body.Close()
+
+	// Objects written before attributes were recorded only have their
+	// LastModified time, which is used so that a subsequent backup does not
+	// consider the restored file newer than the copy in S3.
+	fileAttrs := fileattr.Parse(result.Metadata)
+	if attrs.attrs != nil {
+		fileAttrs = *attrs.attrs
+	}
+	if fileAttrs.Mtime.IsZero() && result.LastModified != nil {
+		fileAttrs.Mtime = *result.LastModified
+	}
+
+	if restored, err := r.restoreWithoutContents(attrs.path, result.Metadata, fileAttrs); restored {
+		return err
+	}
+
+	var body io.Reader = result.Body
+	if _, encrypted := result.Metadata[s3crypt.MetadataAlgorithm]; encrypted {
+		if r.c == nil {
+			r.l.Error().Err(errNoCipher).Str("s3_key", key).Msg(msgDecryptError)
+			return errNoCipher
+		}
+		if body, err = r.c.Decrypt(result.Body, result.Metadata); err != nil {
+			r.l.Error().Err(err).Str("s3_key", key).Msg(msgDecryptError)
+			return err
+		}
+	}
+	encoding := aws.ToString(result.ContentEncoding)
+	if compression, ok := result.Metadata[s3backup.MetadataCompression]; ok {
+		encoding = compression
+	}
+	contents, err := s3backup.Decompress(body, encoding)
+	if err != nil {
+		r.l.Error().Err(err).Str("s3_key", key).Msg(msgDecompressError)
+		return err
+	}
+	defer contents.Close()
+
+	dir := filepath.Dir(localPath)
+	if err = os.MkdirAll(dir, restoredDirectoryMode); err != nil {
+		r.l.Error().Err(err).Str("path", dir).Msg(msgCreateDirectoryError)
+		return err
+	}
+
+	tmp, err := os.CreateTemp(dir, restoredTempFilePattern)
+	if err != nil {
+		r.l.Error().Err(err).Str("path", localPath).Msg(msgWriteFileError)
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = io.Copy(tmp, contents); err != nil {
+		tmp.Close()
+		r.l.Error().Err(err).Str("path", localPath).Msg(msgWriteFileError)
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		r.l.Error().Err(err).Str("path", localPath).Msg(msgWriteFileError)
+		return err
+	}
+
+	if err = fileattr.Apply(tmp.Name(), fileAttrs); err != nil {
+		r.l.Warn().Err(err).Str("path", localPath).Msg(msgSetAttributesError)
+	}
+
+	if err = os.Rename(tmp.Name(), localPath); err != nil {
+		r.l.Error().Err(err).Str("path", localPath).Msg(msgWriteFileError)
+		return err
+	}
+	return nil
+}
+
+// destination returns the local path key is restored to. Keys with ".."
+// segments are rejected, as are keys that would be restored outside the
+// restored directory or the target, or through a symbolic link restored
+// earlier in the run.
+func (r *s3restore) destination(key string) (string, error) {
+	if slices.Contains(strings.Split(key, restoredKeyPathSeparator), "..") {
+		return "", errUnsafeKey
+	}
+	localPath := filepath.Clean(s3backup.LocalPath(key))
+	if !within(localPath, r.root) {
+		return "", errUnsafeKey
+	}
+	if r.target != "" {
+		localPath = filepath.Join(r.target, localPath)
+		if !within(localPath, filepath.Clean(r.target)) {
+			return "", errUnsafeKey
+		}
+	}
+	for _, link := range r.symlinks {
+		if within(localPath, link) {
+			return "", errUnsafeKey
+		}
+	}
+	return localPath, nil
+}
+
+// within reports whether path is dir or lies below it. Both must be clean.
+func within(path string, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
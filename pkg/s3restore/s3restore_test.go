@@ -0,0 +1,406 @@
+package s3restore_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/jaysonhurd/s3backup/models"
+	"github.com/jaysonhurd/s3backup/pkg/fileattr"
+	"github.com/jaysonhurd/s3backup/pkg/s3backup"
+	"github.com/jaysonhurd/s3backup/pkg/s3crypt"
+	"github.com/jaysonhurd/s3backup/pkg/s3restore"
+	"github.com/jaysonhurd/s3backup/pkg/s3snapshot"
+	"github.com/jaysonhurd/s3backup/test/fakes/s3api"
+	"github.com/rs/zerolog"
+)
+
+func TestRestoreDirectoryToTarget(t *testing.T) {
+	l := zerolog.Nop()
+	cfg := models.Config{AWS: models.AWS{S3Bucket: "test-bucket"}}
+	target := t.TempDir()
+
+	fake := new(s3api.FakeS3API)
+	fake.ListObjectsV2Returns(&s3.ListObjectsV2Output{
+		Contents: []types.Object{
+			{Key: aws.String("/srv/data/")},
+			{Key: aws.String("/srv/data/docs/file.txt")},
+		},
+	}, nil)
+	fake.GetObjectReturns(&s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader("hello"))}, nil)
+
+	restorer := s3restore.New(cfg, fake, "/srv/data", target, &l)
+	if err := restorer.RestoreDirectory(context.Background()); err != nil {
+		t.Fatalf("RestoreDirectory() unexpected error: %v", err)
+	}
+
+	got, err := os.ReadFile(filepath.Join(target, "srv", "data", "docs", "file.txt"))
+	if err != nil {
+		t.Fatalf("expected restored file: %v", err)
+	}
+	if string(got) != "hello" {
+		t.Fatalf("restored content = %q, want %q", got, "hello")
+	}
+}
+
+func TestRestoreDirectoryGetObjectFails(t *testing.T) {
+	l := zerolog.Nop()
+	cfg := models.Config{AWS: models.AWS{S3Bucket: "test-bucket"}}
+
+	fake := new(s3api.FakeS3API)
+	fake.ListObjectsV2Returns(&s3.ListObjectsV2Output{
+		Contents: []types.Object{{Key: aws.String("/srv/data/file.txt")}},
+	}, nil)
+	fake.GetObjectReturns(nil, errors.New("something went wrong"))
+
+	restorer := s3restore.New(cfg, fake, "/srv/data", t.TempDir(), &l)
+	if err := restorer.RestoreDirectory(context.Background()); err == nil {
+		t.Fatalf("expected RestoreDirectory() to report failed files")
+	}
+}
+
+func TestRestoreDirectoryListFails(t *testing.T) {
+	l := zerolog.Nop()
+	cfg := models.Config{AWS: models.AWS{S3Bucket: "test-bucket"}}
+
+	fake := new(s3api.FakeS3API)
+	fake.ListObjectsV2Returns(nil, errors.New("something went wrong"))
+
+	restorer := s3restore.New(cfg, fake, "/srv/data", t.TempDir(), &l)
+	if err := restorer.RestoreDirectory(context.Background()); err == nil {
+		t.Fatalf("expected RestoreDirectory() to fail when listing fails")
+	}
+}
+
+func TestRestoreDirectoryInterrupted(t *testing.T) {
+	l := zerolog.Nop()
+	cfg := models.Config{AWS: models.AWS{S3Bucket: "test-bucket"}}
+	target := t.TempDir()
+
+	fake := new(s3api.FakeS3API)
+	fake.ListObjectsV2Returns(&s3.ListObjectsV2Output{
+		Contents: []types.Object{{Key: aws.String("/srv/data/file.txt")}},
+	}, nil)
+	fake.GetObjectReturns(&s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader("hello"))}, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	restorer := s3restore.New(cfg, fake, "/srv/data", target, &l)
+	if err := restorer.RestoreDirectory(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("RestoreDirectory() = %v, want %v", err, context.Canceled)
+	}
+	if got := len(fake.GetObjectInputs()); got != 0 {
+		t.Fatalf("GetObject called %d times after the restore was interrupted", got)
+	}
+}
+
+func TestRestoreDirectoryAsOf(t *testing.T) {
+	l := zerolog.Nop()
+	cfg := models.Config{AWS: models.AWS{S3Bucket: "test-bucket"}}
+	target := t.TempDir()
+	at := func(day int) *time.Time {
+		when := time.Date(2026, 9, day, 12, 0, 0, 0, time.UTC)
+		return &when
+	}
+
+	fake := new(s3api.FakeS3API)
+	fake.ListObjectVersionsReturns(&s3.ListObjectVersionsOutput{
+		Versions: []types.ObjectVersion{
+			{Key: aws.String("/srv/data/kept.txt"), VersionId: aws.String("v3"), LastModified: at(5)},
+			{Key: aws.String("/srv/data/kept.txt"), VersionId: aws.String("v2"), LastModified: at(1)},
+			{Key: aws.String("/srv/data/kept.txt"), VersionId: aws.String("v1"), LastModified: at(0)},
+			{Key: aws.String("/srv/data/deleted.txt"), VersionId: aws.String("d1"), LastModified: at(0)},
+			{Key: aws.String("/srv/data/later.txt"), VersionId: aws.String("l1"), LastModified: at(3)},
+			{Key: aws.String("/srv/database/other.txt"), VersionId: aws.String("o1"), LastModified: at(0)},
+		},
+		DeleteMarkers: []types.DeleteMarkerEntry{
+			{Key: aws.String("/srv/data/deleted.txt"), VersionId: aws.String("d2"), LastModified: at(1)},
+		},
+	}, nil)
+	fake.GetObjectReturns(&s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader("hello"))}, nil)
+
+	restorer := s3restore.New(cfg, fake, "/srv/data", target, &l)
+	_ = restorer.SetAsOf(*at(2))
+	if err := restorer.RestoreDirectory(context.Background()); err != nil {
+		t.Fatalf("RestoreDirectory() unexpected error: %v", err)
+	}
+
+	inputs := fake.GetObjectInputs()
+	if len(inputs) != 1 {
+		t.Fatalf("expected 1 GetObject call, got %d", len(inputs))
+	}
+	if key, version := aws.ToString(inputs[0].Key), aws.ToString(inputs[0].VersionId); key != "/srv/data/kept.txt" || version != "v2" {
+		t.Fatalf("restored %s version %s, want /srv/data/kept.txt version v2", key, version)
+	}
+	if _, err := os.Stat(filepath.Join(target, "srv", "data", "kept.txt")); err != nil {
+		t.Fatalf("expected restored file: %v", err)
+	}
+}
+
+func TestRestoreDirectorySnapshot(t *testing.T) {
+	l := zerolog.Nop()
+	cfg := models.Config{AWS: models.AWS{S3Bucket: "test-bucket"}}
+	target := t.TempDir()
+	mtime := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+
+	fake := new(s3api.FakeS3API)
+	fake.GetObjectReturns(&s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader("hello"))}, nil)
+
+	restorer := s3restore.New(cfg, fake, "/srv/data", target, &l)
+	_ = restorer.SetSnapshot(s3snapshot.Manifest{Entries: []s3snapshot.Entry{
+		{Path: "/srv/data/script.sh", Mtime: mtime, Mode: 0o750, Key: s3snapshot.ContentKey("aa")},
+		{Path: "/srv/other/file.txt", Mtime: mtime, Mode: 0o644, Key: s3snapshot.ContentKey("bb")},
+	}})
+	if err := restorer.RestoreDirectory(context.Background()); err != nil {
+		t.Fatalf("RestoreDirectory() unexpected error: %v", err)
+	}
+
+	inputs := fake.GetObjectInputs()
+	if len(inputs) != 1 || aws.ToString(inputs[0].Key) != s3snapshot.ContentKey("aa") {
+		t.Fatalf("expected only the content object of /srv/data/script.sh to be fetched")
+	}
+	info, err := os.Stat(filepath.Join(target, "srv", "data", "script.sh"))
+	if err != nil {
+		t.Fatalf("expected restored file: %v", err)
+	}
+	if info.Mode().Perm() != 0o750 || !info.ModTime().Equal(mtime) {
+		t.Fatalf("restored file mode %v mtime %v, want %v and %v", info.Mode().Perm(), info.ModTime(), os.FileMode(0o750), mtime)
+	}
+}
+
+func TestRestoreDirectoryEncrypted(t *testing.T) {
+	l := zerolog.Nop()
+	keyFile := filepath.Join(t.TempDir(), "backup.key")
+	if err := os.WriteFile(keyFile, []byte(strings.Repeat("k", 32)), 0o600); err != nil {
+		t.Fatalf("unable to create key file: %v", err)
+	}
+	cfg := models.Config{AWS: models.AWS{S3Bucket: "test-bucket", EncryptionKeyFile: keyFile}}
+	cipher, err := s3crypt.New(cfg)
+	if err != nil {
+		t.Fatalf("s3crypt.New() unexpected error: %v", err)
+	}
+	ciphertext, _, metadata, err := cipher.Encrypt(strings.NewReader("hello"), 5)
+	if err != nil {
+		t.Fatalf("Encrypt() unexpected error: %v", err)
+	}
+	sealed, _ := io.ReadAll(ciphertext)
+
+	fake := new(s3api.FakeS3API)
+	fake.ListObjectsV2Returns(&s3.ListObjectsV2Output{
+		Contents: []types.Object{{Key: aws.String("/srv/data/file.txt")}},
+	}, nil)
+	newObject := func() *s3.GetObjectOutput {
+		return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(sealed)), Metadata: metadata}
+	}
+
+	fake.GetObjectReturns(newObject(), nil)
+	if err = s3restore.New(cfg, fake, "/srv/data", t.TempDir(), &l).RestoreDirectory(context.Background()); err == nil {
+		t.Fatalf("expected RestoreDirectory() without a cipher to fail on an encrypted object")
+	}
+
+	target := t.TempDir()
+	fake.GetObjectReturns(newObject(), nil)
+	restorer := s3restore.New(cfg, fake, "/srv/data", target, &l)
+	_ = restorer.SetCipher(cipher)
+	if err = restorer.RestoreDirectory(context.Background()); err != nil {
+		t.Fatalf("RestoreDirectory() unexpected error: %v", err)
+	}
+	got, err := os.ReadFile(filepath.Join(target, "srv", "data", "file.txt"))
+	if err != nil {
+		t.Fatalf("expected restored file: %v", err)
+	}
+	if string(got) != "hello" {
+		t.Fatalf("restored content = %q, want %q", got, "hello")
+	}
+}
+
+func TestRestoreDirectoryCompressed(t *testing.T) {
+	l := zerolog.Nop()
+	cfg := models.Config{AWS: models.AWS{S3Bucket: "test-bucket"}}
+	target := t.TempDir()
+
+	var compressed bytes.Buffer
+	w := gzip.NewWriter(&compressed)
+	_, _ = w.Write([]byte("hello"))
+	_ = w.Close()
+
+	fake := new(s3api.FakeS3API)
+	fake.ListObjectsV2Returns(&s3.ListObjectsV2Output{
+		Contents: []types.Object{{Key: aws.String("/srv/data/app.log")}},
+	}, nil)
+	fake.GetObjectReturns(&s3.GetObjectOutput{
+		Body:            io.NopCloser(&compressed),
+		ContentEncoding: aws.String(s3backup.CompressionGzip),
+	}, nil)
+
+	if err := s3restore.New(cfg, fake, "/srv/data", target, &l).RestoreDirectory(context.Background()); err != nil {
+		t.Fatalf("RestoreDirectory() unexpected error: %v", err)
+	}
+	got, err := os.ReadFile(filepath.Join(target, "srv", "data", "app.log"))
+	if err != nil {
+		t.Fatalf("expected restored file: %v", err)
+	}
+	if string(got) != "hello" {
+		t.Fatalf("restored content = %q, want %q", got, "hello")
+	}
+}
+
+func TestRestoreDirectoryAppliesAttributes(t *testing.T) {
+	l := zerolog.Nop()
+	cfg := models.Config{AWS: models.AWS{S3Bucket: "test-bucket"}}
+	target := t.TempDir()
+	mtime := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+
+	fake := new(s3api.FakeS3API)
+	fake.ListObjectsV2Returns(&s3.ListObjectsV2Output{
+		Contents: []types.Object{{Key: aws.String("/srv/data/run.sh")}},
+	}, nil)
+	fake.GetObjectReturns(&s3.GetObjectOutput{
+		Body:         io.NopCloser(strings.NewReader("#!/bin/sh")),
+		LastModified: aws.Time(time.Now()),
+		Metadata:     fileattr.Attributes{Mode: 0o754, Mtime: mtime}.Metadata(),
+	}, nil)
+
+	if err := s3restore.New(cfg, fake, "/srv/data", target, &l).RestoreDirectory(context.Background()); err != nil {
+		t.Fatalf("RestoreDirectory() unexpected error: %v", err)
+	}
+	info, err := os.Stat(filepath.Join(target, "srv", "data", "run.sh"))
+	if err != nil {
+		t.Fatalf("expected restored file: %v", err)
+	}
+	if info.Mode().Perm() != 0o754 || !info.ModTime().Equal(mtime) {
+		t.Fatalf("restored file mode %v mtime %v, want %v and %v", info.Mode().Perm(), info.ModTime(), os.FileMode(0o754), mtime)
+	}
+}
+
+func TestRestoreDirectoryLinksAndDirectories(t *testing.T) {
+	l := zerolog.Nop()
+	cfg := models.Config{AWS: models.AWS{S3Bucket: "test-bucket"}}
+	target := t.TempDir()
+	empty := func(metadata map[string]string) *s3.GetObjectOutput {
+		return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader("")), Metadata: metadata}
+	}
+
+	fake := new(s3api.FakeS3API)
+	fake.ListObjectsV2Returns(&s3.ListObjectsV2Output{
+		Contents: []types.Object{
+			{Key: aws.String("/srv/data/0-link.txt")},
+			{Key: aws.String("/srv/data/a.txt")},
+			{Key: aws.String("/srv/data/c.txt")},
+			{Key: aws.String("/srv/data/empty/")},
+		},
+	}, nil)
+	fake.GetObjectReturnsForKey("/srv/data/0-link.txt", empty(map[string]string{s3backup.MetadataHardLinkTarget: "%2Fsrv%2Fdata%2Fa.txt"}))
+	fake.GetObjectReturnsForKey("/srv/data/a.txt", &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader("hello"))})
+	fake.GetObjectReturnsForKey("/srv/data/c.txt", empty(map[string]string{s3backup.MetadataSymlinkTarget: "a.txt"}))
+	fake.GetObjectReturnsForKey("/srv/data/empty/", empty(nil))
+
+	if err := s3restore.New(cfg, fake, "/srv/data", target, &l).RestoreDirectory(context.Background()); err != nil {
+		t.Fatalf("RestoreDirectory() unexpected error: %v", err)
+	}
+
+	dir := filepath.Join(target, "srv", "data")
+	original, err := os.Stat(filepath.Join(dir, "a.txt"))
+	if err != nil {
+		t.Fatalf("expected restored file: %v", err)
+	}
+	linked, err := os.Stat(filepath.Join(dir, "0-link.txt"))
+	if err != nil || !os.SameFile(original, linked) {
+		t.Fatalf("expected 0-link.txt to be a hard link to a.txt (err %v)", err)
+	}
+	if link, err := os.Readlink(filepath.Join(dir, "c.txt")); err != nil || link != "a.txt" {
+		t.Fatalf("expected c.txt to be a symbolic link to a.txt, got %q (err %v)", link, err)
+	}
+	if info, err := os.Stat(filepath.Join(dir, "empty")); err != nil || !info.IsDir() {
+		t.Fatalf("expected the empty directory to be restored (err %v)", err)
+	}
+}
+
+func TestRestoreDirectoryAsOfInKeyOrder(t *testing.T) {
+	l := zerolog.Nop()
+	cfg := models.Config{AWS: models.AWS{S3Bucket: "test-bucket"}}
+	when := time.Date(2026, 9, 1, 12, 0, 0, 0, time.UTC)
+	outside := t.TempDir()
+
+	fake := new(s3api.FakeS3API)
+	fake.ListObjectVersionsReturns(&s3.ListObjectVersionsOutput{
+		Versions: []types.ObjectVersion{
+			{Key: aws.String("/srv/data/link/a.txt"), VersionId: aws.String("a1"), LastModified: &when},
+			{Key: aws.String("/srv/data/link/b.txt"), VersionId: aws.String("b1"), LastModified: &when},
+			{Key: aws.String("/srv/data/link/c.txt"), VersionId: aws.String("c1"), LastModified: &when},
+			{Key: aws.String("/srv/data/link"), VersionId: aws.String("l1"), LastModified: &when},
+		},
+	}, nil)
+	fake.GetObjectReturns(&s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(""))}, nil)
+	fake.GetObjectReturnsForKey("/srv/data/link", &s3.GetObjectOutput{
+		Body:     io.NopCloser(strings.NewReader("")),
+		Metadata: map[string]string{s3backup.MetadataSymlinkTarget: url.PathEscape(outside)},
+	})
+
+	// The link is restored before the paths below it on every run, so they
+	// are always refused rather than written through it
+	for range 10 {
+		target := t.TempDir()
+		restorer := s3restore.New(cfg, fake, "/srv/data", target, &l)
+		_ = restorer.SetAsOf(when)
+		if err := restorer.RestoreDirectory(context.Background()); err == nil {
+			t.Fatalf("expected RestoreDirectory() to refuse the paths below the link")
+		}
+		if info, err := os.Lstat(filepath.Join(target, "srv", "data", "link")); err != nil || info.Mode()&fs.ModeSymlink == 0 {
+			t.Fatalf("expected the link to be restored as a symbolic link: %v", err)
+		}
+		entries, _ := os.ReadDir(outside)
+		if len(entries) != 0 {
+			t.Fatalf("files were restored through the link: %v", entries)
+		}
+	}
+}
+
+func TestRestoreDirectoryRejectsUnsafeKeys(t *testing.T) {
+	l := zerolog.Nop()
+	cfg := models.Config{AWS: models.AWS{S3Bucket: "test-bucket"}}
+	scratch := t.TempDir()
+	target := filepath.Join(scratch, "target")
+	outside := t.TempDir()
+
+	fake := new(s3api.FakeS3API)
+	fake.ListObjectsV2Returns(&s3.ListObjectsV2Output{
+		Contents: []types.Object{
+			{Key: aws.String("/srv/data/../../../escaped.txt")},
+			{Key: aws.String("/srv/data/link")},
+			{Key: aws.String("/srv/data/link/through.txt")},
+			{Key: aws.String("/srv/data/safe.txt")},
+		},
+	}, nil)
+	fake.GetObjectReturns(&s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader("hello"))}, nil)
+	fake.GetObjectReturnsForKey("/srv/data/link", &s3.GetObjectOutput{
+		Body:     io.NopCloser(strings.NewReader("")),
+		Metadata: map[string]string{s3backup.MetadataSymlinkTarget: url.PathEscape(outside)},
+	})
+
+	if err := s3restore.New(cfg, fake, "/srv/data", target, &l).RestoreDirectory(context.Background()); err == nil {
+		t.Fatalf("expected RestoreDirectory() to report the unsafe keys")
+	}
+
+	if _, err := os.Stat(filepath.Join(scratch, "escaped.txt")); err == nil {
+		t.Fatalf("a key with .. segments was restored outside the target")
+	}
+	if _, err := os.Stat(filepath.Join(outside, "through.txt")); err == nil {
+		t.Fatalf("a file was restored through a symbolic link restored earlier")
+	}
+	if _, err := os.Stat(filepath.Join(target, "srv", "data", "safe.txt")); err != nil {
+		t.Fatalf("expected the safe file to be restored: %v", err)
+	}
+}
@@ -0,0 +1,165 @@
+package s3retry
+
+import (
+	"errors"
+	"math/rand/v2"
+	"slices"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/ratelimit"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/jaysonhurd/s3backup/models"
+	"github.com/rs/zerolog"
+)
+
+const (
+	msgInvalidJitter     = "invalid RetryJitter in configuration"
+	msgUnsupportedJitter = "unsupported retry jitter"
+	msgRetrying          = "S3 request failed, retrying"
+)
+
+// Jitter modes for the RetryJitter config setting. The empty string means
+// JitterFull. With JitterFull the delay before a retry is anywhere between
+// zero and the backoff, with JitterEqual between half the backoff and the
+// backoff, and with JitterNone it is the backoff itself.
+const (
+	JitterFull  = "full"
+	JitterEqual = "equal"
+	JitterNone  = "none"
+)
+
+const (
+	defaultMaxAttempts = retry.DefaultMaxAttempts
+	defaultBaseBackoff = time.Second
+	defaultMaxBackoff  = retry.DefaultMaxBackoff
+)
+
+// DefaultErrorCodes are the S3 error codes that are retried. Codes in
+// RetryErrorCodes are retried as well.
+var DefaultErrorCodes = []string{
+	"RequestTimeout",
+	"RequestTimeoutException",
+	"InternalError",
+	"ServiceUnavailable",
+	"SlowDown",
+	"Throttling",
+	"ThrottlingException",
+	"RequestThrottled",
+	"BandwidthLimitExceeded",
+}
+
+// DefaultStatusCodes are the HTTP status codes that are retried. Codes in
+// RetryStatusCodes are retried as well.
+var DefaultStatusCodes = []int{408, 429, 500, 502, 503, 504}
+
+var errUnsupportedJitter = errors.New(msgUnsupportedJitter)
+
+func validateJitter(mode string) error {
+	switch mode {
+	case "", JitterFull, JitterEqual, JitterNone:
+		return nil
+	}
+	return errUnsupportedJitter
+}
+
+// New returns the retryer used for every S3 request. A failed request is
+// retried up to RetryMaxAttempts attempts in all when its error code is in
+// DefaultErrorCodes or RetryErrorCodes, its HTTP status is in
+// DefaultStatusCodes or RetryStatusCodes, or the connection failed. The
+// backoff starts at RetryBaseBackoffMS, doubles with every attempt up to
+// RetryMaxBackoffSeconds and is randomised according to RetryJitter. Unlike
+// the SDK's default retryer there is no retry quota shared between requests,
+// so a run with many workers does not give up on a file because other files
+// needed retries. Every retry is logged.
+func New(cfg models.Config, l *zerolog.Logger) (aws.Retryer, error) {
+	if err := validateJitter(cfg.AWS.RetryJitter); err != nil {
+		if l != nil {
+			l.Error().Err(err).Str("retry_jitter", cfg.AWS.RetryJitter).Msg(msgInvalidJitter)
+		}
+		return nil, err
+	}
+
+	maxAttempts := cfg.AWS.RetryMaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = defaultMaxAttempts
+	}
+	b := backoff{
+		base:   time.Duration(cfg.AWS.RetryBaseBackoffMS) * time.Millisecond,
+		max:    time.Duration(cfg.AWS.RetryMaxBackoffSeconds) * time.Second,
+		jitter: cfg.AWS.RetryJitter,
+	}
+	if b.base <= 0 {
+		b.base = defaultBaseBackoff
+	}
+	if b.max <= 0 {
+		b.max = defaultMaxBackoff
+	}
+
+	errorCodes := make(map[string]struct{})
+	for _, code := range slices.Concat(DefaultErrorCodes, cfg.AWS.RetryErrorCodes) {
+		errorCodes[code] = struct{}{}
+	}
+	statusCodes := make(map[int]struct{})
+	for _, code := range slices.Concat(DefaultStatusCodes, cfg.AWS.RetryStatusCodes) {
+		statusCodes[code] = struct{}{}
+	}
+
+	standard := retry.NewStandard(func(o *retry.StandardOptions) {
+		o.MaxAttempts = maxAttempts
+		o.MaxBackoff = b.max
+		o.Backoff = b
+		o.RateLimiter = ratelimit.None
+		o.Retryables = []retry.IsErrorRetryable{
+			retry.NoRetryCanceledError{},
+			retry.RetryableError{},
+			retry.RetryableConnectionError{},
+			retry.RetryableHTTPStatusCode{Codes: statusCodes},
+			retry.RetryableErrorCode{Codes: errorCodes},
+		}
+	})
+	return &retryer{RetryerV2: standard, l: l}, nil
+}
+
+// retryer logs every retry the SDK makes.
+type retryer struct {
+	aws.RetryerV2
+	l *zerolog.Logger
+}
+
+func (r *retryer) RetryDelay(attempt int, opErr error) (time.Duration, error) {
+	delay, err := r.RetryerV2.RetryDelay(attempt, opErr)
+	if err == nil && r.l != nil {
+		r.l.Warn().Err(opErr).Int("attempt", attempt).Int("max_attempts", r.MaxAttempts()).Dur("delay", delay).Msg(msgRetrying)
+	}
+	return delay, err
+}
+
+// backoff doubles the delay with every attempt, starting at base and capped
+// at max, and applies jitter to it.
+type backoff struct {
+	base   time.Duration
+	max    time.Duration
+	jitter string
+}
+
+// BackoffDelay returns the delay before retrying after the given attempt,
+// where the first attempt is 1.
+func (b backoff) BackoffDelay(attempt int, _ error) (time.Duration, error) {
+	delay := b.max
+	if shift := attempt - 1; shift >= 0 && shift < 63 && b.base <= b.max>>shift {
+		delay = b.base << shift
+	}
+	if delay <= 0 {
+		return 0, nil
+	}
+
+	switch b.jitter {
+	case JitterNone:
+		return delay, nil
+	case JitterEqual:
+		half := delay / 2
+		return half + rand.N(delay-half+1), nil
+	}
+	return rand.N(delay + 1), nil
+}
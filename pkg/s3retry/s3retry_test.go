@@ -0,0 +1,104 @@
+package s3retry_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/jaysonhurd/s3backup/models"
+	"github.com/jaysonhurd/s3backup/pkg/s3retry"
+	"github.com/rs/zerolog"
+)
+
+func statusError(code int) error {
+	return &smithyhttp.ResponseError{
+		Response: &smithyhttp.Response{Response: &http.Response{StatusCode: code}},
+		Err:      errors.New(http.StatusText(code)),
+	}
+}
+
+func TestIsErrorRetryable(t *testing.T) {
+	l := zerolog.Nop()
+	cfg := models.Config{AWS: models.AWS{RetryErrorCodes: []string{"AccessDenied"}, RetryStatusCodes: []int{409}}}
+	retryer, err := s3retry.New(cfg, &l)
+	if err != nil {
+		t.Fatalf("New() unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "throttled", err: &smithy.GenericAPIError{Code: "SlowDown"}, want: true},
+		{name: "internal error", err: &smithy.GenericAPIError{Code: "InternalError"}, want: true},
+		{name: "configured error code", err: &smithy.GenericAPIError{Code: "AccessDenied"}, want: true},
+		{name: "other error code", err: &smithy.GenericAPIError{Code: "NoSuchBucket"}},
+		{name: "service unavailable", err: statusError(http.StatusServiceUnavailable), want: true},
+		{name: "too many requests", err: statusError(http.StatusTooManyRequests), want: true},
+		{name: "configured status", err: statusError(http.StatusConflict), want: true},
+		{name: "forbidden", err: statusError(http.StatusForbidden)},
+		{name: "cancelled", err: context.Canceled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := retryer.IsErrorRetryable(tt.err); got != tt.want {
+				t.Fatalf("IsErrorRetryable() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	l := zerolog.Nop()
+	cfg := models.Config{AWS: models.AWS{
+		RetryMaxAttempts:       6,
+		RetryBaseBackoffMS:     100,
+		RetryMaxBackoffSeconds: 1,
+		RetryJitter:            s3retry.JitterNone,
+	}}
+	retryer, err := s3retry.New(cfg, &l)
+	if err != nil {
+		t.Fatalf("New() unexpected error: %v", err)
+	}
+	if got := retryer.MaxAttempts(); got != 6 {
+		t.Fatalf("MaxAttempts() = %d, want 6", got)
+	}
+
+	opErr := &smithy.GenericAPIError{Code: "SlowDown"}
+	for attempt, want := range map[int]time.Duration{
+		1: 100 * time.Millisecond,
+		2: 200 * time.Millisecond,
+		4: 800 * time.Millisecond,
+		5: time.Second,
+		9: time.Second,
+	} {
+		got, err := retryer.RetryDelay(attempt, opErr)
+		if err != nil {
+			t.Fatalf("RetryDelay(%d) unexpected error: %v", attempt, err)
+		}
+		if got != want {
+			t.Fatalf("RetryDelay(%d) = %v, want %v", attempt, got, want)
+		}
+	}
+
+	cfg.AWS.RetryJitter = s3retry.JitterEqual
+	retryer, _ = s3retry.New(cfg, &l)
+	for range 100 {
+		got, _ := retryer.RetryDelay(3, opErr)
+		if got < 200*time.Millisecond || got > 400*time.Millisecond {
+			t.Fatalf("RetryDelay(3) with equal jitter = %v, want between 200ms and 400ms", got)
+		}
+	}
+}
+
+func TestNewRejectsUnknownJitter(t *testing.T) {
+	l := zerolog.Nop()
+	if _, err := s3retry.New(models.Config{AWS: models.AWS{RetryJitter: "sometimes"}}, &l); err == nil {
+		t.Fatalf("expected New() to reject an unknown jitter mode")
+	}
+}
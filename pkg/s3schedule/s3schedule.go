@@ -0,0 +1,177 @@
+package s3schedule
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/jaysonhurd/s3backup/models"
+	"github.com/robfig/cron/v3"
+	"github.com/rs/zerolog"
+)
+
+const (
+	msgInvalidSchedule = "invalid cron expression in Schedule"
+	msgNoJobs          = "no jobs are scheduled, set at least one cron expression in Schedule"
+	msgUnknownJob      = "job in Schedule is not available"
+	msgJobScheduled    = "job scheduled"
+	msgJobStarted      = "scheduled job started"
+	msgJobFinished     = "scheduled job finished"
+	msgJobFailed       = "scheduled job failed"
+	msgJobSkipped      = "previous run of job is still in progress, skipping this run"
+	msgDaemonStopping  = "stopping scheduler, waiting for running jobs to finish"
+	msgDaemonStopped   = "scheduler stopped"
+)
+
+// Names of the jobs in the Schedule config section, in the order they are
+// scheduled.
+const (
+	JobBackup = "backup"
+	JobSync   = "sync"
+	JobPrune  = "prune"
+	JobVerify = "verify"
+)
+
+var (
+	errNoJobs     = errors.New(msgNoJobs)
+	errUnknownJob = errors.New(msgUnknownJob)
+)
+
+// Scheduler runs the configured jobs on their schedule until it is stopped.
+type Scheduler interface {
+	Run(ctx context.Context) error
+}
+
+type s3schedule struct {
+	cfg  models.Config
+	jobs map[string]func(ctx context.Context) error
+	l    *zerolog.Logger
+}
+
+// New returns a Scheduler for the cron expressions in cfg.Schedule. jobs maps
+// each job name (JobBackup, JobSync, ...) to the function that runs it. Jobs
+// are passed the context given to Run.
+func New(
+	cfg models.Config,
+	jobs map[string]func(ctx context.Context) error,
+	l *zerolog.Logger,
+) Scheduler {
+	return &s3schedule{
+		cfg:  cfg,
+		jobs: jobs,
+		l:    l,
+	}
+}
+
+// Run schedules every job that has a cron expression and blocks until ctx is
+// done, then waits for running jobs to finish; ctx is passed to each job so
+// that a long run can stop early. Expressions use the standard
+// five fields or a descriptor such as @daily or @every 6h, in local time
+// unless prefixed with CRON_TZ=. A run that comes due while the previous run
+// of the same job is still in progress is skipped. The next run time of each
+// job is logged when it is scheduled and after every run.
+func (s *s3schedule) Run(ctx context.Context) error {
+	c := cron.New(
+		cron.WithLogger(cronLogger{l: s.l}),
+		cron.WithChain(cron.Recover(cronLogger{l: s.l})),
+	)
+
+	var scheduled []*job
+	for _, name := range []string{JobBackup, JobSync, JobPrune, JobVerify} {
+		spec := s.spec(name)
+		if spec == "" {
+			continue
+		}
+		schedule, err := cron.ParseStandard(spec)
+		if err != nil {
+			s.l.Error().Err(err).Str("job", name).Str("schedule", spec).Msg(msgInvalidSchedule)
+			return err
+		}
+		run, ok := s.jobs[name]
+		if !ok {
+			s.l.Error().Err(errUnknownJob).Str("job", name).Msg(msgUnknownJob)
+			return errUnknownJob
+		}
+		j := &job{ctx: ctx, name: name, run: run, c: c, l: s.l}
+		j.id = c.Schedule(schedule, j)
+		scheduled = append(scheduled, j)
+	}
+	if len(scheduled) == 0 {
+		s.l.Error().Err(errNoJobs).Msg(msgNoJobs)
+		return errNoJobs
+	}
+
+	c.Start()
+	for _, j := range scheduled {
+		s.l.Info().Str("job", j.name).Str("schedule", s.spec(j.name)).Time("next_run", j.next()).Msg(msgJobScheduled)
+	}
+
+	<-ctx.Done()
+	s.l.Info().Msg(msgDaemonStopping)
+	<-c.Stop().Done()
+	s.l.Info().Msg(msgDaemonStopped)
+	return nil
+}
+
+// spec returns the cron expression configured for the named job.
+func (s *s3schedule) spec(name string) string {
+	switch name {
+	case JobBackup:
+		return s.cfg.Schedule.Backup
+	case JobSync:
+		return s.cfg.Schedule.Sync
+	case JobPrune:
+		return s.cfg.Schedule.Prune
+	case JobVerify:
+		return s.cfg.Schedule.Verify
+	}
+	return ""
+}
+
+// job is one scheduled job. cron starts every run in its own goroutine, so
+// running keeps runs of the same job from overlapping. cron.Job takes no
+// context, so the one given to Run is kept with the job.
+type job struct {
+	ctx     context.Context
+	name    string
+	run     func(ctx context.Context) error
+	c       *cron.Cron
+	id      cron.EntryID
+	l       *zerolog.Logger
+	running atomic.Bool
+}
+
+func (j *job) Run() {
+	if !j.running.CompareAndSwap(false, true) {
+		j.l.Warn().Str("job", j.name).Time("next_run", j.next()).Msg(msgJobSkipped)
+		return
+	}
+	defer j.running.Store(false)
+
+	j.l.Info().Str("job", j.name).Msg(msgJobStarted)
+	start := time.Now()
+	if err := j.run(j.ctx); err != nil {
+		j.l.Error().Err(err).Str("job", j.name).Dur("duration", time.Since(start)).Time("next_run", j.next()).Msg(msgJobFailed)
+		return
+	}
+	j.l.Info().Str("job", j.name).Dur("duration", time.Since(start)).Time("next_run", j.next()).Msg(msgJobFinished)
+}
+
+func (j *job) next() time.Time {
+	return j.c.Entry(j.id).Next
+}
+
+// cronLogger passes what cron itself logs, such as recovered panics, to
+// zerolog. Its routine messages are only of interest when debugging.
+type cronLogger struct {
+	l *zerolog.Logger
+}
+
+func (c cronLogger) Info(msg string, keysAndValues ...any) {
+	c.l.Debug().Fields(keysAndValues).Msg(msg)
+}
+
+func (c cronLogger) Error(err error, msg string, keysAndValues ...any) {
+	c.l.Error().Err(err).Fields(keysAndValues).Msg(msg)
+}
@@ -0,0 +1,80 @@
+package s3schedule_test
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jaysonhurd/s3backup/models"
+	"github.com/jaysonhurd/s3backup/pkg/s3schedule"
+	"github.com/rs/zerolog"
+)
+
+func TestRunRejectsBadSchedule(t *testing.T) {
+	l := zerolog.Nop()
+	noop := func(context.Context) error { return nil }
+
+	tests := []struct {
+		name     string
+		schedule models.Schedule
+		jobs     map[string]func(ctx context.Context) error
+	}{
+		{name: "nothing scheduled", jobs: map[string]func(ctx context.Context) error{s3schedule.JobBackup: noop}},
+		{name: "invalid expression", schedule: models.Schedule{Backup: "every day"}, jobs: map[string]func(ctx context.Context) error{s3schedule.JobBackup: noop}},
+		{name: "unknown job", schedule: models.Schedule{Verify: "@daily"}, jobs: map[string]func(ctx context.Context) error{s3schedule.JobBackup: noop}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scheduler := s3schedule.New(models.Config{Schedule: tt.schedule}, tt.jobs, &l)
+			if err := scheduler.Run(context.Background()); err == nil {
+				t.Fatalf("expected Run() to fail")
+			}
+		})
+	}
+}
+
+func TestRunSkipsOverlappingRuns(t *testing.T) {
+	l := zerolog.Nop()
+	var (
+		runs    atomic.Int32
+		started = make(chan struct{})
+		release = make(chan struct{})
+	)
+	backup := func(context.Context) error {
+		if runs.Add(1) == 1 {
+			close(started)
+		}
+		<-release
+		return nil
+	}
+
+	cfg := models.Config{Schedule: models.Schedule{Backup: "@every 1s"}}
+	scheduler := s3schedule.New(cfg, map[string]func(ctx context.Context) error{s3schedule.JobBackup: backup}, &l)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- scheduler.Run(ctx) }()
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("backup job was never run")
+	}
+	// Let at least two more runs come due while the first is still going.
+	time.Sleep(2200 * time.Millisecond)
+	cancel()
+
+	select {
+	case <-done:
+		t.Fatalf("Run() returned before the running job finished")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatalf("Run() unexpected error: %v", err)
+	}
+	if got := runs.Load(); got != 1 {
+		t.Fatalf("expected overlapping runs to be skipped, got %d runs", got)
+	}
+}
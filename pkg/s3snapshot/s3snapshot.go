@@ -0,0 +1,294 @@
+package s3snapshot
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/jaysonhurd/s3backup/models"
+	"github.com/jaysonhurd/s3backup/pkg/s3crypt"
+	"github.com/rs/zerolog"
+)
+
+const (
+	msgSaveManifestError  = "unable to write snapshot manifest"
+	msgManifestSaved      = "snapshot manifest written"
+	msgDryRunManifest     = "dry run: would write snapshot manifest"
+	msgListSnapshotsError = "unable to list snapshots"
+	msgReadManifestError  = "unable to read snapshot manifest"
+	msgManifestEncrypted  = "snapshot manifest is encrypted but no encryption key is configured"
+)
+
+var errManifestEncrypted = errors.New(msgManifestEncrypted)
+
+const (
+	// SnapshotsPrefix holds one manifest per snapshot, ObjectsPrefix the file
+	// contents they refer to. Neither starts with a slash, so sync and restore
+	// never mistake them for mirrored files.
+	SnapshotsPrefix = "snapshots/"
+	ObjectsPrefix   = "objects/"
+
+	manifestSuffix        = ".json"
+	manifestContentType   = "application/json"
+	encryptedContentType  = "application/octet-stream"
+	manifestFormatVersion = 1
+
+	// snapshotIDFormat keeps every digit of the nanoseconds, so that runs
+	// started within the same second do not overwrite each other's manifest
+	// and IDs still sort in the order the snapshots were taken.
+	snapshotIDFormat = "20060102T150405.000000000Z"
+)
+
+// Entry describes one file as it was when the snapshot was taken. Key is the
+// content-addressed object holding its data.
+type Entry struct {
+	Path   string      `json:"path"`
+	Size   int64       `json:"size"`
+	Mtime  time.Time   `json:"mtime"`
+	Mode   fs.FileMode `json:"mode"`
+	SHA256 string      `json:"sha256"`
+	Key    string      `json:"key"`
+
+	// Attributes holds the file's ownership, access time and extended
+	// attributes, encoded as by fileattr.Attributes.Metadata.
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+// Manifest is the object written to snapshots/<id>.json at the end of a run.
+type Manifest struct {
+	Version int       `json:"version"`
+	ID      string    `json:"id"`
+	Bucket  string    `json:"bucket"`
+	Created time.Time `json:"created"`
+	Entries []Entry   `json:"entries"`
+}
+
+// Summary is what -snapshots shows for each stored snapshot.
+type Summary struct {
+	ID      string
+	Created time.Time
+	Files   int
+	Bytes   int64
+}
+
+type Snapshotter interface {
+	ID() string
+	Add(entry Entry)
+	Save(ctx context.Context) error
+	List(ctx context.Context) ([]Summary, error)
+	Manifest(ctx context.Context, id string) (Manifest, error)
+	SetCipher(c s3crypt.Cipher) error
+}
+
+type S3API interface {
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+}
+
+type s3snapshot struct {
+	cfg     models.Config
+	svc     S3API
+	l       *zerolog.Logger
+	c       s3crypt.Cipher
+	created time.Time
+	mu      sync.Mutex
+	entries []Entry
+}
+
+// New starts a snapshot named after the current time. Entries are collected
+// with Add while the backup runs and written out by Save.
+func New(
+	cfg models.Config,
+	svc S3API,
+	l *zerolog.Logger,
+) Snapshotter {
+	return &s3snapshot{
+		cfg:     cfg,
+		svc:     svc,
+		l:       l,
+		created: time.Now().UTC(),
+	}
+}
+
+// ContentKey returns the key file contents named id are stored under. The id
+// is the contents' SHA-256, or Cipher.ContentID of it when encrypting.
+// Identical files share one object across every snapshot.
+func ContentKey(id string) string {
+	return ObjectsPrefix + id
+}
+
+// ManifestKey returns the key of the manifest for snapshot id.
+func ManifestKey(id string) string {
+	return SnapshotsPrefix + id + manifestSuffix
+}
+
+// SetCipher sets the cipher manifests are encrypted with on Save and
+// decrypted with when read. Manifests hold every file's path and hash, so
+// they are encrypted like the file contents are.
+func (s *s3snapshot) SetCipher(c s3crypt.Cipher) (err error) {
+	s.c = c
+	return nil
+}
+
+func (s *s3snapshot) ID() string {
+	return s.created.Format(snapshotIDFormat)
+}
+
+// Add records a file in the snapshot. It is safe for concurrent use.
+func (s *s3snapshot) Add(entry Entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries = append(s.entries, entry)
+}
+
+// Save writes the manifest. Entries are sorted by path so manifests of the
+// same tree compare equal. The manifest is only written once a backup has
+// completed, so a ctx cancelled meanwhile does not stop it.
+func (s *s3snapshot) Save(ctx context.Context) error {
+	s.mu.Lock()
+	entries := slices.Clone(s.entries)
+	s.mu.Unlock()
+	slices.SortFunc(entries, func(a, b Entry) int { return strings.Compare(a.Path, b.Path) })
+
+	key := ManifestKey(s.ID())
+	if s.cfg.DryRun {
+		s.l.Info().Bool("dry_run", true).Str("s3_key", key).Int("files", len(entries)).Msg(msgDryRunManifest)
+		return nil
+	}
+
+	data, err := json.Marshal(Manifest{
+		Version: manifestFormatVersion,
+		ID:      s.ID(),
+		Bucket:  s.cfg.AWS.S3Bucket,
+		Created: s.created,
+		Entries: entries,
+	})
+	if err != nil {
+		s.l.Error().Err(err).Str("s3_key", key).Msg(msgSaveManifestError)
+		return err
+	}
+
+	contentType := manifestContentType
+	var metadata map[string]string
+	if s.c != nil {
+		if data, metadata, err = s.encrypt(data); err != nil {
+			s.l.Error().Err(err).Str("s3_key", key).Msg(msgSaveManifestError)
+			return err
+		}
+		contentType = encryptedContentType
+	}
+
+	// Manifests keep the default storage class so they can always be read back
+	// without a restore, whatever class the file contents are stored in.
+	_, err = s.svc.PutObject(context.WithoutCancel(ctx), &s3.PutObjectInput{
+		Bucket:               aws.String(s.cfg.AWS.S3Bucket),
+		Key:                  aws.String(key),
+		Body:                 bytes.NewReader(data),
+		ContentLength:        aws.Int64(int64(len(data))),
+		ContentType:          aws.String(contentType),
+		Metadata:             metadata,
+		ServerSideEncryption: s3types.ServerSideEncryption(s.cfg.AWS.ServerSideEncryption),
+	})
+	if err != nil {
+		s.l.Error().Err(err).Str("s3_key", key).Msg(msgSaveManifestError)
+		return err
+	}
+
+	s.l.Info().Str("s3_key", key).Int("files", len(entries)).Msg(msgManifestSaved)
+	return nil
+}
+
+// encrypt returns the ciphertext of a manifest and the metadata to store with
+// it. Manifests are small enough to be sealed in memory.
+func (s *s3snapshot) encrypt(data []byte) ([]byte, map[string]string, error) {
+	ciphertext, _, metadata, err := s.c.Encrypt(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, nil, err
+	}
+	sealed, err := io.ReadAll(ciphertext)
+	return sealed, metadata, err
+}
+
+// List reads every manifest in the bucket and returns a summary of each,
+// oldest first.
+func (s *s3snapshot) List(ctx context.Context) ([]Summary, error) {
+	var summaries []Summary
+
+	p := s3.NewListObjectsV2Paginator(s.svc, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.cfg.AWS.S3Bucket),
+		Prefix: aws.String(SnapshotsPrefix),
+	})
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			s.l.Error().Err(err).Str("bucket", s.cfg.AWS.S3Bucket).Msg(msgListSnapshotsError)
+			return nil, err
+		}
+		for _, object := range page.Contents {
+			key := aws.ToString(object.Key)
+			if !strings.HasSuffix(key, manifestSuffix) {
+				continue
+			}
+			manifest, err := s.readManifest(ctx, key)
+			if err != nil {
+				s.l.Error().Err(err).Str("s3_key", key).Msg(msgReadManifestError)
+				return nil, err
+			}
+			summary := Summary{ID: manifest.ID, Created: manifest.Created, Files: len(manifest.Entries)}
+			for i := range manifest.Entries {
+				summary.Bytes += manifest.Entries[i].Size
+			}
+			summaries = append(summaries, summary)
+		}
+	}
+
+	slices.SortFunc(summaries, func(a, b Summary) int { return strings.Compare(a.ID, b.ID) })
+	return summaries, nil
+}
+
+// Manifest reads the manifest of snapshot id, e.g. to restore from it.
+func (s *s3snapshot) Manifest(ctx context.Context, id string) (Manifest, error) {
+	key := ManifestKey(id)
+	manifest, err := s.readManifest(ctx, key)
+	if err != nil {
+		s.l.Error().Err(err).Str("s3_key", key).Msg(msgReadManifestError)
+	}
+	return manifest, err
+}
+
+func (s *s3snapshot) readManifest(ctx context.Context, key string) (Manifest, error) {
+	var manifest Manifest
+
+	result, err := s.svc.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.cfg.AWS.S3Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return manifest, err
+	}
+	defer result.Body.Close()
+
+	var body io.Reader = result.Body
+	if _, encrypted := result.Metadata[s3crypt.MetadataAlgorithm]; encrypted {
+		if s.c == nil {
+			return manifest, errManifestEncrypted
+		}
+		if body, err = s.c.Decrypt(result.Body, result.Metadata); err != nil {
+			return manifest, err
+		}
+	}
+
+	err = json.NewDecoder(body).Decode(&manifest)
+	return manifest, err
+}
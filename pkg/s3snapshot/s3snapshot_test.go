@@ -0,0 +1,148 @@
+package s3snapshot_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/jaysonhurd/s3backup/models"
+	"github.com/jaysonhurd/s3backup/pkg/s3crypt"
+	"github.com/jaysonhurd/s3backup/pkg/s3snapshot"
+	"github.com/jaysonhurd/s3backup/test/fakes/s3api"
+	"github.com/rs/zerolog"
+)
+
+func TestSaveWritesSortedManifest(t *testing.T) {
+	l := zerolog.Nop()
+	cfg := models.Config{AWS: models.AWS{S3Bucket: "test-bucket", StorageClass: "GLACIER"}}
+	fake := new(s3api.FakeS3API)
+
+	snap := s3snapshot.New(cfg, fake, &l)
+	snap.Add(s3snapshot.Entry{Path: "/home/user/b.txt", Size: 2, SHA256: "bb", Key: s3snapshot.ContentKey("bb")})
+	snap.Add(s3snapshot.Entry{Path: "/home/user/a.txt", Size: 1, SHA256: "aa", Key: s3snapshot.ContentKey("aa")})
+	if err := snap.Save(context.Background()); err != nil {
+		t.Fatalf("Save() unexpected error: %v", err)
+	}
+
+	input := fake.LastPutObjectInput
+	if got, want := aws.ToString(input.Key), s3snapshot.ManifestKey(snap.ID()); got != want {
+		t.Fatalf("manifest key = %q, want %q", got, want)
+	}
+	if input.StorageClass != "" {
+		t.Fatalf("manifest storage class = %q, want the bucket default", input.StorageClass)
+	}
+	var manifest s3snapshot.Manifest
+	if err := json.NewDecoder(input.Body).Decode(&manifest); err != nil {
+		t.Fatalf("unable to decode manifest: %v", err)
+	}
+	if manifest.ID != snap.ID() || len(manifest.Entries) != 2 || manifest.Entries[0].Path != "/home/user/a.txt" {
+		t.Fatalf("unexpected manifest %+v", manifest)
+	}
+}
+
+func TestIDsAreUnique(t *testing.T) {
+	l := zerolog.Nop()
+	cfg := models.Config{AWS: models.AWS{S3Bucket: "test-bucket"}}
+	fake := new(s3api.FakeS3API)
+
+	// Snapshots started within the same second get their own manifests, in
+	// the order they were taken
+	first := s3snapshot.New(cfg, fake, &l).ID()
+	time.Sleep(time.Microsecond)
+	second := s3snapshot.New(cfg, fake, &l).ID()
+	if first >= second {
+		t.Fatalf("snapshot IDs %q and %q, want distinct IDs in the order taken", first, second)
+	}
+}
+
+func TestSaveDryRun(t *testing.T) {
+	l := zerolog.Nop()
+	cfg := models.Config{AWS: models.AWS{S3Bucket: "test-bucket"}, DryRun: true}
+	fake := new(s3api.FakeS3API)
+
+	if err := s3snapshot.New(cfg, fake, &l).Save(context.Background()); err != nil {
+		t.Fatalf("Save() unexpected error: %v", err)
+	}
+	if fake.PutObjectCallCount() != 0 {
+		t.Fatalf("expected no manifest to be written in a dry run")
+	}
+}
+
+func TestList(t *testing.T) {
+	l := zerolog.Nop()
+	cfg := models.Config{AWS: models.AWS{S3Bucket: "test-bucket"}}
+	created := time.Date(2024, 1, 31, 2, 0, 0, 0, time.UTC)
+	manifest, _ := json.Marshal(s3snapshot.Manifest{
+		ID:      "20240131T020000Z",
+		Created: created,
+		Entries: []s3snapshot.Entry{{Path: "/a", Size: 3}, {Path: "/b", Size: 4}},
+	})
+
+	fake := new(s3api.FakeS3API)
+	fake.ListObjectsV2Returns(&s3.ListObjectsV2Output{Contents: []types.Object{
+		{Key: aws.String(s3snapshot.ManifestKey("20240131T020000Z"))},
+		{Key: aws.String(s3snapshot.ContentKey("aa"))},
+	}}, nil)
+	fake.GetObjectReturns(&s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(string(manifest)))}, nil)
+
+	summaries, err := s3snapshot.New(cfg, fake, &l).List(context.Background())
+	if err != nil {
+		t.Fatalf("List() unexpected error: %v", err)
+	}
+	want := s3snapshot.Summary{ID: "20240131T020000Z", Created: created, Files: 2, Bytes: 7}
+	if len(summaries) != 1 || summaries[0] != want {
+		t.Fatalf("List() = %+v, want [%+v]", summaries, want)
+	}
+}
+
+func TestSaveEncrypted(t *testing.T) {
+	l := zerolog.Nop()
+	keyFile := filepath.Join(t.TempDir(), "backup.key")
+	if err := os.WriteFile(keyFile, bytes.Repeat([]byte{7}, 32), 0o600); err != nil {
+		t.Fatalf("unable to write key file: %v", err)
+	}
+	cfg := models.Config{AWS: models.AWS{S3Bucket: "test-bucket", EncryptionKeyFile: keyFile}}
+	cipher, err := s3crypt.New(cfg)
+	if err != nil {
+		t.Fatalf("s3crypt.New() unexpected error: %v", err)
+	}
+	fake := new(s3api.FakeS3API)
+
+	snap := s3snapshot.New(cfg, fake, &l)
+	_ = snap.SetCipher(cipher)
+	snap.Add(s3snapshot.Entry{Path: "/home/user/secret-plans.txt", Size: 2, SHA256: "bb", Key: s3snapshot.ContentKey("bb")})
+	if err = snap.Save(context.Background()); err != nil {
+		t.Fatalf("Save() unexpected error: %v", err)
+	}
+
+	input := fake.LastPutObjectInput
+	sealed, _ := io.ReadAll(input.Body)
+	if bytes.Contains(sealed, []byte("secret-plans")) || input.Metadata[s3crypt.MetadataAlgorithm] == "" {
+		t.Fatalf("expected the manifest to be stored encrypted")
+	}
+
+	fake.GetObjectReturns(&s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(sealed)), Metadata: input.Metadata}, nil)
+	if _, err = s3snapshot.New(cfg, fake, &l).Manifest(context.Background(), snap.ID()); err == nil {
+		t.Fatalf("expected Manifest() without a cipher to fail on an encrypted manifest")
+	}
+
+	fake.GetObjectReturns(&s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(sealed)), Metadata: input.Metadata}, nil)
+	reader := s3snapshot.New(cfg, fake, &l)
+	_ = reader.SetCipher(cipher)
+	manifest, err := reader.Manifest(context.Background(), snap.ID())
+	if err != nil {
+		t.Fatalf("Manifest() unexpected error: %v", err)
+	}
+	if len(manifest.Entries) != 1 || manifest.Entries[0].Path != "/home/user/secret-plans.txt" {
+		t.Fatalf("unexpected manifest %+v", manifest)
+	}
+}
@@ -0,0 +1,380 @@
+package s3watch
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/jaysonhurd/s3backup/models"
+	"github.com/jaysonhurd/s3backup/pkg/s3backup"
+	"github.com/jaysonhurd/s3backup/pkg/s3clean"
+	"github.com/jaysonhurd/s3backup/pkg/s3index"
+	"github.com/jaysonhurd/s3backup/pkg/s3lock"
+	"github.com/rs/zerolog"
+)
+
+const (
+	msgWatchStarted         = "watching backup directories for changes"
+	msgWatchStopped         = "watch stopped"
+	msgCreateWatcherError   = "unable to create filesystem watcher"
+	msgAddWatchError        = "unable to watch directory"
+	msgWatcherError         = "error reported by filesystem watcher"
+	msgEventOverflow        = "filesystem events were lost, rescanning every backup directory"
+	msgBackupDirectoryError = "unable to back up directory"
+	msgBackupPathError      = "unable to back up changed path"
+	msgRemovePathsError     = "unable to remove deleted paths from S3"
+	msgSyncBucketError      = "unable to remove deleted files from S3 after rescan"
+	msgDeletionIgnored      = "path was deleted, leaving it in S3 because WatchDeletes is off"
+	msgSaveIndexError       = "unable to save local state index"
+	msgSnapshotMode         = "watch mode cannot be combined with BackupMode snapshot"
+	msgBackupsMismatch      = "watch needs exactly one backuper per configured backup directory"
+)
+
+const (
+	defaultDebounce = 2 * time.Second
+
+	// ticksPerDebounce is how often pending paths are checked within one
+	// debounce interval, so a path is flushed at most a quarter late.
+	ticksPerDebounce = 4
+
+	// maxWaitDebounces is how many debounce intervals a path that keeps
+	// changing waits at most before it is backed up anyway.
+	maxWaitDebounces = 5
+)
+
+var (
+	errSnapshotMode    = errors.New(msgSnapshotMode)
+	errBackupsMismatch = errors.New(msgBackupsMismatch)
+)
+
+// Watcher keeps the bucket up to date with the backup directories until it is
+// stopped.
+type Watcher interface {
+	Watch(ctx context.Context) error
+}
+
+type s3watch struct {
+	cfg     models.Config
+	backups []s3backup.S3backuper
+	cleaner s3clean.S3Cleaner
+	idx     s3index.Indexer
+	l       *zerolog.Logger
+
+	debounce time.Duration
+	fsw      *fsnotify.Watcher
+
+	// Events are recorded in pending by the reader goroutine. overflow holds
+	// at most one queued rescan, as one rescan covers every overflow before
+	// it started.
+	mu       sync.Mutex
+	pending  map[string]pendingPath
+	overflow chan struct{}
+}
+
+// pendingPath records when a path changed first and last since it was last
+// backed up.
+type pendingPath struct {
+	first time.Time
+	last  time.Time
+}
+
+// New returns a Watcher for the configured backup directories. backups holds
+// one backuper per entry of AWS.BackupDirectories, in the same order; cleaner
+// is only used when AWS.WatchDeletes is set and idx may be nil.
+func New(
+	cfg models.Config,
+	backups []s3backup.S3backuper,
+	cleaner s3clean.S3Cleaner,
+	idx s3index.Indexer,
+	l *zerolog.Logger,
+) Watcher {
+	debounce := time.Duration(cfg.AWS.WatchDebounceSeconds) * time.Second
+	if debounce <= 0 {
+		debounce = defaultDebounce
+	}
+	return &s3watch{
+		cfg:      cfg,
+		backups:  backups,
+		cleaner:  cleaner,
+		idx:      idx,
+		l:        l,
+		debounce: debounce,
+		pending:  make(map[string]pendingPath),
+		overflow: make(chan struct{}, 1),
+	}
+}
+
+// Watch subscribes to filesystem events for every directory below the backup
+// directories, backs them up in full once, and then backs up each path that
+// changes once it has been quiet for WatchDebounceSeconds. A path that never
+// goes quiet, such as a log file, is backed up every few debounce intervals
+// while it keeps changing. With WatchDeletes
+// deleted paths are removed from the bucket as well. Directories created
+// later are watched as they appear. If the kernel drops events, everything is
+// rescanned. Events are read while backups and rescans run, so the kernel
+// queue keeps draining on large trees. Watch returns once ctx is done and the paths still pending have
+// been flushed; a full backup or rescan in progress at that point is cut
+// short. If ctx was cancelled because the run lock was lost, nothing pending
+// is flushed and s3lock.ErrLockLost is returned.
+func (w *s3watch) Watch(ctx context.Context) (err error) {
+	if w.cfg.AWS.BackupMode == s3backup.BackupModeSnapshot {
+		w.l.Error().Err(errSnapshotMode).Msg(msgSnapshotMode)
+		return errSnapshotMode
+	}
+	if len(w.backups) != len(w.cfg.AWS.BackupDirectories) {
+		w.l.Error().Err(errBackupsMismatch).Int("backups", len(w.backups)).Int("directories", len(w.cfg.AWS.BackupDirectories)).Msg(msgBackupsMismatch)
+		return errBackupsMismatch
+	}
+
+	w.fsw, err = fsnotify.NewWatcher()
+	if err != nil {
+		w.l.Error().Err(err).Msg(msgCreateWatcherError)
+		return err
+	}
+	var reader sync.WaitGroup
+	defer reader.Wait()
+	defer w.fsw.Close()
+	reader.Go(w.readEvents)
+
+	// Watches go in before the initial pass so nothing that changes while it
+	// runs is missed.
+	for _, dir := range w.cfg.AWS.BackupDirectories {
+		w.addWatches(dir.Path)
+	}
+	w.backupAll(ctx)
+
+	w.l.Info().Int("directories", len(w.backups)).Dur("debounce", w.debounce).Bool("watch_deletes", w.cfg.AWS.WatchDeletes).Msg(msgWatchStarted)
+
+	ticker := time.NewTicker(w.debounce / ticksPerDebounce)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			// Once the run lock is lost another run may own the bucket, so
+			// nothing more is uploaded or deleted.
+			if cause := context.Cause(ctx); errors.Is(cause, s3lock.ErrLockLost) {
+				w.mu.Lock()
+				pending := len(w.pending)
+				w.mu.Unlock()
+				w.l.Error().Err(cause).Int("pending", pending).Msg(msgWatchStopped)
+				return cause
+			}
+			// Changes already seen are still backed up so that they are not
+			// lost until the next full pass.
+			w.flush(context.WithoutCancel(ctx), time.Time{})
+			w.l.Info().Msg(msgWatchStopped)
+			return nil
+		case <-w.overflow:
+			w.rescan(ctx)
+		case now := <-ticker.C:
+			w.flush(ctx, now)
+		}
+	}
+}
+
+// readEvents records filesystem events until the watcher is closed. A lost
+// event queues a rescan unless one is queued already.
+func (w *s3watch) readEvents() {
+	events, watchErrs := w.fsw.Events, w.fsw.Errors
+	for events != nil || watchErrs != nil {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			w.handle(event)
+		case watchErr, ok := <-watchErrs:
+			if !ok {
+				watchErrs = nil
+				continue
+			}
+			if !errors.Is(watchErr, fsnotify.ErrEventOverflow) {
+				w.l.Warn().Err(watchErr).Msg(msgWatcherError)
+				continue
+			}
+			select {
+			case w.overflow <- struct{}{}:
+				w.l.Warn().Err(watchErr).Msg(msgEventOverflow)
+			default:
+			}
+		}
+	}
+}
+
+// handle records the path of an event as pending. A new directory is watched
+// straight away, and backed up as a whole once it is flushed, so files created
+// in it before the watch was added are not missed.
+func (w *s3watch) handle(event fsnotify.Event) {
+	// A mode change alone does not make a file look changed to the backup.
+	if event.Op == fsnotify.Chmod {
+		return
+	}
+	if event.Has(fsnotify.Create) {
+		if info, err := os.Lstat(event.Name); err == nil && info.IsDir() {
+			w.addWatches(event.Name)
+		}
+	}
+	now := time.Now()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	pending, ok := w.pending[event.Name]
+	if !ok {
+		pending.first = now
+	}
+	pending.last = now
+	w.pending[event.Name] = pending
+}
+
+// flush backs up every pending path that has been quiet for the debounce
+// interval or first changed maxWaitDebounces intervals ago, or every pending
+// path if now is zero, and hands those that no longer exist to removeDeleted.
+func (w *s3watch) flush(ctx context.Context, now time.Time) {
+	var due []string
+	w.mu.Lock()
+	for path, pending := range w.pending {
+		if !now.IsZero() && now.Sub(pending.last) < w.debounce && now.Sub(pending.first) < maxWaitDebounces*w.debounce {
+			continue
+		}
+		delete(w.pending, path)
+		due = append(due, path)
+	}
+	w.mu.Unlock()
+
+	var deleted []string
+	for _, path := range due {
+		backup := w.backupFor(path)
+		if backup == nil {
+			continue
+		}
+		if _, err := os.Lstat(path); errors.Is(err, fs.ErrNotExist) {
+			deleted = append(deleted, path)
+			continue
+		}
+		if err := backup.BackupFile(ctx, path); err != nil {
+			w.l.Error().Err(err).Str("path", path).Msg(msgBackupPathError)
+		}
+	}
+
+	if len(deleted) > 0 {
+		w.removeDeleted(ctx, deleted)
+	}
+	if len(due) > 0 {
+		w.saveIndex()
+	}
+}
+
+// removeDeleted removes the objects of deleted paths when WatchDeletes is set
+// and forgets them in the index, so a file that comes back is uploaded again.
+func (w *s3watch) removeDeleted(ctx context.Context, paths []string) {
+	if !w.cfg.AWS.WatchDeletes {
+		for _, path := range paths {
+			w.l.Debug().Str("path", path).Msg(msgDeletionIgnored)
+		}
+		return
+	}
+	if err := w.cleaner.RemovePaths(ctx, paths); err != nil {
+		w.l.Error().Err(err).Strs("paths", paths).Msg(msgRemovePathsError)
+		return
+	}
+	if w.idx == nil {
+		return
+	}
+	for _, path := range paths {
+		key, err := s3backup.ObjectKey(path)
+		if err != nil {
+			continue
+		}
+		w.idx.Remove(key)
+		for _, indexed := range w.idx.Keys(key) {
+			if _, err = os.Lstat(s3backup.LocalPath(indexed)); errors.Is(err, fs.ErrNotExist) {
+				w.idx.Remove(indexed)
+			}
+		}
+	}
+}
+
+// rescan catches up after lost events: every directory is watched and backed
+// up again, and with WatchDeletes a sync removes whatever was deleted.
+func (w *s3watch) rescan(ctx context.Context) {
+	w.mu.Lock()
+	clear(w.pending)
+	w.mu.Unlock()
+	for _, dir := range w.cfg.AWS.BackupDirectories {
+		w.addWatches(dir.Path)
+	}
+	w.backupAll(ctx)
+	if w.cfg.AWS.WatchDeletes && ctx.Err() == nil {
+		if err := w.cleaner.SyncS3Bucket(ctx); err != nil {
+			w.l.Error().Err(err).Str("bucket", w.cfg.AWS.S3Bucket).Msg(msgSyncBucketError)
+		}
+	}
+}
+
+// backupAll backs up every backup directory in full, stopping early once ctx
+// is done.
+func (w *s3watch) backupAll(ctx context.Context) {
+	for i, backup := range w.backups {
+		if ctx.Err() != nil {
+			break
+		}
+		if err := backup.BackupDirectory(ctx); err != nil && ctx.Err() == nil {
+			w.l.Error().Err(err).Str("root_dir", w.cfg.AWS.BackupDirectories[i].Path).Msg(msgBackupDirectoryError)
+		}
+	}
+	w.saveIndex()
+}
+
+// addWatches watches root and every directory below it. Symbolic links are
+// not followed. Excluded directories are watched too; their paths are skipped
+// when they are backed up.
+func (w *s3watch) addWatches(root string) {
+	_ = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			w.l.Warn().Err(err).Str("path", path).Msg(msgAddWatchError)
+			return nil
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if err = w.fsw.Add(path); err != nil {
+			w.l.Warn().Err(err).Str("path", path).Msg(msgAddWatchError)
+		}
+		return nil
+	})
+}
+
+// backupFor returns the backuper of the innermost backup directory holding
+// path, or nil if there is none.
+func (w *s3watch) backupFor(path string) s3backup.S3backuper {
+	var (
+		found   s3backup.S3backuper
+		longest = -1
+	)
+	for i, dir := range w.cfg.AWS.BackupDirectories {
+		root := filepath.Clean(dir.Path)
+		if path != root && !strings.HasPrefix(path, strings.TrimSuffix(root, string(filepath.Separator))+string(filepath.Separator)) {
+			continue
+		}
+		if len(root) > longest {
+			found, longest = w.backups[i], len(root)
+		}
+	}
+	return found
+}
+
+func (w *s3watch) saveIndex() {
+	if w.idx == nil || w.cfg.DryRun {
+		return
+	}
+	if err := w.idx.Save(); err != nil {
+		w.l.Error().Err(err).Msg(msgSaveIndexError)
+	}
+}
@@ -0,0 +1,326 @@
+package s3watch_test
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/jaysonhurd/s3backup/models"
+	"github.com/jaysonhurd/s3backup/pkg/s3backup"
+	"github.com/jaysonhurd/s3backup/pkg/s3clean"
+	"github.com/jaysonhurd/s3backup/pkg/s3lock"
+	"github.com/jaysonhurd/s3backup/pkg/s3watch"
+	"github.com/jaysonhurd/s3backup/test/fakes/s3api"
+	"github.com/rs/zerolog"
+)
+
+// recorder stands in for both the backuper and the cleaner and records which
+// paths each was asked to handle.
+type recorder struct {
+	s3backup.S3backuper
+	s3clean.S3Cleaner
+
+	mu      sync.Mutex
+	started chan struct{}
+	backed  []string
+	removed []string
+	changed chan struct{}
+}
+
+func newRecorder() *recorder {
+	return &recorder{started: make(chan struct{}), changed: make(chan struct{}, 100)}
+}
+
+func (r *recorder) BackupDirectory(ctx context.Context) error {
+	close(r.started)
+	return nil
+}
+
+func (r *recorder) BackupFile(ctx context.Context, path string) error {
+	r.mu.Lock()
+	r.backed = append(r.backed, path)
+	r.mu.Unlock()
+	r.changed <- struct{}{}
+	return nil
+}
+
+func (r *recorder) RemovePaths(ctx context.Context, paths []string) error {
+	r.mu.Lock()
+	r.removed = append(r.removed, paths...)
+	r.mu.Unlock()
+	r.changed <- struct{}{}
+	return nil
+}
+
+func (r *recorder) waitFor(t *testing.T, done func() bool) {
+	t.Helper()
+	timeout := time.After(10 * time.Second)
+	for {
+		r.mu.Lock()
+		ok := done()
+		r.mu.Unlock()
+		if ok {
+			return
+		}
+		select {
+		case <-r.changed:
+		case <-timeout:
+			t.Fatalf("timed out, backed up %v, removed %v", r.backed, r.removed)
+		}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	l := zerolog.Nop()
+	root := t.TempDir()
+	old := filepath.Join(root, "old.txt")
+	if err := os.WriteFile(old, []byte("old"), 0o600); err != nil {
+		t.Fatalf("unable to create temp file: %v", err)
+	}
+
+	cfg := models.Config{AWS: models.AWS{
+		S3Bucket:             "test-bucket",
+		BackupDirectories:    []models.BackupDirectory{{Path: root}},
+		WatchDebounceSeconds: 1,
+		WatchDeletes:         true,
+	}}
+	rec := newRecorder()
+	watcher := s3watch.New(cfg, []s3backup.S3backuper{rec}, rec, nil, &l)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- watcher.Watch(ctx) }()
+	<-rec.started
+
+	sub := filepath.Join(root, "sub")
+	if err := os.Mkdir(sub, 0o755); err != nil {
+		t.Fatalf("unable to create directory: %v", err)
+	}
+	rec.waitFor(t, func() bool { return slices.Contains(rec.backed, sub) })
+
+	// A file in a directory created after the watch started is seen too, and
+	// a burst of writes is uploaded once.
+	created := filepath.Join(sub, "new.txt")
+	for i := range 5 {
+		if err := os.WriteFile(created, []byte{byte(i)}, 0o600); err != nil {
+			t.Fatalf("unable to write temp file: %v", err)
+		}
+	}
+	if err := os.Remove(old); err != nil {
+		t.Fatalf("unable to remove temp file: %v", err)
+	}
+	rec.waitFor(t, func() bool { return slices.Contains(rec.backed, created) && slices.Contains(rec.removed, old) })
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Watch() unexpected error: %v", err)
+	}
+
+	count := 0
+	for _, path := range rec.backed {
+		if path == created {
+			count++
+		}
+	}
+	if count != 1 {
+		t.Fatalf("expected %s to be backed up once, got %d", created, count)
+	}
+}
+
+func TestWatchBusyFile(t *testing.T) {
+	l := zerolog.Nop()
+	root := t.TempDir()
+	busy := filepath.Join(root, "busy.log")
+
+	cfg := models.Config{AWS: models.AWS{
+		S3Bucket:             "test-bucket",
+		BackupDirectories:    []models.BackupDirectory{{Path: root}},
+		WatchDebounceSeconds: 1,
+	}}
+	rec := newRecorder()
+	watcher := s3watch.New(cfg, []s3backup.S3backuper{rec}, rec, nil, &l)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- watcher.Watch(ctx) }()
+	<-rec.started
+
+	// A file written more often than the debounce interval is still backed
+	// up while the writes go on.
+	stop := make(chan struct{})
+	writing := make(chan struct{})
+	go func() {
+		defer close(writing)
+		ticker := time.NewTicker(200 * time.Millisecond)
+		defer ticker.Stop()
+		for i := 0; ; i++ {
+			if err := os.WriteFile(busy, []byte{byte(i)}, 0o600); err != nil {
+				t.Errorf("unable to write temp file: %v", err)
+				return
+			}
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	rec.waitFor(t, func() bool { return slices.Contains(rec.backed, busy) })
+	close(stop)
+	<-writing
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Watch() unexpected error: %v", err)
+	}
+}
+
+// tracker wraps a real backuper and records which paths it was asked to back
+// up once each of them is done.
+type tracker struct {
+	s3backup.S3backuper
+	started chan struct{}
+	backed  chan string
+}
+
+func (tr *tracker) BackupDirectory(ctx context.Context) error {
+	defer close(tr.started)
+	return tr.S3backuper.BackupDirectory(ctx)
+}
+
+func (tr *tracker) BackupFile(ctx context.Context, path string) error {
+	defer func() { tr.backed <- path }()
+	return tr.S3backuper.BackupFile(ctx, path)
+}
+
+func TestWatchHardLink(t *testing.T) {
+	l := zerolog.Nop()
+	root := t.TempDir()
+	first := filepath.Join(root, "a.txt")
+	second := filepath.Join(root, "b.txt")
+	if err := os.WriteFile(first, []byte("old"), 0o600); err != nil {
+		t.Fatalf("unable to create temp file: %v", err)
+	}
+	if err := os.Link(first, second); err != nil {
+		t.Fatalf("unable to create hard link: %v", err)
+	}
+	firstKey, _ := s3backup.ObjectKey(first)
+	secondKey, _ := s3backup.ObjectKey(second)
+
+	cfg := models.Config{AWS: models.AWS{
+		S3Bucket:             "test-bucket",
+		BackupDirectories:    []models.BackupDirectory{{Path: root}},
+		WatchDebounceSeconds: 1,
+	}}
+	fake := new(s3api.FakeS3API)
+	fake.HeadObjectReturns(nil, &s3types.NotFound{})
+	tr := &tracker{
+		S3backuper: s3backup.New(cfg, fake, cfg.AWS.BackupDirectories[0], &l),
+		started:    make(chan struct{}),
+		backed:     make(chan string, 10),
+	}
+	watcher := s3watch.New(cfg, []s3backup.S3backuper{tr}, newRecorder(), nil, &l)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- watcher.Watch(ctx) }()
+	<-tr.started
+	initial := len(fake.PutObjectInputs())
+
+	// Writing through the second link changes the contents stored under the
+	// first path, and the second path stays a reference to it.
+	if err := os.WriteFile(second, []byte("new"), 0o600); err != nil {
+		t.Fatalf("unable to write temp file: %v", err)
+	}
+	select {
+	case <-tr.backed:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timed out waiting for %s to be backed up", second)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Watch() unexpected error: %v", err)
+	}
+
+	var firstUploaded bool
+	for _, input := range fake.PutObjectInputs()[initial:] {
+		switch aws.ToString(input.Key) {
+		case firstKey:
+			firstUploaded = input.Metadata[s3backup.MetadataHardLinkTarget] == ""
+		case secondKey:
+			if got := input.Metadata[s3backup.MetadataHardLinkTarget]; got != url.PathEscape(firstKey) {
+				t.Fatalf("%s stored with hard link target %q, want a reference to %s", second, got, firstKey)
+			}
+		}
+	}
+	if !firstUploaded {
+		t.Fatalf("expected the new contents to be uploaded under %s", firstKey)
+	}
+}
+
+func TestWatchStopFlushesPending(t *testing.T) {
+	l := zerolog.Nop()
+
+	tests := []struct {
+		name        string
+		cause       error
+		wantFlushed bool
+	}{
+		{name: "signal", wantFlushed: true},
+		{name: "lock lost", cause: s3lock.ErrLockLost},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			cfg := models.Config{AWS: models.AWS{
+				S3Bucket:             "test-bucket",
+				BackupDirectories:    []models.BackupDirectory{{Path: root}},
+				WatchDebounceSeconds: 60,
+			}}
+			rec := newRecorder()
+			watcher := s3watch.New(cfg, []s3backup.S3backuper{rec}, rec, nil, &l)
+
+			ctx, cancel := context.WithCancelCause(context.Background())
+			done := make(chan error)
+			go func() { done <- watcher.Watch(ctx) }()
+			<-rec.started
+
+			// The change is still pending, well within the debounce interval,
+			// when the watch is stopped.
+			changed := filepath.Join(root, "changed.txt")
+			if err := os.WriteFile(changed, []byte("changed"), 0o600); err != nil {
+				t.Fatalf("unable to create temp file: %v", err)
+			}
+			time.Sleep(500 * time.Millisecond)
+			cancel(tt.cause)
+
+			if err := <-done; !errors.Is(err, tt.cause) {
+				t.Fatalf("Watch() error = %v, want %v", err, tt.cause)
+			}
+			if flushed := slices.Contains(rec.backed, changed); flushed != tt.wantFlushed {
+				t.Fatalf("backed up %v, want the pending change flushed: %v", rec.backed, tt.wantFlushed)
+			}
+		})
+	}
+}
+
+func TestWatchRejectsSnapshotMode(t *testing.T) {
+	l := zerolog.Nop()
+	cfg := models.Config{AWS: models.AWS{
+		BackupMode:        s3backup.BackupModeSnapshot,
+		BackupDirectories: []models.BackupDirectory{{Path: t.TempDir()}},
+	}}
+	rec := newRecorder()
+	watcher := s3watch.New(cfg, []s3backup.S3backuper{rec}, rec, nil, &l)
+	if err := watcher.Watch(context.Background()); err == nil {
+		t.Fatalf("expected Watch() to reject snapshot mode")
+	}
+}
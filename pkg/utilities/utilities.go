@@ -3,13 +3,18 @@ package utilities
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"os"
 	"path"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/jaysonhurd/s3backup/models"
+	"github.com/jaysonhurd/s3backup/pkg/s3retry"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"gopkg.in/natefinch/lumberjack.v2"
@@ -17,21 +22,47 @@ import (
 
 const (
 	msgLoadAWSConfigFailed = "unable to load AWS configuration"
+	msgInvalidAge          = "invalid age, expected a duration such as 24h or 30d"
+	daySuffix              = "d"
 	msgProgramUsageHelp    = `Program Usage:
 		-backup : 	Backs up the filesystems listed in config.json (default is false)
 		-config : 	Relative or full path to config file (requires a valid path e.g. '-config configs/config.json'
 		-sync 	: 	Reconciles s3 with local filesystem.  Any files not found on the local filesystem
 					will be removed from S3 (default is false)
 		-wipe 	: 	Wipes the entire S3 bucket from the config.json file (Default is false)
-		-force	:	Forces a wipe without asking for confirmation (Default is false)
+		-all-versions : With -wipe, also deletes every object version and delete marker and aborts incomplete uploads (default is false)
+		-force	:	Forces a wipe without asking for confirmation and overrides the sync safety checks (Default is false)
 		-level  :   Which logging level - Info, Warn, Error, Debug (Default is Error)
 		-console :  If you would also like to log to console in addition to the logfile. Default is off (false)
+		-parallel : Number of concurrent upload workers, overrides Concurrency in config.json (default is 0)
+		-dry-run :  Performs all reads but only logs the uploads and deletions that would be made (default is false)
+		-rebuild-index : Repopulates the local state index in StateDirectory from a bucket listing (default is false)
+		-restore :  Restores the filesystems listed in config.json from S3 (default is false)
+		-restore-to : Restores into this directory instead of over the original files (e.g. '-restore-to /tmp/restore')
+		-prune : Deletes noncurrent object versions outside the KeepLast/KeepDaily/KeepWeekly/KeepMonthly/KeepYearly policy (default is false)
+		-purge-trash : Permanently removes objects moved to the trash by a SyncMode trash sync (requires -older-than)
+		-abort-stale-uploads : Aborts incomplete multipart uploads initiated before -older-than (requires -older-than)
+		-older-than : Minimum age of what -purge-trash and -abort-stale-uploads remove, e.g. '-older-than 30d' or '-older-than 24h'
+		-snapshots : Lists the snapshots stored in the bucket when BackupMode is snapshot (default is false)
+		-as-of : With -restore, restores files as they were at this RFC3339 time (e.g. '-as-of 2026-09-01T00:00:00Z')
+		-snapshot : With -restore, restores the files recorded in this snapshot ID
+		-restore-path : With -restore, only restores this file or directory (e.g. '-restore-path /srv/data')
+		-verify : Checks that every file is in the bucket and up to date without uploading anything (default is false)
+		-daemon : Runs the jobs in the Schedule section of config.json on their cron schedule until interrupted (default is false)
+		-watch : Backs up once, then keeps uploading files as they change until interrupted (default is false)
 		`
 )
 
+// CreateAWSSession loads the AWS configuration for the configured region. Every
+// request made with it is retried according to the Retry* settings.
 func CreateAWSSession(cfg models.Config, l *zerolog.Logger) (aws.Config, error) {
+	retryer, err := s3retry.New(cfg, l)
+	if err != nil {
+		return aws.Config{}, err
+	}
 	loadOpts := []func(*config.LoadOptions) error{
 		config.WithRegion(cfg.AWS.S3Region),
+		config.WithRetryer(func() aws.Retryer { return retryer }),
 	}
 
 	if cfg.AWS.AccessKeyId != "" && cfg.AWS.SecretAccessKey != "" {
@@ -96,6 +127,25 @@ func LoggerSetup(cfg models.Config, llevel zerolog.Level) (*zerolog.Logger, erro
 	return &l, err
 }
 
+// ParseAge parses a duration such as "24h" or "30d". On top of the units
+// time.ParseDuration understands, a whole number of days can be given with a
+// "d" suffix. A zero age is rejected, since it would remove everything,
+// including multipart uploads still in progress.
+func ParseAge(age string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(age, daySuffix); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 1 {
+			return 0, fmt.Errorf("%s: %q", msgInvalidAge, age)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(age)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("%s: %q", msgInvalidAge, age)
+	}
+	return d, nil
+}
+
 func PrintHelp() {
 	log.Info().Msg(msgProgramUsageHelp)
 }
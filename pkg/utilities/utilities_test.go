@@ -1,14 +1,18 @@
 package utilities
 
 import (
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/jaysonhurd/s3backup/models"
 	"github.com/rs/zerolog"
 )
 
 func TestCreateAWSSession(t *testing.T) {
-	cfg := models.Config{AWS: models.AWS{S3Region: "us-east-1"}}
+	cfg := models.Config{AWS: models.AWS{S3Region: "us-east-1", RetryMaxAttempts: 7}}
 	l := zerolog.Nop()
 
 	got, err := CreateAWSSession(cfg, &l)
@@ -19,6 +23,9 @@ func TestCreateAWSSession(t *testing.T) {
 	if got.Region != cfg.AWS.S3Region {
 		t.Fatalf("CreateAWSSession() region = %q, want %q", got.Region, cfg.AWS.S3Region)
 	}
+	if got.Retryer == nil || got.Retryer().MaxAttempts() != cfg.AWS.RetryMaxAttempts {
+		t.Fatalf("CreateAWSSession() does not use the configured retry policy")
+	}
 }
 
 func TestLoadConfig(t *testing.T) {
@@ -41,3 +48,61 @@ func TestLoadConfig(t *testing.T) {
 		})
 	}
 }
+
+func TestLoadConfigBackupDirectories(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.json")
+	config := `{
+  "AWS": {
+    "BackupDirectories": [
+      "/home/user/directory1",
+      {"Path": "/home/user/directory2", "Include": ["*.go"], "Exclude": ["node_modules/"]}
+    ]
+  }
+}`
+	if err := os.WriteFile(configFile, []byte(config), 0o600); err != nil {
+		t.Fatalf("unable to write config file: %v", err)
+	}
+
+	got, err := LoadConfig(configFile)
+	if err != nil {
+		t.Fatalf("LoadConfig() unexpected error = %v", err)
+	}
+
+	want := []models.BackupDirectory{
+		{Path: "/home/user/directory1"},
+		{Path: "/home/user/directory2", Include: []string{"*.go"}, Exclude: []string{"node_modules/"}},
+	}
+	if !reflect.DeepEqual(got.AWS.BackupDirectories, want) {
+		t.Fatalf("LoadConfig() BackupDirectories = %+v, want %+v", got.AWS.BackupDirectories, want)
+	}
+}
+
+func TestParseAge(t *testing.T) {
+	tests := []struct {
+		age     string
+		want    time.Duration
+		wantErr bool
+	}{
+		{age: "30d", want: 30 * 24 * time.Hour},
+		{age: "24h", want: 24 * time.Hour},
+		{age: "90m", want: 90 * time.Minute},
+		{age: "0d", wantErr: true},
+		{age: "0", wantErr: true},
+		{age: "0s", wantErr: true},
+		{age: "1.5d", wantErr: true},
+		{age: "-1d", wantErr: true},
+		{age: "-5h", wantErr: true},
+		{age: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.age, func(t *testing.T) {
+			got, err := ParseAge(tt.age)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseAge(%q) error = %v, wantErr %v", tt.age, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("ParseAge(%q) = %v, want %v", tt.age, got, tt.want)
+			}
+		})
+	}
+}
@@ -2,72 +2,425 @@ package s3api
 
 import (
 	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
 // FakeS3API is a minimal test double for the subset of S3 APIs used by this project.
 type FakeS3API struct {
+	mu                 sync.Mutex
 	headObjectOutput   *s3.HeadObjectOutput
 	headObjectErr      error
+	headObjectCalls    int
 	putObjectOutput    *s3.PutObjectOutput
 	putObjectErr       error
 	LastPutObjectInput *s3.PutObjectInput
+	putObjectCalls     int
+	putObjectInputs    []*s3.PutObjectInput
+	putObjectOnCall    map[int]putObjectResult
 	listObjectsOutput  *s3.ListObjectsV2Output
 	listObjectsErr     error
+	listObjectsPages   []*s3.ListObjectsV2Output
+	listObjectsCalls   int
 	deleteObjectOutput *s3.DeleteObjectOutput
 	deleteObjectErr    error
+	deleteObjectCalls  int
 	deleteObjsOutput   *s3.DeleteObjectsOutput
 	deleteObjsErr      error
+	deleteObjsCalls    int
+	deleteObjsInputs   []*s3.DeleteObjectsInput
+	getObjectOutput    *s3.GetObjectOutput
+	getObjectErr       error
+	getObjectInputs    []*s3.GetObjectInput
+	getObjectByKey     map[string]*s3.GetObjectOutput
+	listVersionsOutput *s3.ListObjectVersionsOutput
+	listVersionsErr    error
+	createMPUOutput    *s3.CreateMultipartUploadOutput
+	createMPUErr       error
+	createMPUInputs    []*s3.CreateMultipartUploadInput
+	uploadPartErr      error
+	uploadPartCalls    int
+	completeMPUOutput  *s3.CompleteMultipartUploadOutput
+	completeMPUErr     error
+	completeMPUCalls   int
+	abortMPUErr        error
+	abortMPUCalls      int
+	copyObjectErr      error
+	copyObjectInputs   []*s3.CopyObjectInput
+	uploadPartCopyErr  error
+	uploadPartCopies   []*s3.UploadPartCopyInput
+	listUploadsOutput  *s3.ListMultipartUploadsOutput
+	listUploadsErr     error
+	listPartsOutput    *s3.ListPartsOutput
 }
 
 func (f *FakeS3API) HeadObjectReturns(out *s3.HeadObjectOutput, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	f.headObjectOutput = out
 	f.headObjectErr = err
 }
 func (f *FakeS3API) PutObjectReturns(out *s3.PutObjectOutput, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	f.putObjectOutput = out
 	f.putObjectErr = err
 }
 func (f *FakeS3API) ListObjectsV2Returns(out *s3.ListObjectsV2Output, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	f.listObjectsOutput = out
 	f.listObjectsErr = err
 }
+
+// ListObjectsV2ReturnsPages makes successive ListObjectsV2 calls return each
+// page in turn. Every page but the last is marked as truncated.
+func (f *FakeS3API) ListObjectsV2ReturnsPages(pages ...*s3.ListObjectsV2Output) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := range pages {
+		if i < len(pages)-1 {
+			pages[i].IsTruncated = aws.Bool(true)
+			pages[i].NextContinuationToken = aws.String(fmt.Sprintf("page-%d", i+1))
+		}
+	}
+	f.listObjectsPages = pages
+	f.listObjectsCalls = 0
+}
 func (f *FakeS3API) DeleteObjectReturns(out *s3.DeleteObjectOutput, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	f.deleteObjectOutput = out
 	f.deleteObjectErr = err
 }
 func (f *FakeS3API) DeleteObjectsReturns(out *s3.DeleteObjectsOutput, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	f.deleteObjsOutput = out
 	f.deleteObjsErr = err
 }
+func (f *FakeS3API) GetObjectReturns(out *s3.GetObjectOutput, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.getObjectOutput = out
+	f.getObjectErr = err
+}
+func (f *FakeS3API) GetObjectReturnsForKey(key string, out *s3.GetObjectOutput) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.getObjectByKey == nil {
+		f.getObjectByKey = make(map[string]*s3.GetObjectOutput)
+	}
+	f.getObjectByKey[key] = out
+}
+
+// PutObjectReturnsOnCall overrides what the PutObject call with the given
+// zero-based index returns.
+func (f *FakeS3API) PutObjectReturnsOnCall(call int, out *s3.PutObjectOutput, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.putObjectOnCall == nil {
+		f.putObjectOnCall = make(map[int]putObjectResult)
+	}
+	f.putObjectOnCall[call] = putObjectResult{out: out, err: err}
+}
+
+type putObjectResult struct {
+	out *s3.PutObjectOutput
+	err error
+}
+
+func (f *FakeS3API) PutObjectInputs() []*s3.PutObjectInput {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*s3.PutObjectInput(nil), f.putObjectInputs...)
+}
+func (f *FakeS3API) DeleteObjectCallCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.deleteObjectCalls
+}
+func (f *FakeS3API) DeleteObjectsCallCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.deleteObjsCalls
+}
+func (f *FakeS3API) DeleteObjectsInputs() []*s3.DeleteObjectsInput {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*s3.DeleteObjectsInput(nil), f.deleteObjsInputs...)
+}
+func (f *FakeS3API) HeadObjectCallCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.headObjectCalls
+}
+func (f *FakeS3API) PutObjectCallCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.putObjectCalls
+}
 func (f *FakeS3API) HeadObject(context.Context, *s3.HeadObjectInput, ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.headObjectCalls++
 	if f.headObjectOutput == nil {
 		f.headObjectOutput = &s3.HeadObjectOutput{}
 	}
 	return f.headObjectOutput, f.headObjectErr
 }
 func (f *FakeS3API) PutObject(_ context.Context, in *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	f.LastPutObjectInput = in
+	f.putObjectInputs = append(f.putObjectInputs, in)
+	f.putObjectCalls++
+	if result, ok := f.putObjectOnCall[f.putObjectCalls-1]; ok {
+		return result.out, result.err
+	}
 	if f.putObjectOutput == nil {
 		f.putObjectOutput = &s3.PutObjectOutput{}
 	}
 	return f.putObjectOutput, f.putObjectErr
 }
-func (f *FakeS3API) ListObjectsV2(context.Context, *s3.ListObjectsV2Input, ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+func (f *FakeS3API) ListObjectsV2(_ context.Context, in *s3.ListObjectsV2Input, _ ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.listObjectsPages) > 0 {
+		page := f.listObjectsPages[min(f.listObjectsCalls, len(f.listObjectsPages)-1)]
+		f.listObjectsCalls++
+		return filterByPrefix(page, in.Prefix), nil
+	}
 	if f.listObjectsOutput == nil {
 		f.listObjectsOutput = &s3.ListObjectsV2Output{}
 	}
-	return f.listObjectsOutput, f.listObjectsErr
+	return filterByPrefix(f.listObjectsOutput, in.Prefix), f.listObjectsErr
+}
+
+// filterByPrefix mimics S3 by only returning the objects under prefix.
+func filterByPrefix(out *s3.ListObjectsV2Output, prefix *string) *s3.ListObjectsV2Output {
+	if out == nil || prefix == nil {
+		return out
+	}
+	filtered := *out
+	filtered.Contents = nil
+	for _, object := range out.Contents {
+		if strings.HasPrefix(aws.ToString(object.Key), *prefix) {
+			filtered.Contents = append(filtered.Contents, object)
+		}
+	}
+	return &filtered
 }
 func (f *FakeS3API) DeleteObject(context.Context, *s3.DeleteObjectInput, ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.deleteObjectCalls++
 	if f.deleteObjectOutput == nil {
 		f.deleteObjectOutput = &s3.DeleteObjectOutput{}
 	}
 	return f.deleteObjectOutput, f.deleteObjectErr
 }
-func (f *FakeS3API) DeleteObjects(context.Context, *s3.DeleteObjectsInput, ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error) {
+func (f *FakeS3API) DeleteObjects(_ context.Context, in *s3.DeleteObjectsInput, _ ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.deleteObjsCalls++
+	f.deleteObjsInputs = append(f.deleteObjsInputs, in)
 	if f.deleteObjsOutput == nil {
 		f.deleteObjsOutput = &s3.DeleteObjectsOutput{}
 	}
 	return f.deleteObjsOutput, f.deleteObjsErr
 }
+func (f *FakeS3API) GetObject(_ context.Context, in *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.getObjectInputs = append(f.getObjectInputs, in)
+	if out, ok := f.getObjectByKey[aws.ToString(in.Key)]; ok {
+		return out, nil
+	}
+	if f.getObjectOutput == nil {
+		f.getObjectOutput = &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(""))}
+	}
+	return f.getObjectOutput, f.getObjectErr
+}
+func (f *FakeS3API) CreateMultipartUploadReturns(out *s3.CreateMultipartUploadOutput, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.createMPUOutput = out
+	f.createMPUErr = err
+}
+func (f *FakeS3API) UploadPartReturns(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.uploadPartErr = err
+}
+func (f *FakeS3API) CompleteMultipartUploadReturns(out *s3.CompleteMultipartUploadOutput, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.completeMPUOutput = out
+	f.completeMPUErr = err
+}
+func (f *FakeS3API) AbortMultipartUploadReturns(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.abortMPUErr = err
+}
+func (f *FakeS3API) UploadPartCallCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.uploadPartCalls
+}
+func (f *FakeS3API) CompleteMultipartUploadCallCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.completeMPUCalls
+}
+func (f *FakeS3API) AbortMultipartUploadCallCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.abortMPUCalls
+}
+func (f *FakeS3API) CreateMultipartUpload(_ context.Context, in *s3.CreateMultipartUploadInput, _ ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.createMPUInputs = append(f.createMPUInputs, in)
+	if f.createMPUOutput == nil {
+		f.createMPUOutput = &s3.CreateMultipartUploadOutput{UploadId: aws.String("upload-id")}
+	}
+	return f.createMPUOutput, f.createMPUErr
+}
+func (f *FakeS3API) UploadPart(_ context.Context, in *s3.UploadPartInput, _ ...func(*s3.Options)) (*s3.UploadPartOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.uploadPartCalls++
+	if f.uploadPartErr != nil {
+		return nil, f.uploadPartErr
+	}
+	return &s3.UploadPartOutput{ETag: aws.String(fmt.Sprintf("etag-%d", aws.ToInt32(in.PartNumber)))}, nil
+}
+func (f *FakeS3API) CompleteMultipartUpload(context.Context, *s3.CompleteMultipartUploadInput, ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.completeMPUCalls++
+	if f.completeMPUOutput == nil {
+		f.completeMPUOutput = &s3.CompleteMultipartUploadOutput{}
+	}
+	return f.completeMPUOutput, f.completeMPUErr
+}
+func (f *FakeS3API) AbortMultipartUpload(context.Context, *s3.AbortMultipartUploadInput, ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.abortMPUCalls++
+	return &s3.AbortMultipartUploadOutput{}, f.abortMPUErr
+}
+func (f *FakeS3API) CopyObjectReturns(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.copyObjectErr = err
+}
+func (f *FakeS3API) CopyObjectInputs() []*s3.CopyObjectInput {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*s3.CopyObjectInput(nil), f.copyObjectInputs...)
+}
+func (f *FakeS3API) CreateMultipartUploadInputs() []*s3.CreateMultipartUploadInput {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*s3.CreateMultipartUploadInput(nil), f.createMPUInputs...)
+}
+func (f *FakeS3API) UploadPartCopyInputs() []*s3.UploadPartCopyInput {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*s3.UploadPartCopyInput(nil), f.uploadPartCopies...)
+}
+func (f *FakeS3API) UploadPartCopyReturns(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.uploadPartCopyErr = err
+}
+func (f *FakeS3API) CopyObject(_ context.Context, in *s3.CopyObjectInput, _ ...func(*s3.Options)) (*s3.CopyObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.copyObjectInputs = append(f.copyObjectInputs, in)
+	if f.copyObjectErr != nil {
+		return nil, f.copyObjectErr
+	}
+	return &s3.CopyObjectOutput{}, nil
+}
+func (f *FakeS3API) UploadPartCopy(_ context.Context, in *s3.UploadPartCopyInput, _ ...func(*s3.Options)) (*s3.UploadPartCopyOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.uploadPartCopies = append(f.uploadPartCopies, in)
+	if f.uploadPartCopyErr != nil {
+		return nil, f.uploadPartCopyErr
+	}
+	return &s3.UploadPartCopyOutput{CopyPartResult: &types.CopyPartResult{
+		ETag: aws.String(fmt.Sprintf("etag-%d", aws.ToInt32(in.PartNumber))),
+	}}, nil
+}
+func (f *FakeS3API) GetObjectInputs() []*s3.GetObjectInput {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*s3.GetObjectInput(nil), f.getObjectInputs...)
+}
+func (f *FakeS3API) ListObjectVersionsReturns(out *s3.ListObjectVersionsOutput, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.listVersionsOutput = out
+	f.listVersionsErr = err
+}
+func (f *FakeS3API) ListObjectVersions(_ context.Context, in *s3.ListObjectVersionsInput, _ ...func(*s3.Options)) (*s3.ListObjectVersionsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.listVersionsOutput == nil {
+		return &s3.ListObjectVersionsOutput{}, f.listVersionsErr
+	}
+	if in.Prefix == nil {
+		return f.listVersionsOutput, f.listVersionsErr
+	}
+	filtered := *f.listVersionsOutput
+	filtered.Versions, filtered.DeleteMarkers = nil, nil
+	for _, version := range f.listVersionsOutput.Versions {
+		if strings.HasPrefix(aws.ToString(version.Key), *in.Prefix) {
+			filtered.Versions = append(filtered.Versions, version)
+		}
+	}
+	for _, marker := range f.listVersionsOutput.DeleteMarkers {
+		if strings.HasPrefix(aws.ToString(marker.Key), *in.Prefix) {
+			filtered.DeleteMarkers = append(filtered.DeleteMarkers, marker)
+		}
+	}
+	return &filtered, f.listVersionsErr
+}
+func (f *FakeS3API) ListMultipartUploadsReturns(out *s3.ListMultipartUploadsOutput, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.listUploadsOutput = out
+	f.listUploadsErr = err
+}
+func (f *FakeS3API) ListMultipartUploads(context.Context, *s3.ListMultipartUploadsInput, ...func(*s3.Options)) (*s3.ListMultipartUploadsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.listUploadsOutput == nil {
+		f.listUploadsOutput = &s3.ListMultipartUploadsOutput{}
+	}
+	return f.listUploadsOutput, f.listUploadsErr
+}
+func (f *FakeS3API) ListPartsReturns(out *s3.ListPartsOutput) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.listPartsOutput = out
+}
+func (f *FakeS3API) ListParts(context.Context, *s3.ListPartsInput, ...func(*s3.Options)) (*s3.ListPartsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.listPartsOutput == nil {
+		f.listPartsOutput = &s3.ListPartsOutput{}
+	}
+	return f.listPartsOutput, nil
+}